@@ -0,0 +1,92 @@
+package bootstrap
+
+import (
+	"authentication/db"
+	"authentication/pkg/sms"
+	"authentication/pkg/tlsconfig"
+	"authentication/services"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ValidateConfig reads the settings of the environment the way starting the service does,
+// and returns every problem it finds instead of stopping at the first. It does not connect
+// to Redis, nor create files.
+func ValidateConfig() error {
+	var errs []error
+	check := func(name string, read func() error) {
+		// Most settings panic when invalid, as the service should not start with them.
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, recovered))
+			}
+		}()
+		if err := read(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	memory := os.Getenv("APP_STORAGE") == "memory"
+	if !memory {
+		check("redis", func() error {
+			config, err := db.RedisConfigFromEnv()
+			if err != nil {
+				return err
+			}
+			_, err = config.UniversalOptions()
+			return err
+		})
+	}
+	check("server", func() error {
+		_, err := ServerConfigFromEnv()
+		return err
+	})
+	check("fraud", func() error {
+		_, err := services.FraudConfigFromEnv()
+		return err
+	})
+	check("challenge", func() error {
+		if _, err := services.ChallengeConfigFromEnv(); err != nil {
+			return err
+		}
+		challengeVerifier(nil)
+		return nil
+	})
+	check("webhooks", func() error {
+		_, err := services.WebhookConfigFromEnv()
+		return err
+	})
+	check("machines", func() error {
+		_, err := tlsconfig.ParseIdentities(os.Getenv("MTLS_IDENTITIES"))
+		return err
+	})
+	check("messages", func() error {
+		configureMessages()
+		return nil
+	})
+	check("phones", func() error {
+		configurePhones()
+		return nil
+	})
+	check("rate limits", func() error {
+		rateLimitPolicies()
+		return nil
+	})
+	check("health", func() error {
+		healthChecker(sms.NewLogSender())
+		return nil
+	})
+	check("audit", func() error {
+		// The sink is not opened: a file sink would be created.
+		config, err := auditConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		if config.sink == "redis" && memory {
+			config.sink = "memory"
+		}
+		return config.checkHashKey()
+	})
+	return errors.Join(errs...)
+}
@@ -3,33 +3,405 @@ package bootstrap
 import (
 	v1 "authentication/controllers"
 	"authentication/db"
+	"authentication/middleware"
+	"authentication/pkg/audit"
+	"authentication/pkg/challenge"
+	"authentication/pkg/health"
+	"authentication/pkg/i18n"
+	"authentication/pkg/metrics"
+	"authentication/pkg/phone"
+	"authentication/pkg/sms"
+	"authentication/pkg/tlsconfig"
+	"authentication/ratelimit"
 	"authentication/repositories"
+	"authentication/requests"
 	"authentication/services"
-	"github.com/go-redis/redis_rate/v10"
+	"authentication/utils"
+	"authentication/utils/logger"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type AppContainer struct {
-	Redis   *redis.Client
-	Limiter *redis_rate.Limiter
-	AuthAPI v1.AuthAPI
+	Redis          redis.UniversalClient
+	Limiter        ratelimit.RateLimiter
+	RateLimits     *ratelimit.Policies
+	AuthRepository repositories.AuthRepository
+	SMS            sms.Sender
+	FraudGuard     services.FraudGuard
+	Challenges     services.ChallengeGuard
+	AuditLog       services.AuditLog
+	AuthService    services.AuthService
+	Keys           services.KeyService
+	Webhooks       services.WebhookService
+	AuthAPI        v1.AuthAPI
+	FraudAPI       v1.FraudAPI
+	AuditAPI       v1.AuditAPI
+	LoggingAPI     v1.LoggingAPI
+	WebhookAPI     v1.WebhookAPI
+	Health         *health.Checker
+	HealthAPI      v1.HealthAPI
+	// Machines are the services allowed in with a client certificate, see MachineAuth.
+	Machines tlsconfig.Identities
 }
 
+// InitAppContainer wires the application against Redis, or entirely in memory
+// when APP_STORAGE=memory (handy for local runs without a Redis server).
 func InitAppContainer() *AppContainer {
+	if os.Getenv("APP_STORAGE") == "memory" {
+		return InitMemoryAppContainer()
+	}
+
 	redisClient := db.RedisClient()
+	if err := instrumentRedis(redisClient); err != nil {
+		panic(err)
+	}
 
-	limiter := redis_rate.NewLimiter(redisClient)
+	limiter := ratelimit.NewRedisLimiter(redisClient)
 
 	//jwtAuth := jwt.Jwt{}
 
 	authRepo := repositories.NewAuthRepository(redisClient)
-	authService := services.NewAuthService(authRepo, limiter)
+	container := newAppContainer(authRepo, repositories.NewFraudRepository(redisClient), repositories.NewChallengeRepository(redisClient), auditRepository(redisClient), repositories.NewSigningKeyRepository(redisClient), repositories.NewWebhookRepository(redisClient), limiter)
+	container.Redis = redisClient
+	container.Health.Add("redis", func(ctx context.Context) error {
+		return db.Ping(ctx, redisClient)
+	})
+	startRedis(container.Health, redisClient, container.Keys)
+
+	return container
+}
+
+// instrumentRedis times and traces the commands of client. Spans leave the commands'
+// arguments out: they hold phone numbers, codes and tokens.
+func instrumentRedis(client redis.UniversalClient, options ...redisotel.TracingOption) error {
+	metrics.InstrumentRedis(client)
+	return redisotel.InstrumentTracing(client, append([]redisotel.TracingOption{redisotel.WithDBStatement(false)}, options...)...)
+}
+
+// Bounds of the delay between attempts to reach Redis at startup.
+const (
+	redisRetryMin = 500 * time.Millisecond
+	redisRetryMax = 30 * time.Second
+)
+
+// startRedis migrates the data in Redis and loads the signing keys, the last step of
+// starting. It tries right away and, while Redis cannot be reached or a migration fails,
+// again in the background with exponential backoff; the service is not ready until it
+// succeeds.
+func startRedis(checker *health.Checker, client redis.UniversalClient, keys services.KeyService) {
+	err := migrateRedis(client, keys)
+	if err == nil {
+		checker.Started()
+		return
+	}
+
+	checker.Starting(err)
+	go func() {
+		for delay := redisRetryMin; ; delay = min(delay*2, redisRetryMax) {
+			logger.Logger().Warn().Err(err).Dur("retry_in", delay).Msg("Redis not ready")
+			time.Sleep(delay)
+			if err = migrateRedis(client, keys); err != nil {
+				checker.Starting(err)
+				continue
+			}
+			checker.Started()
+			logger.Logger().Info().Msg("Redis ready")
+			return
+		}
+	}()
+}
+
+func migrateRedis(client redis.UniversalClient, keys services.KeyService) error {
+	ctx := context.Background()
+	if err := db.Ping(ctx, client); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	if err := repositories.MigrateUserKeys(ctx, client); err != nil {
+		return err
+	}
+	if err := repositories.MigrateUsersIndex(ctx, client); err != nil {
+		return err
+	}
+	if err := repositories.ReindexUsers(ctx, client); err != nil {
+		return err
+	}
+	if err := repositories.MigratePhoneNumbers(ctx, client); err != nil {
+		return err
+	}
+	return keys.Load(ctx)
+}
+
+// InitMemoryAppContainer wires the application with in-memory storage and rate limiting.
+// Every call returns an isolated container, which keeps tests independent of each other.
+func InitMemoryAppContainer() *AppContainer {
+	container := newAppContainer(repositories.NewMemoryAuthRepository(), repositories.NewMemoryFraudRepository(), repositories.NewMemoryChallengeRepository(), auditRepository(nil), repositories.NewMemorySigningKeyRepository(), repositories.NewMemoryWebhookRepository(), ratelimit.NewMemoryLimiter())
+	_ = container.Keys.Load(context.Background())
+	container.Health.Started()
+	return container
+}
+
+// newAppContainer also applies ERROR_FORMAT: "legacy" keeps the bilingual error bodies
+// instead of RFC 7807 problem details, and the LOG_* variables. MTLS_IDENTITIES maps client
+// certificate subjects to machines, see tlsconfig.ParseIdentities.
+func newAppContainer(authRepo repositories.AuthRepository, fraudRepo repositories.FraudRepository, challengeRepo repositories.ChallengeRepository, auditRepo repositories.AuditRepository, keyRepo repositories.SigningKeyRepository, webhookRepo repositories.WebhookRepository, limiter ratelimit.RateLimiter) *AppContainer {
+	logger.SetupLogger()
+	v1.UseLegacyErrors(os.Getenv("ERROR_FORMAT") == "legacy")
+	configureMessages()
+	// Before startRedis: stored phones are normalized in the configured default region.
+	configurePhones()
+	requests.RegisterValidators()
+
+	fraudConfig, err := services.FraudConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	fraudGuard := services.NewFraudGuard(fraudRepo, fraudConfig)
+
+	challengeConfig, err := services.ChallengeConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	challenges := services.NewChallengeGuard(challengeRepo, challengeVerifier(challengeRepo), challengeConfig)
+
+	webhookConfig, err := services.WebhookConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	webhooks := services.NewWebhookService(webhookRepo, webhookConfig)
+
+	machines, err := tlsconfig.ParseIdentities(os.Getenv("MTLS_IDENTITIES"))
+	if err != nil {
+		panic(fmt.Errorf("MTLS_IDENTITIES: %w", err))
+	}
+
+	auditLog := services.NewAuditLog(auditRepo, audit.NewHasher([]byte(os.Getenv("AUDIT_HASH_KEY"))))
+
+	sender := sms.NewLogSender()
+	checker := healthChecker(sender)
+	authService := services.NewAuthService(authRepo, sender, fraudGuard, auditLog, webhooks)
 	authController := v1.NewAuthAPI(authService)
 
 	return &AppContainer{
-		Redis:   redisClient,
-		Limiter: limiter,
-		AuthAPI: authController,
+		Limiter:        limiter,
+		RateLimits:     rateLimitPolicies(),
+		AuthRepository: authRepo,
+		SMS:            sender,
+		FraudGuard:     fraudGuard,
+		Challenges:     challenges,
+		AuditLog:       auditLog,
+		AuthService:    authService,
+		Keys:           services.NewKeyService(keyRepo),
+		Webhooks:       webhooks,
+		AuthAPI:        authController,
+		FraudAPI:       v1.NewFraudAPI(fraudGuard),
+		AuditAPI:       v1.NewAuditAPI(auditLog),
+		LoggingAPI:     v1.NewLoggingAPI(),
+		WebhookAPI:     v1.NewWebhookAPI(webhooks),
+		Health:         checker,
+		HealthAPI:      v1.NewHealthAPI(checker),
+		Machines:       machines,
+	}
+}
+
+// healthChecker checks the dependencies every container has, within HEALTH_CHECK_TIMEOUT
+// (default 2s) each. The signing keys fail the check while the built-in key signs, unless
+// JWT_ALLOW_BUILTIN_KEY is true. It is not started: the container says when it is.
+func healthChecker(sender sms.Sender) *health.Checker {
+	timeout := health.DefaultTimeout
+	if value := os.Getenv("HEALTH_CHECK_TIMEOUT"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			panic(fmt.Errorf("HEALTH_CHECK_TIMEOUT: %q is not a positive duration", value))
+		}
+	}
+
+	allowBuiltinKey := false
+	if value := os.Getenv("JWT_ALLOW_BUILTIN_KEY"); value != "" {
+		var err error
+		if allowBuiltinKey, err = strconv.ParseBool(value); err != nil {
+			panic(fmt.Errorf("JWT_ALLOW_BUILTIN_KEY: %q is not a boolean", value))
+		}
 	}
 
+	checker := health.NewChecker(timeout)
+	checker.Add("signing_keys", func(ctx context.Context) error {
+		return utils.CheckSigningKey(allowBuiltinKey)
+	})
+	checker.Add("sms", func(ctx context.Context) error {
+		return sms.Health(ctx, sender)
+	})
+	return checker
+}
+
+// configureMessages loads the extra catalogs in I18N_DIR and applies DEFAULT_LOCALE.
+func configureMessages() {
+	if dir := os.Getenv("I18N_DIR"); dir != "" {
+		if err := i18n.LoadDir(dir); err != nil {
+			panic(err)
+		}
+	}
+
+	locale := os.Getenv("DEFAULT_LOCALE")
+	if locale == "" {
+		locale = i18n.FallbackLocale
+	}
+	if err := i18n.SetDefaultLocale(locale); err != nil {
+		panic(err)
+	}
+}
+
+// configurePhones applies PHONE_DEFAULT_REGION, the country of numbers written without a
+// country code.
+func configurePhones() {
+	region := os.Getenv("PHONE_DEFAULT_REGION")
+	if region == "" {
+		region = phone.DefaultRegion
+	}
+	if err := phone.SetDefaultRegion(region); err != nil {
+		panic(err)
+	}
+}
+
+// rateLimitPolicies reads the policies in RATE_LIMIT_CONFIG, or uses the built-in ones.
+func rateLimitPolicies() *ratelimit.Policies {
+	var policies *ratelimit.Policies
+	var err error
+	if path := os.Getenv("RATE_LIMIT_CONFIG"); path != "" {
+		policies, err = ratelimit.LoadPolicies(path)
+	} else {
+		policies, err = ratelimit.NewPolicies(ratelimit.DefaultConfig())
+	}
+	if err != nil {
+		panic(err)
+	}
+	return policies
+}
+
+// auditConfig is where audit events go.
+type auditConfig struct {
+	// sink is "redis", "file" or "memory".
+	sink      string
+	file      string
+	maxEvents int64
+}
+
+// auditConfigFromEnv reads AUDIT_SINK ("redis" by default), AUDIT_FILE (logs/audit.log)
+// for the file sink, and AUDIT_MAX_EVENTS (1000000), which caps the events kept in Redis
+// or memory.
+func auditConfigFromEnv() (auditConfig, error) {
+	config := auditConfig{sink: os.Getenv("AUDIT_SINK"), file: os.Getenv("AUDIT_FILE"), maxEvents: 1000000}
+	if value := os.Getenv("AUDIT_MAX_EVENTS"); value != "" {
+		var err error
+		if config.maxEvents, err = strconv.ParseInt(value, 10, 64); err != nil || config.maxEvents <= 0 {
+			return config, fmt.Errorf("AUDIT_MAX_EVENTS: %q is not a positive number", value)
+		}
+	}
+	switch config.sink {
+	case "":
+		config.sink = "redis"
+	case "redis", "file", "memory":
+	default:
+		return config, fmt.Errorf("AUDIT_SINK: unknown sink %q", config.sink)
+	}
+	if config.file == "" {
+		config.file = "logs/audit.log"
+	}
+	return config, nil
+}
+
+// checkHashKey requires AUDIT_HASH_KEY of the sinks that keep events. Phone hashes made
+// without a key are reversed by hashing every number.
+func (c auditConfig) checkHashKey() error {
+	if c.sink != "memory" && os.Getenv("AUDIT_HASH_KEY") == "" {
+		return fmt.Errorf("AUDIT_HASH_KEY: required by the %s audit sink", c.sink)
+	}
+	return nil
+}
+
+// auditRepository opens the sink of auditConfigFromEnv. Without Redis, events bound for
+// Redis stay in memory.
+func auditRepository(redisClient redis.UniversalClient) repositories.AuditRepository {
+	config, err := auditConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	if config.sink == "redis" && redisClient == nil {
+		config.sink = "memory"
+	}
+	if err := config.checkHashKey(); err != nil {
+		panic(err)
+	}
+
+	switch config.sink {
+	case "file":
+		repo, err := repositories.NewFileAuditRepository(config.file)
+		if err != nil {
+			panic(err)
+		}
+		return repo
+	case "memory":
+		return repositories.NewMemoryAuditRepository(int(config.maxEvents))
+	}
+	return repositories.NewAuditRepository(redisClient, config.maxEvents)
+}
+
+// challengeVerifier reads CHALLENGE_PROVIDER: "hcaptcha" or "recaptcha" (with
+// CHALLENGE_SITE_KEY, CHALLENGE_SECRET and optionally CHALLENGE_VERIFY_URL), "pow" (signed
+// with CHALLENGE_SECRET, CHALLENGE_POW_DIFFICULTY leading zero bits), or nothing to never
+// challenge clients.
+func challengeVerifier(store challenge.Store) challenge.Verifier {
+	var verifier challenge.Verifier
+	var err error
+	switch provider := os.Getenv("CHALLENGE_PROVIDER"); provider {
+	case "", "none":
+		return nil
+	case "pow":
+		difficulty := 20
+		if value := os.Getenv("CHALLENGE_POW_DIFFICULTY"); value != "" {
+			if difficulty, err = strconv.Atoi(value); err != nil {
+				panic(fmt.Errorf("CHALLENGE_POW_DIFFICULTY: %w", err))
+			}
+		}
+		verifier, err = challenge.NewProofOfWork([]byte(os.Getenv("CHALLENGE_SECRET")), difficulty, 5*time.Minute, store)
+	default:
+		verifier, err = challenge.NewHTTPVerifier(provider, os.Getenv("CHALLENGE_SITE_KEY"),
+			os.Getenv("CHALLENGE_SECRET"), os.Getenv("CHALLENGE_VERIFY_URL"))
+	}
+	if err != nil {
+		panic(err)
+	}
+	return verifier
+}
+
+// ConfigureTracing traces the requests r serves; see middleware.Tracing. The span of a
+// request lives in its http.Request's context, which services read through the gin.Context
+// they are given, so r falls back to it.
+func ConfigureTracing(r *gin.Engine) {
+	r.ContextWithFallback = true
+	r.Use(middleware.Tracing())
+}
+
+// ConfigureProxies applies TRUSTED_PROXIES, a comma-separated list of addresses and CIDR
+// ranges of the load balancers in front of the service. The client IP is read from
+// X-Forwarded-For only when a request comes through one of them, skipping the entries the
+// trusted proxies appended; without the variable no proxy is trusted and the client IP is
+// the peer address, so clients cannot spoof it.
+func ConfigureProxies(r *gin.Engine) {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		panic(err)
+	}
 }
@@ -0,0 +1,47 @@
+package bootstrap
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrumentRedisHidesStatements(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{mr.Addr()}})
+	t.Cleanup(func() { client.Close() })
+	spans := tracetest.NewSpanRecorder()
+	if err := instrumentRedis(client, redisotel.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := client.Set(ctx, "otp:{+989120000000}", "123456", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Get(ctx, "otp:{+989120000000}")
+		pipe.Del(ctx, "otp:{+989120000000}")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ended := spans.Ended()
+	if len(ended) < 2 {
+		t.Fatalf("recorded %d spans, want one per command and pipeline", len(ended))
+	}
+	for _, span := range ended {
+		for _, attr := range span.Attributes() {
+			if attr.Key == "db.statement" || strings.Contains(attr.Value.Emit(), "989120000000") || strings.Contains(attr.Value.Emit(), "123456") {
+				t.Errorf("span %s has attribute %s=%q", span.Name(), attr.Key, attr.Value.Emit())
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package bootstrap
+
+import (
+	"authentication/pkg/tlsconfig"
+	"authentication/utils/logger"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerConfig are the settings of the HTTP server. The timeouts keep slow or idle clients
+// from holding connections open forever.
+type ServerConfig struct {
+	Addr string
+	// ReadHeaderTimeout bounds reading the headers, ReadTimeout the whole request.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// DrainDelay is how long the service reports it is stopping, while still serving, before
+	// it shuts down: the time load balancers need to take it out of rotation.
+	DrainDelay time.Duration
+	// ShutdownTimeout is how long in-flight requests are given to finish on shutdown.
+	ShutdownTimeout time.Duration
+
+	// TLSCertFile and TLSKeyFile, when set, serve HTTPS instead of HTTP. The files are
+	// checked for a new certificate every TLSReloadInterval.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSMinVersion     uint16
+	TLSReloadInterval time.Duration
+	// AdminAddr, when set, is the address of the admin listener, which serves user
+	// management, metrics and profiling instead of the public one. With ClientCAFile it
+	// requires a client certificate issued by those CAs, and with AdminAllowedIPs it only
+	// answers clients from those networks.
+	AdminAddr       string
+	ClientCAFile    string
+	AdminAllowedIPs []netip.Prefix
+	// AdminWriteTimeout replaces WriteTimeout on the admin listener, where profiles and
+	// traces take as long as asked. Zero is no timeout.
+	AdminWriteTimeout time.Duration
+}
+
+// ServerConfigFromEnv reads HTTP_ADDR (default :8080), HTTP_READ_HEADER_TIMEOUT (5s),
+// HTTP_READ_TIMEOUT (15s), HTTP_WRITE_TIMEOUT (30s), HTTP_IDLE_TIMEOUT (120s),
+// HTTP_MAX_HEADER_BYTES (32768), SHUTDOWN_DRAIN_DELAY (5s) and SHUTDOWN_TIMEOUT (30s), and
+// for TLS TLS_CERT_FILE, TLS_KEY_FILE, TLS_MIN_VERSION (1.2) and TLS_RELOAD_INTERVAL (1m),
+// and for the admin listener ADMIN_ADDR, MTLS_CLIENT_CA_FILE, ADMIN_ALLOWED_IPS and
+// ADMIN_WRITE_TIMEOUT (none).
+func ServerConfigFromEnv() (ServerConfig, error) {
+	config := ServerConfig{
+		Addr:         os.Getenv("HTTP_ADDR"),
+		TLSCertFile:  os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:   os.Getenv("TLS_KEY_FILE"),
+		AdminAddr:    os.Getenv("ADMIN_ADDR"),
+		ClientCAFile: os.Getenv("MTLS_CLIENT_CA_FILE"),
+	}
+	if config.Addr == "" {
+		config.Addr = ":8080"
+	}
+
+	durations := []struct {
+		name     string
+		value    *time.Duration
+		fallback time.Duration
+		// zero tells whether 0 is allowed, to turn the setting off.
+		zero bool
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", &config.ReadHeaderTimeout, 5 * time.Second, false},
+		{"HTTP_READ_TIMEOUT", &config.ReadTimeout, 15 * time.Second, false},
+		{"HTTP_WRITE_TIMEOUT", &config.WriteTimeout, 30 * time.Second, false},
+		{"HTTP_IDLE_TIMEOUT", &config.IdleTimeout, 120 * time.Second, false},
+		{"SHUTDOWN_DRAIN_DELAY", &config.DrainDelay, 5 * time.Second, true},
+		{"SHUTDOWN_TIMEOUT", &config.ShutdownTimeout, 30 * time.Second, false},
+		{"TLS_RELOAD_INTERVAL", &config.TLSReloadInterval, time.Minute, false},
+		{"ADMIN_WRITE_TIMEOUT", &config.AdminWriteTimeout, 0, true},
+	}
+	for _, d := range durations {
+		*d.value = d.fallback
+		if raw := os.Getenv(d.name); raw != "" {
+			parsed, err := time.ParseDuration(raw)
+			if err != nil || parsed < 0 || parsed == 0 && !d.zero {
+				return config, fmt.Errorf("%s: %q is not a positive duration", d.name, raw)
+			}
+			*d.value = parsed
+		}
+	}
+
+	config.MaxHeaderBytes = 32 << 10
+	if raw := os.Getenv("HTTP_MAX_HEADER_BYTES"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			return config, fmt.Errorf("HTTP_MAX_HEADER_BYTES: %q is not a positive number", raw)
+		}
+		config.MaxHeaderBytes = parsed
+	}
+
+	var err error
+	if config.TLSMinVersion, err = tlsconfig.ParseVersion(os.Getenv("TLS_MIN_VERSION")); err != nil {
+		return config, fmt.Errorf("TLS_MIN_VERSION: %w", err)
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return config, errors.New("TLS_CERT_FILE and TLS_KEY_FILE go together")
+	}
+	if config.ClientCAFile != "" && (config.AdminAddr == "" || config.TLSCertFile == "") {
+		return config, errors.New("MTLS_CLIENT_CA_FILE needs ADMIN_ADDR, TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	for _, raw := range strings.Split(os.Getenv("ADMIN_ALLOWED_IPS"), ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		prefix, err := parsePrefix(raw)
+		if err != nil {
+			return config, fmt.Errorf("ADMIN_ALLOWED_IPS: %w", err)
+		}
+		config.AdminAllowedIPs = append(config.AdminAllowedIPs, prefix)
+	}
+	if len(config.AdminAllowedIPs) > 0 && config.AdminAddr == "" {
+		return config, errors.New("ADMIN_ALLOWED_IPS needs ADMIN_ADDR")
+	}
+	return config, nil
+}
+
+// parsePrefix reads a network, or a single address.
+func parsePrefix(raw string) (netip.Prefix, error) {
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// Listener is a server and the listener it serves on.
+type Listener struct {
+	Server   *http.Server
+	Listener net.Listener
+}
+
+// Listen opens the listeners of config: the public one serving public and, with AdminAddr,
+// the admin one serving admin. New certificates are picked up until ctx is done.
+func Listen(ctx context.Context, config ServerConfig, public, admin http.Handler) ([]Listener, error) {
+	servers := []*http.Server{NewServer(config, public)}
+	if config.AdminAddr != "" {
+		server := NewServer(config, admin)
+		server.Addr = config.AdminAddr
+		server.WriteTimeout = config.AdminWriteTimeout
+		servers = append(servers, server)
+	}
+
+	if config.TLSCertFile != "" {
+		reloader, err := tlsconfig.NewReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("TLS_CERT_FILE: %w", err)
+		}
+		go reloader.Watch(ctx, config.TLSReloadInterval)
+		for _, server := range servers {
+			server.TLSConfig = tlsconfig.Server(reloader, config.TLSMinVersion)
+		}
+
+		if config.ClientCAFile != "" {
+			clientCAs, err := tlsconfig.LoadCertPool(config.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("MTLS_CLIENT_CA_FILE: %w", err)
+			}
+			servers[1].TLSConfig = tlsconfig.Mutual(reloader, config.TLSMinVersion, clientCAs)
+		}
+	}
+
+	var listeners []Listener
+	for _, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, Listener{Server: server, Listener: listener})
+	}
+	return listeners, nil
+}
+
+// Drain returns a context that is done delay after ctx. When ctx is done it calls stopping
+// first, so that /readyz takes the service out of rotation while it still serves the
+// requests load balancers send before they notice.
+func Drain(ctx context.Context, delay time.Duration, stopping func()) context.Context {
+	drained, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		defer cancel()
+		<-ctx.Done()
+		stopping()
+		logger.Logger().Info().Dur("delay", delay).Msg("Draining")
+		time.Sleep(delay)
+	}()
+	return drained
+}
+
+// ServeAll serves every listener until ctx is done, or until one of them stops serving,
+// then shuts them all down; see Serve.
+func ServeAll(ctx context.Context, shutdownTimeout time.Duration, listeners ...Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			err := Serve(ctx, l.Server, l.Listener, shutdownTimeout)
+			cancel()
+			errs <- err
+		}()
+	}
+
+	var all []error
+	for range listeners {
+		all = append(all, <-errs)
+	}
+	return errors.Join(all...)
+}
+
+// NewServer serves handler with config. The server's own errors, such as failed TLS
+// handshakes, go to the log.
+func NewServer(config ServerConfig, handler http.Handler) *http.Server {
+	errorLog := logger.Logger().With().Str("handle", "HTTP").Logger()
+	return &http.Server{
+		Addr:              config.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		ErrorLog:          log.New(errorLog, "", 0),
+	}
+}
+
+// Serve serves requests on listener, over TLS when the server has a TLSConfig, until ctx
+// is done, then stops taking new ones and waits up to shutdownTimeout for those in flight.
+// It returns why serving stopped early, or the error of a shutdown that did not finish in
+// time.
+func Serve(ctx context.Context, server *http.Server, listener net.Listener, shutdownTimeout time.Duration) error {
+	served := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			served <- server.ServeTLS(listener, "", "")
+			return
+		}
+		served <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Logger().Info().Dur("timeout", shutdownTimeout).Msg("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package bootstrap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerConfig(t *testing.T) {
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", "2s")
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "8192")
+	config, err := ServerConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(config, http.NotFoundHandler())
+	if server.Addr != ":8080" || server.ReadHeaderTimeout != 2*time.Second || server.ReadTimeout != 15*time.Second ||
+		server.WriteTimeout != 30*time.Second || server.IdleTimeout != 120*time.Second || server.MaxHeaderBytes != 8192 {
+		t.Fatalf("unexpected server settings %+v", server)
+	}
+
+	if config.DrainDelay != 5*time.Second || config.AdminWriteTimeout != 0 {
+		t.Fatalf("unexpected drain delay %v and admin write timeout %v", config.DrainDelay, config.AdminWriteTimeout)
+	}
+
+	// The admin listener has its own write timeout, none by default, for the profiler.
+	config.Addr, config.AdminAddr = "127.0.0.1:0", "127.0.0.1:0"
+	for _, timeout := range []time.Duration{0, 5 * time.Minute} {
+		config.AdminWriteTimeout = timeout
+		listeners, err := Listen(context.Background(), config, http.NotFoundHandler(), http.NotFoundHandler())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range listeners {
+			l.Listener.Close()
+		}
+		if listeners[0].Server.WriteTimeout != 30*time.Second || listeners[1].Server.WriteTimeout != timeout {
+			t.Fatalf("expected write timeouts of 30s and %v, got %v and %v", timeout, listeners[0].Server.WriteTimeout, listeners[1].Server.WriteTimeout)
+		}
+	}
+
+	// Zero turns the drain delay and the admin write timeout off; the other settings need a duration.
+	t.Setenv("SHUTDOWN_DRAIN_DELAY", "0")
+	t.Setenv("ADMIN_WRITE_TIMEOUT", "10m")
+	if config, err := ServerConfigFromEnv(); err != nil || config.DrainDelay != 0 || config.AdminWriteTimeout != 10*time.Minute {
+		t.Fatalf("unexpected drain delay and admin write timeout %+v %v", config, err)
+	}
+	t.Setenv("ADMIN_WRITE_TIMEOUT", "-1s")
+	if _, err := ServerConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "ADMIN_WRITE_TIMEOUT") {
+		t.Fatalf("expected a negative ADMIN_WRITE_TIMEOUT to be refused, got %v", err)
+	}
+	t.Setenv("ADMIN_WRITE_TIMEOUT", "")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "0")
+	if _, err := ServerConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "HTTP_WRITE_TIMEOUT") {
+		t.Fatalf("expected no HTTP_WRITE_TIMEOUT to be refused, got %v", err)
+	}
+	t.Setenv("HTTP_WRITE_TIMEOUT", "soon")
+	if _, err := ServerConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "HTTP_WRITE_TIMEOUT") {
+		t.Fatalf("expected an invalid HTTP_WRITE_TIMEOUT to be refused, got %v", err)
+	}
+}
+
+func TestServerConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"certificate without a key", map[string]string{"TLS_CERT_FILE": certFile}, "TLS_KEY_FILE"},
+		{"TLS 1.1", map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_MIN_VERSION": "1.1"}, "TLS_MIN_VERSION"},
+		{
+			"client certificates without an admin listener",
+			map[string]string{"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "MTLS_CLIENT_CA_FILE": filepath.Join(dir, "ca.crt")},
+			"ADMIN_ADDR",
+		},
+		{"allowlist without an admin listener", map[string]string{"ADMIN_ALLOWED_IPS": "127.0.0.1"}, "ADMIN_ADDR"},
+		{"invalid network", map[string]string{"ADMIN_ADDR": "127.0.0.1:0", "ADMIN_ALLOWED_IPS": "10.0.0.0/33"}, "ADMIN_ALLOWED_IPS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			if _, err := ServerConfigFromEnv(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("ServerConfigFromEnv() = %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// serve serves the listeners config opens for public and admin until the test ends, and
+// returns their addresses.
+func serve(t *testing.T, config ServerConfig, public, admin http.Handler) []string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listeners, err := Listen(ctx, config, public, admin)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeAll(ctx, time.Second, listeners...)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	})
+
+	addrs := make([]string, len(listeners))
+	for i, l := range listeners {
+		addrs[i] = l.Listener.Addr().String()
+	}
+	return addrs
+}
+
+// named answers every request with name, and the common name of the verified client
+// certificate if there is one.
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := name
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			body += " " + r.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+		_, _ = io.WriteString(w, body)
+	})
+}
+
+// get returns the status and body of url, fetched with client.
+func get(client *http.Client, url string) (int, string, *tls.ConnectionState, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return res.StatusCode, string(body), res.TLS, err
+}
+
+func TestListen(t *testing.T) {
+	t.Setenv("HTTP_ADDR", "127.0.0.1:0")
+	config, err := ServerConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without ADMIN_ADDR, one listener serves it all.
+	if addrs := serve(t, config, named("public"), named("admin")); len(addrs) != 1 {
+		t.Fatalf("expected a single listener, got %v", addrs)
+	}
+
+	config.AdminAddr = "127.0.0.1:0"
+	addrs := serve(t, config, named("public"), named("admin"))
+	if len(addrs) != 2 {
+		t.Fatalf("expected a public and an admin listener, got %v", addrs)
+	}
+	for i, want := range []string{"public", "admin"} {
+		if _, body, _, err := get(http.DefaultClient, "http://"+addrs[i]); err != nil || body != want {
+			t.Errorf("listener %d served %q, %v, want %q", i, body, err, want)
+		}
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	pki.serverFiles(certFile, keyFile)
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HTTP_ADDR", "127.0.0.1:0")
+	t.Setenv("ADMIN_ADDR", "127.0.0.1:0")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_RELOAD_INTERVAL", "10ms")
+	t.Setenv("MTLS_CLIENT_CA_FILE", caFile)
+	config, err := ServerConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := serve(t, config, named("public"), named("admin"))
+	public, admin := "https://"+addrs[0], "https://"+addrs[1]
+
+	status, body, state, err := get(pki.client("", 0), public)
+	if err != nil || status != http.StatusOK || body != "public" || state.Version < tls.VersionTLS12 {
+		t.Fatalf("expected HTTPS on the public listener, got %d %q %v", status, body, err)
+	}
+	if _, _, _, err := get(pki.client("", tls.VersionTLS11), public); err == nil {
+		t.Fatal("expected TLS 1.1 to be refused")
+	}
+	// The public listener does not ask for client certificates, so they authenticate nothing.
+	if _, body, _, err := get(pki.client("billing.internal", 0), public); err != nil || body != "public" {
+		t.Fatalf("expected a client certificate to be ignored on the public listener, got %q %v", body, err)
+	}
+
+	if _, _, _, err := get(pki.client("", 0), admin); err == nil {
+		t.Fatal("expected the admin listener to require a client certificate")
+	}
+	if _, body, _, err := get(pki.client("billing.internal", 0), admin); err != nil || body != "admin billing.internal" {
+		t.Fatalf("expected the admin listener to verify the client certificate, got %q %v", body, err)
+	}
+
+	// A renewed certificate is served to new connections without a restart.
+	renewed := pki.serverFiles(certFile, keyFile)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, _, state, err := get(pki.client("", 0), public)
+		if err == nil && state.PeerCertificates[0].SerialNumber.Cmp(renewed) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the renewed certificate to be served, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDrainDelay(t *testing.T) {
+	// stopping stands for the health checker: the handler answers like /readyz.
+	var stopping atomic.Bool
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := Drain(ctx, 300*time.Millisecond, func() { stopping.Store(true) })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := ServerConfigFromEnv()
+	server := NewServer(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stopping.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(drained, server, listener, time.Second)
+	}()
+	addr := "http://" + listener.Addr().String()
+
+	cancel()
+	started := time.Now()
+	// Until the delay is over, the service reports stopping and still serves new requests.
+	for {
+		res, err := http.Get(addr + "/readyz")
+		if err != nil {
+			t.Fatalf("expected requests to be served while draining, got %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Since(started) > 200*time.Millisecond {
+			t.Fatalf("expected /readyz to report stopping, got %d", res.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := <-served; err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if waited := time.Since(started); waited < 200*time.Millisecond {
+		t.Fatalf("expected the server to drain before shutting down, stopped after %v", waited)
+	}
+}
+
+// testPKI issues certificates from a throwaway CA.
+type testPKI struct {
+	t      *testing.T
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	p := &testPKI{t: t}
+	p.ca, p.caKey = p.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return p
+}
+
+func (p *testPKI) issue(template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	p.t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.serial++
+	template.SerialNumber = big.NewInt(p.serial)
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, parentKey := p.ca, p.caKey
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return cert, key
+}
+
+// serverFiles writes a certificate for 127.0.0.1 and its key to certFile and keyFile, and
+// returns the certificate's serial number.
+func (p *testPKI) serverFiles(certFile, keyFile string) *big.Int {
+	p.t.Helper()
+
+	cert, key := p.issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "auth.test"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		p.t.Fatal(err)
+	}
+	return cert.SerialNumber
+}
+
+// client presents a client certificate for commonName, unless it is empty, and trusts the CA.
+func (p *testPKI) client(commonName string, maxVersion uint16) *http.Client {
+	p.t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca)
+	config := &tls.Config{RootCAs: roots, MaxVersion: maxVersion}
+	if commonName != "" {
+		cert, key := p.issue(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: commonName},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		config.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
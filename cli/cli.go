@@ -0,0 +1,183 @@
+// Package cli is the command line of the service's binary: serving HTTP, and the
+// operations tasks that work on the same data through the service layer.
+package cli
+
+import (
+	"authentication/bootstrap"
+	"authentication/pkg/apperrors"
+	"authentication/requests"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+// ErrUsage is returned for commands that are unknown or given the wrong arguments; the
+// usage has been written by then.
+var ErrUsage = errors.New("usage")
+
+// startTimeout is how long commands wait for Redis before giving up.
+const startTimeout = 10 * time.Second
+
+const usage = `Usage: authentication <command> [arguments]
+
+Commands:
+  serve                                      serve HTTP (the default)
+  user get <phone>                           show a user
+  user list [flags]                          list users, newest first
+  user suspend <phone> --reason r [--until t] suspend a user, until time t (RFC 3339) if given
+  user delete <phone> --reason r             soft-delete a user
+  sessions revoke --user <phone>             log a user out everywhere
+  keys generate                              add a JWT signing key
+  keys rotate                                add a JWT signing key and retire the unused ones
+  keys list                                  list the JWT signing keys
+  admin create <phone>                       make a user an admin, signing them up if needed
+  otp purge [--user <phone>]                 delete the pending OTP codes, or those of one user
+  config validate                            check the settings of the environment
+`
+
+// CLI runs the commands of the binary.
+type CLI struct {
+	// Out receives what commands show, as JSON for data, and their usage.
+	Out io.Writer
+	// App wires the application the commands work on; bootstrap.InitAppContainer unless set.
+	App func() *bootstrap.AppContainer
+}
+
+// command runs with the arguments that follow its name.
+type command func(ctx context.Context, args []string) error
+
+// Run runs the command named by args, serve when there is none.
+func (c *CLI) Run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return c.serve(ctx, nil)
+	}
+
+	commands := map[string]command{
+		"serve":           c.serve,
+		"user get":        c.withApp(c.userGet),
+		"user list":       c.withApp(c.userList),
+		"user suspend":    c.withApp(c.userSuspend),
+		"user delete":     c.withApp(c.userDelete),
+		"sessions revoke": c.withApp(c.sessionsRevoke),
+		"keys generate":   c.withApp(c.keysGenerate),
+		"keys rotate":     c.withApp(c.keysRotate),
+		"keys list":       c.withApp(c.keysList),
+		"admin create":    c.withApp(c.adminCreate),
+		"otp purge":       c.withApp(c.otpPurge),
+		"config validate": c.configValidate,
+		"help":            c.help,
+		"-h":              c.help,
+		"--help":          c.help,
+	}
+	if run, ok := commands[args[0]]; ok {
+		return run(ctx, args[1:])
+	}
+	if len(args) > 1 {
+		if run, ok := commands[args[0]+" "+args[1]]; ok {
+			return run(ctx, args[2:])
+		}
+	}
+	fmt.Fprint(c.Out, usage)
+	return ErrUsage
+}
+
+func (c *CLI) help(ctx context.Context, args []string) error {
+	fmt.Fprint(c.Out, usage)
+	return nil
+}
+
+// appCommand works on the application's data.
+type appCommand func(ctx context.Context, app *bootstrap.AppContainer, args []string) error
+
+// withApp wires the application for run, once Redis is ready, and releases it after.
+func (c *CLI) withApp(run appCommand) command {
+	return func(ctx context.Context, args []string) error {
+		app, release := c.app()
+		defer release()
+		if err := waitStarted(ctx, app); err != nil {
+			return err
+		}
+		return run(ctx, app, args)
+	}
+}
+
+// app wires the application, and returns how to release its connections. An App given
+// to the CLI belongs to the caller, who releases it.
+func (c *CLI) app() (*bootstrap.AppContainer, func()) {
+	if c.App != nil {
+		return c.App(), func() {}
+	}
+	app := bootstrap.InitAppContainer()
+	return app, func() {
+		if app.Redis != nil {
+			app.Redis.Close()
+		}
+	}
+}
+
+// waitStarted waits for the application to reach Redis and migrate its data, the way the
+// server does before taking requests.
+func waitStarted(ctx context.Context, app *bootstrap.AppContainer) error {
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !app.Health.IsStarted() {
+		select {
+		case <-ctx.Done():
+			startup := app.Health.Ready(context.Background()).Checks["startup"]
+			return fmt.Errorf("not started: %s", startup.Error)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// flags parses the flags of a command, and returns its positional arguments. Flags may
+// come after them, as in "user suspend <phone> --reason fraud".
+func (c *CLI) flags(set *flag.FlagSet, args []string, positional int) ([]string, error) {
+	set.SetOutput(c.Out)
+	var values []string
+	for {
+		if err := set.Parse(args); err != nil {
+			return nil, ErrUsage
+		}
+		if set.NArg() == 0 {
+			break
+		}
+		values = append(values, set.Arg(0))
+		args = set.Args()[1:]
+	}
+	if len(values) != positional {
+		fmt.Fprintf(c.Out, "%s takes %d argument(s), got %d\n", set.Name(), positional, len(values))
+		return nil, ErrUsage
+	}
+	return values, nil
+}
+
+// validate checks request the way the HTTP API binds it.
+func validate(request interface{}) error {
+	if err := binding.Validator.ValidateStruct(request); err != nil {
+		return apperrors.ErrInvalidRequest.Wrap(err)
+	}
+	return nil
+}
+
+// validatePhone refuses what the API refuses as a phone number.
+func validatePhone(phone string) error {
+	return validate(requests.OTPRequest{PhoneNumber: phone})
+}
+
+// print shows value as indented JSON.
+func (c *CLI) print(value interface{}) error {
+	encoder := json.NewEncoder(c.Out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
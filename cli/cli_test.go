@@ -0,0 +1,281 @@
+package cli
+
+import (
+	"authentication/bootstrap"
+	"authentication/pkg/apperrors"
+	"authentication/pkg/phone"
+	"authentication/requests"
+	"authentication/utils"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newApp(t *testing.T) *bootstrap.AppContainer {
+	t.Helper()
+	t.Setenv("APP_STORAGE", "memory")
+	t.Setenv("ADMIN_PHONES", "")
+	return bootstrap.InitMemoryAppContainer()
+}
+
+// run runs a command on the data of app, and returns what it printed.
+func run(app *bootstrap.AppContainer, args ...string) (string, error) {
+	var out bytes.Buffer
+	command := &CLI{Out: &out, App: func() *bootstrap.AppContainer { return app }}
+	err := command.Run(context.Background(), args)
+	return out.String(), err
+}
+
+// runJSON runs a command that succeeds and decodes what it printed into value.
+func runJSON(t *testing.T, app *bootstrap.AppContainer, value interface{}, args ...string) {
+	t.Helper()
+
+	out, err := run(app, args...)
+	if err != nil {
+		t.Fatalf("%v: %v (output %q)", args, err, out)
+	}
+	if err := json.Unmarshal([]byte(out), value); err != nil {
+		t.Fatalf("%v: decode %q: %v", args, out, err)
+	}
+}
+
+// e164 is the form the service stores number in.
+func e164(t *testing.T, number string) string {
+	t.Helper()
+	normalized, err := phone.Normalize(number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return normalized
+}
+
+// signUp logs number in with an OTP, and returns its access token.
+func signUp(t *testing.T, app *bootstrap.AppContainer, number string) string {
+	t.Helper()
+
+	ctx := context.Background()
+	if _, err := app.AuthService.SendOTPCode(requests.OTPRequest{PhoneNumber: number}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	code, err := app.AuthRepository.GetOTP(ctx, e164(t, number))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := app.AuthService.Login(requests.LoginRequest{PhoneNumber: number, OTPCode: code}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user["access_token"]
+}
+
+func TestUsage(t *testing.T) {
+	app := newApp(t)
+
+	for _, args := range [][]string{{"users", "get"}, {"user", "get"}, {"user", "get", "0912", "0913"}, {"user", "list", "--colour"}} {
+		if out, err := run(app, args...); !errors.Is(err, ErrUsage) || out == "" {
+			t.Errorf("%v = %v, want the usage", args, err)
+		}
+	}
+	if out, err := run(app, "help"); err != nil || !strings.Contains(out, "config validate") {
+		t.Errorf("help = %q, %v, want the usage", out, err)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	app := newApp(t)
+	ctx := context.Background()
+
+	if _, err := run(app, "user", "get", "09120000999"); !errors.Is(err, apperrors.ErrUserNotFound) {
+		t.Fatalf("expected an unknown user to be reported, got %v", err)
+	}
+	if _, err := run(app, "user", "get", "12"); !errors.Is(err, apperrors.ErrInvalidRequest) {
+		t.Fatalf("expected an invalid phone to be refused, got %v", err)
+	}
+
+	// The first admin of a deployment is made from the command line, then logs in as usual.
+	var admin map[string]string
+	runJSON(t, app, &admin, "admin", "create", "09120000981")
+	if admin["phone"] != e164(t, "09120000981") || admin["role"] != "admin" {
+		t.Fatalf("unexpected admin %v", admin)
+	}
+	token := signUp(t, app, "09120000981")
+	if claims, err := utils.ParseAccessToken(token); err != nil || claims.Role != "admin" {
+		t.Fatalf("expected the new admin to log in as an admin, got %v %v", claims, err)
+	}
+
+	signUp(t, app, "09120000982")
+	var user map[string]string
+	runJSON(t, app, &user, "user", "get", "0912 000 0982")
+	if user["phone"] != e164(t, "09120000982") || user["role"] != "user" {
+		t.Fatalf("unexpected user %v", user)
+	}
+	var page struct {
+		Total int64 `json:"total"`
+	}
+	runJSON(t, app, &page, "user", "list", "--role", "admin")
+	if page.Total != 1 {
+		t.Fatalf("expected one admin, got %v", page.Total)
+	}
+	if _, err := run(app, "user", "list", "--role", "root"); !errors.Is(err, apperrors.ErrInvalidRequest) {
+		t.Fatalf("expected an invalid filter to be refused, got %v", err)
+	}
+
+	if _, err := run(app, "user", "suspend", "09120000982"); !errors.Is(err, apperrors.ErrInvalidRequest) {
+		t.Fatalf("expected a suspension without reason to be refused, got %v", err)
+	}
+	if _, err := run(app, "user", "suspend", "09120000982", "--reason", "chargeback", "--until", "tomorrow"); err == nil {
+		t.Fatal("expected an invalid end of suspension to be refused")
+	}
+	runJSON(t, app, &user, "user", "suspend", "09120000982", "--reason", "chargeback")
+	if user["status"] != "suspended" {
+		t.Fatalf("unexpected user after suspension %v", user)
+	}
+	history, err := app.AuditLog.History(ctx, e164(t, "09120000982"), requests.AuditHistory{Types: []string{"status_changed"}})
+	if err != nil || len(history.Events) != 1 || history.Events[0].Actor != "machine:cli" {
+		t.Fatalf("expected the command line to be recorded as the actor, got %v %v", history.Events, err)
+	}
+	runJSON(t, app, &user, "user", "delete", "09120000982", "--reason", "asked")
+	if user["status"] != "deleted" {
+		t.Fatalf("unexpected user after deletion %v", user)
+	}
+
+	claims, err := utils.ParseAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runJSON(t, app, &user, "sessions", "revoke", "--user", "09120000981")
+	if _, err := app.AuthService.CheckAccount(ctx, claims); !errors.Is(err, apperrors.ErrSessionRevoked) {
+		t.Fatalf("expected the admin's tokens to be revoked, got %v", err)
+	}
+}
+
+func TestOTPPurge(t *testing.T) {
+	app := newApp(t)
+	ctx := context.Background()
+	for _, number := range []string{"09120000983", "09120000984"} {
+		if _, err := app.AuthService.SendOTPCode(requests.OTPRequest{PhoneNumber: number}, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var purged map[string]int
+	runJSON(t, app, &purged, "otp", "purge", "--user", "09120000983")
+	if purged["purged"] != 1 {
+		t.Fatalf("expected one code purged, got %v", purged)
+	}
+	runJSON(t, app, &purged, "otp", "purge")
+	if purged["purged"] != 1 {
+		t.Fatalf("expected the remaining code purged, got %v", purged)
+	}
+	if _, err := app.AuthRepository.GetOTP(ctx, e164(t, "09120000984")); !errors.Is(err, apperrors.ErrOTPInvalid) {
+		t.Fatalf("expected no code left, got %v", err)
+	}
+}
+
+func TestKeysCommands(t *testing.T) {
+	t.Setenv("JWT_KEYS_REFRESH", "10ms")
+	t.Cleanup(func() { utils.SetSigningKeys(nil) })
+	app := newApp(t)
+
+	var generated map[string]interface{}
+	runJSON(t, app, &generated, "keys", "generate")
+	if generated["state"] != keyPending || generated["secret"] != nil {
+		t.Fatalf("unexpected generated key %v", generated)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var rotated struct {
+		Key     keyInfo  `json:"key"`
+		Retired []string `json:"retired"`
+	}
+	runJSON(t, app, &rotated, "keys", "rotate")
+	if rotated.Key.State != keyPending || len(rotated.Retired) != 0 {
+		t.Fatalf("expected the current key to be kept, got %+v", rotated)
+	}
+	var keys []keyInfo
+	runJSON(t, app, &keys, "keys", "list")
+	if len(keys) != 2 || keys[0].ID != generated["id"] || keys[0].State != keyCurrent || keys[1].State != keyPending {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+}
+
+func TestKeyInfos(t *testing.T) {
+	now := time.Now()
+	key := func(id string, activeAt time.Duration) utils.SigningKey {
+		return utils.SigningKey{ID: id, Secret: []byte(id), ActiveAt: now.Add(activeAt)}
+	}
+	tests := []struct {
+		name string
+		keys []utils.SigningKey
+		want []string
+	}{
+		{"none", nil, []string{}},
+		{"only pending", []utils.SigningKey{key("a", time.Minute)}, []string{keyPending}},
+		{"rotated", []utils.SigningKey{key("a", -2*time.Hour), key("b", -time.Hour), key("c", time.Minute)}, []string{keyVerifying, keyCurrent, keyPending}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			infos := keyInfos(tt.keys, now)
+			states := []string{}
+			for _, info := range infos {
+				states = append(states, info.State)
+			}
+			if strings.Join(states, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("keyInfos() states = %v, want %v", states, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Setenv("APP_STORAGE", "")
+	t.Setenv("AUDIT_HASH_KEY", "pepper")
+	// Redis is not reached, but its settings are checked.
+	t.Setenv("REDIS_HOST", "localhost")
+	t.Setenv("REDIS_PORT", "6379")
+	if out, err := run(nil, "config", "validate"); err != nil || !strings.Contains(out, "valid") {
+		t.Fatalf("expected the configuration to be valid, got %q %v", out, err)
+	}
+
+	t.Run("every problem", func(t *testing.T) {
+		t.Setenv("REDIS_MODE", "sentinel")
+		t.Setenv("HTTP_WRITE_TIMEOUT", "soon")
+		t.Setenv("AUDIT_SINK", "kafka")
+		// Proof-of-work seeds need a key.
+		t.Setenv("CHALLENGE_PROVIDER", "pow")
+		_, err := run(nil, "config", "validate")
+		for _, want := range []string{"REDIS_MASTER_NAME", "HTTP_WRITE_TIMEOUT", "AUDIT_SINK", "challenge"} {
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("config validate = %v, want %s reported", err, want)
+			}
+		}
+	})
+
+	t.Run("file sink", func(t *testing.T) {
+		// The file sink is checked, not created.
+		path := filepath.Join(t.TempDir(), "audit", "events.log")
+		t.Setenv("AUDIT_SINK", "file")
+		t.Setenv("AUDIT_FILE", path)
+		if out, err := run(nil, "config", "validate"); err != nil || !strings.Contains(out, "valid") {
+			t.Fatalf("expected the configuration to be valid, got %q %v", out, err)
+		}
+		if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+			t.Fatalf("expected validation to leave the audit file alone, got %v", err)
+		}
+	})
+
+	t.Run("audit hash key", func(t *testing.T) {
+		// Events kept in Redis need the key of the phone hashes.
+		t.Setenv("AUDIT_SINK", "redis")
+		t.Setenv("AUDIT_HASH_KEY", "")
+		if _, err := run(nil, "config", "validate"); err == nil || !strings.Contains(err.Error(), "AUDIT_HASH_KEY") {
+			t.Fatalf("expected the missing audit hash key to be reported, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"authentication/bootstrap"
+	"authentication/utils"
+	"context"
+	"flag"
+	"time"
+)
+
+// Key states, as keys list shows them.
+const (
+	keyPending   = "pending"
+	keyCurrent   = "current"
+	keyVerifying = "verifying"
+)
+
+// keyInfo is what is shown of a key: never its secret.
+type keyInfo struct {
+	ID        string    `json:"id"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	ActiveAt  time.Time `json:"active_at"`
+}
+
+func (c *CLI) keysGenerate(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	if _, err := c.flags(flag.NewFlagSet("keys generate", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	key, err := app.Keys.Generate(ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(keyInfo{ID: key.ID, State: keyPending, CreatedAt: key.CreatedAt, ActiveAt: key.ActiveAt})
+}
+
+func (c *CLI) keysRotate(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	if _, err := c.flags(flag.NewFlagSet("keys rotate", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	key, retired, err := app.Keys.Rotate(ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]interface{}{
+		"key":     keyInfo{ID: key.ID, State: keyPending, CreatedAt: key.CreatedAt, ActiveAt: key.ActiveAt},
+		"retired": append([]string{}, retired...),
+	})
+}
+
+func (c *CLI) keysList(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	if _, err := c.flags(flag.NewFlagSet("keys list", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	keys, err := app.Keys.Keys(ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(keyInfos(keys, time.Now()))
+}
+
+// keyInfos tells which of keys, in the order they activate, signs at now.
+func keyInfos(keys []utils.SigningKey, now time.Time) []keyInfo {
+	infos := make([]keyInfo, len(keys))
+	current := -1
+	for i, key := range keys {
+		infos[i] = keyInfo{ID: key.ID, State: keyVerifying, CreatedAt: key.CreatedAt, ActiveAt: key.ActiveAt}
+		if key.ActiveAt.After(now) {
+			infos[i].State = keyPending
+		} else {
+			current = i
+		}
+	}
+	if current >= 0 {
+		infos[current].State = keyCurrent
+	}
+	return infos
+}
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"authentication/bootstrap"
+	"context"
+	"flag"
+	"fmt"
+)
+
+func (c *CLI) otpPurge(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	var phone string
+	set := flag.NewFlagSet("otp purge", flag.ContinueOnError)
+	set.StringVar(&phone, "user", "", "phone number of the user (default every user)")
+	if _, err := c.flags(set, args, 0); err != nil {
+		return err
+	}
+	if phone != "" {
+		if err := validatePhone(phone); err != nil {
+			return err
+		}
+	}
+
+	purged, err := app.AuthService.PurgeOTPs(ctx, phone)
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]int{"purged": purged})
+}
+
+func (c *CLI) configValidate(ctx context.Context, args []string) error {
+	if _, err := c.flags(flag.NewFlagSet("config validate", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	if err := bootstrap.ValidateConfig(); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.Out, "configuration is valid")
+	return nil
+}
@@ -0,0 +1,86 @@
+package cli
+
+import (
+	"authentication/bootstrap"
+	_ "authentication/docs"
+	"authentication/middleware"
+	"authentication/pkg/tracing"
+	"authentication/routes"
+	"authentication/services"
+	"authentication/utils/logger"
+	"context"
+	"flag"
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+	"os"
+	"syscall"
+)
+
+// serve serves until ctx is done, then drains the requests in flight and releases the
+// service's connections.
+func (c *CLI) serve(ctx context.Context, args []string) error {
+	if _, err := c.flags(flag.NewFlagSet("serve", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	err := c.run(ctx)
+	if err != nil {
+		logger.Logger().Error().Err(err).Msg("Server stopped")
+	}
+	return err
+}
+
+func (c *CLI) run(ctx context.Context) error {
+	// GIN_MODE=debug brings back gin's route listing and warnings.
+	if os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	serverConfig, err := bootstrap.ServerConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	app, release := c.app()
+	defer release()
+	// Without ADMIN_ADDR, one listener serves it all.
+	public, admin := newRouter(), newRouter(middleware.AllowIPs(serverConfig.AdminAllowedIPs))
+	if serverConfig.AdminAddr == "" {
+		admin = routes.Urls(public, app)
+	} else {
+		routes.PublicUrls(public, app)
+		routes.AdminUrls(admin, app)
+	}
+	admin.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	services.StartDeletedUsersPurger(app.AuthService)
+	services.StartSigningKeysRefresher(app.Keys)
+	services.StartWebhookDispatcher(app.Webhooks)
+	app.RateLimits.ReloadOn(syscall.SIGHUP)
+
+	ctx = bootstrap.Drain(ctx, serverConfig.DrainDelay, app.Health.Stopping)
+	listeners, err := bootstrap.Listen(ctx, serverConfig, public, admin)
+	if err != nil {
+		return err
+	}
+	for _, l := range listeners {
+		l.Server.RegisterOnShutdown(app.Health.Stopping)
+		logger.Logger().Info().Str("addr", l.Listener.Addr().String()).Bool("tls", l.Server.TLSConfig != nil).Msg("Serving")
+	}
+	return bootstrap.ServeAll(ctx, serverConfig.ShutdownTimeout, listeners...)
+}
+
+// newRouter is a router with the middleware of every listener, then with extra.
+func newRouter(extra ...gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	bootstrap.ConfigureProxies(r)
+	bootstrap.ConfigureTracing(r)
+
+	r.Use(middleware.RequestID(), middleware.AccessLog(), middleware.Metrics(), middleware.AuditClient(), middleware.Locale(), middleware.ErrorHandling())
+	r.Use(extra...)
+	return r
+}
@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"authentication/bootstrap"
+	"authentication/pkg/tlsconfig"
+	"authentication/requests"
+	"authentication/services"
+	"context"
+	"flag"
+	"time"
+)
+
+// operator is the machine changes made from the command line are audited as.
+const operator = "cli"
+
+// asOperator has the audit log record changes as made from the command line.
+func asOperator(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tlsconfig.MachineKey, operator)
+}
+
+func (c *CLI) userGet(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	phone, err := c.flags(flag.NewFlagSet("user get", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	if err := validatePhone(phone[0]); err != nil {
+		return err
+	}
+
+	// The operator sees every profile, the way an admin does.
+	user, err := app.AuthService.GetUserProfile(requests.Profile{PhoneNumber: phone[0], CallerRole: "admin"}, ctx)
+	if err != nil {
+		return err
+	}
+	return c.print(user)
+}
+
+func (c *CLI) userList(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	var request requests.UsersList
+	set := flag.NewFlagSet("user list", flag.ContinueOnError)
+	set.Int64Var(&request.PageSize, "page-size", 0, "users per page (default 20)")
+	set.StringVar(&request.Cursor, "cursor", "", "next_cursor of the previous page")
+	set.StringVar(&request.Order, "order", "", "asc or desc (default desc)")
+	set.StringVar(&request.PhoneLike, "phone", "", "part of the phone number")
+	set.StringVar(&request.PhonePrefix, "phone-prefix", "", "start of the phone number")
+	set.StringVar(&request.Email, "email", "", "start of the email")
+	set.StringVar(&request.Name, "name", "", "words of the name")
+	set.StringVar(&request.Status, "status", "", "active, suspended, banned or deleted")
+	set.StringVar(&request.Role, "role", "", "user or admin")
+	if _, err := c.flags(set, args, 0); err != nil {
+		return err
+	}
+	if err := validate(request); err != nil {
+		return err
+	}
+
+	page, err := app.AuthService.ListUsers(ctx, request)
+	if err != nil {
+		return err
+	}
+	return c.print(map[string]interface{}{
+		"total":       page.Total,
+		"next_cursor": page.NextCursor,
+		"users":       page.Users,
+	})
+}
+
+func (c *CLI) userSuspend(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	request := requests.UserStatus{Status: services.UserStatusSuspended}
+	var until string
+	set := flag.NewFlagSet("user suspend", flag.ContinueOnError)
+	set.StringVar(&request.Reason, "reason", "", "why the user is suspended (required)")
+	set.StringVar(&until, "until", "", "end of the suspension, in RFC 3339 (default never)")
+	phone, err := c.flags(set, args, 1)
+	if err != nil {
+		return err
+	}
+	if until != "" {
+		parsed, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return err
+		}
+		request.Until = &parsed
+	}
+	if err := validate(request); err != nil {
+		return err
+	}
+
+	user, err := app.AuthService.SetUserStatus(asOperator(ctx), phone[0], request)
+	if err != nil {
+		return err
+	}
+	return c.print(user)
+}
+
+func (c *CLI) userDelete(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	var request requests.DeleteUser
+	set := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	set.StringVar(&request.Reason, "reason", "", "why the user is deleted (required)")
+	phone, err := c.flags(set, args, 1)
+	if err != nil {
+		return err
+	}
+	if err := validate(request); err != nil {
+		return err
+	}
+
+	user, err := app.AuthService.DeleteUser(asOperator(ctx), phone[0], request)
+	if err != nil {
+		return err
+	}
+	return c.print(user)
+}
+
+func (c *CLI) sessionsRevoke(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	var phone string
+	set := flag.NewFlagSet("sessions revoke", flag.ContinueOnError)
+	set.StringVar(&phone, "user", "", "phone number of the user (required)")
+	if _, err := c.flags(set, args, 0); err != nil {
+		return err
+	}
+	if err := validatePhone(phone); err != nil {
+		return err
+	}
+
+	user, err := app.AuthService.RevokeSessions(asOperator(ctx), phone)
+	if err != nil {
+		return err
+	}
+	return c.print(user)
+}
+
+func (c *CLI) adminCreate(ctx context.Context, app *bootstrap.AppContainer, args []string) error {
+	phone, err := c.flags(flag.NewFlagSet("admin create", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	if err := validatePhone(phone[0]); err != nil {
+		return err
+	}
+
+	user, err := app.AuthService.CreateAdmin(asOperator(ctx), phone[0])
+	if err != nil {
+		return err
+	}
+	return c.print(user)
+}
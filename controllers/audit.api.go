@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/requests"
+	"authentication/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditAPI interface {
+	History(c *gin.Context)
+}
+
+type auditAPI struct {
+	auditLog services.AuditLog
+}
+
+func NewAuditAPI(auditLog services.AuditLog) AuditAPI {
+	return &auditAPI{auditLog}
+}
+
+// History godoc
+// @Summary Security history of a user
+// @Description Audit events of a phone number, newest first: codes sent, logins, sessions and account changes, with the client they came from. Follow next_cursor for further pages. Admin only.
+// @Tags Admin
+// @Produce json
+// @Param phone path string true "Phone number"
+// @Param cursor query string false "Opaque cursor from the previous response's next_cursor"
+// @Param page_size query int false "Number of events per page (default 50, max 100)"
+// @Param type query []string false "Event types, repeatable" collectionFormat(multi) Enums(otp_sent, login, user_created, token_refreshed, user_updated, status_changed, sessions_revoked)
+// @Param outcome query string false "Outcome" Enums(success, failure)
+// @Param from query string false "At or after (RFC 3339)"
+// @Param to query string false "At or before (RFC 3339)"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/users/{phone}/audit [get]
+func (api auditAPI) History(c *gin.Context) {
+	var request requests.AuditHistory
+	if err := c.ShouldBindQuery(&request); err != nil {
+		AbortWithError(c, apperrors.ErrInvalidRequest.Wrap(err))
+		return
+	}
+
+	page, err := api.auditLog.History(c, c.Param("phone"), request)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"page_size":   request.Limit(),
+		"next_cursor": page.NextCursor,
+		"events":      page.Events,
+	})
+}
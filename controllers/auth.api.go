@@ -1,18 +1,27 @@
 package controllers
 
 import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/i18n"
+	"authentication/ratelimit"
 	"authentication/requests"
 	"authentication/services"
 	"github.com/gin-gonic/gin"
+	"math"
 	"net/http"
+	"time"
 )
 
 type AuthAPI interface {
-	CheckDTO(context *gin.Context, dto interface{})
+	CheckDTO(context *gin.Context, dto interface{}) error
 	Login(context *gin.Context)
 	SendOTP(context *gin.Context)
 	Profile(context *gin.Context)
 	ListUsers(c *gin.Context)
+	UpdateUser(c *gin.Context)
+	Refresh(c *gin.Context)
+	SetUserStatus(c *gin.Context)
+	DeleteUser(c *gin.Context)
 }
 
 type authAPI struct {
@@ -23,11 +32,12 @@ func NewAuthAPI(authService services.AuthService) AuthAPI {
 	return &authAPI{authService}
 }
 
-func (api authAPI) CheckDTO(context *gin.Context, dto interface{}) {
+func (api authAPI) CheckDTO(context *gin.Context, dto interface{}) error {
 	err := context.ShouldBind(&dto)
 	if err != nil {
-		panic(err)
+		return apperrors.ErrInvalidRequest.Wrap(err)
 	}
+	return nil
 }
 
 // SendOTP godoc
@@ -37,19 +47,37 @@ func (api authAPI) CheckDTO(context *gin.Context, dto interface{}) {
 // @Accept json
 // @Produce json
 // @Param request body requests.OTPRequest true "OTP request"
-// @Success 200 {object} map[string]string
-// @Failure 400 {object} map[string]string
+// @Param X-Challenge-Token header string false "Solution of the challenge of a challenge_required error"
+// @Success 200 {object} map[string]interface{} "message, expires_in and resend_after (seconds)"
+// @Failure 400 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 409 {object} controllers.Problem
+// @Failure 429 {object} controllers.Problem
+// @Failure 503 {object} controllers.Problem
 // @Router /api/v1/auth/send/otp [post]
 func (api authAPI) SendOTP(context *gin.Context) {
 	var otpRequest requests.OTPRequest
-	api.CheckDTO(context, &otpRequest)
+	if err := api.CheckDTO(context, &otpRequest); err != nil {
+		AbortWithError(context, err)
+		return
+	}
 
-	api.authService.SendOTPCode(otpRequest, context)
+	validFor, err := api.authService.SendOTPCode(otpRequest, context)
+	if err != nil {
+		AbortWithError(context, err)
+		return
+	}
 
-	context.JSON(http.StatusOK, gin.H{
-		"fa_message": "کد یکبارمصرف با موفقیت ارسال شد",
-		"en_message": "OTP code sent successfully",
-	})
+	// A new code can be requested once this one expires and the rate limits allow it.
+	resendAfter := validFor
+	if wait := context.GetDuration(ratelimit.WaitKey); wait > resendAfter {
+		resendAfter = wait
+	}
+
+	response := localized(context, "otp.sent", nil)
+	response["expires_in"] = seconds(validFor)
+	response["resend_after"] = seconds(resendAfter)
+	context.JSON(http.StatusOK, response)
 }
 
 // Login godoc
@@ -59,67 +87,250 @@ func (api authAPI) SendOTP(context *gin.Context) {
 // @Accept json
 // @Produce json
 // @Param request body requests.LoginRequest true "Login request"
+// @Param X-Challenge-Token header string false "Solution of the challenge of a challenge_required error"
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]string
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 429 {object} controllers.Problem
 // @Router /api/v1/auth/login [post]
 func (api authAPI) Login(context *gin.Context) {
 	var loginRequest requests.LoginRequest
-	api.CheckDTO(context, &loginRequest)
+	if err := api.CheckDTO(context, &loginRequest); err != nil {
+		AbortWithError(context, err)
+		return
+	}
 
-	user := api.authService.Login(loginRequest, context)
+	user, err := api.authService.Login(loginRequest, context)
+	if err != nil {
+		AbortWithError(context, err)
+		return
+	}
 
-	context.JSON(http.StatusOK, gin.H{
-		"fa_message": "ورود با موفقیت انجام شد",
-		"en_message": "Login successful",
-		"user":       user,
-	})
+	body := localized(context, "login.success", nil)
+	body["user"] = user
+	context.JSON(http.StatusOK, body)
+}
+
+// Refresh godoc
+// @Summary Refresh the access token
+// @Description Exchange a refresh token for a new access token and a rotated refresh token
+// @Tags Auth
+// @Accept json
+// @Produce json
+// @Param request body requests.RefreshRequest true "Refresh request"
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 429 {object} controllers.Problem
+// @Router /api/v1/auth/refresh [post]
+func (api authAPI) Refresh(context *gin.Context) {
+	var refreshRequest requests.RefreshRequest
+	if err := api.CheckDTO(context, &refreshRequest); err != nil {
+		AbortWithError(context, err)
+		return
+	}
+
+	user, err := api.authService.RefreshToken(refreshRequest, context)
+	if err != nil {
+		AbortWithError(context, err)
+		return
+	}
+
+	context.JSON(http.StatusOK, gin.H{"user": user})
 }
 
 // Profile godoc
 // @Summary Get user profile
-// @Description Retrieve user profile by query parameters
+// @Description The profile of the caller, or of the user with the given phone. Only admins see other users' profiles.
 // @Tags Auth
 // @Accept json
 // @Produce json
-// @Param phone query string true "Phone number"
+// @Param phone query string false "Phone number, by default the caller's"
+// @Security BearerAuth
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]string
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 404 {object} controllers.Problem
 // @Router /api/v1/auth/profile [get]
 func (api authAPI) Profile(context *gin.Context) {
 	var profileRequest requests.Profile
 
 	if err := context.ShouldBindQuery(&profileRequest); err != nil {
-		panic(err)
+		AbortWithError(context, apperrors.ErrInvalidRequest.Wrap(err))
+		return
 	}
+	profileRequest.Caller = context.GetString("phone")
+	profileRequest.CallerRole = context.GetString("role")
 
-	user := api.authService.GetUserProfile(profileRequest, context)
+	user, err := api.authService.GetUserProfile(profileRequest, context)
+	if err != nil {
+		AbortWithError(context, err)
+		return
+	}
 
 	context.JSON(200, gin.H{"user": user})
 }
 
 // ListUsers godoc
-// @Summary List users
-// @Description Paginated list of users with optional phone search
-// @Tags Auth
+// @Summary List and search users
+// @Description Users ordered by creation time, filtered by every given search field (AND). Follow next_cursor for further pages, or use page/page_size (compatibility mode). Admin only.
+// @Tags Admin
 // @Accept json
 // @Produce json
-// @Param page query int true "Page number"
-// @Param page_size query int true "Number of users per page"
-// @Param phone query string false "Search by phone"
+// @Param cursor query string false "Opaque cursor from the previous response's next_cursor"
+// @Param page query int false "Page number (compatibility mode, ignored when cursor is set)"
+// @Param page_size query int false "Number of users per page (default 20, max 100)"
+// @Param order query string false "Sort by creation time" Enums(asc, desc)
+// @Param phone query string false "Phone contains"
+// @Param phone_prefix query string false "Phone starts with"
+// @Param email query string false "Email starts with (case-insensitive)"
+// @Param name query string false "Every word appears in the name (case-insensitive)"
+// @Param status query string false "Account status"
+// @Param role query string false "Role" Enums(user, admin)
+// @Param created_from query string false "Created at or after (RFC 3339)"
+// @Param created_to query string false "Created at or before (RFC 3339)"
+// @Param last_login_from query string false "Last login at or after (RFC 3339)"
+// @Param last_login_to query string false "Last login at or before (RFC 3339)"
+// @Param meta[key] query string false "Metadata field equals value, repeatable"
+// @Security BearerAuth
 // @Success 200 {object} map[string]interface{}
-// @Failure 400 {object} map[string]string
-// @Router /api/v1/auth/users [get]
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/users [get]
 func (api authAPI) ListUsers(c *gin.Context) {
 	var request requests.UsersList
 	if err := c.ShouldBindQuery(&request); err != nil {
-		panic(err)
+		AbortWithError(c, apperrors.ErrInvalidRequest.Wrap(err))
+		return
+	}
+	request.Metadata = c.QueryMap("meta")
+
+	page, err := api.authService.ListUsers(c, request)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+
+	order := "desc"
+	if !request.Descending() {
+		order = "asc"
 	}
 
-	users := api.authService.ListUsers(c, request)
 	c.JSON(200, gin.H{
-		"page":      request.Page,
-		"page_size": request.PageSize,
-		"search":    request.PhoneLike,
-		"users":     users,
+		"page":        request.Page,
+		"page_size":   request.Limit(),
+		"order":       order,
+		"search":      request.PhoneLike,
+		"total":       page.Total,
+		"next_cursor": page.NextCursor,
+		"users":       page.Users,
 	})
 }
+
+// UpdateUser godoc
+// @Summary Update a user's profile
+// @Description Set email, name, role or metadata of a user. Metadata entries with an empty value are removed. Admin only.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param phone path string true "Phone number"
+// @Param request body requests.UpdateUser true "Fields to change"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 404 {object} controllers.Problem
+// @Router /api/v1/admin/users/{phone} [patch]
+func (api authAPI) UpdateUser(c *gin.Context) {
+	var request requests.UpdateUser
+	if err := api.CheckDTO(c, &request); err != nil {
+		AbortWithError(c, err)
+		return
+	}
+
+	user, err := api.authService.UpdateUser(c, c.Param("phone"), request)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"user": user})
+}
+
+// SetUserStatus godoc
+// @Summary Change a user's account status
+// @Description Activate, suspend (optionally until a given time), ban or soft-delete a user. Anything but active revokes the user's sessions. Admin only.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param phone path string true "Phone number"
+// @Param request body requests.UserStatus true "New status"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 404 {object} controllers.Problem
+// @Router /api/v1/admin/users/{phone}/status [post]
+func (api authAPI) SetUserStatus(c *gin.Context) {
+	var request requests.UserStatus
+	if err := api.CheckDTO(c, &request); err != nil {
+		AbortWithError(c, err)
+		return
+	}
+
+	user, err := api.authService.SetUserStatus(c, c.Param("phone"), request)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"user": user})
+}
+
+// DeleteUser godoc
+// @Summary Soft-delete a user
+// @Description Marks the user deleted and revokes its sessions. The record is purged after USER_PURGE_AFTER unless restored. Admin only.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param phone path string true "Phone number"
+// @Param request body requests.DeleteUser true "Reason"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 404 {object} controllers.Problem
+// @Router /api/v1/admin/users/{phone} [delete]
+func (api authAPI) DeleteUser(c *gin.Context) {
+	var request requests.DeleteUser
+	if err := api.CheckDTO(c, &request); err != nil {
+		AbortWithError(c, err)
+		return
+	}
+
+	user, err := api.authService.DeleteUser(c, c.Param("phone"), request)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"user": user})
+}
+
+// seconds rounds d up to whole seconds, the unit of every duration in responses.
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// localized is a response body carrying the message in the request's locale, along with
+// the Persian and English texts that clients have always received.
+func localized(c *gin.Context, key string, args i18n.Args) gin.H {
+	return gin.H{
+		"message":    i18n.T(i18n.FromContext(c), key, args),
+		"fa_message": i18n.T("fa", key, args),
+		"en_message": i18n.T("en", key, args),
+	}
+}
@@ -0,0 +1,2606 @@
+package controllers_test
+
+import (
+	"authentication/bootstrap"
+	"authentication/controllers"
+	"authentication/middleware"
+	"authentication/pkg/apperrors"
+	"authentication/pkg/challenge"
+	"authentication/pkg/i18n"
+	"authentication/pkg/phone"
+	"authentication/pkg/webhook"
+	"authentication/ratelimit"
+	"authentication/routes"
+	"authentication/services"
+	"authentication/utils"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis_rate/v10"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// adminPhone is listed in ADMIN_PHONES for every test server.
+const adminPhone = "09990000000"
+
+type testServer struct {
+	t      *testing.T
+	router *gin.Engine
+	app    *bootstrap.AppContainer
+	// token is sent as a bearer token when set.
+	token string
+	// header is added to every request.
+	header http.Header
+	// remoteAddr, when set, is the peer address requests come from.
+	remoteAddr string
+	// clientCert, when set, is the verified client certificate of a mutual TLS connection
+	// requests come on.
+	clientCert *x509.Certificate
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_PHONES", adminPhone)
+	t.Setenv("USER_PURGE_AFTER", "1h")
+	t.Setenv("AUDIT_HASH_KEY", "pepper")
+	t.Setenv("JWT_ALLOW_BUILTIN_KEY", "true")
+
+	app := bootstrap.InitMemoryAppContainer()
+	return &testServer{t: t, router: routes.Urls(newRouter(), app), app: app}
+}
+
+// newRouter has the middleware main gives every listener, then extra.
+func newRouter(extra ...gin.HandlerFunc) *gin.Engine {
+	r := gin.New()
+	bootstrap.ConfigureProxies(r)
+	bootstrap.ConfigureTracing(r)
+	r.Use(middleware.RequestID(), middleware.AccessLog(), middleware.Metrics(), middleware.AuditClient(), middleware.Locale(), middleware.ErrorHandling())
+	r.Use(extra...)
+	return r
+}
+
+func (s *testServer) do(method, path string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	s.t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatalf("marshal request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	for name, values := range s.header {
+		req.Header[name] = values
+	}
+	if s.remoteAddr != "" {
+		req.RemoteAddr = s.remoteAddr
+	}
+	if s.clientCert != nil {
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{s.clientCert}}}
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+
+	var decoded map[string]interface{}
+	if rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil {
+			s.t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+		}
+	}
+	return rec, decoded
+}
+
+func (s *testServer) sendOTP(phone string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	return s.do(http.MethodPost, "/api/v1/auth/send/otp/", map[string]string{"phoneNumber": phone})
+}
+
+func (s *testServer) login(phone, code string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	return s.do(http.MethodPost, "/api/v1/auth/login/", map[string]string{"phoneNumber": phone, "OTPCode": code})
+}
+
+func (s *testServer) refresh(phone, token string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	return s.do(http.MethodPost, "/api/v1/auth/refresh/", map[string]string{"phoneNumber": phone, "refreshToken": token})
+}
+
+func (s *testServer) setStatus(phone string, status map[string]interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	return s.do(http.MethodPost, "/api/v1/admin/users/"+phone+"/status", status)
+}
+
+// otpFor reads the code the service stored for phone, the way an SMS would deliver it.
+func (s *testServer) otpFor(phone string) string {
+	s.t.Helper()
+
+	code, err := s.app.AuthRepository.GetOTP(context.Background(), e164(phone))
+	if err != nil {
+		s.t.Fatalf("no OTP stored for %s: %v", phone, err)
+	}
+	return code
+}
+
+// e164 is the form the service stores phone in.
+func e164(raw string) string {
+	number, err := phone.Normalize(raw)
+	if err != nil {
+		panic(err)
+	}
+	return number
+}
+
+// signUp runs the full OTP flow and returns the logged-in user payload.
+func (s *testServer) signUp(phone string) map[string]interface{} {
+	s.t.Helper()
+
+	if rec, body := s.sendOTP(phone); rec.Code != http.StatusOK {
+		s.t.Fatalf("send otp for %s: status %d, body %v", phone, rec.Code, body)
+	}
+	rec, body := s.login(phone, s.otpFor(phone))
+	if rec.Code != http.StatusOK {
+		s.t.Fatalf("login %s: status %d, body %v", phone, rec.Code, body)
+	}
+	return body["user"].(map[string]interface{})
+}
+
+// loginAsAdmin signs up the bootstrap admin and uses its token for the following requests.
+func (s *testServer) loginAsAdmin() {
+	s.t.Helper()
+	s.token = s.signUp(adminPhone)["access_token"].(string)
+}
+
+func assertError(t *testing.T, rec *httptest.ResponseRecorder, body map[string]interface{}, status int, want *apperrors.Error) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("expected status %d, got %d (body %v)", status, rec.Code, body)
+	}
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/problem+json") {
+		t.Fatalf("expected a problem+json body, got %q", contentType)
+	}
+	if body["code"] != want.Code {
+		t.Fatalf("expected code %q, got %v", want.Code, body["code"])
+	}
+	if body["status"] != float64(status) {
+		t.Fatalf("expected status %d in the body, got %v", status, body["status"])
+	}
+	if title := i18n.T(rec.Header().Get("Content-Language"), "errors."+want.Code, nil); body["title"] != title {
+		t.Fatalf("expected title %q, got %v", title, body["title"])
+	}
+}
+
+func TestSendOTP(t *testing.T) {
+	s := newTestServer(t)
+
+	rec, body := s.sendOTP("09120000001")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	if body["en_message"] != "OTP code sent successfully" {
+		t.Fatalf("unexpected message: %v", body["en_message"])
+	}
+	if code := s.otpFor("09120000001"); len(code) != 6 {
+		t.Fatalf("expected a 6 digit code to be stored, got %q", code)
+	}
+}
+
+func TestSendOTPAlreadySent(t *testing.T) {
+	s := newTestServer(t)
+
+	s.sendOTP("09120000002")
+	rec, body := s.sendOTP("09120000002")
+	assertError(t, rec, body, http.StatusConflict, apperrors.ErrOTPAlreadySent)
+}
+
+func TestSendOTPRateLimited(t *testing.T) {
+	s := newTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		s.sendOTP("09120000003")
+	}
+	rec, body := s.sendOTP("09120000003")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+}
+
+func TestSendOTPMissingPhone(t *testing.T) {
+	s := newTestServer(t)
+
+	rec, body := s.do(http.MethodPost, "/api/v1/auth/send/otp/", map[string]string{})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+}
+
+func TestLoginCreatesUser(t *testing.T) {
+	s := newTestServer(t)
+
+	user := s.signUp("09120000010")
+	if user["phone"] != e164("09120000010") {
+		t.Fatalf("unexpected phone: %v", user["phone"])
+	}
+	if user["id"] == "" || user["id"] == nil {
+		t.Fatal("expected user id")
+	}
+	if user["refresh_token"] == "" || user["refresh_token"] == nil {
+		t.Fatal("expected refresh token")
+	}
+
+	claims, err := utils.ParseAccessToken(user["access_token"].(string))
+	if err != nil {
+		t.Fatalf("access token does not parse: %v", err)
+	}
+	if claims.Phone != e164("09120000010") {
+		t.Fatalf("unexpected phone claim: %s", claims.Phone)
+	}
+
+	refresh, err := s.app.AuthRepository.GetRefreshToken(context.Background(), e164("09120000010"))
+	if err != nil || refresh != user["refresh_token"] {
+		t.Fatalf("refresh token not stored: %q, %v", refresh, err)
+	}
+}
+
+func TestLoginExistingUserKeepsID(t *testing.T) {
+	s := newTestServer(t)
+
+	first := s.signUp("09120000011")
+
+	// Codes are not consumed on login, so the stored one is still valid for a second login.
+	rec, body := s.login("09120000011", s.otpFor("09120000011"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	second := body["user"].(map[string]interface{})
+	if first["id"] != second["id"] {
+		t.Fatalf("expected the same user, got %v and %v", first["id"], second["id"])
+	}
+}
+
+func TestLoginWrongOTP(t *testing.T) {
+	s := newTestServer(t)
+
+	s.sendOTP("09120000012")
+	rec, body := s.login("09120000012", "000000")
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrOTPInvalid)
+}
+
+func TestLoginWithoutOTP(t *testing.T) {
+	s := newTestServer(t)
+
+	rec, body := s.login("09120000013", "123456")
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrOTPInvalid)
+}
+
+func TestLoginShortOTP(t *testing.T) {
+	s := newTestServer(t)
+
+	rec, body := s.login("09120000014", "123")
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+}
+
+func TestLoginRateLimited(t *testing.T) {
+	s := newTestServer(t)
+
+	s.sendOTP("09120000015")
+	for i := 0; i < 3; i++ {
+		s.login("09120000015", "000000")
+	}
+	rec, body := s.login("09120000015", s.otpFor("09120000015"))
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+}
+
+func TestProfile(t *testing.T) {
+	s := newTestServer(t)
+
+	other := s.signUp("09120000021")
+	user := s.signUp("09120000020")
+
+	rec, body := s.do(http.MethodGet, "/api/v1/auth/profile/", nil)
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrUnauthenticated)
+
+	s.token = user["access_token"].(string)
+	for _, path := range []string{"/api/v1/auth/profile/", "/api/v1/auth/profile/?phone=09120000020", "/api/v1/auth/profile/?phone=%2B989120000020"} {
+		rec, body := s.do(http.MethodGet, path, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d (body %v)", path, rec.Code, body)
+		}
+		profile := body["user"].(map[string]interface{})
+		if profile["id"] != user["id"] {
+			t.Fatalf("%s: expected user %v, got %v", path, user["id"], profile["id"])
+		}
+		if _, ok := profile["access_token"]; ok {
+			t.Fatal("profile must not leak tokens")
+		}
+	}
+
+	// Users only see their own profile, whether or not the other one exists.
+	rec, body = s.do(http.MethodGet, "/api/v1/auth/profile/?phone=09120000021", nil)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrForbidden)
+	rec, body = s.do(http.MethodGet, "/api/v1/auth/profile/?phone=09129999999", nil)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrForbidden)
+
+	s.loginAsAdmin()
+	rec, body = s.do(http.MethodGet, "/api/v1/auth/profile/?phone=09120000021", nil)
+	if rec.Code != http.StatusOK || body["user"].(map[string]interface{})["id"] != other["id"] {
+		t.Fatalf("expected an admin to see other users, got %d %v", rec.Code, body)
+	}
+}
+
+func TestRoleFromAccount(t *testing.T) {
+	s := newTestServer(t)
+	user := s.signUp("09120000022")
+	s.loginAsAdmin()
+	admin := s.token
+
+	// A token keeps the role it was issued with; the stored one decides.
+	if rec, body := s.do(http.MethodPatch, "/api/v1/admin/users/09120000022", map[string]string{"role": "admin"}); rec.Code != http.StatusOK {
+		t.Fatalf("promote: %d %v", rec.Code, body)
+	}
+	s.token = user["access_token"].(string)
+	if rec, body := s.do(http.MethodGet, "/api/v1/admin/users", nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected the promoted user's token to be an admin's, got %d %v", rec.Code, body)
+	}
+	if _, err := s.app.AuthRepository.UpdateUser(context.Background(), e164(adminPhone), map[string]string{"role": "user"}); err != nil {
+		t.Fatal(err)
+	}
+	s.token = admin
+	rec, body := s.do(http.MethodGet, "/api/v1/admin/users", nil)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrForbidden)
+}
+
+func TestProfileUnknownUser(t *testing.T) {
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	rec, body := s.do(http.MethodGet, "/api/v1/auth/profile/?phone=09129999999", nil)
+	assertError(t, rec, body, http.StatusNotFound, apperrors.ErrUserNotFound)
+}
+
+func TestListUsers(t *testing.T) {
+	s := newTestServer(t)
+
+	for _, phone := range []string{"09120000031", "09120000032", "09350000033"} {
+		s.signUp(phone)
+	}
+	s.loginAsAdmin()
+
+	rec, body := s.do(http.MethodGet, "/api/v1/admin/users?page=1&page_size=2&role=user", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	users := body["users"].([]interface{})
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users on the first page, got %d", len(users))
+	}
+	if newest := users[0].(map[string]interface{}); newest["phone"] != e164("09350000033") {
+		t.Fatalf("expected newest user first, got %v", newest["phone"])
+	}
+
+	_, body = s.do(http.MethodGet, "/api/v1/admin/users?page=2&page_size=2&role=user", nil)
+	if users := body["users"].([]interface{}); len(users) != 1 {
+		t.Fatalf("expected 1 user on the second page, got %d", len(users))
+	}
+
+	_, body = s.do(http.MethodGet, "/api/v1/auth/users?page=1&page_size=10&phone=0912", nil)
+	if users := body["users"].([]interface{}); len(users) != 2 {
+		t.Fatalf("expected 2 users matching 0912, got %d", len(users))
+	}
+	if body["total"] != float64(2) {
+		t.Fatalf("expected total 2 for the filtered listing, got %v", body["total"])
+	}
+}
+
+func TestListUsersCursor(t *testing.T) {
+	s := newTestServer(t)
+
+	phones := []string{"09120000041", "09120000042", "09120000043", "09120000044", "09120000045"}
+	for _, phone := range phones {
+		s.signUp(phone)
+	}
+	s.loginAsAdmin()
+
+	for _, order := range []string{"asc", "desc"} {
+		seen := make(map[interface{}]bool)
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(phones) {
+				t.Fatalf("%s: cursor never reached the end", order)
+			}
+			rec, body := s.do(http.MethodGet, "/api/v1/admin/users?role=user&page_size=2&order="+order+"&cursor="+cursor, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: expected 200, got %d (body %v)", order, rec.Code, body)
+			}
+			if body["total"] != float64(len(phones)) {
+				t.Fatalf("%s: expected total %d, got %v", order, len(phones), body["total"])
+			}
+			for _, user := range body["users"].([]interface{}) {
+				phone := user.(map[string]interface{})["phone"]
+				if seen[phone] {
+					t.Fatalf("%s: %v returned twice", order, phone)
+				}
+				seen[phone] = true
+			}
+			cursor = body["next_cursor"].(string)
+			if cursor == "" {
+				break
+			}
+		}
+		if len(seen) != len(phones) {
+			t.Fatalf("%s: expected %d users across pages, got %d", order, len(phones), len(seen))
+		}
+	}
+}
+
+func TestListUsersCursorRejectsOrderChange(t *testing.T) {
+	s := newTestServer(t)
+
+	s.signUp("09120000051")
+	s.loginAsAdmin()
+
+	_, body := s.do(http.MethodGet, "/api/v1/admin/users?page_size=1&order=asc", nil)
+	cursor := body["next_cursor"].(string)
+
+	rec, body := s.do(http.MethodGet, "/api/v1/admin/users?order=desc&cursor="+cursor, nil)
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidCursor)
+
+	rec, body = s.do(http.MethodGet, "/api/v1/admin/users?cursor=not-a-cursor", nil)
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidCursor)
+}
+
+func TestListUsersInvalidQuery(t *testing.T) {
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	for _, query := range []string{"page=1&page_size=500", "order=sideways", "role=root", "created_from=yesterday"} {
+		rec, body := s.do(http.MethodGet, "/api/v1/admin/users?"+query, nil)
+		assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	}
+}
+
+func TestListUsersRequiresAdmin(t *testing.T) {
+	s := newTestServer(t)
+	userToken := s.signUp("09120000061")["access_token"].(string)
+
+	for _, path := range []string{"/api/v1/admin/users", "/api/v1/auth/users"} {
+		s.token = ""
+		if rec, _ := s.do(http.MethodGet, path, nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401 without a token, got %d", path, rec.Code)
+		}
+
+		s.token = userToken
+		if rec, _ := s.do(http.MethodGet, path, nil); rec.Code != http.StatusForbidden {
+			t.Fatalf("%s: expected 403 for a regular user, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	s := newTestServer(t)
+
+	s.signUp("09120000071")
+	s.signUp("09120000072")
+	s.signUp("09350000073")
+	s.loginAsAdmin()
+
+	updates := map[string]map[string]interface{}{
+		"09120000071": {"email": "Sara@Example.com", "name": "Sara Ahmadi", "metadata": map[string]string{"plan": "pro"}},
+		"09120000072": {"email": "reza@example.com", "name": "Reza Ahmadi", "metadata": map[string]string{"plan": "free"}},
+		"09350000073": {"email": "sara.k@other.org", "name": "Sara Karimi", "metadata": map[string]string{"plan": "pro"}},
+	}
+	for phone, update := range updates {
+		if rec, body := s.do(http.MethodPatch, "/api/v1/admin/users/"+phone, update); rec.Code != http.StatusOK {
+			t.Fatalf("update %s: expected 200, got %d (body %v)", phone, rec.Code, body)
+		}
+	}
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"email=sara", []string{"09120000071", "09350000073"}},
+		{"email=SARA@example", []string{"09120000071"}},
+		{"name=ahmadi", []string{"09120000071", "09120000072"}},
+		{"name=sara+ahmadi", []string{"09120000071"}},
+		{"meta[plan]=pro", []string{"09120000071", "09350000073"}},
+		{"meta[plan]=pro&phone_prefix=0912", []string{"09120000071"}},
+		{"meta[plan]=pro&name=karimi&status=active", []string{"09350000073"}},
+		{"phone_prefix=0935", []string{"09350000073"}},
+		{"status=suspended", []string{}},
+		{"role=admin", []string{adminPhone}},
+		{"created_from=2000-01-01T00:00:00Z&role=user", []string{"09120000071", "09120000072", "09350000073"}},
+		{"created_from=2999-01-01T00:00:00Z", []string{}},
+		{"last_login_from=2000-01-01T00:00:00Z&email=reza", []string{"09120000072"}},
+		{"last_login_to=2000-01-01T00:00:00Z", []string{}},
+	}
+	for _, tc := range cases {
+		rec, body := s.do(http.MethodGet, "/api/v1/admin/users?"+tc.query, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d (body %v)", tc.query, rec.Code, body)
+		}
+
+		found := make(map[interface{}]bool)
+		for _, user := range body["users"].([]interface{}) {
+			found[user.(map[string]interface{})["phone"]] = true
+		}
+		if len(found) != len(tc.expected) || body["total"] != float64(len(tc.expected)) {
+			t.Fatalf("%s: expected %v, got %v (total %v)", tc.query, tc.expected, found, body["total"])
+		}
+		for _, phone := range tc.expected {
+			if !found[e164(phone)] {
+				t.Fatalf("%s: expected %s in %v", tc.query, phone, found)
+			}
+		}
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	s := newTestServer(t)
+
+	s.signUp("09120000081")
+	s.loginAsAdmin()
+
+	rec, body := s.do(http.MethodPatch, "/api/v1/admin/users/09120000081", map[string]interface{}{
+		"name":     "Ali",
+		"metadata": map[string]string{"plan": "pro", "team": "ops"},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+
+	_, body = s.do(http.MethodPatch, "/api/v1/admin/users/09120000081", map[string]interface{}{
+		"metadata": map[string]string{"team": ""},
+	})
+	user := body["user"].(map[string]interface{})
+	if user["name"] != "Ali" || user["meta.plan"] != "pro" {
+		t.Fatalf("expected earlier fields to be kept, got %v", user)
+	}
+	if _, ok := user["meta.team"]; ok {
+		t.Fatalf("expected meta.team to be removed, got %v", user)
+	}
+
+	rec, body = s.do(http.MethodPatch, "/api/v1/admin/users/09120000081", map[string]interface{}{"email": "not-an-email"})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+
+	rec, body = s.do(http.MethodPatch, "/api/v1/admin/users/09129999999", map[string]interface{}{"name": "Nobody"})
+	assertError(t, rec, body, http.StatusNotFound, apperrors.ErrUserNotFound)
+}
+
+func TestRefresh(t *testing.T) {
+	s := newTestServer(t)
+
+	user := s.signUp("09120000091")
+	if token := user["refresh_token"].(string); len(token) != 64 {
+		t.Fatalf("expected 32 random bytes in hex, got %q", token)
+	}
+
+	rec, body := s.refresh("09120000091", user["refresh_token"].(string))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	refreshed := body["user"].(map[string]interface{})
+	if refreshed["refresh_token"] == user["refresh_token"] {
+		t.Fatal("expected the refresh token to be rotated")
+	}
+	if _, err := utils.ParseAccessToken(refreshed["access_token"].(string)); err != nil {
+		t.Fatalf("access token does not parse: %v", err)
+	}
+
+	rec, body = s.refresh("09120000091", user["refresh_token"].(string))
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrInvalidRefreshToken)
+
+	rec, body = s.refresh("09120000092", "whatever")
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrInvalidRefreshToken)
+}
+
+func TestRefreshIsRateLimited(t *testing.T) {
+	s := newTestServer(t)
+
+	user := s.signUp("09120000093")
+	for i := 0; i < 10; i++ {
+		rec, body := s.refresh("09120000093", fmt.Sprintf("%064x", i))
+		assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrInvalidRefreshToken)
+	}
+	// Guessing is cut short, even once the right token comes.
+	rec, body := s.refresh("09120000093", user["refresh_token"].(string))
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+}
+
+func TestSuspendUser(t *testing.T) {
+	s := newTestServer(t)
+
+	user := s.signUp("09120000101")
+	s.loginAsAdmin()
+
+	rec, body := s.setStatus("09120000101", map[string]interface{}{"status": "suspended"})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+
+	rec, body = s.setStatus("09120000101", map[string]interface{}{"status": "suspended", "reason": "chargeback", "until": "2001-01-01T00:00:00Z"})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrSuspensionInPast)
+
+	rec, body = s.setStatus("09120000101", map[string]interface{}{"status": "suspended", "reason": "chargeback"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	if suspended := body["user"].(map[string]interface{}); suspended["status"] != "suspended" || suspended["status_reason"] != "chargeback" {
+		t.Fatalf("unexpected user after suspension: %v", suspended)
+	}
+
+	rec, body = s.login("09120000101", s.otpFor("09120000101"))
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrAccountSuspended)
+
+	rec, body = s.refresh("09120000101", user["refresh_token"].(string))
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrInvalidRefreshToken)
+
+	_, body = s.do(http.MethodGet, "/api/v1/admin/users?status=suspended", nil)
+	if body["total"] != float64(1) {
+		t.Fatalf("expected one suspended user, got %v", body["total"])
+	}
+}
+
+func TestSuspensionExpires(t *testing.T) {
+	s := newTestServer(t)
+
+	s.signUp("09120000111")
+	s.loginAsAdmin()
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if rec, body := s.setStatus("09120000111", map[string]interface{}{"status": "suspended", "reason": "spam", "until": until}); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+
+	// Pretend the hour went by.
+	_, err := s.app.AuthRepository.UpdateUser(context.Background(), e164("09120000111"), map[string]string{
+		"suspended_until": time.Now().Add(-time.Minute).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, body := s.login("09120000111", s.otpFor("09120000111"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the suspension to have expired, got %d (body %v)", rec.Code, body)
+	}
+	if user := body["user"].(map[string]interface{}); user["status"] != "active" {
+		t.Fatalf("expected the user to be active again, got %v", user["status"])
+	}
+}
+
+func TestBanUser(t *testing.T) {
+	s := newTestServer(t)
+
+	s.signUp("09120000121")
+	s.loginAsAdmin()
+
+	s.setStatus("09120000121", map[string]interface{}{"status": "banned", "reason": "fraud"})
+
+	rec, body := s.login("09120000121", s.otpFor("09120000121"))
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrAccountBanned)
+}
+
+func TestSuspensionRevokesAccessTokens(t *testing.T) {
+	s := newTestServer(t)
+
+	s.signUp("09120000131")
+	s.loginAsAdmin()
+	adminToken := s.token
+
+	// Make the user an admin so its token is accepted by the admin routes.
+	s.do(http.MethodPatch, "/api/v1/admin/users/09120000131", map[string]interface{}{"role": "admin"})
+	rec, body := s.login("09120000131", s.otpFor("09120000131"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	userToken := body["user"].(map[string]interface{})["access_token"].(string)
+
+	s.token = userToken
+	if rec, body := s.do(http.MethodGet, "/api/v1/admin/users", nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+
+	s.token = adminToken
+	s.setStatus("09120000131", map[string]interface{}{"status": "suspended", "reason": "investigation"})
+
+	s.token = userToken
+	rec, body = s.do(http.MethodGet, "/api/v1/admin/users", nil)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrAccountSuspended)
+
+	s.token = adminToken
+	s.setStatus("09120000131", map[string]interface{}{"status": "active", "reason": "cleared"})
+
+	s.token = userToken
+	rec, body = s.do(http.MethodGet, "/api/v1/admin/users", nil)
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrSessionRevoked)
+}
+
+func TestSoftDeleteAndPurge(t *testing.T) {
+	s := newTestServer(t)
+
+	s.signUp("09120000141")
+	s.signUp("09120000142")
+	s.loginAsAdmin()
+
+	rec, body := s.do(http.MethodDelete, "/api/v1/admin/users/09120000141", map[string]string{})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+
+	for _, phone := range []string{"09120000141", "09120000142"} {
+		rec, body = s.do(http.MethodDelete, "/api/v1/admin/users/"+phone, map[string]string{"reason": "user request"})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+		}
+	}
+
+	rec, body = s.login("09120000141", s.otpFor("09120000141"))
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrAccountDeleted)
+
+	// Restoring within the purge window brings the account back.
+	s.setStatus("09120000142", map[string]interface{}{"status": "active", "reason": "changed their mind"})
+
+	ctx := context.Background()
+	if purged, err := s.app.AuthService.PurgeDeletedUsers(ctx); err != nil || purged != 0 {
+		t.Fatalf("expected nothing to purge inside the window, purged %d", purged)
+	}
+
+	_, err := s.app.AuthRepository.UpdateUser(ctx, e164("09120000141"), map[string]string{
+		"deleted_at": time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := s.app.AuthService.PurgeDeletedUsers(ctx); err != nil || purged != 1 {
+		t.Fatalf("expected one user purged, purged %d (%v)", purged, err)
+	}
+	if exists, _ := s.app.AuthRepository.UserExists(ctx, e164("09120000141")); exists {
+		t.Fatal("expected the purged user to be gone")
+	}
+	if exists, _ := s.app.AuthRepository.UserExists(ctx, e164("09120000142")); !exists {
+		t.Fatal("expected the restored user to be kept")
+	}
+}
+
+// brokenLimiter fails every call with err, the way a limiter backed by a broken Redis would.
+type brokenLimiter struct {
+	err error
+}
+
+func (l brokenLimiter) Allow(ctx context.Context, key string, limit redis_rate.Limit) (*redis_rate.Result, error) {
+	return nil, l.err
+}
+
+func (l brokenLimiter) AllowN(ctx context.Context, key string, limit redis_rate.Limit, n int) (*redis_rate.Result, error) {
+	return nil, l.err
+}
+
+func (s *testServer) useLimiter(limiter ratelimit.RateLimiter) {
+	s.app.Limiter = limiter
+	s.rebuild()
+}
+
+// rebuild wires a new service, controller and router around the container's parts.
+func (s *testServer) rebuild() {
+	s.app.AuthService = services.NewAuthService(s.app.AuthRepository, s.app.SMS, s.app.FraudGuard, s.app.AuditLog, s.app.Webhooks)
+	s.app.AuthAPI = controllers.NewAuthAPI(s.app.AuthService)
+	s.router = routes.Urls(newRouter(), s.app)
+}
+
+func TestStorageOutageIsUnavailable(t *testing.T) {
+	s := newTestServer(t)
+	s.useLimiter(brokenLimiter{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}})
+
+	rec, body := s.sendOTP("09120000151")
+	assertError(t, rec, body, http.StatusServiceUnavailable, apperrors.ErrUnavailable)
+}
+
+func TestStorageErrorIsInternal(t *testing.T) {
+	s := newTestServer(t)
+	s.useLimiter(brokenLimiter{err: errors.New("ERR unknown command 'EVALSHA'")})
+
+	rec, body := s.sendOTP("09120000152")
+	// The cause stays in the log; clients only get the generic message.
+	assertError(t, rec, body, http.StatusInternalServerError, apperrors.ErrInternal)
+	if strings.Contains(rec.Body.String(), "EVALSHA") {
+		t.Fatalf("internal error leaked to the client: %s", rec.Body.String())
+	}
+}
+
+func TestPanicIsInternal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	t.Setenv("LOG_OUTPUT", path)
+	s := newTestServer(t)
+	s.router.GET("/panic", func(c *gin.Context) {
+		var user map[string]string
+		user["boom"] = "assignment to entry in nil map"
+	})
+
+	rec, body := s.do(http.MethodGet, "/panic", nil)
+	assertError(t, rec, body, http.StatusInternalServerError, apperrors.ErrInternal)
+
+	// The panic is logged once, with its stack trace.
+	lines, data := logLines(t, path)
+	logged := 0
+	for _, line := range lines {
+		if line["level"] == "error" && line["message"] != "request" {
+			logged++
+			if message, _ := line["error"].(string); !strings.Contains(message, "assignment to entry in nil map") || !strings.Contains(message, "goroutine") {
+				t.Fatalf("expected the panic and its stack, got %v", line)
+			}
+		}
+	}
+	if logged != 1 {
+		t.Fatalf("expected the panic to be logged once, got %s", data)
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/profile/?phone=09120000161", nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	assertError(t, rec, body, http.StatusNotFound, apperrors.ErrUserNotFound)
+	if body["type"] != "/problems/user_not_found" || body["instance"] != "/api/v1/auth/profile/" {
+		t.Fatalf("unexpected type or instance: %v", body)
+	}
+	if body["request_id"] != "req-42" || rec.Header().Get("X-Request-ID") != "req-42" {
+		t.Fatalf("expected the request id to be echoed, got %v / %q", body["request_id"], rec.Header().Get("X-Request-ID"))
+	}
+
+	// Validation problems explain what is wrong.
+	rec, body = s.do(http.MethodPost, "/api/v1/auth/send/otp/", map[string]string{})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	if body["detail"] != "1 field is invalid." {
+		t.Fatalf("unexpected detail: %v", body["detail"])
+	}
+	if body["request_id"] == "" || body["request_id"] == nil {
+		t.Fatal("expected a generated request id")
+	}
+}
+
+func TestRateLimitedRetryAfter(t *testing.T) {
+	s := newTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		s.sendOTP("09120000171")
+	}
+	rec, body := s.sendOTP("09120000171")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+
+	// Three per ten minutes: the next request is accepted after one emission interval.
+	retryAfter, _ := body["retry_after"].(float64)
+	if retryAfter < 199 || retryAfter > 200 {
+		t.Fatalf("expected retry_after of about 200s, got %v", body["retry_after"])
+	}
+	if rec.Header().Get("Retry-After") != strconv.Itoa(int(retryAfter)) {
+		t.Fatalf("expected a matching Retry-After header, got %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestLegacyErrors(t *testing.T) {
+	t.Setenv("ERROR_FORMAT", "legacy")
+	s := newTestServer(t)
+	t.Cleanup(func() { controllers.UseLegacyErrors(false) })
+
+	rec, body := s.login("09120000181", "123456")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d (body %v)", rec.Code, body)
+	}
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/problem+json") {
+		t.Fatal("expected a plain JSON body in legacy mode")
+	}
+	if body["en_message"] != "OTP code is wrong" || body["fa_message"] != "کد تایید نادرست است" {
+		t.Fatalf("expected the bilingual messages, got %v", body)
+	}
+}
+
+// recordingSender keeps the texts it is asked to send.
+type recordingSender struct {
+	sent map[string][]string
+}
+
+func (r *recordingSender) Send(ctx context.Context, phone, text string) error {
+	r.sent[phone] = append(r.sent[phone], text)
+	return nil
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	s.header = http.Header{"Accept-Language": {"de-DE, fa-IR;q=0.9, en;q=0.5"}}
+	rec, body := s.do(http.MethodGet, "/api/v1/auth/profile/?phone=09120000191", nil)
+	if rec.Code != http.StatusNotFound || body["title"] != "کاربری با این شماره تماس پیدا نشد" {
+		t.Fatalf("expected a Persian 404, got %d %v", rec.Code, body)
+	}
+	if rec.Header().Get("Content-Language") != "fa" {
+		t.Fatalf("expected Content-Language fa, got %q", rec.Header().Get("Content-Language"))
+	}
+
+	s.header = http.Header{"Accept-Language": {"de-DE, *;q=0.5"}}
+	rec, body = s.do(http.MethodGet, "/api/v1/auth/profile/?phone=09120000191", nil)
+	assertError(t, rec, body, http.StatusNotFound, apperrors.ErrUserNotFound)
+
+	// Success messages follow the locale and keep both legacy fields.
+	s.header = http.Header{"Accept-Language": {"fa"}}
+	_, body = s.sendOTP("09120000191")
+	if body["message"] != body["fa_message"] || body["en_message"] != "OTP code sent successfully" {
+		t.Fatalf("unexpected messages: %v", body)
+	}
+}
+
+func TestRateLimitedDetailIsPluralized(t *testing.T) {
+	s := newTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		s.sendOTP("09120000201")
+	}
+	_, body := s.sendOTP("09120000201")
+	if body["detail"] != "Too many requests. Please try again in 200 seconds." {
+		t.Fatalf("unexpected detail: %v", body["detail"])
+	}
+
+	s.header = http.Header{"Accept-Language": {"fa"}}
+	_, body = s.sendOTP("09120000201")
+	if body["detail"] != "درخواست بیش از حد. لطفا 200 ثانیه دیگر دوباره تلاش کنید." {
+		t.Fatalf("unexpected Persian detail: %v", body["detail"])
+	}
+}
+
+func TestOTPTextIsLocalized(t *testing.T) {
+	s := newTestServer(t)
+	sender := &recordingSender{sent: make(map[string][]string)}
+	s.app.SMS = sender
+	s.rebuild()
+
+	// A new user gets the language of the request.
+	s.header = http.Header{"Accept-Language": {"fa-IR"}}
+	s.sendOTP("09120000211")
+	text := sender.sent[e164("09120000211")][0]
+	if want := "کد تایید شما: " + s.otpFor("09120000211"); !strings.HasPrefix(text, want) {
+		t.Fatalf("expected a Persian SMS with the code, got %q", text)
+	}
+
+	// A user who saved a locale gets it, whatever the request says.
+	s.header = nil
+	s.signUp("09120000212")
+	s.loginAsAdmin()
+	rec, body := s.do(http.MethodPatch, "/api/v1/admin/users/09120000212", map[string]interface{}{"locale": "en"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	s.app.AuthRepository.DeleteOTP(context.Background(), e164("09120000212"))
+
+	s.header = http.Header{"Accept-Language": {"fa"}}
+	s.sendOTP("09120000212")
+	texts := sender.sent[e164("09120000212")]
+	want := fmt.Sprintf("Your verification code is %s. It expires in 2 minutes.", s.otpFor("09120000212"))
+	if texts[len(texts)-1] != want {
+		t.Fatalf("expected %q, got %q", want, texts[len(texts)-1])
+	}
+}
+
+func TestSavedLocaleAppliesToAuthenticatedRequests(t *testing.T) {
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	rec, body := s.do(http.MethodPatch, "/api/v1/admin/users/"+adminPhone, map[string]interface{}{"locale": "xx"})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+
+	s.do(http.MethodPatch, "/api/v1/admin/users/"+adminPhone, map[string]interface{}{"locale": "fa"})
+
+	s.header = http.Header{"Accept-Language": {"en"}}
+	_, body = s.do(http.MethodGet, "/api/v1/admin/users?cursor=bogus", nil)
+	if body["title"] != "نشانگر صفحه‌بندی نامعتبر است" {
+		t.Fatalf("expected the saved locale to win, got %v", body["title"])
+	}
+}
+
+func TestExternalCatalogs(t *testing.T) {
+	dir := t.TempDir()
+	catalog := `{"errors.user_not_found": "Bu telefon numarasıyla kullanıcı bulunamadı"}`
+	if err := os.WriteFile(filepath.Join(dir, "tr.json"), []byte(catalog), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("I18N_DIR", dir)
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	s.header = http.Header{"Accept-Language": {"tr-TR"}}
+	_, body := s.do(http.MethodGet, "/api/v1/auth/profile/?phone=09120000221", nil)
+	if body["title"] != "Bu telefon numarasıyla kullanıcı bulunamadı" {
+		t.Fatalf("expected the Turkish title, got %v", body["title"])
+	}
+	// Keys the catalog lacks fall back to the default locale.
+	_, body = s.login("09120000221", "123456")
+	if body["title"] != "OTP code is wrong" {
+		t.Fatalf("expected the English fallback, got %v", body["title"])
+	}
+}
+
+// fieldErrors decodes the errors member of a problem into field -> rule.
+func fieldErrors(t *testing.T, body map[string]interface{}) map[string]string {
+	t.Helper()
+
+	list, _ := body["errors"].([]interface{})
+	rules := make(map[string]string, len(list))
+	for _, item := range list {
+		fe := item.(map[string]interface{})
+		if fe["message"] == "" || fe["message"] == nil {
+			t.Fatalf("field error without a message: %v", fe)
+		}
+		rules[fe["field"].(string)] = fe["rule"].(string)
+	}
+	return rules
+}
+
+func TestValidationErrors(t *testing.T) {
+	s := newTestServer(t)
+
+	rec, body := s.login("0912-abc", "12a")
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	if rules := fieldErrors(t, body); rules["phoneNumber"] != "phone" || rules["OTPCode"] != "otp" || len(rules) != 2 {
+		t.Fatalf("unexpected field errors: %v", body["errors"])
+	}
+	if body["detail"] != "2 fields are invalid." {
+		t.Fatalf("unexpected detail: %v", body["detail"])
+	}
+
+	rec, body = s.do(http.MethodPost, "/api/v1/auth/send/otp/", map[string]interface{}{"phoneNumber": 9120000231})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	if rules := fieldErrors(t, body); rules["phoneNumber"] != "type" {
+		t.Fatalf("unexpected field errors: %v", body["errors"])
+	}
+
+	s.loginAsAdmin()
+	rec, body = s.do(http.MethodGet, "/api/v1/admin/users?page_size=500&order=sideways", nil)
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	if rules := fieldErrors(t, body); rules["page_size"] != "max" || rules["order"] != "oneof" {
+		t.Fatalf("unexpected field errors: %v", body["errors"])
+	}
+
+	s.header = http.Header{"Accept-Language": {"fa"}}
+	rec, body = s.do(http.MethodPatch, "/api/v1/admin/users/"+adminPhone, map[string]interface{}{
+		"name":     strings.Repeat("x", 101),
+		"metadata": map[string]string{"a:b": "c"},
+	})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	if rules := fieldErrors(t, body); rules["name"] != "max" || rules["metadata[a:b]"] != "excludesall" {
+		t.Fatalf("unexpected field errors: %v", body["errors"])
+	}
+	for _, item := range body["errors"].([]interface{}) {
+		if fe := item.(map[string]interface{}); fe["field"] == "name" && fe["message"] != "name باید حداکثر 100 کاراکتر باشد" {
+			t.Fatalf("unexpected Persian message: %v", fe["message"])
+		}
+	}
+}
+
+func TestPhoneFormatsAreOneUser(t *testing.T) {
+	s := newTestServer(t)
+
+	user := s.signUp("09120000301")
+	if user["phone"] != "+989120000301" {
+		t.Fatalf("expected the E.164 phone, got %v", user["phone"])
+	}
+
+	for _, format := range []string{"+98 912 000 0301", "989120000301", "00989120000301", "9120000301", "۰۹۱۲۰۰۰۰۳۰۱", "٠٩١٢٠٠٠٠٣٠١", "+98 (0)912-000-0301"} {
+		s.app.AuthRepository.DeleteOTP(context.Background(), e164("09120000301"))
+		rec, body := s.sendOTP(format)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d (body %v)", format, rec.Code, body)
+		}
+		rec, body = s.login(format, s.otpFor("09120000301"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d (body %v)", format, rec.Code, body)
+		}
+		if again := body["user"].(map[string]interface{}); again["id"] != user["id"] {
+			t.Fatalf("%s: logged in as %v instead of %v", format, again["id"], user["id"])
+		}
+		s.useLimiter(ratelimit.NewMemoryLimiter())
+	}
+}
+
+func TestPhoneMustBeMobile(t *testing.T) {
+	s := newTestServer(t)
+
+	// A Tehran landline, a number too short for Iran, a country we do not serve and letters.
+	for _, number := range []string{"02188888888", "0912000030", "+8613800138000", "0912abc0000"} {
+		rec, body := s.sendOTP(number)
+		assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+		if rules := fieldErrors(t, body); rules["phoneNumber"] != "phone" {
+			t.Fatalf("%s: unexpected field errors: %v", number, body["errors"])
+		}
+	}
+
+	for _, number := range []string{"+447700900123", "+971501234567", "+15005550006"} {
+		if rec, body := s.sendOTP(number); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d (body %v)", number, rec.Code, body)
+		}
+	}
+}
+
+func TestPhoneDefaultRegion(t *testing.T) {
+	t.Setenv("PHONE_DEFAULT_REGION", "GB")
+	s := newTestServer(t)
+	t.Cleanup(func() { _ = phone.SetDefaultRegion(phone.DefaultRegion) })
+
+	if user := s.signUp("07700 900123"); user["phone"] != "+447700900123" {
+		t.Fatalf("expected a British number, got %v", user["phone"])
+	}
+	if rec, body := s.sendOTP("09120000311"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected an Iranian national number to be refused, got %d (body %v)", rec.Code, body)
+	}
+}
+
+// writeFile writes content to name in a temporary directory and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRateLimitPolicies(t *testing.T) {
+	t.Setenv("RATE_LIMIT_CONFIG", writeFile(t, "ratelimits.json", `{"policies": [
+		{"name": "otp_ip", "routes": ["send_otp"], "scope": "ip", "rate": 3, "period": "1h"},
+		{"name": "otp_device", "routes": ["send_otp"], "scope": "device", "rate": 1, "period": "1h"},
+		{"name": "login_all", "routes": ["login"], "scope": "global", "rate": 1, "period": "1h", "dry_run": true}
+	]}`))
+	s := newTestServer(t)
+
+	// The device policy only counts requests that name a device.
+	s.header = http.Header{}
+	s.header.Set(ratelimit.DeviceHeader, "device-1")
+	if rec, body := s.sendOTP("09120000401"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	rec, body := s.sendOTP("09120000402")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+
+	s.header = nil
+	if rec, body := s.sendOTP("09120000403"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	// Three requests from this address so far, different phones or not.
+	rec, body = s.sendOTP("09120000404")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+
+	// Dry-run policies never refuse; the phone policies are gone with the defaults.
+	for i := 0; i < 5; i++ {
+		if rec, _ := s.login("09120000401", "000000"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 from the handler, got %d", rec.Code)
+		}
+	}
+}
+
+func TestRateLimitDryRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	t.Setenv("LOG_OUTPUT", path)
+	config := `{"policies": [{"name": "otp_all", "routes": ["send_otp"], "scope": "global", "rate": 2, "period": "1h", "dry_run": %t}]}`
+	configPath := writeFile(t, "ratelimits.json", fmt.Sprintf(config, true))
+	t.Setenv("RATE_LIMIT_CONFIG", configPath)
+	s := newTestServer(t)
+
+	// Past the limit, requests still go through, and the refusals are only logged.
+	for _, number := range []string{"09120000421", "09120000422", "09120000423", "09120000424"} {
+		if rec, body := s.sendOTP(number); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+		}
+	}
+	lines, data := logLines(t, path)
+	refused := 0
+	for _, line := range lines {
+		if line["handle"] == "RATELIMIT" && line["policy"] == "otp_all" {
+			refused++
+		}
+	}
+	if refused != 2 {
+		t.Fatalf("expected the 2 requests over the limit to be logged, got %s", data)
+	}
+
+	// Enforced from now on, the policy starts with all of its burst.
+	if err := os.WriteFile(configPath, []byte(fmt.Sprintf(config, false)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.app.RateLimits.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []string{"09120000425", "09120000426"} {
+		if rec, body := s.sendOTP(number); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+		}
+	}
+	rec, body := s.sendOTP("09120000427")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+}
+
+func TestRateLimitBodyIsCapped(t *testing.T) {
+	s := newTestServer(t)
+
+	rec, body := s.do(http.MethodPost, "/api/v1/auth/send/otp/", map[string]string{
+		"phoneNumber": "09120000431",
+		"padding":     strings.Repeat("x", 8<<10),
+	})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+}
+
+func TestRateLimitPoliciesReload(t *testing.T) {
+	config := `{"policies": [{"name": "otp_request", "routes": ["send_otp"], "scope": "phone", "rate": %d, "period": "1h"}]}`
+	path := writeFile(t, "ratelimits.json", fmt.Sprintf(config, 10))
+	t.Setenv("RATE_LIMIT_CONFIG", path)
+	s := newTestServer(t)
+
+	s.sendOTP("09120000411")
+	rec, body := s.sendOTP("+98 912 000 0411")
+	assertError(t, rec, body, http.StatusConflict, apperrors.ErrOTPAlreadySent)
+
+	if err := os.WriteFile(path, []byte(`{"policies": [{"name": "broken", "scope": "sms"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.app.RateLimits.Reload(); err == nil {
+		t.Fatal("expected an invalid configuration to be refused")
+	}
+
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(config, 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.app.RateLimits.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	rec, body = s.sendOTP("09120000411")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+}
+
+// rateLimitHeaders returns the RateLimit-Limit, -Remaining and -Reset values of rec.
+func rateLimitHeaders(t *testing.T, rec *httptest.ResponseRecorder) (limit, remaining, reset int) {
+	t.Helper()
+
+	values := make([]int, 3)
+	for i, name := range []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"} {
+		value, err := strconv.Atoi(rec.Header().Get(name))
+		if err != nil {
+			t.Fatalf("%s: %q is not a number", name, rec.Header().Get(name))
+		}
+		values[i] = value
+	}
+	return values[0], values[1], values[2]
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	s := newTestServer(t)
+
+	rec, body := s.sendOTP("09120000421")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	if limit, remaining, reset := rateLimitHeaders(t, rec); limit != 3 || remaining != 2 || reset != 200 {
+		t.Fatalf("unexpected headers: limit %d, remaining %d, reset %d", limit, remaining, reset)
+	}
+
+	// The pending code blocks a new one until it expires.
+	rec, body = s.sendOTP("09120000421")
+	assertError(t, rec, body, http.StatusConflict, apperrors.ErrOTPAlreadySent)
+	if retryAfter, _ := body["retry_after"].(float64); retryAfter < 119 || retryAfter > 120 {
+		t.Fatalf("expected retry_after of about 120s, got %v", body["retry_after"])
+	}
+	if _, remaining, _ := rateLimitHeaders(t, rec); remaining != 1 {
+		t.Fatalf("expected 1 request left, got %d", remaining)
+	}
+
+	s.sendOTP("09120000421")
+	rec, body = s.sendOTP("09120000421")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrRateLimited)
+	if limit, remaining, reset := rateLimitHeaders(t, rec); limit != 3 || remaining != 0 || reset < 599 || reset > 600 {
+		t.Fatalf("unexpected headers: limit %d, remaining %d, reset %d", limit, remaining, reset)
+	}
+	if rec.Header().Get("Retry-After") != "200" {
+		t.Fatalf("expected Retry-After 200, got %q", rec.Header().Get("Retry-After"))
+	}
+
+	rec, _ = s.login("09120000421", "000000")
+	if _, remaining, _ := rateLimitHeaders(t, rec); remaining != 2 {
+		t.Fatalf("login has its own policy, expected 2 left, got %d", remaining)
+	}
+}
+
+func TestSendOTPCooldown(t *testing.T) {
+	s := newTestServer(t)
+
+	_, body := s.sendOTP("09120000431")
+	if body["expires_in"] != float64(120) || body["resend_after"] != float64(120) {
+		t.Fatalf("expected a 120s cooldown, got expires_in %v, resend_after %v", body["expires_in"], body["resend_after"])
+	}
+
+	// A stricter rate limit than the code's lifetime sets the cooldown.
+	t.Setenv("RATE_LIMIT_CONFIG", writeFile(t, "ratelimits.json",
+		`{"policies": [{"name": "otp_request", "routes": ["send_otp"], "scope": "phone", "rate": 1, "period": "1h"}]}`))
+	s = newTestServer(t)
+
+	_, body = s.sendOTP("09120000432")
+	if body["expires_in"] != float64(120) || body["resend_after"] != float64(3600) {
+		t.Fatalf("expected a 3600s cooldown, got expires_in %v, resend_after %v", body["expires_in"], body["resend_after"])
+	}
+}
+
+func TestAddressThrottles(t *testing.T) {
+	t.Setenv("RATE_LIMIT_CONFIG", writeFile(t, "ratelimits.json", `{"policies": [
+		{"name": "otp_ip", "routes": ["send_otp", "login"], "scope": "ip", "rate": 2, "period": "1h"},
+		{"name": "otp_subnet", "routes": ["send_otp", "login"], "scope": "subnet", "rate": 3, "period": "1h"}
+	]}`))
+	s := newTestServer(t)
+
+	phones := 0
+	send := func(remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+		t.Helper()
+		s.remoteAddr = remoteAddr
+		s.header = http.Header{}
+		if forwardedFor != "" {
+			s.header.Set("X-Forwarded-For", forwardedFor)
+		}
+		phones++
+		rec, _ := s.sendOTP(fmt.Sprintf("0912000%04d", 500+phones))
+		return rec
+	}
+
+	// Different phones from one address; without trusted proxies X-Forwarded-For is ignored.
+	for _, forwardedFor := range []string{"", "198.51.100.1"} {
+		if rec := send("203.0.113.5:4000", forwardedFor); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+	}
+	if rec := send("203.0.113.5:4001", "198.51.100.2"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the address to be throttled, got %d", rec.Code)
+	}
+	// Neighbours share the /24.
+	if rec := send("203.0.113.77:4000", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if rec := send("203.0.113.78:4000", ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the subnet to be throttled, got %d", rec.Code)
+	}
+	if rec := send("203.0.114.5:4000", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected another subnet to pass, got %d", rec.Code)
+	}
+
+	// IPv6 clients are grouped by /64.
+	for i, addr := range []string{"[2001:db8:0:1::1]:4000", "[2001:db8:0:1::2]:4000", "[2001:db8:0:1:ffff::3]:4000"} {
+		if rec := send(addr, ""); rec.Code != http.StatusOK {
+			t.Fatalf("%d: expected 200, got %d", i, rec.Code)
+		}
+	}
+	if rec := send("[2001:db8:0:1::4]:4000", ""); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the /64 to be throttled, got %d", rec.Code)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	t.Setenv("RATE_LIMIT_CONFIG", writeFile(t, "ratelimits.json",
+		`{"policies": [{"name": "otp_ip", "routes": ["send_otp"], "scope": "ip", "rate": 1, "period": "1h"}]}`))
+	s := newTestServer(t)
+	s.remoteAddr = "10.0.0.1:4000"
+
+	// The client is the last address the trusted proxies did not add, not what it claims.
+	cases := []struct {
+		forwardedFor string
+		status       int
+	}{
+		{"198.51.100.7", http.StatusOK},
+		{"198.51.100.7, 10.0.0.2", http.StatusTooManyRequests},
+		{"1.2.3.4, 198.51.100.7", http.StatusTooManyRequests},
+		{"198.51.100.8", http.StatusOK},
+		{"", http.StatusOK},
+		{"", http.StatusTooManyRequests},
+	}
+	for i, tc := range cases {
+		s.header = http.Header{"X-Forwarded-For": {tc.forwardedFor}}
+		if tc.forwardedFor == "" {
+			s.header = nil
+		}
+		if rec, body := s.sendOTP(fmt.Sprintf("091200006%02d", i)); rec.Code != tc.status {
+			t.Fatalf("%q: expected %d, got %d (body %v)", tc.forwardedFor, tc.status, rec.Code, body)
+		}
+	}
+}
+
+func TestFraudCountryLists(t *testing.T) {
+	t.Setenv("FRAUD_DENIED_COUNTRIES", "gb")
+	s := newTestServer(t)
+
+	rec, body := s.sendOTP("+447700900123")
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrCountryNotAllowed)
+	if _, err := s.app.AuthRepository.GetOTP(context.Background(), "+447700900123"); !errors.Is(err, apperrors.ErrOTPInvalid) {
+		t.Fatalf("expected no code to be kept for a refused number, got %v", err)
+	}
+	if rec, body := s.sendOTP("09120000701"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+
+	t.Setenv("FRAUD_DENIED_COUNTRIES", "")
+	t.Setenv("FRAUD_ALLOWED_COUNTRIES", "IR, GB")
+	s = newTestServer(t)
+	if rec, body := s.sendOTP("+447700900123"); rec.Code != http.StatusOK {
+		t.Fatalf("expected an allowed country to pass, got %d (body %v)", rec.Code, body)
+	}
+	rec, body = s.sendOTP("+905321234567")
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrCountryNotAllowed)
+}
+
+func TestFraudPrefixBudget(t *testing.T) {
+	t.Setenv("FRAUD_PREFIX_DAILY_BUDGET", "2")
+	s := newTestServer(t)
+
+	for _, number := range []string{"09120000711", "09120000712"} {
+		if rec, body := s.sendOTP(number); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+		}
+	}
+	// The budget is spent: the prefix is blocked for the rest of the day.
+	for _, number := range []string{"09120000713", "+98 912 000 0714"} {
+		rec, body := s.sendOTP(number)
+		assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrDestinationBlocked)
+		if retry, _ := strconv.Atoi(rec.Header().Get("Retry-After")); retry <= 0 || retry > 86400 {
+			t.Fatalf("expected a retry before midnight, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+	if rec, body := s.sendOTP("09350000711"); rec.Code != http.StatusOK {
+		t.Fatalf("expected another prefix to pass, got %d (body %v)", rec.Code, body)
+	}
+}
+
+func TestFraudCountryBudget(t *testing.T) {
+	t.Setenv("FRAUD_COUNTRY_BUDGETS", "GB=1")
+	s := newTestServer(t)
+
+	if rec, body := s.sendOTP("+447700900121"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	rec, body := s.sendOTP("+447800900122")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrDestinationBlocked)
+	if rec, body := s.sendOTP("09120000721"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the default budget for other countries, got %d (body %v)", rec.Code, body)
+	}
+}
+
+func TestFraudLowConversion(t *testing.T) {
+	t.Setenv("FRAUD_MIN_SAMPLE", "3")
+	t.Setenv("FRAUD_MIN_CONVERSION", "0.5")
+	t.Setenv("FRAUD_BREAKER_DURATION", "30m")
+	s := newTestServer(t)
+
+	s.signUp("09120000731")
+	if rec, body := s.sendOTP("09120000732"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	// One login out of three codes sent: the codes are not reaching people.
+	rec, body := s.sendOTP("09120000733")
+	assertError(t, rec, body, http.StatusTooManyRequests, apperrors.ErrDestinationBlocked)
+	if retry := rec.Header().Get("Retry-After"); retry != "1800" {
+		t.Fatalf("expected Retry-After 1800, got %q", retry)
+	}
+}
+
+func TestFraudAdminPrefixes(t *testing.T) {
+	t.Setenv("FRAUD_PREFIX_DAILY_BUDGET", "2")
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	s.signUp("09120000741")
+	s.sendOTP("09120000742")
+	s.sendOTP("09120000743")
+
+	rec, body := s.do(http.MethodGet, "/api/v1/admin/fraud/prefixes", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	if countries := body["countries"].(map[string]interface{}); countries["IR"] != float64(4) {
+		t.Fatalf("expected 4 codes sent to IR, got %v", countries)
+	}
+	var found bool
+	for _, entry := range body["prefixes"].([]interface{}) {
+		prefix := entry.(map[string]interface{})
+		if prefix["prefix"] != "+98912" {
+			continue
+		}
+		found = true
+		if prefix["sent"] != float64(3) || prefix["logins"] != float64(1) || prefix["blocked"] != true || prefix["block_reason"] != "prefix_budget" {
+			t.Fatalf("unexpected counters %v", prefix)
+		}
+	}
+	if !found {
+		t.Fatalf("expected +98912 to be listed, got %v", body["prefixes"])
+	}
+
+	// Any spelling of the prefix goes.
+	rec, body = s.do(http.MethodDelete, "/api/v1/admin/fraud/prefixes/0912", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	if prefix := body["prefix"].(map[string]interface{}); prefix["prefix"] != "+98912" || prefix["sent"] != float64(0) || prefix["blocked"] != false {
+		t.Fatalf("expected the prefix to be reset, got %v", prefix)
+	}
+	if rec, body := s.sendOTP("09120000744"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the reset prefix to pass, got %d (body %v)", rec.Code, body)
+	}
+	_, body = s.do(http.MethodGet, "/api/v1/admin/fraud/prefixes/+98912", nil)
+	if prefix := body["prefix"].(map[string]interface{}); prefix["sent"] != float64(1) {
+		t.Fatalf("expected 1 code sent since the reset, got %v", prefix)
+	}
+
+	rec, body = s.do(http.MethodGet, "/api/v1/admin/fraud/prefixes/abc", nil)
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+
+	s.token = s.signUp("09120000745")["access_token"].(string)
+	rec, body = s.do(http.MethodDelete, "/api/v1/admin/fraud/prefixes/0912", nil)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrForbidden)
+}
+
+// challengeOf returns the challenge of a challenge_required or challenge_failed problem.
+func challengeOf(t *testing.T, body map[string]interface{}) map[string]interface{} {
+	t.Helper()
+
+	issued, ok := body["challenge"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a challenge in %v", body)
+	}
+	return issued
+}
+
+func TestChallengeProofOfWork(t *testing.T) {
+	t.Setenv("RATE_LIMIT_CONFIG", writeFile(t, "ratelimits.json", `{"policies": []}`))
+	t.Setenv("CHALLENGE_PROVIDER", "pow")
+	t.Setenv("CHALLENGE_SECRET", "secret")
+	t.Setenv("CHALLENGE_POW_DIFFICULTY", "8")
+	t.Setenv("CHALLENGE_PHONE_THRESHOLD", "2")
+	s := newTestServer(t)
+	number := "09120000801"
+
+	s.sendOTP(number)
+	s.app.AuthRepository.DeleteOTP(context.Background(), e164(number))
+	s.sendOTP(number)
+	s.app.AuthRepository.DeleteOTP(context.Background(), e164(number))
+
+	rec, body := s.sendOTP(number)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrChallengeRequired)
+	issued := challengeOf(t, body)
+	if issued["type"] != "pow" || issued["difficulty"] != float64(8) || issued["seed"] == "" {
+		t.Fatalf("unexpected challenge %v", issued)
+	}
+
+	s.header = http.Header{}
+	s.header.Set(middleware.ChallengeHeader, issued["seed"].(string)+":0")
+	if rec, body := s.sendOTP(number); rec.Code != http.StatusForbidden || body["code"] != apperrors.ErrChallengeFailed.Code {
+		t.Fatalf("expected an unsolved challenge to fail, got %d (body %v)", rec.Code, body)
+	} else if challengeOf(t, body)["seed"] == issued["seed"] {
+		t.Fatal("expected a new challenge after a failed one")
+	}
+
+	token := challenge.Solve(issued["seed"].(string), 8)
+	s.header.Set(middleware.ChallengeHeader, token)
+	if rec, body := s.sendOTP(number); rec.Code != http.StatusOK {
+		t.Fatalf("expected a solved challenge to pass, got %d (body %v)", rec.Code, body)
+	}
+
+	// A solution is good for one request.
+	s.app.AuthRepository.DeleteOTP(context.Background(), e164(number))
+	s.sendOTP(number)
+	s.app.AuthRepository.DeleteOTP(context.Background(), e164(number))
+	rec, body = s.sendOTP(number)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrChallengeFailed)
+
+	// Other phones are not challenged.
+	s.header = nil
+	if rec, body := s.sendOTP("09120000802"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+}
+
+func TestChallengeAfterFailedLogins(t *testing.T) {
+	t.Setenv("RATE_LIMIT_CONFIG", writeFile(t, "ratelimits.json", `{"policies": []}`))
+	t.Setenv("CHALLENGE_PROVIDER", "pow")
+	t.Setenv("CHALLENGE_SECRET", "secret")
+	t.Setenv("CHALLENGE_POW_DIFFICULTY", "4")
+	t.Setenv("CHALLENGE_PHONE_THRESHOLD", "100")
+	t.Setenv("CHALLENGE_IP_THRESHOLD", "3")
+	s := newTestServer(t)
+	number := "09120000811"
+
+	s.sendOTP(number)
+	code := s.otpFor(number)
+	// Successful requests to login do not count; failed ones do.
+	s.login("09120000812", "000000")
+	s.login(number, "000000")
+
+	rec, body := s.login(number, code)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrChallengeRequired)
+
+	s.header = http.Header{}
+	s.header.Set(middleware.ChallengeHeader, challenge.Solve(challengeOf(t, body)["seed"].(string), 4))
+	if rec, body := s.login(number, code); rec.Code != http.StatusOK {
+		t.Fatalf("expected a solved challenge to pass, got %d (body %v)", rec.Code, body)
+	}
+}
+
+func TestChallengeCaptcha(t *testing.T) {
+	var remoteIPs []string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteIPs = append(remoteIPs, r.PostFormValue("remoteip"))
+		success := r.PostFormValue("secret") == "secret" && r.PostFormValue("response") == "solved"
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": success, "error-codes": []string{}})
+	}))
+	defer provider.Close()
+
+	t.Setenv("RATE_LIMIT_CONFIG", writeFile(t, "ratelimits.json", `{"policies": []}`))
+	t.Setenv("CHALLENGE_PROVIDER", "hcaptcha")
+	t.Setenv("CHALLENGE_SITE_KEY", "site-key")
+	t.Setenv("CHALLENGE_SECRET", "secret")
+	t.Setenv("CHALLENGE_VERIFY_URL", provider.URL)
+	t.Setenv("CHALLENGE_PHONE_THRESHOLD", "1")
+	s := newTestServer(t)
+	s.remoteAddr = "203.0.113.9:4000"
+	number := "09120000821"
+
+	s.sendOTP(number)
+	rec, body := s.sendOTP(number)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrChallengeRequired)
+	if issued := challengeOf(t, body); issued["type"] != "hcaptcha" || issued["site_key"] != "site-key" {
+		t.Fatalf("unexpected challenge %v", issued)
+	}
+
+	s.header = http.Header{}
+	s.header.Set(middleware.ChallengeHeader, "guessed")
+	rec, body = s.sendOTP(number)
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrChallengeFailed)
+
+	s.app.AuthRepository.DeleteOTP(context.Background(), e164(number))
+	s.header.Set(middleware.ChallengeHeader, "solved")
+	if rec, body := s.sendOTP(number); rec.Code != http.StatusOK {
+		t.Fatalf("expected a solved CAPTCHA to pass, got %d (body %v)", rec.Code, body)
+	}
+	if len(remoteIPs) != 2 || remoteIPs[1] != "203.0.113.9" {
+		t.Fatalf("expected the client IP to be sent to the provider, got %v", remoteIPs)
+	}
+}
+
+// auditEvents fetches a page of the security history of phone.
+func (s *testServer) auditEvents(phone, query string) (*httptest.ResponseRecorder, []map[string]interface{}, map[string]interface{}) {
+	s.t.Helper()
+
+	rec, body := s.do(http.MethodGet, "/api/v1/admin/users/"+url.PathEscape(phone)+"/audit?"+query, nil)
+	var events []map[string]interface{}
+	list, _ := body["events"].([]interface{})
+	for _, event := range list {
+		events = append(events, event.(map[string]interface{}))
+	}
+	return rec, events, body
+}
+
+func eventTypes(events []map[string]interface{}) string {
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = fmt.Sprint(event["type"], ":", event["outcome"])
+	}
+	return strings.Join(types, ",")
+}
+
+func TestAuditHistory(t *testing.T) {
+	s := newTestServer(t)
+	s.loginAsAdmin()
+	adminToken := s.token
+	number := "09120000901"
+
+	s.header = http.Header{}
+	s.header.Set("User-Agent", "audit-test/1.0")
+	s.remoteAddr = "203.0.113.20:4000"
+	user := s.signUp(number)
+	s.sendOTP("09120000902")
+	s.login(number, "000000")
+	s.header, s.remoteAddr = nil, ""
+
+	if rec, body := s.setStatus(number, map[string]interface{}{"status": "suspended", "reason": "chargeback"}); rec.Code != http.StatusOK {
+		t.Fatalf("suspend: status %d, body %v", rec.Code, body)
+	}
+
+	rec, events, body := s.auditEvents("+98 912 000 0901", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d (body %v)", rec.Code, body)
+	}
+	want := "status_changed:success,sessions_revoked:success,login:failure,login:success,user_created:success,otp_sent:success"
+	if got := eventTypes(events); got != want {
+		t.Fatalf("expected events %s, got %s", want, got)
+	}
+
+	login := events[3]
+	if login["user_id"] != user["id"] || login["session_id"] == "" || login["ip"] != "203.0.113.20" || login["user_agent"] != "audit-test/1.0" {
+		t.Fatalf("unexpected login event %v", login)
+	}
+	if failed := events[2]; failed["reason"] != apperrors.ErrOTPInvalid.Code || failed["user_id"] != nil {
+		t.Fatalf("unexpected failed login event %v", failed)
+	}
+	if changed := events[0]; changed["reason"] != "suspended: chargeback" || changed["actor"] == nil || changed["actor"] == changed["phone_hash"] {
+		t.Fatalf("expected the admin to be recorded as the actor, got %v", changed)
+	}
+	for _, event := range events {
+		if event["phone_hash"] != events[0]["phone_hash"] {
+			t.Fatalf("expected every event to carry the same phone hash, got %v", event)
+		}
+		if strings.Contains(fmt.Sprint(event), "912000090") {
+			t.Fatalf("expected no phone number in the audit log, got %v", event)
+		}
+	}
+
+	// Filters.
+	if _, events, _ := s.auditEvents(number, "outcome=failure"); eventTypes(events) != "login:failure" {
+		t.Fatalf("expected the failed login only, got %s", eventTypes(events))
+	}
+	if _, events, _ := s.auditEvents(number, "type=otp_sent&type=user_created"); eventTypes(events) != "user_created:success,otp_sent:success" {
+		t.Fatalf("expected the sign-up events, got %s", eventTypes(events))
+	}
+	future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	if _, events, _ := s.auditEvents(number, "from="+future); len(events) != 0 {
+		t.Fatalf("expected no events in the future, got %s", eventTypes(events))
+	}
+
+	// Pagination.
+	var pages []string
+	cursor := ""
+	for {
+		_, events, body := s.auditEvents(number, "page_size=4&cursor="+url.QueryEscape(cursor))
+		pages = append(pages, eventTypes(events))
+		if cursor, _ = body["next_cursor"].(string); cursor == "" {
+			break
+		}
+	}
+	if strings.Join(pages, ",") != want || len(pages) != 2 {
+		t.Fatalf("expected two pages of %s, got %v", want, pages)
+	}
+
+	rec, _, body = s.auditEvents(number, "cursor=nonsense")
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidCursor)
+	rec, _, body = s.auditEvents(number, "type=unknown")
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+
+	s.token = s.signUp("09120000903")["access_token"].(string)
+	rec, _, body = s.auditEvents(number, "")
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrForbidden)
+	s.token = adminToken
+}
+
+func TestAuditFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "events.log")
+	t.Setenv("AUDIT_SINK", "file")
+	t.Setenv("AUDIT_FILE", path)
+	t.Setenv("AUDIT_HASH_KEY", "pepper")
+	s := newTestServer(t)
+	s.loginAsAdmin()
+	s.signUp("09120000911")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, line := range lines {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("expected one JSON event per line, got %q", line)
+		}
+	}
+	if strings.Contains(string(data), "912000091") {
+		t.Fatal("expected no phone number in the audit file")
+	}
+
+	_, events, _ := s.auditEvents("09120000911", "")
+	if got := eventTypes(events); got != "login:success,user_created:success,otp_sent:success" {
+		t.Fatalf("unexpected events %s", got)
+	}
+}
+
+// logLines reads the JSON lines of the log file at path.
+func logLines(t *testing.T, path string) ([]map[string]interface{}, string) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("expected one JSON object per line, got %q", line)
+		}
+		lines = append(lines, entry)
+	}
+	return lines, string(data)
+}
+
+func TestStructuredLogs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	t.Setenv("LOG_OUTPUT", path)
+	s := newTestServer(t)
+	s.header = http.Header{"X-Request-Id": {"trace-042"}}
+
+	number := "09120000921"
+	if rec, body := s.sendOTP(number); rec.Code != http.StatusOK {
+		t.Fatalf("send otp: status %d, body %v", rec.Code, body)
+	}
+	code := s.otpFor(number)
+	rec, body := s.login(number, code)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status %d, body %v", rec.Code, body)
+	}
+	if got := rec.Header().Get("X-Request-ID"); got != "trace-042" {
+		t.Fatalf("expected the request id to be echoed, got %q", got)
+	}
+	accessToken := body["user"].(map[string]interface{})["access_token"].(string)
+	s.login(number, "000000")
+
+	lines, data := logLines(t, path)
+	var access, sms, refused map[string]interface{}
+	for _, line := range lines {
+		switch {
+		case line["message"] == "request" && line["route"] == "/api/v1/auth/login/" && line["status"] == float64(http.StatusOK):
+			access = line
+		case line["message"] == "request" && line["route"] == "/api/v1/auth/login/":
+			refused = line
+		case line["handle"] == "SMS":
+			sms = line
+		}
+	}
+	if access == nil || sms == nil || refused == nil {
+		t.Fatalf("expected access and SMS lines, got %s", data)
+	}
+	if access["request_id"] != "trace-042" || sms["request_id"] != "trace-042" {
+		t.Fatalf("expected the request id on every line of the request, got %v and %v", access, sms)
+	}
+	if _, ok := access["latency_ms"].(float64); !ok || access["level"] != "info" || access["method"] != http.MethodPost {
+		t.Fatalf("unexpected access line %v", access)
+	}
+	if refused["level"] != "warn" || refused["status"] != float64(http.StatusUnauthorized) {
+		t.Fatalf("expected a refused login to be logged as a warning, got %v", refused)
+	}
+
+	for _, secret := range []string{"912000092", code, accessToken} {
+		if strings.Contains(data, secret) {
+			t.Fatalf("expected %q to be redacted from the logs", secret)
+		}
+	}
+	if sms["to"] != "***0921" || sms["sms_text"] != "[REDACTED]" {
+		t.Fatalf("unexpected SMS line %v", sms)
+	}
+}
+
+func TestLogsUnredacted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	t.Setenv("LOG_OUTPUT", path)
+	t.Setenv("LOG_REDACT", "false")
+	s := newTestServer(t)
+	s.sendOTP("09120000922")
+
+	if _, data := logLines(t, path); !strings.Contains(data, s.otpFor("09120000922")) {
+		t.Fatalf("expected the code in development logs, got %s", data)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	t.Setenv("LOG_OUTPUT", path)
+	t.Setenv("LOG_LEVEL", "warn")
+	s := newTestServer(t)
+	s.loginAsAdmin()
+
+	rec, body := s.do(http.MethodGet, "/api/v1/admin/logging/level", nil)
+	if rec.Code != http.StatusOK || body["level"] != "warn" {
+		t.Fatalf("expected level warn, got %d %v", rec.Code, body)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), `"level":"info"`) {
+		t.Fatalf("expected no info lines at level warn, got %s", data)
+	}
+
+	rec, body = s.do(http.MethodPut, "/api/v1/admin/logging/level", map[string]string{"level": "debug"})
+	if rec.Code != http.StatusOK || body["level"] != "debug" {
+		t.Fatalf("expected level debug, got %d %v", rec.Code, body)
+	}
+	s.do(http.MethodGet, "/api/v1/admin/logging/level", nil)
+	if _, data := logLines(t, path); !strings.Contains(data, `"level":"info"`) {
+		t.Fatalf("expected info lines at level debug, got %s", data)
+	}
+
+	rec, body = s.do(http.MethodPut, "/api/v1/admin/logging/level", map[string]string{"level": "verbose"})
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+
+	s.token = s.signUp("09120000923")["access_token"].(string)
+	rec, body = s.do(http.MethodPut, "/api/v1/admin/logging/level", map[string]string{"level": "error"})
+	assertError(t, rec, body, http.StatusForbidden, apperrors.ErrForbidden)
+}
+
+// scrape returns the samples /metrics exposes on the admin listener, by series such as
+// `auth_rate_limited_total{policy="login"}`.
+func (s *testServer) scrape() map[string]float64 {
+	s.t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	routes.AdminUrls(newRouter(), s.app).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		s.t.Fatalf("scrape: status %d", rec.Code)
+	}
+
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			s.t.Fatalf("unexpected sample %q", line)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	before := s.scrape()
+
+	number := "09120000931"
+	user := s.signUp(number)
+	s.refresh(number, user["refresh_token"].(string))
+	for i := 0; i < 3; i++ {
+		s.login(number, "000000")
+	}
+	s.do(http.MethodGet, "/api/v1/admin/users/"+number+"/audit", nil)
+	s.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/no/such/"+number, nil))
+
+	after := s.scrape()
+	for series, want := range map[string]float64{
+		"auth_otp_sent_total":                     1,
+		"auth_otp_verify_failed_total":            2,
+		"auth_login_success_total":                1,
+		"auth_user_created_total":                 1,
+		"auth_token_refreshed_total":              1,
+		`auth_rate_limited_total{policy="login"}`: 1,
+		`auth_http_request_duration_seconds_count{method="POST",route="/api/v1/auth/login/",status="200"}`:             1,
+		`auth_http_request_duration_seconds_count{method="POST",route="/api/v1/auth/login/",status="429"}`:             1,
+		`auth_http_request_duration_seconds_count{method="GET",route="/api/v1/admin/users/:phone/audit",status="401"}`: 1,
+		`auth_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"}`:                        1,
+	} {
+		if got := after[series] - before[series]; got != want {
+			t.Errorf("expected %s to grow by %v, got %v", series, want, got)
+		}
+	}
+	for series := range after {
+		if strings.Contains(series, "0931") {
+			t.Fatalf("expected no phone number in the labels, got %s", series)
+		}
+	}
+	if _, ok := after["go_goroutines"]; !ok {
+		t.Fatal("expected the Go runtime metrics")
+	}
+}
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+)
+
+// recordSpans records the spans of the servers created after it, from now on. The tracer
+// provider is global and services keep the first one set, so it is installed only once.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	spansOnce.Do(func() {
+		spans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spans.Reset()
+	return spans
+}
+
+func TestTracing(t *testing.T) {
+	exporter := recordSpans(t)
+	path := filepath.Join(t.TempDir(), "auth.log")
+	t.Setenv("LOG_OUTPUT", path)
+	s := newTestServer(t)
+	traceID, parentID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	s.header = http.Header{"Traceparent": {"00-" + traceID + "-" + parentID + "-01"}}
+
+	number := "09120000941"
+	s.sendOTP(number)
+	rec, body := s.login(number, "000000")
+	assertError(t, rec, body, http.StatusUnauthorized, apperrors.ErrOTPInvalid)
+	if body["trace_id"] != traceID {
+		t.Fatalf("expected trace id %s in the problem, got %v", traceID, body["trace_id"])
+	}
+
+	// Spans of other traces, such as the Redis commands of migrations, are not the request's.
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() == traceID {
+			byName[span.Name] = span
+		}
+	}
+	request, login := byName["/api/v1/auth/login/"], byName["AuthService.Login"]
+	if request.Parent.SpanID().String() != parentID {
+		t.Fatalf("expected the request span under the client's, got %v", byName)
+	}
+	if login.Parent.SpanID() != request.SpanContext.SpanID() || login.Status.Code != codes.Error {
+		t.Fatalf("expected a failed AuthService.Login span under the request's, got %+v", login)
+	}
+	if byName["RateLimit login"].Parent.SpanID() != request.SpanContext.SpanID() {
+		t.Fatalf("expected the rate limit span under the request's, got %v", byName)
+	}
+	if byName["sms.Send"].Parent.SpanID() != byName["AuthService.SendOTPCode"].SpanContext.SpanID() {
+		t.Fatalf("expected the SMS span under AuthService.SendOTPCode, got %v", byName)
+	}
+
+	lines, data := logLines(t, path)
+	for _, line := range lines {
+		if line["trace_id"] != traceID {
+			t.Fatalf("expected the trace id on every line, got %s", data)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	t.Setenv("HEALTH_CHECK_TIMEOUT", "50ms")
+	s := newTestServer(t)
+
+	rec, body := s.do(http.MethodGet, "/healthz", nil)
+	if rec.Code != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("expected a live process, got %d %v", rec.Code, body)
+	}
+	rec, body = s.do(http.MethodGet, "/readyz", nil)
+	checks, _ := body["checks"].(map[string]interface{})
+	if rec.Code != http.StatusOK || body["status"] != "ok" || checks["signing_keys"] == nil || checks["sms"] == nil {
+		t.Fatalf("expected a ready service, got %d %v", rec.Code, body)
+	}
+
+	s.app.Health.Add("sms", func(ctx context.Context) error {
+		return errors.New("gateway refused the credentials")
+	})
+	// A check that ignores its context is cut off at HEALTH_CHECK_TIMEOUT.
+	s.app.Health.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	start := time.Now()
+	rec, body = s.do(http.MethodGet, "/readyz", nil)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("expected the checks to time out, took %s", elapsed)
+	}
+	checks, _ = body["checks"].(map[string]interface{})
+	smsCheck, _ := checks["sms"].(map[string]interface{})
+	slowCheck, _ := checks["slow"].(map[string]interface{})
+	if rec.Code != http.StatusServiceUnavailable || body["status"] != "unavailable" ||
+		smsCheck["error"] != "gateway refused the credentials" || slowCheck["status"] != "unavailable" {
+		t.Fatalf("expected failed checks, got %d %v", rec.Code, body)
+	}
+	if signing, _ := checks["signing_keys"].(map[string]interface{}); signing["status"] != "ok" {
+		t.Fatalf("expected the signing keys to stay ok, got %v", checks)
+	}
+
+	// Readiness is for load balancers: the API still answers.
+	if rec, body := s.sendOTP("09120000951"); rec.Code != http.StatusOK {
+		t.Fatalf("send otp: status %d, body %v", rec.Code, body)
+	}
+}
+
+func TestReadyWithGeneratedSigningKey(t *testing.T) {
+	t.Setenv("JWT_KEYS_REFRESH", "10ms")
+	t.Setenv("AUDIT_HASH_KEY", "pepper")
+	t.Cleanup(func() { utils.SetSigningKeys(nil) })
+	gin.SetMode(gin.TestMode)
+
+	app := bootstrap.InitMemoryAppContainer()
+	s := &testServer{t: t, router: routes.Urls(newRouter(), app), app: app}
+
+	// Tokens of the built-in key can be forged by anyone who reads this repository.
+	rec, body := s.do(http.MethodGet, "/readyz", nil)
+	checks, _ := body["checks"].(map[string]interface{})
+	signing, _ := checks["signing_keys"].(map[string]interface{})
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(fmt.Sprint(signing["error"]), "built-in key") {
+		t.Fatalf("expected the built-in key to fail readiness, got %d %v", rec.Code, body)
+	}
+
+	if _, err := s.app.Keys.Generate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := s.app.Keys.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rec, body := s.do(http.MethodGet, "/readyz", nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected a generated key to make the service ready, got %d %v", rec.Code, body)
+	}
+}
+
+func TestStartsWithoutRedis(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+	t.Setenv("APP_STORAGE", "")
+	t.Setenv("REDIS_HOST", host)
+	t.Setenv("REDIS_PORT", port)
+	t.Setenv("AUDIT_HASH_KEY", "pepper")
+	gin.SetMode(gin.TestMode)
+
+	app := bootstrap.InitAppContainer()
+	s := &testServer{t: t, router: routes.Urls(newRouter(), app), app: app}
+	t.Cleanup(func() { app.Redis.Close() })
+
+	rec, body := s.do(http.MethodGet, "/readyz", nil)
+	checks, _ := body["checks"].(map[string]interface{})
+	startup, _ := checks["startup"].(map[string]interface{})
+	redisCheck, _ := checks["redis"].(map[string]interface{})
+	if rec.Code != http.StatusServiceUnavailable || body["status"] != "starting" ||
+		startup["status"] != "starting" || !strings.Contains(fmt.Sprint(startup["error"]), "redis") ||
+		redisCheck["status"] != "unavailable" {
+		t.Fatalf("expected a service waiting for Redis, got %d %v", rec.Code, body)
+	}
+	if rec, _ := s.do(http.MethodGet, "/healthz", nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected the process to be live, got %d", rec.Code)
+	}
+
+	rec, body = s.sendOTP("09120000952")
+	assertError(t, rec, body, http.StatusServiceUnavailable, apperrors.ErrUnavailable)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header while starting")
+	}
+}
+
+// serveSlowly serves s with a /slow route that answers once release is closed, and returns
+// the server's address and the result of bootstrap.Serve.
+func (s *testServer) serveSlowly(ctx context.Context, entered, release chan struct{}, shutdownTimeout time.Duration) (string, chan error) {
+	s.t.Helper()
+
+	s.router.GET("/slow", func(c *gin.Context) {
+		close(entered)
+		<-release
+		c.JSON(http.StatusOK, gin.H{"status": "done"})
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	config, _ := bootstrap.ServerConfigFromEnv()
+	server := bootstrap.NewServer(config, s.router)
+	server.RegisterOnShutdown(s.app.Health.Stopping)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- bootstrap.Serve(ctx, server, listener, shutdownTimeout)
+	}()
+	return "http://" + listener.Addr().String(), served
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	entered, release := make(chan struct{}), make(chan struct{})
+	addr, served := s.serveSlowly(ctx, entered, release, 5*time.Second)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get(addr + "/slow")
+		if err != nil {
+			t.Errorf("in-flight request failed: %v", err)
+		}
+		responses <- res
+	}()
+	<-entered
+	cancel()
+
+	// Load balancers are told to stop sending requests while the last ones finish.
+	deadline := time.Now().Add(time.Second)
+	for {
+		rec, body := s.do(http.MethodGet, "/readyz", nil)
+		if rec.Code == http.StatusServiceUnavailable && body["status"] == "stopping" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the service to report stopping, got %d %v", rec.Code, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("expected the server to wait for the request in flight, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if res := <-responses; res == nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the in-flight request to finish, got %v", res)
+	} else {
+		res.Body.Close()
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if _, err := http.Get(addr + "/healthz"); err == nil {
+		t.Fatal("expected new connections to be refused after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	entered, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	addr, served := s.serveSlowly(ctx, entered, release, 50*time.Millisecond)
+
+	go func() {
+		if res, err := http.Get(addr + "/slow"); err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-entered
+	cancel()
+
+	if err := <-served; err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the shutdown to time out, got %v", err)
+	}
+}
+
+func TestMachineIdentity(t *testing.T) {
+	t.Setenv("MTLS_IDENTITIES", "billing.internal=billing:admin,reports.internal=reports")
+	s := newTestServer(t)
+	s.signUp("09120000971")
+
+	// Listeners that verify client certificates are set up in bootstrap.Listen.
+	certificate := func(commonName string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	}
+	s.clientCert = certificate("billing.internal")
+	if rec, body := s.do(http.MethodGet, "/api/v1/admin/users", nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected an admin machine to list users, got %d %v", rec.Code, body)
+	}
+	for _, name := range []string{"reports.internal", "stranger.internal"} {
+		s.clientCert = certificate(name)
+		rec, body := s.do(http.MethodGet, "/api/v1/admin/users", nil)
+		assertError(t, rec, body, http.StatusForbidden, apperrors.ErrForbidden)
+	}
+
+	s.clientCert = certificate("billing.internal")
+	rec, body := s.setStatus("09120000971", map[string]interface{}{"status": "suspended", "reason": "chargeback"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected a machine to suspend a user, got %d %v", rec.Code, body)
+	}
+	s.clientCert = nil
+	s.loginAsAdmin()
+	if _, events, _ := s.auditEvents("09120000971", "type=status_changed"); len(events) != 1 || events[0]["actor"] != "machine:billing" {
+		t.Fatalf("expected the machine to be recorded as the actor, got %v", events)
+	}
+}
+
+// webhookReceiver is an endpoint recording the webhook requests it gets, and answering
+// them with status.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	receiver := &webhookReceiver{status: http.StatusOK}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, receivedWebhook{header: r.Header.Clone(), body: body})
+		w.WriteHeader(receiver.status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) answer(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *webhookReceiver) received() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedWebhook(nil), r.requests...)
+}
+
+// dispatch attempts the due webhook deliveries, as the dispatcher does every interval.
+func (s *testServer) dispatch() int {
+	s.t.Helper()
+
+	attempted, err := s.app.Webhooks.Dispatch(context.Background())
+	if err != nil {
+		s.t.Fatalf("dispatch webhooks: %v", err)
+	}
+	return attempted
+}
+
+// deliveries fetches a page of the delivery log of webhook id.
+func (s *testServer) deliveries(id, query string) (*httptest.ResponseRecorder, []map[string]interface{}, map[string]interface{}) {
+	s.t.Helper()
+
+	rec, body := s.do(http.MethodGet, "/api/v1/admin/webhooks/"+id+"/deliveries?"+query, nil)
+	var deliveries []map[string]interface{}
+	list, _ := body["deliveries"].([]interface{})
+	for _, delivery := range list {
+		deliveries = append(deliveries, delivery.(map[string]interface{}))
+	}
+	return rec, deliveries, body
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOWED_NETWORKS", "127.0.0.0/8")
+	s := newTestServer(t)
+	s.loginAsAdmin()
+	receiver := newWebhookReceiver(t)
+
+	rec, body := s.do(http.MethodPost, "/api/v1/admin/webhooks", map[string]interface{}{
+		"url":    receiver.URL + "/hooks",
+		"events": []string{"user.created", "user.status_changed"},
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (body %v)", rec.Code, body)
+	}
+	subscription := body["webhook"].(map[string]interface{})
+	id, secret := subscription["id"].(string), subscription["secret"].(string)
+	if !strings.HasPrefix(secret, "whsec_") {
+		t.Fatalf("expected a generated secret, got %v", subscription)
+	}
+	for _, invalid := range []map[string]interface{}{
+		{"url": "ftp://example.com", "events": []string{"user.created"}},
+		{"url": receiver.URL, "events": []string{"user.phone_changed"}},
+		{"url": receiver.URL, "events": []string{}},
+		{"url": receiver.URL, "events": []string{"user.created"}, "secret": "short"},
+	} {
+		rec, body := s.do(http.MethodPost, "/api/v1/admin/webhooks", invalid)
+		assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	}
+	_, body = s.do(http.MethodGet, "/api/v1/admin/webhooks", nil)
+	if list := body["webhooks"].([]interface{}); len(list) != 1 || list[0].(map[string]interface{})["secret"] != nil {
+		t.Fatalf("expected the webhook without its secret, got %v", body)
+	}
+
+	number := "09120000951"
+	user := s.signUp(number)
+	if rec, body := s.setStatus(number, map[string]interface{}{"status": "suspended", "reason": "chargeback"}); rec.Code != http.StatusOK {
+		t.Fatalf("suspend: status %d, body %v", rec.Code, body)
+	}
+	if attempted := s.dispatch(); attempted != 2 {
+		t.Fatalf("expected the creation and the suspension to be delivered, got %d deliveries", attempted)
+	}
+	if attempted := s.dispatch(); attempted != 0 {
+		t.Fatalf("expected nothing left to deliver, got %d deliveries", attempted)
+	}
+
+	events := make(map[string]map[string]interface{})
+	for _, request := range receiver.received() {
+		if err := webhook.Verify(secret, request.header.Get(webhook.SignatureHeader), request.body, 5*time.Minute, time.Now()); err != nil {
+			t.Fatalf("expected a valid signature, got %v", err)
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal(request.body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if request.header.Get(webhook.EventHeader) != event["type"] || request.header.Get(webhook.DeliveryHeader) == "" {
+			t.Fatalf("unexpected headers %v for %v", request.header, event)
+		}
+		events[event["type"].(string)] = event["data"].(map[string]interface{})
+	}
+	created, suspended := events["user.created"], events["user.status_changed"]
+	if created == nil || created["id"] != user["id"] || created["phone"] != e164(number) {
+		t.Fatalf("unexpected user.created event %v", events)
+	}
+	if suspended == nil || suspended["status"] != "suspended" || suspended["status_reason"] != "chargeback" {
+		t.Fatalf("unexpected user.status_changed event %v", events)
+	}
+	for _, data := range events {
+		if data["access_token"] != nil || data["refresh_token"] != nil {
+			t.Fatalf("expected no tokens in events, got %v", data)
+		}
+	}
+
+	// A signature only holds for its body and, against replays, for a while.
+	request := receiver.received()[0]
+	signature := request.header.Get(webhook.SignatureHeader)
+	if err := webhook.Verify("whsec_other", signature, request.body, 5*time.Minute, time.Now()); !errors.Is(err, webhook.ErrInvalidSignature) {
+		t.Fatalf("expected another secret to be refused, got %v", err)
+	}
+	if err := webhook.Verify(secret, signature, append(request.body, ' '), 5*time.Minute, time.Now()); !errors.Is(err, webhook.ErrInvalidSignature) {
+		t.Fatalf("expected a changed body to be refused, got %v", err)
+	}
+	if err := webhook.Verify(secret, signature, request.body, 5*time.Minute, time.Now().Add(time.Hour)); !errors.Is(err, webhook.ErrSignatureExpired) {
+		t.Fatalf("expected an old signature to be refused, got %v", err)
+	}
+
+	// The delivery log, newest first.
+	rec, deliveries, body := s.deliveries(id, "page_size=1")
+	if rec.Code != http.StatusOK || len(deliveries) != 1 || deliveries[0]["event_type"] != "user.status_changed" ||
+		deliveries[0]["status"] != "delivered" || deliveries[0]["attempts"] != float64(1) || deliveries[0]["last_status_code"] != float64(200) {
+		t.Fatalf("unexpected first page %d %v", rec.Code, body)
+	}
+	if payload := deliveries[0]["payload"].(map[string]interface{}); payload["type"] != "user.status_changed" {
+		t.Fatalf("expected the payload in the log, got %v", payload)
+	}
+	_, deliveries, body = s.deliveries(id, "page_size=1&cursor="+url.QueryEscape(body["next_cursor"].(string)))
+	if len(deliveries) != 1 || deliveries[0]["event_type"] != "user.created" || body["next_cursor"] != "" {
+		t.Fatalf("unexpected second page %v", body)
+	}
+	if _, deliveries, _ := s.deliveries(id, "status=dead"); len(deliveries) != 0 {
+		t.Fatalf("expected no dead deliveries, got %v", deliveries)
+	}
+	rec, _, body = s.deliveries(id, "cursor=nonsense")
+	assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidCursor)
+
+	if rec, _ := s.do(http.MethodDelete, "/api/v1/admin/webhooks/"+id, nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	rec, _, body = s.deliveries(id, "")
+	assertError(t, rec, body, http.StatusNotFound, apperrors.ErrWebhookNotFound)
+	rec, body = s.do(http.MethodDelete, "/api/v1/admin/webhooks/"+id, nil)
+	assertError(t, rec, body, http.StatusNotFound, apperrors.ErrWebhookNotFound)
+
+	s.setStatus(number, map[string]interface{}{"status": "active", "reason": "appeal"})
+	if attempted := s.dispatch(); attempted != 0 {
+		t.Fatalf("expected no deliveries once unsubscribed, got %d", attempted)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	t.Setenv("WEBHOOK_RETRY_BASE", "100ms")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "3")
+	t.Setenv("WEBHOOK_ALLOWED_NETWORKS", "127.0.0.0/8")
+	s := newTestServer(t)
+	s.loginAsAdmin()
+	receiver := newWebhookReceiver(t)
+	receiver.answer(http.StatusServiceUnavailable)
+
+	_, body := s.do(http.MethodPost, "/api/v1/admin/webhooks", map[string]interface{}{
+		"url":    receiver.URL,
+		"events": []string{"user.logged_in"},
+		"secret": "a-secret-of-our-own",
+	})
+	id := body["webhook"].(map[string]interface{})["id"].(string)
+	s.signUp("09120000952")
+
+	delivery := func() map[string]interface{} {
+		t.Helper()
+		_, deliveries, body := s.deliveries(id, "")
+		if len(deliveries) != 1 {
+			t.Fatalf("expected one delivery, got %v", body)
+		}
+		return deliveries[0]
+	}
+
+	// Attempts back off: 100ms after the first failure, 200ms after the second.
+	for attempt, wait := range []time.Duration{0, 150 * time.Millisecond, 250 * time.Millisecond} {
+		time.Sleep(wait)
+		if attempted := s.dispatch(); attempted != 1 {
+			t.Fatalf("attempt %d: expected the delivery to be due, got %d", attempt+1, attempted)
+		}
+		if attempted := s.dispatch(); attempted != 0 {
+			t.Fatalf("attempt %d: expected the retry to wait, got %d", attempt+1, attempted)
+		}
+	}
+	dead := delivery()
+	if dead["status"] != "dead" || dead["attempts"] != float64(3) || dead["last_status_code"] != float64(503) || dead["last_error"] == nil {
+		t.Fatalf("expected the delivery to be dead after 3 attempts, got %v", dead)
+	}
+	if _, deliveries, _ := s.deliveries(id, "status=dead"); len(deliveries) != 1 {
+		t.Fatalf("expected the dead delivery to be listed, got %v", deliveries)
+	}
+
+	// Once the endpoint is fixed, dead deliveries can be replayed.
+	receiver.answer(http.StatusNoContent)
+	rec, body := s.do(http.MethodPost, "/api/v1/admin/webhooks/"+id+"/deliveries/"+dead["id"].(string)+"/redeliver", nil)
+	if rec.Code != http.StatusAccepted || body["delivery"].(map[string]interface{})["status"] != "pending" {
+		t.Fatalf("expected the delivery to be queued again, got %d %v", rec.Code, body)
+	}
+	if attempted := s.dispatch(); attempted != 1 {
+		t.Fatalf("expected the redelivery to be attempted, got %d", attempted)
+	}
+	if replayed := delivery(); replayed["status"] != "delivered" || replayed["attempts"] != float64(1) {
+		t.Fatalf("expected the delivery to be delivered, got %v", replayed)
+	}
+
+	received := receiver.received()
+	if len(received) != 4 {
+		t.Fatalf("expected 4 attempts, got %d", len(received))
+	}
+	for _, request := range received {
+		if request.header.Get(webhook.DeliveryHeader) != dead["id"] || !bytes.Equal(request.body, received[0].body) {
+			t.Fatalf("expected every attempt to send the same delivery, got %v", request.header)
+		}
+		if err := webhook.Verify("a-secret-of-our-own", request.header.Get(webhook.SignatureHeader), request.body, time.Minute, time.Now()); err != nil {
+			t.Fatalf("expected the given secret to sign, got %v", err)
+		}
+	}
+
+	rec, body = s.do(http.MethodPost, "/api/v1/admin/webhooks/"+id+"/deliveries/dlv_unknown/redeliver", nil)
+	assertError(t, rec, body, http.StatusNotFound, apperrors.ErrDeliveryNotFound)
+}
+
+func TestWebhookInternalAddresses(t *testing.T) {
+	s := newTestServer(t)
+	s.loginAsAdmin()
+	receiver := newWebhookReceiver(t)
+
+	for _, endpoint := range []string{receiver.URL, "http://169.254.169.254/latest/meta-data", "http://10.0.0.1/hooks", "http://[::1]/hooks", "http://0.0.0.0/hooks"} {
+		rec, body := s.do(http.MethodPost, "/api/v1/admin/webhooks", map[string]interface{}{"url": endpoint, "events": []string{"user.created"}})
+		assertError(t, rec, body, http.StatusBadRequest, apperrors.ErrInvalidRequest)
+	}
+
+	// Names are checked once resolved: the attempt fails without reaching the endpoint.
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(receiver.URL, "http://"))
+	rec, body := s.do(http.MethodPost, "/api/v1/admin/webhooks", map[string]interface{}{
+		"url":    "http://localhost:" + port + "/hooks",
+		"events": []string{"user.created"},
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d (body %v)", rec.Code, body)
+	}
+	id := body["webhook"].(map[string]interface{})["id"].(string)
+	s.signUp("09120000961")
+	if attempted := s.dispatch(); attempted != 1 {
+		t.Fatalf("expected one delivery, got %d", attempted)
+	}
+	_, deliveries, body := s.deliveries(id, "")
+	if len(deliveries) != 1 || deliveries[0]["status"] != "pending" || !strings.Contains(fmt.Sprint(deliveries[0]["last_error"]), "not allowed") {
+		t.Fatalf("expected the attempt to be refused, got %v", body)
+	}
+	if received := receiver.received(); len(received) != 0 {
+		t.Fatalf("expected nothing to reach the endpoint, got %d requests", len(received))
+	}
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/challenge"
+	"authentication/pkg/i18n"
+	"authentication/pkg/tracing"
+	"authentication/utils/logger"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+const problemContentType = "application/problem+json"
+
+// ProblemTypeBase prefixes error codes to form the RFC 7807 "type" URI of a problem.
+const ProblemTypeBase = "/problems/"
+
+// errorStatus maps error codes to HTTP statuses. Codes missing here are answered with 400.
+var errorStatus = map[string]int{
+	apperrors.ErrUnauthenticated.Code:     http.StatusUnauthorized,
+	apperrors.ErrForbidden.Code:           http.StatusForbidden,
+	apperrors.ErrOTPInvalid.Code:          http.StatusUnauthorized,
+	apperrors.ErrUserNotFound.Code:        http.StatusNotFound,
+	apperrors.ErrOTPAlreadySent.Code:      http.StatusConflict,
+	apperrors.ErrRateLimited.Code:         http.StatusTooManyRequests,
+	apperrors.ErrAccountSuspended.Code:    http.StatusForbidden,
+	apperrors.ErrAccountBanned.Code:       http.StatusForbidden,
+	apperrors.ErrAccountDeleted.Code:      http.StatusForbidden,
+	apperrors.ErrInvalidRefreshToken.Code: http.StatusUnauthorized,
+	apperrors.ErrSessionRevoked.Code:      http.StatusUnauthorized,
+	apperrors.ErrCountryNotAllowed.Code:   http.StatusForbidden,
+	apperrors.ErrDestinationBlocked.Code:  http.StatusTooManyRequests,
+	apperrors.ErrChallengeRequired.Code:   http.StatusForbidden,
+	apperrors.ErrChallengeFailed.Code:     http.StatusForbidden,
+	apperrors.ErrWebhookNotFound.Code:     http.StatusNotFound,
+	apperrors.ErrDeliveryNotFound.Code:    http.StatusNotFound,
+	apperrors.ErrInternal.Code:            http.StatusInternalServerError,
+	apperrors.ErrUnavailable.Code:         http.StatusServiceUnavailable,
+}
+
+// legacyErrors switches error bodies back to the bilingual {en_message, fa_message} shape.
+var legacyErrors bool
+
+// UseLegacyErrors is the compatibility switch for clients that still parse the bilingual
+// error bodies. Statuses and the code field are the same in both formats.
+func UseLegacyErrors(enabled bool) {
+	legacyErrors = enabled
+}
+
+// Problem is the RFC 7807 body of an error response.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	// TraceID finds the request in the tracing backend.
+	TraceID string `json:"trace_id,omitempty"`
+	// RetryAfter is in whole seconds.
+	RetryAfter int64 `json:"retry_after,omitempty"`
+	// Errors lists the offending fields of an invalid request.
+	Errors []FieldError `json:"errors,omitempty"`
+	// Challenge is what to solve before retrying a request refused with challenge_required.
+	Challenge *challenge.Challenge `json:"challenge,omitempty"`
+}
+
+// AbortWithError answers the request with the client-facing form of err. Errors that are
+// not domain errors are treated as internal: they are logged and hidden behind a 500, or
+// a 503 when the cause is that a backend could not be reached.
+func AbortWithError(c *gin.Context, err error) {
+	appErr := apperrors.As(err)
+	if appErr.Code == apperrors.ErrInternal.Code {
+		if unavailable(err) {
+			appErr = apperrors.ErrUnavailable.Wrap(err)
+		}
+		logger.LogErrorWithDepth(map[string]interface{}{
+			"error":   err,
+			"depth":   2,
+			"message": "An Error Occurred",
+			"context": c,
+		})
+	}
+
+	status, ok := errorStatus[appErr.Code]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	retryAfter := seconds(appErr.RetryAfter)
+	if retryAfter > 0 {
+		c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+
+	// A challenge travels as the cause of the error, see services.ChallengeGuard.
+	var required *challenge.Required
+	errors.As(appErr.Err, &required)
+
+	if legacyErrors {
+		body := gin.H{
+			"code":       appErr.Code,
+			"fa_message": errorTitle("fa", appErr),
+			"en_message": errorTitle("en", appErr),
+		}
+		if required != nil {
+			body["challenge"] = required.Challenge
+		}
+		c.AbortWithStatusJSON(status, body)
+		return
+	}
+
+	locale := i18n.FromContext(c)
+	problem := Problem{
+		Type:       ProblemTypeBase + appErr.Code,
+		Title:      errorTitle(locale, appErr),
+		Status:     status,
+		Detail:     problemDetail(locale, appErr, retryAfter),
+		Instance:   c.Request.URL.Path,
+		Code:       appErr.Code,
+		RequestID:  c.GetString("request_id"),
+		TraceID:    tracing.TraceID(c),
+		RetryAfter: retryAfter,
+	}
+	if required != nil {
+		problem.Challenge = &required.Challenge
+	}
+	if appErr.Code == apperrors.ErrInvalidRequest.Code {
+		problem.Errors = fieldErrors(locale, appErr.Err)
+		if len(problem.Errors) > 0 {
+			problem.Detail = i18n.T(locale, "errors.invalid_request.detail", i18n.Args{"count": len(problem.Errors)})
+		}
+	}
+
+	c.Abort()
+	c.Header("Content-Type", problemContentType)
+	c.JSON(status, problem)
+}
+
+// errorTitle is the translated summary of the error's code, or its built-in English
+// message for codes the catalogs do not know.
+func errorTitle(locale string, appErr *apperrors.Error) string {
+	key := "errors." + appErr.Code
+	if title := i18n.T(locale, key, nil); title != key {
+		return title
+	}
+	return appErr.Message
+}
+
+// problemDetail explains this occurrence of the problem. Only request errors carry a cause
+// that is meant for the client; every other cause stays in the logs.
+func problemDetail(locale string, appErr *apperrors.Error, retryAfter int64) string {
+	if appErr.Code == apperrors.ErrInvalidRequest.Code && appErr.Err != nil {
+		return appErr.Err.Error()
+	}
+	if retryAfter > 0 {
+		key := "errors." + appErr.Code + ".detail"
+		if detail := i18n.T(locale, key, i18n.Args{"count": retryAfter}); detail != key {
+			return detail
+		}
+	}
+	return errorTitle(locale, appErr)
+}
+
+// unavailable reports whether err means Redis, or another backend, could not be reached.
+func unavailable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, redis.ErrClosed) ||
+		errors.Is(err, redis.ErrPoolTimeout)
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"authentication/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FraudAPI interface {
+	Prefixes(c *gin.Context)
+	Prefix(c *gin.Context)
+	ResetPrefix(c *gin.Context)
+}
+
+type fraudAPI struct {
+	fraudGuard services.FraudGuard
+}
+
+func NewFraudAPI(fraudGuard services.FraudGuard) FraudAPI {
+	return &fraudAPI{fraudGuard}
+}
+
+// Prefixes godoc
+// @Summary SMS fraud counters of today
+// @Description Codes sent today (UTC) per country, and codes sent, logins and block of every prefix codes were sent to. Admin only.
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/fraud/prefixes [get]
+func (api fraudAPI) Prefixes(c *gin.Context) {
+	stats, err := api.fraudGuard.Stats(c)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+
+	prefixes := make([]gin.H, len(stats.Prefixes))
+	for i, status := range stats.Prefixes {
+		prefixes[i] = prefixBody(status)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"day":       stats.Day,
+		"countries": stats.Countries,
+		"prefixes":  prefixes,
+	})
+}
+
+// Prefix godoc
+// @Summary SMS fraud counters of a prefix
+// @Description Codes sent today (UTC), logins and block of a prefix such as +98912. Admin only.
+// @Tags Admin
+// @Produce json
+// @Param prefix path string true "Phone number prefix"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/fraud/prefixes/{prefix} [get]
+func (api fraudAPI) Prefix(c *gin.Context) {
+	status, err := api.fraudGuard.PrefixStatus(c, c.Param("prefix"))
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"prefix": prefixBody(status)})
+}
+
+// ResetPrefix godoc
+// @Summary Unblock a prefix
+// @Description Lifts the block of a prefix and starts its counters of today from zero. Admin only.
+// @Tags Admin
+// @Produce json
+// @Param prefix path string true "Phone number prefix"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/fraud/prefixes/{prefix} [delete]
+func (api fraudAPI) ResetPrefix(c *gin.Context) {
+	if err := api.fraudGuard.ResetPrefix(c, c.Param("prefix")); err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	api.Prefix(c)
+}
+
+func prefixBody(status services.PrefixStatus) gin.H {
+	body := gin.H{
+		"prefix":     status.Prefix,
+		"sent":       status.Sent,
+		"logins":     status.Logins,
+		"conversion": status.Conversion(),
+		"blocked":    status.BlockReason != "",
+	}
+	if status.BlockReason != "" {
+		body["block_reason"] = status.BlockReason
+		if status.BlockedFor > 0 {
+			body["blocked_for"] = seconds(status.BlockedFor)
+		}
+	}
+	return body
+}
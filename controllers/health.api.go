@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"authentication/pkg/health"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type HealthAPI interface {
+	Live(c *gin.Context)
+	Ready(c *gin.Context)
+}
+
+type healthAPI struct {
+	checker *health.Checker
+}
+
+func NewHealthAPI(checker *health.Checker) HealthAPI {
+	return &healthAPI{checker}
+}
+
+// Live godoc
+// @Summary Liveness
+// @Description Answers as long as the process serves HTTP, whatever the state of its dependencies. A failure means the process should be restarted.
+// @Tags Health
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Router /healthz [get]
+func (api healthAPI) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": health.StatusOK})
+}
+
+// Ready godoc
+// @Summary Readiness
+// @Description Checks every dependency (Redis, the JWT signing keys, the SMS sender) and answers 503 with the status of each while one fails or the service is still starting. Load balancers should only send traffic to ready instances.
+// @Tags Health
+// @Produce json
+// @Success 200 {object} health.Report
+// @Failure 503 {object} health.Report
+// @Router /readyz [get]
+func (api healthAPI) Ready(c *gin.Context) {
+	report := api.checker.Ready(c)
+	status := http.StatusOK
+	if report.Status != health.StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
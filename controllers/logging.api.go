@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/requests"
+	"authentication/utils/logger"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LoggingAPI interface {
+	Level(c *gin.Context)
+	SetLevel(c *gin.Context)
+}
+
+type loggingAPI struct{}
+
+func NewLoggingAPI() LoggingAPI {
+	return loggingAPI{}
+}
+
+// Level godoc
+// @Summary Log level
+// @Description The level the service logs at. Admin only.
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/logging/level [get]
+func (api loggingAPI) Level(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level()})
+}
+
+// SetLevel godoc
+// @Summary Change the log level
+// @Description Changes the level the service logs at until it restarts, for instance to debug an incident without a redeploy. Admin only.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param request body requests.LogLevel true "New level"
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/logging/level [put]
+func (api loggingAPI) SetLevel(c *gin.Context) {
+	var request requests.LogLevel
+	if err := c.ShouldBindJSON(&request); err != nil {
+		AbortWithError(c, apperrors.ErrInvalidRequest.Wrap(err))
+		return
+	}
+	if err := logger.SetLevel(request.Level); err != nil {
+		AbortWithError(c, apperrors.ErrInvalidRequest.Wrap(err))
+		return
+	}
+
+	logger.FromContext(c).Warn().Str("handle", "LOGGING").Str("level", request.Level).Msg("log level changed")
+	c.JSON(http.StatusOK, gin.H{"level": logger.Level()})
+}
@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"authentication/pkg/i18n"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError tells the client which field of a request broke which rule.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// fieldErrors lists the field-level failures behind a request error, translated into
+// locale. Errors that are not about a particular field, like malformed JSON, yield none.
+func fieldErrors(locale string, err error) []FieldError {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		list := make([]FieldError, 0, len(validationErrs))
+		for _, fe := range validationErrs {
+			field := fieldPath(fe.Namespace())
+			list = append(list, FieldError{
+				Field:   field,
+				Rule:    fe.Tag(),
+				Message: validationMessage(locale, field, fe),
+			})
+		}
+		return list
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return []FieldError{{
+			Field:   typeErr.Field,
+			Rule:    "type",
+			Message: i18n.T(locale, "validation.type", i18n.Args{"field": typeErr.Field}),
+		}}
+	}
+	return nil
+}
+
+// fieldPath drops the struct name the validator puts in front of every field.
+func fieldPath(namespace string) string {
+	if _, path, found := strings.Cut(namespace, "."); found {
+		return path
+	}
+	return namespace
+}
+
+// validationMessage looks for the most specific message: the rule for the field's kind
+// (validation.max.string), then the rule (validation.max), then a generic one.
+func validationMessage(locale, field string, fe validator.FieldError) string {
+	args := i18n.Args{"field": field, "param": fe.Param()}
+	if count, err := strconv.ParseInt(fe.Param(), 10, 64); err == nil {
+		args["count"] = count
+	}
+
+	keys := []string{"validation." + fe.Tag()}
+	switch fe.Kind() {
+	case reflect.String:
+		keys = append([]string{"validation." + fe.Tag() + ".string"}, keys...)
+	case reflect.Map, reflect.Slice, reflect.Array:
+		keys = append([]string{"validation." + fe.Tag() + ".map"}, keys...)
+	}
+
+	for _, key := range keys {
+		if message := i18n.T(locale, key, args); message != key {
+			return message
+		}
+	}
+	return i18n.T(locale, "validation.invalid", args)
+}
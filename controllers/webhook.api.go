@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/requests"
+	"authentication/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookAPI interface {
+	Subscribe(c *gin.Context)
+	Subscriptions(c *gin.Context)
+	Unsubscribe(c *gin.Context)
+	Deliveries(c *gin.Context)
+	Redeliver(c *gin.Context)
+}
+
+type webhookAPI struct {
+	webhooks services.WebhookService
+}
+
+func NewWebhookAPI(webhooks services.WebhookService) WebhookAPI {
+	return &webhookAPI{webhooks}
+}
+
+// Subscribe godoc
+// @Summary Register a webhook
+// @Description Sends the events of the given types to url as signed JSON POSTs. The secret signs them; without one, one is generated. It is only shown in this response. Endpoints on loopback, link-local or private addresses are refused unless WEBHOOK_ALLOWED_NETWORKS allows them. Admin only.
+// @Tags Admin
+// @Accept json
+// @Produce json
+// @Param request body requests.WebhookSubscription true "Endpoint, event types and secret"
+// @Security BearerAuth
+// @Success 201 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/webhooks [post]
+func (api webhookAPI) Subscribe(c *gin.Context) {
+	var request requests.WebhookSubscription
+	if err := c.ShouldBindJSON(&request); err != nil {
+		AbortWithError(c, apperrors.ErrInvalidRequest.Wrap(err))
+		return
+	}
+
+	subscription, err := api.webhooks.Subscribe(c, request)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"webhook": subscription})
+}
+
+// Subscriptions godoc
+// @Summary List webhooks
+// @Description The registered webhooks, oldest first, without their secrets. Admin only.
+// @Tags Admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Router /api/v1/admin/webhooks [get]
+func (api webhookAPI) Subscriptions(c *gin.Context) {
+	subscriptions, err := api.webhooks.Subscriptions(c)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": subscriptions})
+}
+
+// Unsubscribe godoc
+// @Summary Delete a webhook
+// @Description Stops sending events to the webhook, and deletes its delivery log. Admin only.
+// @Tags Admin
+// @Param id path string true "Webhook ID"
+// @Security BearerAuth
+// @Success 204
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 404 {object} controllers.Problem
+// @Router /api/v1/admin/webhooks/{id} [delete]
+func (api webhookAPI) Unsubscribe(c *gin.Context) {
+	if err := api.webhooks.Unsubscribe(c, c.Param("id")); err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Deliveries godoc
+// @Summary Delivery log of a webhook
+// @Description The deliveries of a webhook, newest first, with their payload, attempts and last error. Dead deliveries failed every attempt. Follow next_cursor for further pages. Admin only.
+// @Tags Admin
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Param cursor query string false "Opaque cursor from the previous response's next_cursor"
+// @Param page_size query int false "Number of deliveries per page (default 20, max 100)"
+// @Param status query string false "Status" Enums(pending, delivered, dead)
+// @Security BearerAuth
+// @Success 200 {object} map[string]interface{}
+// @Failure 400 {object} controllers.Problem
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 404 {object} controllers.Problem
+// @Router /api/v1/admin/webhooks/{id}/deliveries [get]
+func (api webhookAPI) Deliveries(c *gin.Context) {
+	var request requests.WebhookDeliveries
+	if err := c.ShouldBindQuery(&request); err != nil {
+		AbortWithError(c, apperrors.ErrInvalidRequest.Wrap(err))
+		return
+	}
+
+	page, err := api.webhooks.Deliveries(c, c.Param("id"), request)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"page_size":   request.Limit(),
+		"next_cursor": page.NextCursor,
+		"deliveries":  page.Deliveries,
+	})
+}
+
+// Redeliver godoc
+// @Summary Redeliver a webhook event
+// @Description Queues a delivery again, with a fresh set of attempts, such as a dead one once its endpoint is fixed. Admin only.
+// @Tags Admin
+// @Produce json
+// @Param id path string true "Webhook ID"
+// @Param delivery path string true "Delivery ID"
+// @Security BearerAuth
+// @Success 202 {object} map[string]interface{}
+// @Failure 401 {object} controllers.Problem
+// @Failure 403 {object} controllers.Problem
+// @Failure 404 {object} controllers.Problem
+// @Router /api/v1/admin/webhooks/{id}/deliveries/{delivery}/redeliver [post]
+func (api webhookAPI) Redeliver(c *gin.Context) {
+	delivery, err := api.webhooks.Redeliver(c, c.Param("id"), c.Param("delivery"))
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"delivery": delivery})
+}
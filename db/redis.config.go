@@ -0,0 +1,247 @@
+package db
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+// RedisConfig describes how to reach Redis. It is read from REDIS_* environment variables,
+// see the README for the full list.
+type RedisConfig struct {
+	Mode       string
+	Addrs      []string
+	MasterName string
+
+	Username         string
+	Password         string
+	SentinelUsername string
+	SentinelPassword string
+	DB               int
+
+	TLSEnabled            bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	PoolSize        int
+	MinIdleConns    int
+	MaxIdleConns    int
+	PoolTimeout     time.Duration
+	ConnMaxIdleTime time.Duration
+	DialTimeout     time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	MaxRetries      int
+}
+
+func RedisConfigFromEnv() (RedisConfig, error) {
+	var err error
+	config := RedisConfig{
+		Mode:                  strings.ToLower(envOr("REDIS_MODE", RedisModeStandalone)),
+		MasterName:            os.Getenv("REDIS_MASTER_NAME"),
+		Username:              os.Getenv("REDIS_USERNAME"),
+		Password:              os.Getenv("REDIS_PASSWORD"),
+		SentinelUsername:      os.Getenv("REDIS_SENTINEL_USERNAME"),
+		SentinelPassword:      os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		TLSCAFile:             os.Getenv("REDIS_TLS_CA_FILE"),
+		TLSCertFile:           os.Getenv("REDIS_TLS_CERT_FILE"),
+		TLSKeyFile:            os.Getenv("REDIS_TLS_KEY_FILE"),
+		TLSServerName:         os.Getenv("REDIS_TLS_SERVER_NAME"),
+		TLSEnabled:            envBool("REDIS_TLS_ENABLED", &err),
+		TLSInsecureSkipVerify: envBool("REDIS_TLS_INSECURE_SKIP_VERIFY", &err),
+		DB:                    envInt("REDIS_DB", &err),
+		PoolSize:              envInt("REDIS_POOL_SIZE", &err),
+		MinIdleConns:          envInt("REDIS_MIN_IDLE_CONNS", &err),
+		MaxIdleConns:          envInt("REDIS_MAX_IDLE_CONNS", &err),
+		MaxRetries:            envInt("REDIS_MAX_RETRIES", &err),
+		PoolTimeout:           envDuration("REDIS_POOL_TIMEOUT", &err),
+		ConnMaxIdleTime:       envDuration("REDIS_CONN_MAX_IDLE_TIME", &err),
+		DialTimeout:           envDuration("REDIS_DIAL_TIMEOUT", &err),
+		ReadTimeout:           envDuration("REDIS_READ_TIMEOUT", &err),
+		WriteTimeout:          envDuration("REDIS_WRITE_TIMEOUT", &err),
+	}
+	if err != nil {
+		return config, err
+	}
+
+	if addrs := os.Getenv("REDIS_ADDRS"); addrs != "" {
+		for _, addr := range strings.Split(addrs, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				config.Addrs = append(config.Addrs, addr)
+			}
+		}
+	} else {
+		config.Addrs = []string{os.Getenv("REDIS_HOST") + ":" + os.Getenv("REDIS_PORT")}
+	}
+
+	// Any TLS material implies TLS, so a CA file alone is enough to switch it on.
+	if config.TLSCAFile != "" || config.TLSCertFile != "" || config.TLSServerName != "" {
+		config.TLSEnabled = true
+	}
+
+	return config, config.Validate()
+}
+
+func (c RedisConfig) Validate() error {
+	if len(c.Addrs) == 0 {
+		return fmt.Errorf("redis: no address configured, set REDIS_ADDRS or REDIS_HOST/REDIS_PORT")
+	}
+	for _, addr := range c.Addrs {
+		if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+			return fmt.Errorf("redis: invalid address %q, set REDIS_ADDRS or REDIS_HOST/REDIS_PORT", addr)
+		}
+	}
+
+	switch c.Mode {
+	case RedisModeStandalone:
+		if len(c.Addrs) > 1 {
+			return fmt.Errorf("redis: standalone mode takes a single address, got %d", len(c.Addrs))
+		}
+	case RedisModeSentinel:
+		if c.MasterName == "" {
+			return fmt.Errorf("redis: sentinel mode requires REDIS_MASTER_NAME")
+		}
+	case RedisModeCluster:
+		if c.DB != 0 {
+			return fmt.Errorf("redis: cluster mode only supports DB 0, got %d", c.DB)
+		}
+	default:
+		return fmt.Errorf("redis: unknown REDIS_MODE %q", c.Mode)
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("redis: REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+
+	return nil
+}
+
+// UniversalOptions translates the config into go-redis options. The mode is explicit,
+// so a single sentinel address is never mistaken for a standalone server and vice versa.
+func (c RedisConfig) UniversalOptions() (*redis.UniversalOptions, error) {
+	options := &redis.UniversalOptions{
+		Addrs:            c.Addrs,
+		Username:         c.Username,
+		Password:         c.Password,
+		SentinelUsername: c.SentinelUsername,
+		SentinelPassword: c.SentinelPassword,
+		DB:               c.DB,
+		PoolSize:         c.PoolSize,
+		MinIdleConns:     c.MinIdleConns,
+		MaxIdleConns:     c.MaxIdleConns,
+		PoolTimeout:      c.PoolTimeout,
+		ConnMaxIdleTime:  c.ConnMaxIdleTime,
+		DialTimeout:      c.DialTimeout,
+		ReadTimeout:      c.ReadTimeout,
+		WriteTimeout:     c.WriteTimeout,
+		MaxRetries:       c.MaxRetries,
+	}
+
+	switch c.Mode {
+	case RedisModeSentinel:
+		options.MasterName = c.MasterName
+	case RedisModeCluster:
+		options.IsClusterMode = true
+	}
+
+	if c.TLSEnabled {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+
+	return options, nil
+}
+
+func (c RedisConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+	}
+
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis: read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("redis: no certificates found in %s", c.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.TLSCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("redis: load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// The env helpers below keep the first parse error in err so RedisConfigFromEnv can report it once.
+
+func envInt(name string, err *error) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	parsed, parseErr := strconv.Atoi(value)
+	if parseErr != nil && *err == nil {
+		*err = fmt.Errorf("redis: invalid %s: %w", name, parseErr)
+	}
+	return parsed
+}
+
+func envBool(name string, err *error) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+	parsed, parseErr := strconv.ParseBool(value)
+	if parseErr != nil && *err == nil {
+		*err = fmt.Errorf("redis: invalid %s: %w", name, parseErr)
+	}
+	return parsed
+}
+
+func envDuration(name string, err *error) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	parsed, parseErr := time.ParseDuration(value)
+	if parseErr != nil && *err == nil {
+		*err = fmt.Errorf("redis: invalid %s: %w", name, parseErr)
+	}
+	return parsed
+}
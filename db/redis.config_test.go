@@ -0,0 +1,82 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedisConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RedisConfig
+		err    string
+	}{
+		{name: "standalone", config: RedisConfig{Mode: RedisModeStandalone, Addrs: []string{"redis:6379"}}},
+		{name: "no address", config: RedisConfig{Mode: RedisModeStandalone}, err: "no address"},
+		{name: "unset host and port", config: RedisConfig{Mode: RedisModeStandalone, Addrs: []string{":"}}, err: "invalid address"},
+		{name: "no port", config: RedisConfig{Mode: RedisModeStandalone, Addrs: []string{"redis:"}}, err: "invalid address"},
+		{name: "no host", config: RedisConfig{Mode: RedisModeStandalone, Addrs: []string{":6379"}}, err: "invalid address"},
+		{name: "standalone with many", config: RedisConfig{Mode: RedisModeStandalone, Addrs: []string{"a:6379", "b:6379"}}, err: "single address"},
+		{name: "sentinel", config: RedisConfig{Mode: RedisModeSentinel, Addrs: []string{"a:26379", "b:26379"}, MasterName: "main"}},
+		{name: "sentinel without master", config: RedisConfig{Mode: RedisModeSentinel, Addrs: []string{"a:26379"}}, err: "REDIS_MASTER_NAME"},
+		{name: "cluster", config: RedisConfig{Mode: RedisModeCluster, Addrs: []string{"a:7000", "b:7001"}}},
+		{name: "cluster with db", config: RedisConfig{Mode: RedisModeCluster, Addrs: []string{"a:7000"}, DB: 1}, err: "DB 0"},
+		{name: "unknown mode", config: RedisConfig{Mode: "ring", Addrs: []string{"a:6379"}}, err: "unknown REDIS_MODE"},
+		{name: "cert without key", config: RedisConfig{Mode: RedisModeStandalone, Addrs: []string{"a:6379"}, TLSCertFile: "cert.pem"}, err: "set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("Validate() = %v, want nil", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRedisConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		addrs []string
+		tls   bool
+		err   string
+	}{
+		{name: "host and port", env: map[string]string{"REDIS_HOST": "redis", "REDIS_PORT": "6379"}, addrs: []string{"redis:6379"}},
+		{name: "nothing set", err: "invalid address"},
+		{name: "addrs", env: map[string]string{"REDIS_MODE": "Cluster", "REDIS_ADDRS": "a:7000, b:7001,"}, addrs: []string{"a:7000", "b:7001"}},
+		{name: "CA implies TLS", env: map[string]string{"REDIS_ADDRS": "a:6379", "REDIS_TLS_CA_FILE": "ca.pem"}, addrs: []string{"a:6379"}, tls: true},
+		{name: "invalid number", env: map[string]string{"REDIS_ADDRS": "a:6379", "REDIS_POOL_SIZE": "many"}, err: "REDIS_POOL_SIZE"},
+		{name: "invalid duration", env: map[string]string{"REDIS_ADDRS": "a:6379", "REDIS_DIAL_TIMEOUT": "5"}, err: "REDIS_DIAL_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"REDIS_HOST", "REDIS_PORT", "REDIS_ADDRS", "REDIS_MODE"} {
+				t.Setenv(name, "")
+			}
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			config, err := RedisConfigFromEnv()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("RedisConfigFromEnv() = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RedisConfigFromEnv() = %v", err)
+			}
+			if strings.Join(config.Addrs, ",") != strings.Join(tt.addrs, ",") {
+				t.Errorf("Addrs = %v, want %v", config.Addrs, tt.addrs)
+			}
+			if config.TLSEnabled != tt.tls {
+				t.Errorf("TLSEnabled = %v, want %v", config.TLSEnabled, tt.tls)
+			}
+		})
+	}
+}
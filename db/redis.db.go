@@ -3,25 +3,27 @@ package db
 import (
 	"context"
 	"github.com/redis/go-redis/v9"
-	"os"
 )
 
-func RedisClient() *redis.Client {
-	redisHost := os.Getenv("REDIS_HOST")
-	redisPort := os.Getenv("REDIS_PORT")
-
-	//redisHost := "localhost"
-	//redisPort := "6379"
-	//redisPassword := os.Getenv("REDIS_PASSWORD")
-
-	rdb := redis.NewClient(&redis.Options{
-		Addr: redisHost + ":" + redisPort,
-	})
+// RedisClient connects to a standalone server, a Sentinel-managed master or a cluster
+// depending on REDIS_MODE. Callers only see redis.UniversalClient, so they work with all three.
+// Connections are opened on first use: the client is returned even while Redis is down, see
+// Ping.
+func RedisClient() redis.UniversalClient {
+	config, err := RedisConfigFromEnv()
+	if err != nil {
+		panic(err)
+	}
 
-	_, err := rdb.Ping(context.Background()).Result()
+	options, err := config.UniversalOptions()
 	if err != nil {
 		panic(err)
 	}
 
-	return rdb
+	return redis.NewUniversalClient(options)
+}
+
+// Ping tells whether client reaches Redis.
+func Ping(ctx context.Context, client redis.UniversalClient) error {
+	return client.Ping(ctx).Err()
 }
@@ -3,32 +3,34 @@
 // @description This is a sample authentication service with OTP + JWT in Go + Gin.
 // @host localhost:8000
 // @BasePath /api/v1
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
 
 package main
 
 import (
-	"authentication/bootstrap"
-	_ "authentication/docs"
-	"authentication/middleware"
-	"authentication/routes"
-	"github.com/gin-gonic/gin"
-	swaggerFiles "github.com/swaggo/files"
-	ginSwagger "github.com/swaggo/gin-swagger"
+	"authentication/cli"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
+// main runs the command of the arguments, serving HTTP without one, until it is done or
+// the process gets SIGINT or SIGTERM.
 func main() {
-	r := gin.Default()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := (&cli.CLI{Out: os.Stdout}).Run(ctx, os.Args[1:])
+	stop()
 
-	r.Use(middleware.ErrorHandling())
-	app := bootstrap.InitAppContainer()
-	routes.Urls(r, app)
-
-	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-
-	gin.SetMode(gin.DebugMode)
-	err := r.Run(":8080")
-	if err != nil {
-		return
+	switch {
+	case errors.Is(err, cli.ErrUsage):
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
 	}
-
 }
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"authentication/utils/logger"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// AccessLog writes a line for every request once it is answered, to the request's logger:
+// at warn level for client errors and error level for server errors. It runs after
+// RequestID.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := zerolog.InfoLevel
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = zerolog.ErrorLevel
+		case status >= http.StatusBadRequest:
+			level = zerolog.WarnLevel
+		}
+
+		logger.FromContext(c).WithLevel(level).
+			Str("method", c.Request.Method).
+			Str("path", c.Request.URL.Path).
+			Str("route", c.FullPath()).
+			Int("status", status).
+			Float64("latency_ms", float64(time.Since(start).Microseconds())/1000).
+			Int("bytes", c.Writer.Size()).
+			Str("ip", c.ClientIP()).
+			Str("user_agent", c.Request.UserAgent()).
+			Msg("request")
+	}
+}
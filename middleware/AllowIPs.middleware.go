@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"authentication/controllers"
+	"authentication/pkg/apperrors"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AllowIPs refuses requests with ErrForbidden unless the client address, as ClientIP finds
+// it behind the trusted proxies, is in one of networks. It lets everything through when
+// networks is empty.
+func AllowIPs(networks []netip.Prefix) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(networks) == 0 {
+			c.Next()
+			return
+		}
+
+		if addr, err := netip.ParseAddr(c.ClientIP()); err == nil {
+			addr = addr.Unmap()
+			for _, network := range networks {
+				if network.Contains(addr) {
+					c.Next()
+					return
+				}
+			}
+		}
+		controllers.AbortWithError(c, apperrors.ErrForbidden)
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"authentication/pkg/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxUserAgent bounds what a client can make the audit log store.
+const maxUserAgent = 256
+
+// AuditClient records who sent the request for the audit log. It runs after RequestID.
+func AuditClient() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userAgent := c.Request.UserAgent()
+		if len(userAgent) > maxUserAgent {
+			userAgent = userAgent[:maxUserAgent]
+		}
+
+		c.Set(audit.ClientKey, audit.Client{
+			IP:        c.ClientIP(),
+			UserAgent: userAgent,
+			RequestID: c.GetString("request_id"),
+		})
+
+		c.Next()
+	}
+}
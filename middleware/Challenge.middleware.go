@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"authentication/controllers"
+	"authentication/services"
+	"authentication/utils/logger"
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChallengeHeader carries the client's solution of the challenge it was given.
+const ChallengeHeader = "X-Challenge-Token"
+
+// RiskCount says which requests to a route add to the risk of their phone and address.
+type RiskCount int
+
+const (
+	// CountAttempts counts every request, for routes like send_otp where many are suspicious.
+	CountAttempts RiskCount = iota
+	// CountFailures counts requests refused with 401, such as logins with a wrong code.
+	CountFailures
+)
+
+// Challenge asks the client for a solved challenge once the phone number of the request
+// body or the client IP is past the guard's risk threshold, and counts the request towards
+// it as count says.
+func Challenge(guard services.ChallengeGuard, count RiskCount) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		number, _ := bodyPhone(c)
+		var ip string
+		if addr, err := netip.ParseAddr(c.ClientIP()); err == nil {
+			ip = addr.Unmap().String()
+		}
+
+		if err := guard.Check(c, number, ip, c.GetHeader(ChallengeHeader)); err != nil {
+			controllers.AbortWithError(c, err)
+			return
+		}
+
+		c.Next()
+
+		if count == CountAttempts || c.Writer.Status() == http.StatusUnauthorized {
+			// The response is out already; a lost count only delays a challenge.
+			if err := guard.AddRisk(c, number, ip); err != nil {
+				logger.LogErrorWithDepth(map[string]interface{}{
+					"error":   err,
+					"depth":   1,
+					"message": "Risk of the request not counted",
+					"context": c,
+				})
+			}
+		}
+	}
+}
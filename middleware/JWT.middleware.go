@@ -1,34 +1,68 @@
 package middleware
 
 import (
+	"authentication/controllers"
+	"authentication/pkg/apperrors"
+	"authentication/pkg/i18n"
+	"authentication/pkg/tlsconfig"
+	"authentication/repositories"
 	"authentication/utils"
+	"context"
 	"github.com/gin-gonic/gin"
-	"net/http"
 	"strings"
 )
 
-func JWTAuthMiddleware() gin.HandlerFunc {
+// AccountChecker vets the account behind a valid token. It returns the account, or the
+// reason to refuse it.
+type AccountChecker interface {
+	CheckAccount(ctx context.Context, claims *utils.JWTClaims) (map[string]string, error)
+}
+
+// JWTAuthMiddleware authenticates users by their access token. Machines MachineAuth already
+// authenticated need none.
+func JWTAuthMiddleware(accounts AccountChecker) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if c.GetString(tlsconfig.MachineKey) != "" {
+			c.Next()
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
+			controllers.AbortWithError(c, apperrors.ErrUnauthenticated)
 			return
 		}
 
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authorization header format"})
+			controllers.AbortWithError(c, apperrors.ErrUnauthenticated)
 			return
 		}
 
 		tokenStr := parts[1]
 		claims, err := utils.ParseAccessToken(tokenStr)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			controllers.AbortWithError(c, apperrors.ErrUnauthenticated)
 			return
 		}
 
+		account, err := accounts.CheckAccount(c, claims)
+		if err != nil {
+			controllers.AbortWithError(c, err)
+			return
+		}
+		if locale := account["locale"]; locale != "" && i18n.Supported(locale) {
+			c.Set(i18n.LocaleKey, locale)
+			c.Header("Content-Language", locale)
+		}
+
+		// The role is the stored one: a token outlives a demotion, the account does not.
+		role := account["role"]
+		if role == "" {
+			role = repositories.DefaultUserRole
+		}
 		c.Set("phone", claims.Phone)
+		c.Set("role", role)
 
 		c.Next()
 	}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"authentication/pkg/i18n"
+	"github.com/gin-gonic/gin"
+)
+
+// Locale negotiates the response language from Accept-Language. JWTAuthMiddleware later
+// overrides it with the authenticated user's saved locale, if there is one.
+func Locale() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		locale := i18n.Match(c.GetHeader("Accept-Language"))
+		if locale == "" {
+			locale = i18n.DefaultLocale()
+		}
+
+		c.Set(i18n.LocaleKey, locale)
+		c.Header("Content-Language", locale)
+
+		c.Next()
+	}
+}
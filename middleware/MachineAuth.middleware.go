@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"authentication/controllers"
+	"authentication/pkg/apperrors"
+	"authentication/pkg/tlsconfig"
+	"github.com/gin-gonic/gin"
+)
+
+// MachineAuth authenticates machines by the client certificate of a mutual TLS connection:
+// the certificate's subject is looked up in identities, and the machine's name and role
+// are put into the context the way JWTAuthMiddleware puts a user's, so RequireRole applies
+// to both. A verified certificate of an unknown machine is refused.
+//
+// Requests without a verified client certificate, such as all those of listeners that do
+// not ask for one, go through untouched.
+func MachineAuth(identities tlsconfig.Identities) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.Next()
+			return
+		}
+
+		identity, ok := identities.Of(c.Request.TLS.VerifiedChains[0][0])
+		if !ok {
+			controllers.AbortWithError(c, apperrors.ErrForbidden)
+			return
+		}
+		c.Set(tlsconfig.MachineKey, identity.Name)
+		c.Set("role", identity.Role)
+
+		c.Next()
+	}
+}
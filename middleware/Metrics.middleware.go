@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"authentication/pkg/metrics"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics times every request for the http_request_duration_seconds histogram. Requests are
+// labelled with the template of their route, so /users/:phone is one series for all users,
+// and requests that match no route share the "unmatched" one.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		metrics.RequestsInFlight.Inc()
+		defer metrics.RequestsInFlight.Dec()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = metrics.UnmatchedRoute
+		}
+		metrics.RequestDuration.
+			WithLabelValues(metricsMethod(c.Request.Method), route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsMethod keeps made-up methods out of the labels.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"authentication/controllers"
+	"authentication/pkg/apperrors"
+	"authentication/pkg/metrics"
+	"authentication/pkg/phone"
+	"authentication/pkg/tracing"
+	"authentication/ratelimit"
+	"authentication/utils/logger"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis_rate/v10"
+)
+
+// RateLimit enforces the policies configured for route. They are charged for the request
+// in order, until one that is used up refuses it with ErrRateLimited. Dry-run policies are
+// charged on counters of their own, apart from the enforced ones, and log the requests
+// they would refuse instead of refusing them. Policies whose
+// subject is missing from the request, such as a device policy without DeviceHeader, do
+// not apply to it.
+//
+// Responses carry the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of
+// the enforced policy with the fewest requests left.
+func RateLimit(limiter ratelimit.RateLimiter, policies *ratelimit.Policies, route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var tightest *redis_rate.Result
+		var wait time.Duration
+		for _, policy := range policies.For(route) {
+			subject, ok := rateLimitSubject(c, policy)
+			if !ok {
+				continue
+			}
+
+			key := policy.Name + ":" + subject
+			ctx, span := tracer.Start(c, "RateLimit "+policy.Name)
+			if policy.DryRun {
+				// A policy on trial measures the real traffic without using up the quota of
+				// an enforced policy of the same name.
+				res, err := limiter.Allow(ctx, "dryrun:"+key, policy.Limit())
+				tracing.End(span, err)
+				if err != nil {
+					controllers.AbortWithError(c, err)
+					return
+				}
+				if res.Allowed == 0 {
+					logger.FromContext(c).Info().Str("handle", "RATELIMIT").Str("policy", policy.Name).
+						Str("subject", subject).Str("route", route).Msg("dry run: policy would refuse the request")
+				}
+				continue
+			}
+			res, err := limiter.Allow(ctx, key, policy.Limit())
+			tracing.End(span, err)
+			if err != nil {
+				controllers.AbortWithError(c, err)
+				return
+			}
+
+			if tightest == nil || res.Remaining < tightest.Remaining ||
+				res.Remaining == tightest.Remaining && res.ResetAfter > tightest.ResetAfter {
+				tightest = res
+			}
+			if next := ratelimit.NextAfter(res); next > wait {
+				wait = next
+			}
+			if res.Allowed == 0 {
+				metrics.RateLimited.WithLabelValues(policy.Name).Inc()
+				setRateLimitHeaders(c, res)
+				controllers.AbortWithError(c, apperrors.ErrRateLimited.WithRetryAfter(res.RetryAfter))
+				return
+			}
+		}
+
+		if tightest != nil {
+			setRateLimitHeaders(c, tightest)
+		}
+		c.Set(ratelimit.WaitKey, wait)
+		c.Next()
+	}
+}
+
+func setRateLimitHeaders(c *gin.Context, res *redis_rate.Result) {
+	c.Header("RateLimit-Limit", strconv.Itoa(res.Limit.Burst))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(res.ResetAfter.Seconds())), 10))
+}
+
+// rateLimitSubject is what the policy counts the request by. The client IP is the one gin
+// finds behind the trusted proxies, see bootstrap.ConfigureProxies.
+func rateLimitSubject(c *gin.Context, policy ratelimit.Policy) (string, bool) {
+	switch policy.Scope {
+	case ratelimit.ScopePhone:
+		return bodyPhone(c)
+	case ratelimit.ScopeIP, ratelimit.ScopeSubnet:
+		ip, err := netip.ParseAddr(c.ClientIP())
+		if err != nil {
+			return "", false
+		}
+		if policy.Scope == ratelimit.ScopeSubnet {
+			return policy.Subnet(ip), true
+		}
+		return ip.Unmap().String(), true
+	case ratelimit.ScopeDevice:
+		device := c.GetHeader(ratelimit.DeviceHeader)
+		return device, device != "" && len(device) <= 128
+	case ratelimit.ScopeGlobal:
+		return "all", true
+	}
+	return "", false
+}
+
+// maxPhoneBody is how much of a body bodyPhone reads. The routes it looks at take a
+// handful of short fields.
+const maxPhoneBody = 4 << 10
+
+// bodyPhone peeks at the phoneNumber of a JSON body, in E.164 so every spelling of a number
+// shares one counter, and leaves the body for the handler to bind. Requests without a
+// valid phone are refused by validation anyway, as are bodies over maxPhoneBody: the
+// handler gets only what was read.
+func bodyPhone(c *gin.Context) (string, bool) {
+	if c.Request.Body == nil {
+		return "", false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPhoneBody))
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", false
+	}
+
+	var request struct {
+		PhoneNumber string `json:"phoneNumber"`
+	}
+	if json.Unmarshal(body, &request) != nil {
+		return "", false
+	}
+	number, err := phone.Normalize(request.PhoneNumber)
+	return number, err == nil
+}
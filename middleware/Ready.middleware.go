@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"authentication/controllers"
+	"authentication/pkg/apperrors"
+	"authentication/pkg/health"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startingRetryAfter is when clients refused during startup are told to retry.
+const startingRetryAfter = 5 * time.Second
+
+// Ready refuses requests with ErrUnavailable until the service has started, so none is
+// served before the data in Redis is migrated.
+func Ready(checker *health.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !checker.IsStarted() {
+			controllers.AbortWithError(c, apperrors.ErrUnavailable.WithRetryAfter(startingRetryAfter))
+			return
+		}
+		c.Next()
+	}
+}
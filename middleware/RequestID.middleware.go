@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"authentication/pkg/tracing"
+	"authentication/utils/logger"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+)
+
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID tags every request with an id, taken from the X-Request-ID header when the
+// client or a proxy sent a sane one, and echoes it back in the response. The request gets
+// a logger that adds the id, and the trace id when the request is traced, to every line;
+// see logger.FromContext.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		c.Set("request_id", id)
+		c.Header(RequestIDHeader, id)
+		fields := map[string]interface{}{"request_id": id}
+		if traceID := tracing.TraceID(c.Request.Context()); traceID != "" {
+			fields["trace_id"] = traceID
+		}
+		requestLogger := logger.WithFields(fields)
+		c.Set(logger.ContextKey, &requestLogger)
+
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts short ids made of characters that are safe to log and echo.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"authentication/controllers"
+	"authentication/pkg/apperrors"
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole only lets requests through whose access token, or machine identity, carries
+// one of roles. It must run after JWTAuthMiddleware, which puts the role into the context.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		for _, allowed := range roles {
+			if role == allowed {
+				c.Next()
+				return
+			}
+		}
+
+		controllers.AbortWithError(c, apperrors.ErrForbidden)
+	}
+}
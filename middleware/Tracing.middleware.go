@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"authentication/pkg/tracing"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+var tracer = tracing.Tracer("authentication/middleware")
+
+// Tracing starts the span of every request, named after its route, continuing the trace of
+// the W3C traceparent header when the client sent one. It runs before every other
+// middleware; metric scrapes and health probes are not traced.
+func Tracing() gin.HandlerFunc {
+	return otelgin.Middleware(tracing.ServiceName, otelgin.WithFilter(func(r *http.Request) bool {
+		switch r.URL.Path {
+		case "/metrics", "/healthz", "/readyz":
+			return false
+		}
+		return true
+	}))
+}
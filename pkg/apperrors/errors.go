@@ -0,0 +1,84 @@
+// Package apperrors holds the domain errors services and repositories return. Each one
+// carries a stable code that clients can rely on; the controllers decide how a code
+// is presented over HTTP.
+package apperrors
+
+import (
+	"errors"
+	"time"
+)
+
+// Error is a failure the API reports to its clients. Code and Message are safe to expose;
+// the wrapped Err, if any, is only logged.
+type Error struct {
+	Code    string
+	Message string
+	Err     error
+	// RetryAfter, when set, tells the client how long to wait before trying again.
+	RetryAfter time.Duration
+}
+
+func New(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches on the code, so a wrapped error still satisfies errors.Is(err, ErrX).
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of e that carries err as its cause.
+func (e *Error) Wrap(err error) *Error {
+	return &Error{Code: e.Code, Message: e.Message, Err: err, RetryAfter: e.RetryAfter}
+}
+
+// WithRetryAfter returns a copy of e that asks the client to wait d before retrying.
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	return &Error{Code: e.Code, Message: e.Message, Err: e.Err, RetryAfter: d}
+}
+
+var (
+	ErrInvalidRequest      = New("invalid_request", "The request is invalid")
+	ErrUnauthenticated     = New("unauthenticated", "User not authenticated")
+	ErrForbidden           = New("forbidden", "Insufficient permissions")
+	ErrOTPInvalid          = New("otp_invalid", "OTP code is wrong")
+	ErrUserNotFound        = New("user_not_found", "No user found with this phone number")
+	ErrOTPAlreadySent      = New("otp_already_sent", "The OTP code has sent before")
+	ErrRateLimited         = New("rate_limited", "Too many requests. Please try again later.")
+	ErrInvalidCursor       = New("invalid_cursor", "Invalid pagination cursor")
+	ErrAccountSuspended    = New("account_suspended", "Your account is suspended")
+	ErrAccountBanned       = New("account_banned", "Your account is banned")
+	ErrAccountDeleted      = New("account_deleted", "This account has been deleted")
+	ErrInvalidRefreshToken = New("invalid_refresh_token", "Invalid or expired refresh token")
+	ErrSessionRevoked      = New("session_revoked", "Session has been revoked, please log in again")
+	ErrSuspensionInPast    = New("suspension_in_past", "Suspension end must be in the future")
+	ErrCountryNotAllowed   = New("country_not_allowed", "Codes cannot be sent to phone numbers of this country")
+	ErrDestinationBlocked  = New("destination_blocked", "Codes cannot be sent to this phone number right now")
+	ErrChallengeRequired   = New("challenge_required", "Please solve the challenge to continue")
+	ErrChallengeFailed     = New("challenge_failed", "The challenge was not solved, please try again")
+	ErrWebhookNotFound     = New("webhook_not_found", "No webhook subscription with this ID")
+	ErrDeliveryNotFound    = New("delivery_not_found", "No webhook delivery with this ID")
+	ErrInternal            = New("internal_error", "An internal error occurred")
+	ErrUnavailable         = New("service_unavailable", "The service is temporarily unavailable")
+)
+
+// As returns the *Error in err's chain, or ErrInternal when there is none.
+func As(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return ErrInternal
+}
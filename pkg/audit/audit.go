@@ -0,0 +1,84 @@
+// Package audit describes the security events of the service: who tried to sign in, from
+// where, and what came of it. Phone numbers are only recorded as keyed hashes.
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Event types.
+const (
+	OTPSent         = "otp_sent"
+	Login           = "login"
+	UserCreated     = "user_created"
+	TokenRefreshed  = "token_refreshed"
+	UserUpdated     = "user_updated"
+	StatusChanged   = "status_changed"
+	SessionsRevoked = "sessions_revoked"
+)
+
+// Outcomes of an event.
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is one entry of the audit log. It is never changed once written.
+type Event struct {
+	// ID orders events; it is assigned when the event is written.
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	UserID    string    `json:"user_id,omitempty"`
+	PhoneHash string    `json:"phone_hash,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Outcome   string    `json:"outcome"`
+	// Reason is the error code of a failure, or the reason an admin gave for a change.
+	Reason    string `json:"reason,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	// Actor is the phone hash of the admin behind a change to another user, or
+	// "machine:<name>" for a machine authenticated by its client certificate.
+	Actor string `json:"actor,omitempty"`
+}
+
+// ClientKey is the gin context key holding the Client of a request.
+const ClientKey = "audit_client"
+
+// Client is who sent a request, as far as the service can tell.
+type Client struct {
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+// ClientFrom returns the client stored in ctx, or none outside of a request.
+func ClientFrom(ctx context.Context) Client {
+	client, _ := ctx.Value(ClientKey).(Client)
+	return client
+}
+
+// Hasher turns phone numbers into stable pseudonyms, so the log can be searched by phone
+// without holding the numbers. Without a key the hash can be reversed by trying every
+// number, so deployments should set one and keep it.
+type Hasher struct {
+	key []byte
+}
+
+func NewHasher(key []byte) Hasher {
+	return Hasher{key: key}
+}
+
+func (h Hasher) Hash(phone string) string {
+	if phone == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(phone))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
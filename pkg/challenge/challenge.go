@@ -0,0 +1,50 @@
+// Package challenge asks clients to prove they are not bots before a request goes through:
+// with a CAPTCHA solved by a person, or with a proof of work that costs a script CPU time.
+package challenge
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrFailed is returned for a token that does not prove the challenge was solved.
+var ErrFailed = errors.New("challenge: not solved")
+
+// Challenge tells a client what to solve. Clients send the solution as the token of the
+// request they retry.
+type Challenge struct {
+	// Type is the verifier's provider: "hcaptcha", "recaptcha" or "pow".
+	Type string `json:"type"`
+	// SiteKey is what the CAPTCHA widget is rendered with.
+	SiteKey string `json:"site_key,omitempty"`
+	// Seed and Difficulty describe a proof of work, see Solve.
+	Seed       string `json:"seed,omitempty"`
+	Difficulty int    `json:"difficulty,omitempty"`
+	// ExpiresIn is how many seconds the client has to solve the challenge, when limited.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+}
+
+// Required is the error of a request that needs a solved challenge first. It carries a
+// new challenge for the client.
+type Required struct {
+	Challenge Challenge
+}
+
+func (r *Required) Error() string {
+	return "challenge: " + r.Challenge.Type + " challenge required"
+}
+
+// Verifier issues challenges and checks their solutions.
+type Verifier interface {
+	Issue(ctx context.Context) (Challenge, error)
+	// Verify returns ErrFailed, possibly wrapped, when token is not a valid solution.
+	// remoteIP is the address of the client, which CAPTCHA providers check as well.
+	Verify(ctx context.Context, token, remoteIP string) error
+}
+
+// Store remembers used solutions, so that each one lets a single request through.
+type Store interface {
+	// Spend records id as used until ttl passes, and reports false if it already was.
+	Spend(ctx context.Context, id string, ttl time.Duration) (bool, error)
+}
@@ -0,0 +1,83 @@
+package challenge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHTTPVerifier(t *testing.T) {
+	tests := []struct {
+		name      string
+		provider  string
+		secret    string
+		verifyURL string
+		wantErr   bool
+	}{
+		{"hcaptcha", "hcaptcha", "secret", "", false},
+		{"recaptcha", "recaptcha", "secret", "", false},
+		{"unknown provider", "turnstile", "secret", "", true},
+		{"own endpoint", "turnstile", "secret", "https://captcha.example.com/verify", false},
+		{"no secret", "hcaptcha", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHTTPVerifier(tt.provider, "site-key", tt.secret, tt.verifyURL)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewHTTPVerifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTTPVerifier(t *testing.T) {
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") != "secret" || r.PostFormValue("remoteip") != "203.0.113.7" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.PostFormValue("response") {
+		case "solved":
+			w.Write([]byte(`{"success": true}`))
+		case "broken":
+			w.Write([]byte(`{"success":`))
+		default:
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+	defer provider.Close()
+
+	v, err := NewHTTPVerifier("hcaptcha", "site-key", "secret", provider.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued, _ := v.Issue(context.Background()); issued.Type != "hcaptcha" || issued.SiteKey != "site-key" {
+		t.Errorf("Issue() = %+v, want the hcaptcha site key", issued)
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		remoteIP   string
+		wantErr    bool
+		wantFailed bool
+	}{
+		{"solved", "solved", "203.0.113.7", false, false},
+		{"refused", "guessed", "203.0.113.7", true, true},
+		{"provider error", "solved", "198.51.100.1", true, false},
+		{"unreadable answer", "broken", "203.0.113.7", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Verify(context.Background(), tt.token, tt.remoteIP)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrFailed) != tt.wantFailed {
+				t.Errorf("Verify() error = %v, want ErrFailed %v", err, tt.wantFailed)
+			}
+		})
+	}
+}
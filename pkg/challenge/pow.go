@@ -0,0 +1,118 @@
+package challenge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// powVerifier is a hashcash-style proof of work that needs no outside service. Seeds are
+// signed rather than stored, so any instance sharing the key verifies them.
+type powVerifier struct {
+	key        []byte
+	difficulty int
+	ttl        time.Duration
+	store      Store
+}
+
+// NewProofOfWork issues seeds signed with key that must be solved within ttl, with
+// difficulty leading zero bits (each one doubles the average work). store keeps each
+// solution from being used twice. The key is required: a random one would differ between
+// instances and restarts, and seeds issued by one would fail on the others.
+func NewProofOfWork(key []byte, difficulty int, ttl time.Duration, store Store) (Verifier, error) {
+	if difficulty < 1 || difficulty > 32 {
+		return nil, fmt.Errorf("challenge: proof of work difficulty %d is not between 1 and 32", difficulty)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("challenge: proof of work needs a key to sign seeds with")
+	}
+	return &powVerifier{key: key, difficulty: difficulty, ttl: ttl, store: store}, nil
+}
+
+// A seed reads "<random>.<expiry>.<difficulty>.<signature>".
+func (v *powVerifier) Issue(ctx context.Context) (Challenge, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return Challenge{}, err
+	}
+	expires := time.Now().Add(v.ttl).Unix()
+	seed := fmt.Sprintf("%s.%d.%d", base64.RawURLEncoding.EncodeToString(random), expires, v.difficulty)
+	return Challenge{
+		Type:       "pow",
+		Seed:       seed + "." + v.sign(seed),
+		Difficulty: v.difficulty,
+		ExpiresIn:  int64(v.ttl / time.Second),
+	}, nil
+}
+
+func (v *powVerifier) sign(seed string) string {
+	mac := hmac.New(sha256.New, v.key)
+	mac.Write([]byte(seed))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Verify accepts "<seed>:<nonce>", see Solve.
+func (v *powVerifier) Verify(ctx context.Context, token, remoteIP string) error {
+	seed, nonce, ok := strings.Cut(token, ":")
+	if !ok || nonce == "" || len(nonce) > 32 {
+		return ErrFailed
+	}
+	parts := strings.Split(seed, ".")
+	if len(parts) != 4 || !hmac.Equal([]byte(parts[3]), []byte(v.sign(strings.Join(parts[:3], ".")))) {
+		return fmt.Errorf("%w: seed was not issued here", ErrFailed)
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrFailed
+	}
+	ttl := time.Until(time.Unix(expires, 0))
+	if ttl <= 0 {
+		return fmt.Errorf("%w: seed expired", ErrFailed)
+	}
+	// The difficulty in force when the seed was issued applies.
+	difficulty, err := strconv.Atoi(parts[2])
+	if err != nil || leadingZeros(seed, nonce) < difficulty {
+		return fmt.Errorf("%w: not enough work", ErrFailed)
+	}
+
+	fresh, err := v.store.Spend(ctx, "pow:"+parts[0], ttl)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return fmt.Errorf("%w: seed already used", ErrFailed)
+	}
+	return nil
+}
+
+// Solve finds the token for a proof of work: the seed, a colon and a decimal nonce such
+// that the SHA-256 of "<seed>:<nonce>" starts with difficulty zero bits. Clients do the
+// same in their own language.
+func Solve(seed string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		n := strconv.Itoa(nonce)
+		if leadingZeros(seed, n) >= difficulty {
+			return seed + ":" + n
+		}
+	}
+}
+
+func leadingZeros(seed, nonce string) int {
+	sum := sha256.Sum256([]byte(seed + ":" + nonce))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
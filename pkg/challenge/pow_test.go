@@ -0,0 +1,125 @@
+package challenge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// spentStore is a Store in a map; ttl is not needed by the tests.
+type spentStore struct {
+	mu    sync.Mutex
+	spent map[string]bool
+}
+
+func (s *spentStore) Spend(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.spent[id] {
+		return false, nil
+	}
+	s.spent[id] = true
+	return true, nil
+}
+
+func newPoW(t *testing.T, key string, difficulty int, ttl time.Duration) Verifier {
+	t.Helper()
+
+	v, err := NewProofOfWork([]byte(key), difficulty, ttl, &spentStore{spent: make(map[string]bool)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestNewProofOfWork(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		difficulty int
+		wantErr    bool
+	}{
+		{"valid", "secret", 20, false},
+		{"no key", "", 20, true},
+		{"too easy", "secret", 0, true},
+		{"too hard", "secret", 33, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewProofOfWork([]byte(tt.key), tt.difficulty, time.Minute, &spentStore{spent: make(map[string]bool)})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewProofOfWork() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	ctx := context.Background()
+	v := newPoW(t, "secret", 8, time.Minute)
+	issued, err := v.Issue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Type != "pow" || issued.Difficulty != 8 || issued.ExpiresIn != 60 {
+		t.Fatalf("Issue() = %+v, want a pow challenge of difficulty 8 for 60s", issued)
+	}
+	solved := Solve(issued.Seed, issued.Difficulty)
+
+	// A nonce that does not do the work; the first one that does is Solve's.
+	unsolved := ""
+	for nonce := 0; unsolved == ""; nonce++ {
+		if leadingZeros(issued.Seed, fmt.Sprint(nonce)) < issued.Difficulty {
+			unsolved = fmt.Sprintf("%s:%d", issued.Seed, nonce)
+		}
+	}
+	parts := strings.Split(issued.Seed, ".")
+	easier := strings.Join([]string{parts[0], parts[1], "1", parts[3]}, ".")
+	other, err := newPoW(t, "other", 8, time.Minute).Issue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := newPoW(t, "secret", 1, -time.Second).Issue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"no nonce", issued.Seed, true},
+		{"empty nonce", issued.Seed + ":", true},
+		{"not enough work", unsolved, true},
+		{"difficulty lowered", Solve(easier, 1), true},
+		{"signed with another key", Solve(other.Seed, 8), true},
+		{"expired", Solve(expired.Seed, 1), true},
+		{"malformed", "seed:1", true},
+		{"solved", solved, false},
+		{"used twice", solved, true},
+	}
+	for _, tt := range tests {
+		err := v.Verify(ctx, tt.token, "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Verify() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrFailed) {
+			t.Errorf("%s: Verify() error = %v, want ErrFailed", tt.name, err)
+		}
+	}
+
+	// Instances sharing the key accept each other's seeds.
+	seed, err := newPoW(t, "secret", 8, time.Minute).Issue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(ctx, Solve(seed.Seed, 8), ""); err != nil {
+		t.Errorf("Verify() of a seed from another instance = %v, want nil", err)
+	}
+}
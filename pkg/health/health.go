@@ -0,0 +1,162 @@
+// Package health tells whether the service is ready to take traffic.
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of a check, and of the service as a whole.
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusStarting    = "starting"
+	StatusStopping    = "stopping"
+)
+
+// DefaultTimeout bounds each check unless the Checker is given another.
+const DefaultTimeout = 2 * time.Second
+
+// Check returns an error when the dependency it looks at cannot serve requests.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Report is the outcome of every check; Status is ok only when all of theirs are.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// Checker runs the checks of the service's dependencies. It starts out not ready, until
+// Started says the service finished starting, and is not ready again once Stopping says it
+// is shutting down.
+type Checker struct {
+	timeout time.Duration
+
+	mu     sync.RWMutex
+	checks map[string]Check
+
+	started    atomic.Bool
+	startupErr atomic.Pointer[string]
+	stopping   atomic.Bool
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Checker{timeout: timeout, checks: make(map[string]Check)}
+}
+
+// Add checks the dependency called name, replacing any check of the same name.
+func (h *Checker) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Starting records why starting has not finished yet.
+func (h *Checker) Starting(err error) {
+	message := err.Error()
+	h.startupErr.Store(&message)
+}
+
+// Started marks the service as started, for good.
+func (h *Checker) Started() {
+	h.started.Store(true)
+	h.startupErr.Store(nil)
+}
+
+// Stopping marks the service as shutting down, so load balancers stop sending it requests
+// while those in flight finish.
+func (h *Checker) Stopping() {
+	h.stopping.Store(true)
+}
+
+func (h *Checker) IsStarted() bool {
+	return h.started.Load()
+}
+
+// Ready runs every check at once, each within the timeout. Until the service is started it
+// also reports a "startup" check that is not ok.
+func (h *Checker) Ready(ctx context.Context) Report {
+	h.mu.RLock()
+	checks := make(map[string]Check, len(h.checks))
+	for name, check := range h.checks {
+		checks[name] = check
+	}
+	h.mu.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks)+1)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := h.run(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != StatusOK {
+			report.Status = StatusUnavailable
+		}
+	}
+	if !h.IsStarted() {
+		startup := Result{Status: StatusStarting}
+		if err := h.startupErr.Load(); err != nil {
+			startup.Error = *err
+		}
+		report.Checks["startup"] = startup
+		report.Status = StatusStarting
+	}
+	if h.stopping.Load() {
+		report.Status = StatusStopping
+	}
+	return report
+}
+
+func (h *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("check panicked: %v", r)
+			}
+		}()
+		done <- check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// A check that ignores its context does not hold up the report.
+		err = fmt.Errorf("timed out after %s", h.timeout)
+	}
+
+	result := Result{Status: StatusOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = StatusUnavailable
+		result.Error = err.Error()
+	}
+	return result
+}
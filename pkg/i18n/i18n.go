@@ -0,0 +1,249 @@
+// Package i18n translates client-facing text. Catalogs are JSON files named after their
+// locale (en.json, fa.json, ...); the ones in locales/ are built in and more can be loaded
+// from a directory at startup, which is how new languages are added without a rebuild.
+//
+// A catalog maps message keys either to a string or, for text that depends on a number,
+// to its plural forms ("zero", "one", "two", "few", "many", "other"). Placeholders are
+// written {name} and filled from the arguments; {count} also selects the plural form.
+package i18n
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// LocaleKey is the gin context key holding the negotiated locale of a request.
+const LocaleKey = "locale"
+
+// FallbackLocale is used when neither the request nor the user picks a supported locale.
+const FallbackLocale = "en"
+
+//go:embed locales/*.json
+var builtin embed.FS
+
+// Args fills the placeholders of a message.
+type Args map[string]interface{}
+
+// message is one catalog entry; a plain string is stored as its "other" form.
+type message map[string]string
+
+func (m *message) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*m = message{"other": text}
+		return nil
+	}
+	var forms map[string]string
+	if err := json.Unmarshal(data, &forms); err != nil {
+		return err
+	}
+	if forms["other"] == "" {
+		return fmt.Errorf("plural message without an \"other\" form")
+	}
+	*m = forms
+	return nil
+}
+
+var (
+	mu            sync.RWMutex
+	catalogs      = make(map[string]map[string]message)
+	defaultLocale = FallbackLocale
+)
+
+func init() {
+	entries, err := builtin.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		data, err := builtin.ReadFile("locales/" + entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		if err := add(entry.Name(), data); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// LoadDir merges every <locale>.json in dir into the catalogs. Keys it defines replace the
+// built-in ones, so a deployment can both reword messages and add languages.
+func LoadDir(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := add(filepath.Base(file), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func add(name string, data []byte) error {
+	var entries map[string]message
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("i18n: %s: %w", name, err)
+	}
+
+	locale := normalize(strings.TrimSuffix(name, filepath.Ext(name)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	catalog, ok := catalogs[locale]
+	if !ok {
+		catalog = make(map[string]message, len(entries))
+		catalogs[locale] = catalog
+	}
+	for key, msg := range entries {
+		catalog[key] = msg
+	}
+	return nil
+}
+
+// SetDefaultLocale picks the locale used when a request does not negotiate one.
+func SetDefaultLocale(locale string) error {
+	locale = normalize(locale)
+	if !Supported(locale) {
+		return fmt.Errorf("i18n: no catalog for default locale %q", locale)
+	}
+	mu.Lock()
+	defaultLocale = locale
+	mu.Unlock()
+	return nil
+}
+
+func DefaultLocale() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultLocale
+}
+
+// Supported reports whether there is a catalog for locale.
+func Supported(locale string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	_, ok := catalogs[normalize(locale)]
+	return ok
+}
+
+// Locales lists the locales that have a catalog.
+func Locales() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	locales := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// T translates key into locale, falling back to the default locale, then to English, and
+// finally to the key itself so a missing translation never breaks a response.
+func T(locale, key string, args Args) string {
+	mu.RLock()
+	msg, ok := catalogs[normalize(locale)][key]
+	if !ok {
+		msg, ok = catalogs[defaultLocale][key]
+		locale = defaultLocale
+	}
+	if !ok {
+		msg, ok = catalogs[FallbackLocale][key]
+		locale = FallbackLocale
+	}
+	mu.RUnlock()
+	if !ok {
+		return key
+	}
+
+	text := msg["other"]
+	if count, ok := countOf(args); ok {
+		if form, ok := msg[pluralForm(locale, count)]; ok {
+			text = form
+		}
+	}
+	for name, value := range args {
+		text = strings.ReplaceAll(text, "{"+name+"}", fmt.Sprint(value))
+	}
+	return text
+}
+
+// FromContext returns the locale negotiated for the request ctx belongs to, or the
+// default locale outside of a request.
+func FromContext(ctx context.Context) string {
+	if locale, ok := ctx.Value(LocaleKey).(string); ok && locale != "" {
+		return locale
+	}
+	return DefaultLocale()
+}
+
+// Match picks the best supported locale from an Accept-Language header, honouring
+// q-values and falling back from regional tags (fa-IR) to their language. It returns
+// "" when nothing matches.
+func Match(acceptLanguage string) string {
+	type candidate struct {
+		locale string
+		q      float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := normalize(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{tag, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	for _, c := range candidates {
+		if Supported(c.locale) {
+			return c.locale
+		}
+		if base, _, found := strings.Cut(c.locale, "-"); found && Supported(base) {
+			return base
+		}
+	}
+	return ""
+}
+
+func normalize(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+func countOf(args Args) (int64, bool) {
+	switch n := args["count"].(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
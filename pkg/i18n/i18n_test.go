@@ -0,0 +1,136 @@
+package i18n
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPluralForm(t *testing.T) {
+	tests := []struct {
+		locale string
+		n      int64
+		want   string
+	}{
+		{"en", 0, "other"},
+		{"en", 1, "one"},
+		{"en", 2, "other"},
+		{"en-US", -1, "one"},
+		{"fa", 0, "one"},
+		{"fa", 1, "one"},
+		{"fa", 5, "other"},
+		{"ar", 0, "zero"},
+		{"ar", 1, "one"},
+		{"ar", 2, "two"},
+		{"ar", 3, "few"},
+		{"ar", 102, "other"},
+		{"ar", 110, "few"},
+		{"ar", 111, "many"},
+		{"ar", 103, "few"},
+		{"tr", 1, "one"},
+	}
+	for _, tt := range tests {
+		if got := pluralForm(tt.locale, tt.n); got != tt.want {
+			t.Errorf("pluralForm(%q, %d) = %q, want %q", tt.locale, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"fa", "fa"},
+		{"FA_ir", "fa"},
+		{"de-DE, fa-IR;q=0.9, en;q=0.5", "fa"},
+		{"en;q=0.4, fa;q=0.8", "fa"},
+		{"fa;q=0, en", "en"},
+		{"de, *;q=0.5", ""},
+		{"de-DE", ""},
+		{"en;q=bogus, fa;q=0.9", "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := Match(tt.header); got != tt.want {
+				t.Errorf("Match(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestT(t *testing.T) {
+	tests := []struct {
+		name   string
+		locale string
+		key    string
+		args   Args
+		want   string
+	}{
+		{name: "plain", locale: "en", key: "otp.sent", want: "OTP code sent successfully"},
+		{name: "persian", locale: "FA", key: "otp.sent", want: "کد یکبارمصرف با موفقیت ارسال شد"},
+		{name: "unknown locale", locale: "xx", key: "otp.sent", want: "OTP code sent successfully"},
+		{name: "unknown key", locale: "en", key: "no.such.key", want: "no.such.key"},
+		{
+			name:   "one",
+			locale: "en",
+			key:    "sms.otp",
+			args:   Args{"code": "123456", "count": 1},
+			want:   "Your verification code is 123456. It expires in 1 minute.",
+		},
+		{
+			name:   "other",
+			locale: "en",
+			key:    "sms.otp",
+			args:   Args{"code": "123456", "count": int64(2)},
+			want:   "Your verification code is 123456. It expires in 2 minutes.",
+		},
+		{
+			name:   "count of another type",
+			locale: "en",
+			key:    "errors.invalid_request.detail",
+			args:   Args{"count": "1"},
+			want:   "1 fields are invalid.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := T(tt.locale, tt.key, tt.args); got != tt.want {
+				t.Errorf("T(%q, %q) = %q, want %q", tt.locale, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("tr.json", `{"otp.sent": "Kod gönderildi", "sms.otp": {"one": "{count} dakika", "other": "{count} dakika"}}`)
+	write("notes.txt", `not a catalog`)
+
+	if err := LoadDir(dir); err != nil {
+		t.Fatalf("LoadDir: %v", err)
+	}
+	if !Supported("tr") || Supported("notes") {
+		t.Fatalf("locales after loading: %v", Locales())
+	}
+	if got := T(Match("tr-TR"), "otp.sent", nil); got != "Kod gönderildi" {
+		t.Errorf("T(tr) = %q", got)
+	}
+	if got := T("tr", "login.success", nil); got != "Login successful" {
+		t.Errorf("keys the catalog lacks fall back to English, got %q", got)
+	}
+
+	write("broken.json", `{"otp.sent": 42}`)
+	if err := LoadDir(dir); err == nil {
+		t.Error("expected a malformed catalog to be refused")
+	}
+	if err := SetDefaultLocale("xx"); err == nil {
+		t.Error("expected a default locale without a catalog to be refused")
+	}
+}
@@ -0,0 +1,39 @@
+package i18n
+
+import "strings"
+
+// pluralForm is the CLDR plural category of the integer n in locale. Only the languages
+// we ship or expect to ship have their own rule; the rest use the English one.
+func pluralForm(locale string, n int64) string {
+	if n < 0 {
+		n = -n
+	}
+	language, _, _ := strings.Cut(locale, "-")
+
+	switch language {
+	case "fa":
+		if n <= 1 {
+			return "one"
+		}
+		return "other"
+	case "ar":
+		switch mod := n % 100; {
+		case n == 0:
+			return "zero"
+		case n == 1:
+			return "one"
+		case n == 2:
+			return "two"
+		case mod >= 3 && mod <= 10:
+			return "few"
+		case mod >= 11 && mod <= 99:
+			return "many"
+		}
+		return "other"
+	default:
+		if n == 1 {
+			return "one"
+		}
+		return "other"
+	}
+}
@@ -0,0 +1,93 @@
+// Package metrics exposes the service's Prometheus metrics: HTTP requests, business events,
+// the Redis client and the Go runtime.
+//
+// Labels only take values from small fixed sets, such as route templates and policy names,
+// never phone numbers or raw paths, so the number of series stays bounded.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "auth"
+
+// UnmatchedRoute labels requests that matched no route, whatever their path.
+const UnmatchedRoute = "unmatched"
+
+// Registry holds every metric of the service. It is separate from the default registry of
+// client_golang, so imported libraries cannot add series to it.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// RequestDuration observes the time to answer a request, by method, route template and
+	// status code.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to answer HTTP requests, by method, route and status.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method", "route", "status"})
+	RequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests being answered.",
+	})
+
+	OTPSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_sent_total",
+		Help:      "One-time codes sent.",
+	})
+	OTPVerifyFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_verify_failed_total",
+		Help:      "Logins refused for a wrong or expired code.",
+	})
+	LoginSuccess = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_success_total",
+		Help:      "Successful logins.",
+	})
+	UserCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "user_created_total",
+		Help:      "Users created by their first login.",
+	})
+	TokenRefreshed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshed_total",
+		Help:      "Refresh tokens exchanged for new tokens.",
+	})
+	// RateLimited counts requests refused by a rate limit policy, by the policy's name.
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests refused by a rate limit, by policy.",
+	}, []string{"policy"})
+	// WebhookDeliveries counts webhook delivery attempts, by outcome: delivered, failed
+	// (to be retried) or dead.
+	WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts, by outcome.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestDuration, RequestsInFlight,
+		OTPSent, OTPVerifyFailed, LoginSuccess, UserCreated, TokenRefreshed, RateLimited, WebhookDeliveries,
+		redisPool, redisDuration, redisErrors,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Time Redis commands take, by command; pipelines and transactions count as one.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+	redisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_command_errors_total",
+		Help:      "Redis commands that failed, by command.",
+	}, []string{"command"})
+	redisPool = &poolCollector{
+		hits:     prometheus.NewDesc(namespace+"_redis_pool_hits_total", "Connections reused from the pool.", nil, nil),
+		misses:   prometheus.NewDesc(namespace+"_redis_pool_misses_total", "Connections the pool had to open.", nil, nil),
+		timeouts: prometheus.NewDesc(namespace+"_redis_pool_timeouts_total", "Waits for a free connection that timed out.", nil, nil),
+		stale:    prometheus.NewDesc(namespace+"_redis_pool_stale_connections_total", "Idle connections closed by the pool.", nil, nil),
+		total:    prometheus.NewDesc(namespace+"_redis_pool_connections", "Open connections.", nil, nil),
+		idle:     prometheus.NewDesc(namespace+"_redis_pool_idle_connections", "Idle connections.", nil, nil),
+	}
+)
+
+// InstrumentRedis times the commands of client and reports the stats of its connection
+// pool. The pool stats are those of the last client instrumented.
+func InstrumentRedis(client redis.UniversalClient) {
+	client.AddHook(redisHook{})
+	redisPool.client.Store(&client)
+}
+
+type redisHook struct{}
+
+func (redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observeRedis(strings.ToLower(cmd.Name()), start, err)
+		return err
+	}
+}
+
+func (redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		observeRedis("pipeline", start, err)
+		return err
+	}
+}
+
+func observeRedis(command string, start time.Time, err error) {
+	redisDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	// A missing key or a transaction whose WATCHed keys changed is an answer, not a failure.
+	if err != nil && !errors.Is(err, redis.Nil) && !errors.Is(err, redis.TxFailedErr) {
+		redisErrors.WithLabelValues(command).Inc()
+	}
+}
+
+// poolCollector reads the pool stats of a client when the metrics are scraped.
+type poolCollector struct {
+	client                                     atomic.Pointer[redis.UniversalClient]
+	hits, misses, timeouts, stale, total, idle *prometheus.Desc
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.hits
+	ch <- p.misses
+	ch <- p.timeouts
+	ch <- p.stale
+	ch <- p.total
+	ch <- p.idle
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	client := p.client.Load()
+	if client == nil {
+		return
+	}
+	stats := (*client).PoolStats()
+	ch <- prometheus.MustNewConstMetric(p.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(p.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(p.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(p.stale, prometheus.CounterValue, float64(stats.StaleConns))
+	ch <- prometheus.MustNewConstMetric(p.total, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(stats.IdleConns))
+}
@@ -0,0 +1,72 @@
+package phone
+
+// country describes how mobile numbers are written in one country. Lengths and prefixes
+// apply to the national significant number, i.e. without country code or trunk prefix.
+type country struct {
+	region string
+	code   string
+	// trunk is the prefix dialled before national numbers inside the country, if any.
+	trunk    string
+	lengths  []int
+	prefixes []string
+}
+
+// countries we accept numbers from. Iran comes first as the default region; to support
+// another country, add its mobile numbering plan here.
+var countries = []country{
+	{region: "IR", code: "98", trunk: "0", lengths: []int{10}, prefixes: []string{"90", "91", "92", "93", "94", "99"}},
+	{region: "AE", code: "971", trunk: "0", lengths: []int{9}, prefixes: []string{"5"}},
+	{region: "AF", code: "93", trunk: "0", lengths: []int{9}, prefixes: []string{"7"}},
+	{region: "AM", code: "374", trunk: "0", lengths: []int{8}, prefixes: []string{"4", "5", "7", "9"}},
+	{region: "AZ", code: "994", trunk: "0", lengths: []int{9}, prefixes: []string{"10", "40", "50", "51", "55", "60", "70", "77", "99"}},
+	{region: "DE", code: "49", trunk: "0", lengths: []int{10, 11}, prefixes: []string{"15", "16", "17"}},
+	{region: "FR", code: "33", trunk: "0", lengths: []int{9}, prefixes: []string{"6", "7"}},
+	{region: "GB", code: "44", trunk: "0", lengths: []int{10}, prefixes: []string{"71", "72", "73", "74", "75", "77", "78", "79"}},
+	{region: "IQ", code: "964", trunk: "0", lengths: []int{10}, prefixes: []string{"7"}},
+	{region: "OM", code: "968", lengths: []int{8}, prefixes: []string{"7", "9"}},
+	{region: "QA", code: "974", lengths: []int{8}, prefixes: []string{"3", "5", "6", "7"}},
+	{region: "TR", code: "90", trunk: "0", lengths: []int{10}, prefixes: []string{"5"}},
+	// The North American plan does not tell mobile numbers apart; any valid area code goes.
+	{region: "US", code: "1", trunk: "1", lengths: []int{10}, prefixes: []string{"2", "3", "4", "5", "6", "7", "8", "9"}},
+}
+
+func countryByRegion(region string) (country, bool) {
+	for _, c := range countries {
+		if c.region == region {
+			return c, true
+		}
+	}
+	return country{}, false
+}
+
+// countryByNumber finds the country whose calling code starts digits. Calling codes are
+// prefix-free, so at most one matches.
+func countryByNumber(digits string) (country, bool) {
+	for _, c := range countries {
+		if len(digits) > len(c.code) && digits[:len(c.code)] == c.code {
+			return c, true
+		}
+	}
+	return country{}, false
+}
+
+func (c country) validLength(national string) bool {
+	for _, length := range c.lengths {
+		if len(national) == length {
+			return true
+		}
+	}
+	return false
+}
+
+func (c country) mobile(national string) bool {
+	if !c.validLength(national) {
+		return false
+	}
+	for _, prefix := range c.prefixes {
+		if len(national) >= len(prefix) && national[:len(prefix)] == prefix {
+			return true
+		}
+	}
+	return false
+}
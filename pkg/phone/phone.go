@@ -0,0 +1,209 @@
+// Package phone turns the many ways people write a mobile number into its E.164 form, so
+// that 09121234567, +98 912 123 4567, 989121234567 and ۰۹۱۲۱۲۳۴۵۶۷ are the same user.
+// Numbers without a country code are read in the default region, Iran unless configured.
+package phone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalid            = errors.New("phone: not a phone number")
+	ErrUnsupportedCountry = errors.New("phone: country not supported")
+	ErrNotMobile          = errors.New("phone: not a mobile number")
+)
+
+// DefaultRegion is used until SetDefaultRegion picks another one.
+const DefaultRegion = "IR"
+
+var (
+	mu            sync.RWMutex
+	defaultRegion = DefaultRegion
+)
+
+// SetDefaultRegion sets the ISO 3166 region that numbers without a country code belong to.
+func SetDefaultRegion(region string) error {
+	region = strings.ToUpper(strings.TrimSpace(region))
+	if _, ok := countryByRegion(region); !ok {
+		return fmt.Errorf("phone: unsupported default region %q", region)
+	}
+	mu.Lock()
+	defaultRegion = region
+	mu.Unlock()
+	return nil
+}
+
+// SupportedRegion tells whether numbers of the ISO 3166 region can be parsed.
+func SupportedRegion(region string) bool {
+	_, ok := countryByRegion(region)
+	return ok
+}
+
+func defaultCountry() country {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, _ := countryByRegion(defaultRegion)
+	return c
+}
+
+// Number is a parsed mobile number.
+type Number struct {
+	// Region is the ISO 3166-1 alpha-2 code of the number's country.
+	Region string
+	// CountryCode is the calling code, without the plus.
+	CountryCode string
+	// National is the national significant number: no country code, no trunk prefix.
+	National string
+}
+
+// E164 is the canonical form, e.g. +989121234567.
+func (n Number) E164() string {
+	return "+" + n.CountryCode + n.National
+}
+
+// Prefix is the E.164 beginning of the number: the country code and the first digits of
+// the national number, e.g. +98912 for digits 3. Operators allocate numbers in such blocks.
+func (n Number) Prefix(digits int) string {
+	if digits > len(n.National) {
+		digits = len(n.National)
+	}
+	return "+" + n.CountryCode + n.National[:digits]
+}
+
+// Parse reads a mobile number written in national or international format. Separators
+// (spaces, dashes, dots, parentheses) are ignored and Persian or Arabic-Indic digits are
+// read as their ASCII counterparts.
+func Parse(raw string) (Number, error) {
+	digits, international, ok := clean(raw)
+	if !ok {
+		return Number{}, ErrInvalid
+	}
+
+	if international {
+		c, found := countryByNumber(digits)
+		if !found {
+			if len(digits) >= 8 && len(digits) <= 15 {
+				return Number{}, ErrUnsupportedCountry
+			}
+			return Number{}, ErrInvalid
+		}
+		national := digits[len(c.code):]
+		// People often keep the trunk prefix after the country code: +98 0912...
+		if c.trunk != "" && !c.validLength(national) && strings.HasPrefix(national, c.trunk) {
+			national = national[len(c.trunk):]
+		}
+		return number(c, national)
+	}
+
+	c := defaultCountry()
+	switch {
+	case c.trunk != "" && strings.HasPrefix(digits, c.trunk) && c.validLength(digits[len(c.trunk):]):
+		return number(c, digits[len(c.trunk):])
+	case c.validLength(digits):
+		return number(c, digits)
+	case strings.HasPrefix(digits, c.code):
+		// International format without the plus: 989121234567.
+		national := digits[len(c.code):]
+		if c.trunk != "" && !c.validLength(national) && strings.HasPrefix(national, c.trunk) {
+			national = national[len(c.trunk):]
+		}
+		return number(c, national)
+	}
+	return Number{}, ErrInvalid
+}
+
+func number(c country, national string) (Number, error) {
+	if !c.validLength(national) {
+		return Number{}, ErrInvalid
+	}
+	if !c.mobile(national) {
+		return Number{}, ErrNotMobile
+	}
+	return Number{Region: c.region, CountryCode: c.code, National: national}, nil
+}
+
+// Normalize returns the E.164 form of raw.
+func Normalize(raw string) (string, error) {
+	n, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return n.E164(), nil
+}
+
+// Valid reports whether raw is a mobile number of a supported country.
+func Valid(raw string) bool {
+	_, err := Parse(raw)
+	return err == nil
+}
+
+// NormalizePrefix brings the beginning of a number, as typed into a search box, into the
+// shape stored numbers have: 0912 and 98912 both become +98912. It returns "" if raw
+// cannot be the start of a phone number.
+func NormalizePrefix(raw string) string {
+	digits, international, ok := clean(raw)
+	if !ok {
+		return ""
+	}
+	if international {
+		return "+" + digits
+	}
+
+	c := defaultCountry()
+	switch {
+	case c.trunk != "" && strings.HasPrefix(digits, c.trunk):
+		return "+" + c.code + digits[len(c.trunk):]
+	case strings.HasPrefix(digits, c.code):
+		return "+" + digits
+	}
+	return "+" + c.code + digits
+}
+
+// Digits converts Persian and Arabic-Indic digits and drops separators and a leading
+// national trunk prefix, which makes raw usable as a substring of stored numbers.
+func Digits(raw string) string {
+	digits, international, ok := clean(raw)
+	if !ok {
+		return ""
+	}
+	if c := defaultCountry(); !international && c.trunk != "" {
+		digits = strings.TrimPrefix(digits, c.trunk)
+	}
+	return digits
+}
+
+// separators may appear between digits. Besides punctuation this includes the no-break
+// space, the zero-width non-joiner and the direction marks that right-to-left keyboards
+// and copy-pasting from Persian text leave behind.
+const separators = " -.()/\u00a0\u200c\u200e\u200f\u202a\u202b\u202c\u202d\u202e"
+
+// clean keeps the digits of raw and tells whether it was written in international format,
+// with a leading + or 00. ok is false if raw contains anything but digits and separators.
+func clean(raw string) (digits string, international bool, ok bool) {
+	raw = strings.TrimSpace(raw)
+	var b strings.Builder
+	for i, r := range raw {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r >= '۰' && r <= '۹':
+			b.WriteRune('0' + (r - '۰'))
+		case r >= '٠' && r <= '٩':
+			b.WriteRune('0' + (r - '٠'))
+		case r == '+' && i == 0:
+			international = true
+		case strings.ContainsRune(separators, r):
+		default:
+			return "", false, false
+		}
+	}
+
+	digits = b.String()
+	if !international && strings.HasPrefix(digits, "00") {
+		digits, international = digits[2:], true
+	}
+	return digits, international, digits != ""
+}
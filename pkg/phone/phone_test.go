@@ -0,0 +1,111 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw    string
+		e164   string
+		region string
+		err    error
+	}{
+		{raw: "09121234567", e164: "+989121234567", region: "IR"},
+		{raw: "9121234567", e164: "+989121234567", region: "IR"},
+		{raw: "989121234567", e164: "+989121234567", region: "IR"},
+		{raw: "+98 912 123 4567", e164: "+989121234567", region: "IR"},
+		{raw: "+98 0912 123 4567", e164: "+989121234567", region: "IR"},
+		{raw: "0098-912-123-4567", e164: "+989121234567", region: "IR"},
+		{raw: "۰۹۱۲۱۲۳۴۵۶۷", e164: "+989121234567", region: "IR"},
+		{raw: "٠٩١٢١٢٣٤٥٦٧", e164: "+989121234567", region: "IR"},
+		{raw: "‎(0912) 123 4567", e164: "+989121234567", region: "IR"},
+		{raw: "+44 7700 900123", e164: "+447700900123", region: "GB"},
+		{raw: "+1 (415) 555-2671", e164: "+14155552671", region: "US"},
+		{raw: "02112345678", err: ErrNotMobile},
+		{raw: "+44 20 7946 0958", err: ErrNotMobile},
+		{raw: "+88 1234 5678", err: ErrUnsupportedCountry},
+		{raw: "091212345", err: ErrInvalid},
+		{raw: "0912-abc-4567", err: ErrInvalid},
+		{raw: "91+21234567", err: ErrInvalid},
+		{raw: "", err: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			n, err := Parse(tt.raw)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Parse(%q) error = %v, want %v", tt.raw, err, tt.err)
+			}
+			if tt.err != nil {
+				if Valid(tt.raw) {
+					t.Errorf("Valid(%q) = true", tt.raw)
+				}
+				return
+			}
+			if n.E164() != tt.e164 || n.Region != tt.region {
+				t.Errorf("Parse(%q) = %s in %s, want %s in %s", tt.raw, n.E164(), n.Region, tt.e164, tt.region)
+			}
+			if normalized, _ := Normalize(tt.raw); normalized != tt.e164 {
+				t.Errorf("Normalize(%q) = %q", tt.raw, normalized)
+			}
+		})
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	n, err := Parse("09121234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for digits, want := range map[int]string{0: "+98", 3: "+98912", 20: "+989121234567"} {
+		if got := n.Prefix(digits); got != want {
+			t.Errorf("Prefix(%d) = %q, want %q", digits, got, want)
+		}
+	}
+}
+
+func TestNormalizePrefixAndDigits(t *testing.T) {
+	tests := []struct {
+		raw    string
+		prefix string
+		digits string
+	}{
+		{raw: "0912", prefix: "+98912", digits: "912"},
+		{raw: "98912", prefix: "+98912", digits: "98912"},
+		{raw: "912", prefix: "+98912", digits: "912"},
+		{raw: "+4477", prefix: "+4477", digits: "4477"},
+		{raw: "۰۹۱۲ ۱۲", prefix: "+9891212", digits: "91212"},
+		{raw: "09x", prefix: "", digits: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := NormalizePrefix(tt.raw); got != tt.prefix {
+				t.Errorf("NormalizePrefix(%q) = %q, want %q", tt.raw, got, tt.prefix)
+			}
+			if got := Digits(tt.raw); got != tt.digits {
+				t.Errorf("Digits(%q) = %q, want %q", tt.raw, got, tt.digits)
+			}
+		})
+	}
+}
+
+func TestSetDefaultRegion(t *testing.T) {
+	t.Cleanup(func() { _ = SetDefaultRegion(DefaultRegion) })
+
+	if err := SetDefaultRegion("xx"); err == nil {
+		t.Fatal("expected an unsupported region to be refused")
+	}
+	if err := SetDefaultRegion(" gb "); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := Normalize("07700 900123"); got != "+447700900123" {
+		t.Errorf("Normalize in GB = %q", got)
+	}
+	if got, _ := Normalize("09121234567"); got != "" {
+		t.Errorf("an Iranian national number read in GB = %q", got)
+	}
+	if !SupportedRegion("TR") || SupportedRegion("XX") {
+		t.Error("SupportedRegion disagrees with the countries")
+	}
+}
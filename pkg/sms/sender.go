@@ -0,0 +1,41 @@
+// Package sms delivers text messages to phones.
+package sms
+
+import (
+	"authentication/utils/logger"
+	"context"
+)
+
+// Sender delivers one text message. Implementations wrap an SMS gateway.
+type Sender interface {
+	Send(ctx context.Context, phone, text string) error
+}
+
+// HealthChecker is implemented by senders that can tell whether their gateway takes
+// messages, for the readiness check.
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+// Health asks sender whether it can deliver messages. Senders that cannot tell are assumed
+// to be able to.
+func Health(ctx context.Context, sender Sender) error {
+	if checker, ok := sender.(HealthChecker); ok {
+		return checker.Health(ctx)
+	}
+	return nil
+}
+
+type logSender struct{}
+
+// NewLogSender returns a Sender that only writes messages to the log. It stands in for a
+// gateway during development; never use it where the log is less private than the phone.
+func NewLogSender() Sender {
+	return logSender{}
+}
+
+func (logSender) Send(ctx context.Context, phone, text string) error {
+	// The text holds the code: it is redacted unless LOG_REDACT=false.
+	logger.FromContext(ctx).Info().Str("handle", "SMS").Str("to", phone).Str("sms_text", text).Msg("SMS sent")
+	return nil
+}
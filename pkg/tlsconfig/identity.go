@@ -0,0 +1,56 @@
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// MachineKey is the context key holding the name of the machine a request comes from.
+const MachineKey = "machine"
+
+// DefaultMachineRole is the role of machines whose identity does not name one.
+const DefaultMachineRole = "service"
+
+// Identity is the machine a client certificate stands for, and the role it acts with.
+type Identity struct {
+	Name string
+	Role string
+}
+
+// Identities maps certificate subjects, a URI SAN such as a SPIFFE ID or a common name, to
+// the machines they stand for.
+type Identities map[string]Identity
+
+// ParseIdentities reads comma-separated "<subject>=<name>[:<role>]" entries, such as
+// "spiffe://acme.internal/billing=billing:admin,reports.acme.internal=reports".
+func ParseIdentities(entries string) (Identities, error) {
+	identities := make(Identities)
+	for _, entry := range strings.Split(entries, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		subject, identity, ok := strings.Cut(entry, "=")
+		name, role, _ := strings.Cut(identity, ":")
+		subject, name, role = strings.TrimSpace(subject), strings.TrimSpace(name), strings.TrimSpace(role)
+		if !ok || subject == "" || name == "" {
+			return nil, fmt.Errorf("invalid machine identity %q", entry)
+		}
+		if role == "" {
+			role = DefaultMachineRole
+		}
+		identities[subject] = Identity{Name: name, Role: role}
+	}
+	return identities, nil
+}
+
+// Of is the identity of cert, looked up by its URI SANs and then its common name.
+func (ids Identities) Of(cert *x509.Certificate) (Identity, bool) {
+	for _, uri := range cert.URIs {
+		if identity, ok := ids[uri.String()]; ok {
+			return identity, true
+		}
+	}
+	identity, ok := ids[cert.Subject.CommonName]
+	return identity, ok
+}
@@ -0,0 +1,79 @@
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func TestParseIdentities(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries string
+		want    Identities
+		wantErr bool
+	}{
+		{"empty", "", Identities{}, false},
+		{"default role", "reports.acme.internal=reports", Identities{"reports.acme.internal": {Name: "reports", Role: DefaultMachineRole}}, false},
+		{
+			"several with spaces",
+			" spiffe://acme.internal/billing = billing : admin , reports.acme.internal=reports,",
+			Identities{
+				"spiffe://acme.internal/billing": {Name: "billing", Role: "admin"},
+				"reports.acme.internal":          {Name: "reports", Role: DefaultMachineRole},
+			},
+			false,
+		},
+		{"no name", "reports.acme.internal=", nil, true},
+		{"no subject", "=reports", nil, true},
+		{"no separator", "reports", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIdentities(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIdentities(%q) error = %v, wantErr %v", tt.entries, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseIdentities(%q) = %v, want %v", tt.entries, got, tt.want)
+			}
+			for subject, identity := range tt.want {
+				if got[subject] != identity {
+					t.Errorf("ParseIdentities(%q)[%q] = %v, want %v", tt.entries, subject, got[subject], identity)
+				}
+			}
+		})
+	}
+}
+
+func TestIdentitiesOf(t *testing.T) {
+	ids, err := ParseIdentities("spiffe://acme.internal/billing=billing:admin,reports.acme.internal=reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffe := func(path string) []*url.URL {
+		return []*url.URL{{Scheme: "spiffe", Host: "acme.internal", Path: path}}
+	}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		want   Identity
+		wantOK bool
+	}{
+		{"URI SAN", &x509.Certificate{URIs: spiffe("/billing")}, Identity{Name: "billing", Role: "admin"}, true},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "reports.acme.internal"}}, Identity{Name: "reports", Role: DefaultMachineRole}, true},
+		{"URI SAN first", &x509.Certificate{URIs: spiffe("/billing"), Subject: pkix.Name{CommonName: "reports.acme.internal"}}, Identity{Name: "billing", Role: "admin"}, true},
+		{"unknown URI SAN, known common name", &x509.Certificate{URIs: spiffe("/other"), Subject: pkix.Name{CommonName: "reports.acme.internal"}}, Identity{Name: "reports", Role: DefaultMachineRole}, true},
+		{"unknown", &x509.Certificate{URIs: spiffe("/other"), Subject: pkix.Name{CommonName: "other.acme.internal"}}, Identity{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ids.Of(tt.cert)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Of() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
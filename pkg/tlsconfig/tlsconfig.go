@@ -0,0 +1,153 @@
+// Package tlsconfig builds the TLS settings of the service's listeners.
+package tlsconfig
+
+import (
+	"authentication/utils/logger"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// cipherSuites are the TLS 1.2 suites offered: forward secret AEADs only. TLS 1.3 suites are
+// not configurable and all fine.
+var cipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// ParseVersion reads "1.2" or "1.3", the TLS versions clients may be held to.
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q", version)
+}
+
+// Server is the TLS configuration of a listener serving the certificate of reloader.
+func Server(reloader *Reloader, minVersion uint16) *tls.Config {
+	return &tls.Config{
+		MinVersion:       minVersion,
+		CipherSuites:     cipherSuites,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		GetCertificate:   reloader.GetCertificate,
+	}
+}
+
+// Mutual is Server that also requires clients to present a certificate issued by one of
+// clientCAs.
+func Mutual(reloader *Reloader, minVersion uint16, clientCAs *x509.CertPool) *tls.Config {
+	config := Server(reloader, minVersion)
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.ClientCAs = clientCAs
+	return config
+}
+
+// LoadCertPool reads the PEM certificates of file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificate", file)
+	}
+	return pool, nil
+}
+
+// Reloader serves a certificate and key from files, and picks up new ones when the files
+// change, such as when cert-manager renews them, without dropping connections.
+type Reloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+	// version tells whether the files changed since they were loaded.
+	version string
+}
+
+// NewReloader loads the certificate and key of certFile and keyFile.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Watch checks the files every interval until ctx is done. A pair that does not load, such
+// as a certificate written before its key, is logged and the current one kept.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.reload()
+		switch {
+		case err != nil:
+			logger.Logger().Warn().Str("handle", "TLS").Err(err).Str("cert_file", r.certFile).Msg("certificate not reloaded")
+		case reloaded:
+			logger.Logger().Info().Str("handle", "TLS").Str("cert_file", r.certFile).
+				Time("not_after", r.cert.Load().Leaf.NotAfter).Msg("certificate reloaded")
+		}
+	}
+}
+
+// reload loads the files when they changed since the last time, and tells whether it did.
+func (r *Reloader) reload() (bool, error) {
+	version, err := fileVersion(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if version == r.version {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, err
+		}
+	}
+	r.cert.Store(&cert)
+	r.version = version
+	return true, nil
+}
+
+// fileVersion changes whenever one of files is written or replaced.
+func fileVersion(files ...string) (string, error) {
+	var version string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		if info.IsDir() {
+			return "", errors.New(file + " is a directory")
+		}
+		version += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return version, nil
+}
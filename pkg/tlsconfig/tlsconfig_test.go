@@ -0,0 +1,192 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for commonName and its key to certFile and
+// keyFile.
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile != "" {
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{"", tls.VersionTLS12, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"TLS1.3", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseVersion(%q) error = %v, wantErr %v", tt.version, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseVersion(%q) = %x, want %x", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	writeCert(t, ca, "", "test CA")
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{"PEM", ca, false},
+		{"not PEM", notPEM, true},
+		{"missing", filepath.Join(dir, "missing.pem"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := LoadCertPool(tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadCertPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && pool == nil {
+				t.Error("LoadCertPool() returned no pool")
+			}
+		})
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "auth.test")
+	reloader, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := Server(reloader, tls.VersionTLS13)
+	if server.MinVersion != tls.VersionTLS13 || server.ClientAuth != tls.NoClientCert {
+		t.Errorf("Server() = min version %x, client auth %v, want TLS 1.3 without client certificates", server.MinVersion, server.ClientAuth)
+	}
+	if cert, _ := server.GetCertificate(nil); cert == nil || cert.Leaf.Subject.CommonName != "auth.test" {
+		t.Errorf("GetCertificate() = %v, want the auth.test certificate", cert)
+	}
+
+	pool := x509.NewCertPool()
+	mutual := Mutual(reloader, tls.VersionTLS12, pool)
+	if mutual.ClientAuth != tls.RequireAndVerifyClientCert || mutual.ClientCAs != pool {
+		t.Errorf("Mutual() = client auth %v, want client certificates verified with the pool", mutual.ClientAuth)
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Fatal("NewReloader() of missing files succeeded")
+	}
+	writeCert(t, certFile, keyFile, "first.test")
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, _ := r.GetCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+
+	tests := []struct {
+		name         string
+		change       func()
+		wantReloaded bool
+		wantErr      bool
+		want         string
+	}{
+		{"unchanged", func() {}, false, false, "first.test"},
+		{"renewed", func() { writeCert(t, certFile, keyFile, "second.test") }, true, false, "second.test"},
+		// A certificate written before its key does not match the old key: the current pair stays.
+		{"certificate without its key", func() { writeCert(t, certFile, "", "third.test") }, false, true, "second.test"},
+		{"key written too", func() { writeCert(t, certFile, keyFile, "fourth.test") }, true, false, "fourth.test"},
+		{"removed", func() { os.Remove(keyFile) }, false, true, "fourth.test"},
+	}
+	for _, tt := range tests {
+		tt.change()
+		reloaded, err := r.reload()
+		if reloaded != tt.wantReloaded || (err != nil) != tt.wantErr {
+			t.Errorf("%s: reload() = %v, %v, want %v, error %v", tt.name, reloaded, err, tt.wantReloaded, tt.wantErr)
+		}
+		if got := commonName(); got != tt.want {
+			t.Errorf("%s: certificate of %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileVersion(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "tls.crt")
+	if err := os.WriteFile(file, []byte("one"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before, err := fileVersion(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("three"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := fileVersion(file); err != nil || after == before {
+		t.Errorf("fileVersion() after a write = %q, %v, want a new version", after, err)
+	}
+	if _, err := fileVersion(dir); err == nil {
+		t.Error("fileVersion() of a directory succeeded")
+	}
+}
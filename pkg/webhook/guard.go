@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrForbiddenAddress is the error of an endpoint on an internal address.
+var ErrForbiddenAddress = errors.New("webhook: endpoint address not allowed")
+
+// Guard keeps deliveries away from the service's own network: loopback, link-local,
+// private and unspecified addresses are refused, unless they are in Allowed. Otherwise
+// whoever registers a webhook could have the service post to internal endpoints, such as
+// a cloud metadata service.
+type Guard struct {
+	Allowed []netip.Prefix
+}
+
+// ParseNetworks reads comma-separated CIDR ranges and addresses.
+func ParseNetworks(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Check returns ErrForbiddenAddress for an internal addr that is not allowed.
+func (g Guard) Check(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range g.Allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+	}
+	return nil
+}
+
+// CheckURL validates the URL of an endpoint: http or https, with a host that, when it is
+// an address, is allowed. Host names are checked when they are dialed, see Control.
+func (g Guard) CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook: endpoint scheme %q is not http or https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("webhook: endpoint without a host")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return g.Check(addr)
+	}
+	return nil
+}
+
+// Control is a net.Dialer Control function that refuses to connect to addresses Check
+// refuses. It runs once names are resolved, so a name that points inside is refused too.
+func (g Guard) Control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	return g.Check(addr)
+}
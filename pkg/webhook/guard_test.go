@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"10.1.2.0/24", []string{"10.1.2.0/24"}, false},
+		{" 10.1.2.3/24 , fd00::/8,192.168.0.7 ", []string{"10.1.2.0/24", "fd00::/8", "192.168.0.7/32"}, false},
+		{"::ffff:10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{"10.0.0.0/33", nil, true},
+		{"intranet", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseNetworks(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNetworks(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseNetworks(%q) = %v, want %v", tt.raw, got, tt.want)
+			}
+			for i := range got {
+				if got[i].String() != tt.want[i] {
+					t.Errorf("ParseNetworks(%q) = %v, want %v", tt.raw, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGuardCheck(t *testing.T) {
+	guard := Guard{Allowed: []netip.Prefix{netip.MustParsePrefix("10.20.0.0/16")}}
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"203.0.113.10", true},
+		{"2001:db8::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"fd12::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"10.20.30.40", true},
+		{"::ffff:10.20.30.40", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			err := guard.Check(netip.MustParseAddr(tt.addr))
+			if (err == nil) != tt.allowed {
+				t.Fatalf("Check(%s) = %v, want allowed %v", tt.addr, err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrForbiddenAddress) {
+				t.Errorf("Check(%s) = %v, want ErrForbiddenAddress", tt.addr, err)
+			}
+		})
+	}
+}
+
+func TestGuardCheckURL(t *testing.T) {
+	guard := Guard{}
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://crm.example.com/hooks", false},
+		{"http://203.0.113.10:8080/hooks", false},
+		// Names are checked once resolved, by Control.
+		{"http://localhost/hooks", false},
+		{"ftp://crm.example.com/hooks", true},
+		{"https:///hooks", true},
+		{"crm.example.com/hooks", true},
+		{"http://127.0.0.1:8080/hooks", true},
+		{"http://[::1]/hooks", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://%zz", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := guard.CheckURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("CheckURL(%q) = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGuardControl(t *testing.T) {
+	guard := Guard{Allowed: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{"203.0.113.10:443", false},
+		{"127.0.0.1:8080", false},
+		{"[::1]:8080", true},
+		{"10.0.0.1:80", true},
+		{"[fe80::1%eth0]:80", true},
+		{"no-port", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if err := guard.Control("tcp", tt.address, nil); (err != nil) != tt.wantErr {
+				t.Errorf("Control(%q) = %v, wantErr %v", tt.address, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+// Package webhook describes the user events other services subscribe to, and how their
+// deliveries are signed so that receivers can tell they come from this service.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event types.
+const (
+	UserCreated       = "user.created"
+	UserLoggedIn      = "user.logged_in"
+	UserUpdated       = "user.updated"
+	UserStatusChanged = "user.status_changed"
+	SessionsRevoked   = "user.sessions_revoked"
+)
+
+// Types lists every event type.
+var Types = []string{UserCreated, UserLoggedIn, UserUpdated, UserStatusChanged, SessionsRevoked}
+
+// Event is something that happened to a user, as subscribers receive it.
+type Event struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	CreatedAt time.Time         `json:"created_at"`
+	Data      map[string]string `json:"data"`
+}
+
+// Subscription is an endpoint that receives the events of the types in Events.
+type Subscription struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret signs the deliveries. It is only shown when the subscription is created.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Wants tells whether the subscription receives events of eventType.
+func (s Subscription) Wants(eventType string) bool {
+	for _, t := range s.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery statuses.
+const (
+	// Pending deliveries wait for their first attempt, or for a retry after failed ones.
+	Pending   = "pending"
+	Delivered = "delivered"
+	// Dead deliveries failed every attempt; they are only retried on request.
+	Dead = "dead"
+)
+
+// Delivery is an event on its way to one subscription, and what came of the attempts to
+// send it. Payload is the body of every attempt.
+type Delivery struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	// NextAttemptAt is when a pending delivery is due.
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Headers of a delivery.
+const (
+	// SignatureHeader carries the signature of the body; see Sign.
+	SignatureHeader = "X-Webhook-Signature"
+	// EventHeader carries the event type.
+	EventHeader = "X-Webhook-Event"
+	// DeliveryHeader carries the delivery ID, the same for every attempt.
+	DeliveryHeader = "X-Webhook-Delivery"
+)
+
+var (
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrSignatureExpired = errors.New("webhook: signature timestamp out of tolerance")
+)
+
+// NewID returns a random ID starting with prefix, such as "wh_3f9a...".
+func NewID(prefix string) string {
+	id := make([]byte, 12)
+	_, _ = rand.Read(id)
+	return prefix + hex.EncodeToString(id)
+}
+
+// NewSecret returns a random signing secret.
+func NewSecret() string {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return "whsec_" + hex.EncodeToString(secret)
+}
+
+// Sign returns the signature header of body sent at t: "t=<unix seconds>,v1=<hex>", where
+// the hex is the HMAC-SHA256 of "<unix seconds>.<body>" keyed with secret. The timestamp
+// is signed along with the body, so receivers can refuse replayed deliveries.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac(secret, timestamp, body))
+}
+
+// Verify checks that header signs body with secret, at most tolerance away from now.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if signature, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, signature)
+			}
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: no timestamp", ErrInvalidSignature)
+	}
+	expected := mac(secret, timestamp, body)
+	valid := false
+	for _, signature := range signatures {
+		valid = valid || hmac.Equal(signature, expected)
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func mac(secret, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Backoff is how long to wait after the failed attempt number attempt (from 1) before the
+// next one: base, doubled after every failure, up to ceiling.
+func Backoff(attempt int, base, ceiling time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < ceiling; i++ {
+		delay *= 2
+	}
+	return min(delay, ceiling)
+}
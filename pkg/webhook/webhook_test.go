@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	sent := time.Unix(1735689600, 0)
+	body := []byte(`{"id":"evt_1"}`)
+	header := Sign("whsec_secret", sent, body)
+	if !strings.HasPrefix(header, "t=1735689600,v1=") {
+		t.Fatalf("Sign() = %q, want the timestamp then the signature", header)
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		header  string
+		body    []byte
+		now     time.Time
+		wantErr error
+	}{
+		{"valid", "whsec_secret", header, body, sent.Add(time.Minute), nil},
+		{"rotated secret among several", "whsec_secret", Sign("whsec_old", sent, body) + "," + strings.Split(header, ",")[1], body, sent, nil},
+		{"other secret", "whsec_other", header, body, sent, ErrInvalidSignature},
+		{"changed body", "whsec_secret", header, []byte(`{"id":"evt_2"}`), sent, ErrInvalidSignature},
+		{"changed timestamp", "whsec_secret", strings.Replace(header, "t=1735689600", "t=1735689601", 1), body, sent, ErrInvalidSignature},
+		{"no timestamp", "whsec_secret", strings.Split(header, ",")[1], body, sent, ErrInvalidSignature},
+		{"no signature", "whsec_secret", "t=1735689600", body, sent, ErrInvalidSignature},
+		{"not hex", "whsec_secret", "t=1735689600,v1=zz", body, sent, ErrInvalidSignature},
+		{"too old", "whsec_secret", header, body, sent.Add(6 * time.Minute), ErrSignatureExpired},
+		{"from the future", "whsec_secret", header, body, sent.Add(-6 * time.Minute), ErrSignatureExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.secret, tt.header, tt.body, 5*time.Minute, tt.now)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt, 30*time.Second, time.Hour); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionWants(t *testing.T) {
+	s := Subscription{Events: []string{UserCreated, SessionsRevoked}}
+	for _, eventType := range Types {
+		want := eventType == UserCreated || eventType == SessionsRevoked
+		if got := s.Wants(eventType); got != want {
+			t.Errorf("Wants(%q) = %v, want %v", eventType, got, want)
+		}
+	}
+}
+
+func TestNewIDAndSecret(t *testing.T) {
+	if a, b := NewID("wh_"), NewID("wh_"); !strings.HasPrefix(a, "wh_") || len(a) != len("wh_")+24 || a == b {
+		t.Errorf("NewID() = %q, %q, want distinct prefixed IDs", a, b)
+	}
+	if a, b := NewSecret(), NewSecret(); !strings.HasPrefix(a, "whsec_") || len(a) != len("whsec_")+64 || a == b {
+		t.Errorf("NewSecret() = %q, %q, want distinct secrets", a, b)
+	}
+}
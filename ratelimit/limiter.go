@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/go-redis/redis_rate/v10"
+	"time"
+)
+
+// WaitKey holds, in the gin context of a rate-limited route, how long the client has to
+// wait before the route's policies accept another request.
+const WaitKey = "rate_limit_wait"
+
+// RateLimiter reports whether an event identified by key may happen under the given limit.
+// Results use the redis_rate types so every implementation behaves like the Redis GCRA limiter.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit redis_rate.Limit) (*redis_rate.Result, error)
+	// AllowN charges n events at once. With n = 0 nothing is charged: Remaining tells how
+	// many events the key has left, and is 0 when the next one would be refused.
+	AllowN(ctx context.Context, key string, limit redis_rate.Limit, n int) (*redis_rate.Result, error)
+}
+
+// NextAfter is how long after res the next request on the same key would be allowed.
+func NextAfter(res *redis_rate.Result) time.Duration {
+	if res.Allowed == 0 {
+		return res.RetryAfter
+	}
+	if res.Remaining > 0 {
+		return 0
+	}
+	// The request took the last unit of burst: the next one frees up an emission interval
+	// after the burst window started.
+	interval := res.Limit.Period / time.Duration(res.Limit.Rate)
+	wait := res.ResetAfter - time.Duration(res.Limit.Burst-1)*interval
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
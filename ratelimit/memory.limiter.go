@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis_rate/v10"
+)
+
+// maxMemoryKeys is how many keys are kept before those that expired are swept.
+const maxMemoryKeys = 10000
+
+// memoryLimiter is a process-local GCRA limiter that mirrors the redis_rate Lua script,
+// so tests and local runs see the same Remaining/RetryAfter values as production.
+type memoryLimiter struct {
+	mu  sync.Mutex
+	tat map[string]time.Time
+}
+
+func NewMemoryLimiter() RateLimiter {
+	return &memoryLimiter{
+		tat: make(map[string]time.Time),
+	}
+}
+
+func (l *memoryLimiter) Allow(ctx context.Context, key string, limit redis_rate.Limit) (*redis_rate.Result, error) {
+	return l.AllowN(ctx, key, limit, 1)
+}
+
+func (l *memoryLimiter) AllowN(ctx context.Context, key string, limit redis_rate.Limit, n int) (*redis_rate.Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.tat) > maxMemoryKeys {
+		l.sweep(now)
+	}
+
+	emissionInterval := limit.Period / time.Duration(limit.Rate)
+	burstOffset := emissionInterval * time.Duration(limit.Burst)
+
+	tat, ok := l.tat[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(emissionInterval * time.Duration(n))
+	allowAt := newTat.Add(-burstOffset)
+	diff := now.Sub(allowAt)
+
+	if diff < 0 {
+		return &redis_rate.Result{
+			Limit:      limit,
+			Allowed:    0,
+			Remaining:  0,
+			RetryAfter: -diff,
+			ResetAfter: tat.Sub(now),
+		}, nil
+	}
+
+	if n > 0 {
+		l.tat[key] = newTat
+	}
+
+	return &redis_rate.Result{
+		Limit:      limit,
+		Allowed:    n,
+		Remaining:  int(diff / emissionInterval),
+		RetryAfter: -1,
+		ResetAfter: newTat.Sub(now),
+	}, nil
+}
+
+// sweep drops keys whose theoretical arrival time has passed; they are equivalent to unseen keys.
+func (l *memoryLimiter) sweep(now time.Time) {
+	for key, tat := range l.tat {
+		if tat.Before(now) {
+			delete(l.tat, key)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis_rate/v10"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	limit := redis_rate.Limit{Rate: 3, Period: time.Hour, Burst: 3}
+
+	tests := []struct {
+		name          string
+		n             int
+		wantAllowed   int
+		wantRemaining int
+	}{
+		{"peek at an unseen key", 0, 0, 3},
+		{"first", 1, 1, 2},
+		{"peek does not charge", 0, 0, 2},
+		{"second", 1, 1, 1},
+		{"third", 1, 1, 0},
+		{"peek when used up", 0, 0, 0},
+		{"refused", 1, 0, 0},
+		{"refused at once", 2, 0, 0},
+	}
+	l := NewMemoryLimiter()
+	for _, tt := range tests {
+		res, err := l.AllowN(context.Background(), "otp:+989120000000", limit, tt.n)
+		if err != nil {
+			t.Fatalf("%s: AllowN() error = %v", tt.name, err)
+		}
+		if res.Allowed != tt.wantAllowed || res.Remaining != tt.wantRemaining {
+			t.Errorf("%s: AllowN() = allowed %d, remaining %d, want %d, %d", tt.name, res.Allowed, res.Remaining, tt.wantAllowed, tt.wantRemaining)
+		}
+		if tt.wantAllowed == 0 && tt.n > 0 && res.RetryAfter <= 0 {
+			t.Errorf("%s: RetryAfter = %v, want it positive", tt.name, res.RetryAfter)
+		}
+	}
+
+	// Keys are counted apart.
+	res, err := l.Allow(context.Background(), "otp:+989120000001", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed != 1 || res.Remaining != 2 {
+		t.Errorf("Allow() on another key = allowed %d, remaining %d, want 1, 2", res.Allowed, res.Remaining)
+	}
+}
+
+func TestNextAfter(t *testing.T) {
+	limit := redis_rate.Limit{Rate: 6, Period: time.Minute, Burst: 3}
+
+	tests := []struct {
+		name string
+		res  redis_rate.Result
+		want time.Duration
+	}{
+		{"refused", redis_rate.Result{Limit: limit, RetryAfter: 7 * time.Second, ResetAfter: 30 * time.Second}, 7 * time.Second},
+		{"room left", redis_rate.Result{Limit: limit, Allowed: 1, Remaining: 1, ResetAfter: 20 * time.Second}, 0},
+		// The burst window began 30s-2*10s ago: the next request waits for its first 10s.
+		{"last of the burst", redis_rate.Result{Limit: limit, Allowed: 1, ResetAfter: 30 * time.Second}, 10 * time.Second},
+		{"window over", redis_rate.Result{Limit: limit, Allowed: 1, ResetAfter: 15 * time.Second}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NextAfter(&tt.res); got != tt.want {
+				t.Errorf("NextAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package ratelimit
+
+import (
+	"authentication/utils/logger"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis_rate/v10"
+)
+
+// Scope is what a policy counts requests by.
+type Scope string
+
+const (
+	// ScopePhone counts per normalized phoneNumber of the request body.
+	ScopePhone Scope = "phone"
+	// ScopeIP counts per client IP address.
+	ScopeIP Scope = "ip"
+	// ScopeSubnet counts per network of the client IP address, /24 and /64 by default.
+	ScopeSubnet Scope = "subnet"
+	// ScopeDevice counts per DeviceHeader value.
+	ScopeDevice Scope = "device"
+	// ScopeGlobal counts every request to the routes together.
+	ScopeGlobal Scope = "global"
+)
+
+// DeviceHeader carries the client's device fingerprint for ScopeDevice policies.
+const DeviceHeader = "X-Device-ID"
+
+// Policy is a named limit applied to the routes it lists. Its counters are stored under
+// "<name>:<subject>", so renaming a policy starts it from scratch.
+type Policy struct {
+	Name   string   `json:"name"`
+	Routes []string `json:"routes"`
+	Scope  Scope    `json:"scope"`
+	// Rate requests are allowed per Period; Burst, which defaults to Rate, of them at once.
+	Rate   int      `json:"rate"`
+	Period Duration `json:"period"`
+	Burst  int      `json:"burst,omitempty"`
+	// DryRun only logs the requests the policy would refuse.
+	DryRun bool `json:"dry_run,omitempty"`
+	// IPv4Prefix and IPv6Prefix size the networks of ScopeSubnet policies.
+	IPv4Prefix int `json:"ipv4_prefix,omitempty"`
+	IPv6Prefix int `json:"ipv6_prefix,omitempty"`
+}
+
+// Default network sizes of ScopeSubnet: what one customer or hosting tenant usually gets.
+const (
+	DefaultIPv4Prefix = 24
+	DefaultIPv6Prefix = 64
+)
+
+// Subnet is the network of ip that a ScopeSubnet policy counts by, such as 203.0.113.0/24.
+func (p Policy) Subnet(ip netip.Addr) string {
+	bits := p.IPv6Prefix
+	if bits == 0 {
+		bits = DefaultIPv6Prefix
+	}
+	if ip = ip.Unmap(); ip.Is4() {
+		bits = p.IPv4Prefix
+		if bits == 0 {
+			bits = DefaultIPv4Prefix
+		}
+	}
+	prefix, _ := ip.Prefix(bits)
+	return prefix.String()
+}
+
+func (p Policy) Limit() redis_rate.Limit {
+	burst := p.Burst
+	if burst == 0 {
+		burst = p.Rate
+	}
+	return redis_rate.Limit{Rate: p.Rate, Period: time.Duration(p.Period), Burst: burst}
+}
+
+// Duration reads durations such as "10m" from JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config is the shape of the RATE_LIMIT_CONFIG file.
+type Config struct {
+	// DryRun puts every policy in dry-run mode.
+	DryRun   bool     `json:"dry_run"`
+	Policies []Policy `json:"policies"`
+}
+
+// DefaultConfig is used when no configuration file is given. The address limits are loose
+// because mobile carriers put many subscribers behind one address.
+func DefaultConfig() Config {
+	return Config{Policies: []Policy{
+		{Name: "otp_request", Routes: []string{"send_otp"}, Scope: ScopePhone, Rate: 3, Period: Duration(10 * time.Minute)},
+		{Name: "otp_request_ip", Routes: []string{"send_otp"}, Scope: ScopeIP, Rate: 30, Period: Duration(time.Hour)},
+		{Name: "otp_request_subnet", Routes: []string{"send_otp"}, Scope: ScopeSubnet, Rate: 100, Period: Duration(time.Hour)},
+		{Name: "login", Routes: []string{"login"}, Scope: ScopePhone, Rate: 3, Period: Duration(10 * time.Minute)},
+		{Name: "login_ip", Routes: []string{"login"}, Scope: ScopeIP, Rate: 60, Period: Duration(time.Hour)},
+		{Name: "login_subnet", Routes: []string{"login"}, Scope: ScopeSubnet, Rate: 200, Period: Duration(time.Hour)},
+		{Name: "refresh", Routes: []string{"refresh"}, Scope: ScopePhone, Rate: 10, Period: Duration(10 * time.Minute)},
+		{Name: "refresh_ip", Routes: []string{"refresh"}, Scope: ScopeIP, Rate: 120, Period: Duration(time.Hour)},
+	}}
+}
+
+func (c Config) validate() error {
+	names := make(map[string]bool, len(c.Policies))
+	for _, p := range c.Policies {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("rate limit policy without a name")
+		case names[p.Name]:
+			return fmt.Errorf("rate limit policy %q is defined twice", p.Name)
+		case p.Scope != ScopePhone && p.Scope != ScopeIP && p.Scope != ScopeSubnet && p.Scope != ScopeDevice && p.Scope != ScopeGlobal:
+			return fmt.Errorf("rate limit policy %q: unknown scope %q", p.Name, p.Scope)
+		case p.Rate <= 0 || p.Period <= 0 || p.Burst < 0:
+			return fmt.Errorf("rate limit policy %q: rate and period must be positive", p.Name)
+		case p.IPv4Prefix < 0 || p.IPv4Prefix > 32 || p.IPv6Prefix < 0 || p.IPv6Prefix > 128:
+			return fmt.Errorf("rate limit policy %q: invalid subnet prefix length", p.Name)
+		}
+		names[p.Name] = true
+	}
+	return nil
+}
+
+// Policies holds the current configuration. Reload swaps it while requests are served.
+type Policies struct {
+	path   string
+	config atomic.Pointer[Config]
+}
+
+// NewPolicies uses config as is; Reload has no file to read.
+func NewPolicies(config Config) (*Policies, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	p := &Policies{}
+	p.config.Store(&config)
+	return p, nil
+}
+
+// LoadPolicies reads the JSON configuration at path.
+func LoadPolicies(path string) (*Policies, error) {
+	p := &Policies{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the configuration file again. On error the current policies stay in force.
+func (p *Policies) Reload() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %w", p.path, err)
+	}
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("%s: %w", p.path, err)
+	}
+	p.config.Store(&config)
+	return nil
+}
+
+// ReloadOn reloads the configuration whenever the process receives one of signals.
+func (p *Policies) ReloadOn(signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		for range ch {
+			if err := p.Reload(); err != nil {
+				logger.LogErrorWithDepth(map[string]interface{}{
+					"error":   err,
+					"depth":   1,
+					"message": "Rate limit policies not reloaded",
+				})
+				continue
+			}
+			logger.LogInfo("RATELIMIT", "policies reloaded from "+p.path)
+		}
+	}()
+}
+
+// For lists the policies applied to route, with the global dry-run switch folded in.
+func (p *Policies) For(route string) []Policy {
+	config := p.config.Load()
+	var matched []Policy
+	for _, policy := range config.Policies {
+		for _, r := range policy.Routes {
+			if r == route {
+				policy.DryRun = policy.DryRun || config.DryRun
+				matched = append(matched, policy)
+				break
+			}
+		}
+	}
+	return matched
+}
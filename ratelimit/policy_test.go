@@ -0,0 +1,156 @@
+package ratelimit
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis_rate/v10"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := Policy{Name: "otp", Routes: []string{"send_otp"}, Scope: ScopePhone, Rate: 3, Period: Duration(time.Minute)}
+	with := func(change func(p *Policy)) Policy {
+		p := valid
+		change(&p)
+		return p
+	}
+
+	tests := []struct {
+		name     string
+		policies []Policy
+		wantErr  bool
+	}{
+		{"valid", []Policy{valid}, false},
+		{"defaults", DefaultConfig().Policies, false},
+		{"no name", []Policy{with(func(p *Policy) { p.Name = "" })}, true},
+		{"twice", []Policy{valid, valid}, true},
+		{"unknown scope", []Policy{with(func(p *Policy) { p.Scope = "sms" })}, true},
+		{"no rate", []Policy{with(func(p *Policy) { p.Rate = 0 })}, true},
+		{"no period", []Policy{with(func(p *Policy) { p.Period = 0 })}, true},
+		{"negative burst", []Policy{with(func(p *Policy) { p.Burst = -1 })}, true},
+		{"IPv4 prefix", []Policy{with(func(p *Policy) { p.IPv4Prefix = 33 })}, true},
+		{"IPv6 prefix", []Policy{with(func(p *Policy) { p.IPv6Prefix = 129 })}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicies(Config{Policies: tt.policies})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPolicies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `{"dry_run": true, "policies": [{"name": "otp", "routes": ["send_otp"], "scope": "ip", "rate": 3, "period": "10m"}]}`, false},
+		{"bad JSON", `{"policies": [`, true},
+		{"bad period", `{"policies": [{"name": "otp", "scope": "ip", "rate": 3, "period": "ten minutes"}]}`, true},
+		{"invalid policy", `{"policies": [{"name": "otp", "scope": "sms", "rate": 3, "period": "10m"}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ratelimits.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			policies, err := LoadPolicies(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadPolicies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := policies.For("send_otp")
+			if len(got) != 1 || !got[0].DryRun || time.Duration(got[0].Period) != 10*time.Minute {
+				t.Errorf("For(send_otp) = %+v, want the otp policy in dry run", got)
+			}
+		})
+	}
+
+	if _, err := LoadPolicies(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadPolicies() of a missing file succeeded")
+	}
+}
+
+func TestPoliciesFor(t *testing.T) {
+	policies, err := NewPolicies(Config{Policies: []Policy{
+		{Name: "a", Routes: []string{"login", "send_otp"}, Scope: ScopeIP, Rate: 1, Period: Duration(time.Minute)},
+		{Name: "b", Routes: []string{"login"}, Scope: ScopePhone, Rate: 1, Period: Duration(time.Minute), DryRun: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		route string
+		want  []string
+	}{
+		{"login", []string{"a", "b"}},
+		{"send_otp", []string{"a"}},
+		{"refresh", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			var got []string
+			for _, p := range policies.For(tt.route) {
+				got = append(got, p.Name)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("For(%q) = %v, want %v", tt.route, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("For(%q) = %v, want %v", tt.route, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		want   redis_rate.Limit
+	}{
+		{"burst defaults to rate", Policy{Rate: 3, Period: Duration(time.Minute)}, redis_rate.Limit{Rate: 3, Period: time.Minute, Burst: 3}},
+		{"explicit burst", Policy{Rate: 3, Period: Duration(time.Minute), Burst: 10}, redis_rate.Limit{Rate: 3, Period: time.Minute, Burst: 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Limit(); got != tt.want {
+				t.Errorf("Limit() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicySubnet(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		ip     string
+		want   string
+	}{
+		{"IPv4 default", Policy{}, "203.0.113.77", "203.0.113.0/24"},
+		{"IPv4 prefix", Policy{IPv4Prefix: 16}, "203.0.113.77", "203.0.0.0/16"},
+		{"IPv4-mapped", Policy{}, "::ffff:203.0.113.77", "203.0.113.0/24"},
+		{"IPv6 default", Policy{}, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"IPv6 prefix", Policy{IPv6Prefix: 48}, "2001:db8:1:2:3:4:5:6", "2001:db8:1::/48"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Subnet(netip.MustParseAddr(tt.ip)); got != tt.want {
+				t.Errorf("Subnet(%s) = %q, want %q", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+package ratelimit
+
+import (
+	"github.com/go-redis/redis_rate/v10"
+	"github.com/redis/go-redis/v9"
+)
+
+func NewRedisLimiter(redisConnection redis.UniversalClient) RateLimiter {
+	return redis_rate.NewLimiter(redisConnection)
+}
@@ -0,0 +1,40 @@
+package repositories
+
+import (
+	"authentication/pkg/audit"
+	"authentication/requests"
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryAuditRepository keeps the last maxEvents events in process memory.
+type memoryAuditRepository struct {
+	mu        sync.Mutex
+	ids       auditIDs
+	events    []audit.Event
+	maxEvents int
+}
+
+func NewMemoryAuditRepository(maxEvents int) AuditRepository {
+	return &memoryAuditRepository{maxEvents: maxEvents}
+}
+
+func (r *memoryAuditRepository) Append(ctx context.Context, event audit.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	event.ID = r.ids.next(time.Now()).String()
+	r.events = append(r.events, event)
+	if len(r.events) > r.maxEvents {
+		r.events = append([]audit.Event(nil), r.events[len(r.events)-r.maxEvents:]...)
+	}
+	return nil
+}
+
+func (r *memoryAuditRepository) History(ctx context.Context, phoneHash string, request requests.AuditHistory) (AuditPage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return auditHistory(r.events, phoneHash, request)
+}
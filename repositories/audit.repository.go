@@ -0,0 +1,236 @@
+package repositories
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/audit"
+	"authentication/requests"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AuditRepository is the append-only store of the audit log.
+type AuditRepository interface {
+	// Append writes event and assigns its ID.
+	Append(ctx context.Context, event audit.Event) error
+	// History returns the events of a phone hash, newest first.
+	History(ctx context.Context, phoneHash string, request requests.AuditHistory) (AuditPage, error)
+}
+
+type AuditPage struct {
+	Events     []audit.Event
+	NextCursor string
+}
+
+// Event IDs read "<unix milliseconds>-<sequence>", the shape of Redis stream IDs, and
+// order events in time. They double as pagination cursors.
+type auditID struct {
+	ms, seq uint64
+}
+
+func parseAuditID(id string) (auditID, bool) {
+	ms, seq, found := strings.Cut(id, "-")
+	if !found {
+		return auditID{}, false
+	}
+	var parsed auditID
+	var err1, err2 error
+	parsed.ms, err1 = strconv.ParseUint(ms, 10, 64)
+	parsed.seq, err2 = strconv.ParseUint(seq, 10, 64)
+	return parsed, err1 == nil && err2 == nil
+}
+
+func (id auditID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id auditID) before(other auditID) bool {
+	return id.ms < other.ms || id.ms == other.ms && id.seq < other.seq
+}
+
+// previous is the greatest ID below id, for exclusive ranges.
+func (id auditID) previous() auditID {
+	if id.seq > 0 {
+		return auditID{id.ms, id.seq - 1}
+	}
+	return auditID{id.ms - 1, ^uint64(0)}
+}
+
+// auditIDs hands out increasing IDs to the stores that do not get them from Redis.
+type auditIDs struct {
+	mu   sync.Mutex
+	last auditID
+}
+
+func (g *auditIDs) next(t time.Time) auditID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := auditID{ms: uint64(t.UnixMilli())}
+	if !g.last.before(id) {
+		id = auditID{g.last.ms, g.last.seq + 1}
+	}
+	g.last = id
+	return id
+}
+
+// auditMatches applies the filters of request, other than the cursor, to event.
+func auditMatches(event audit.Event, request requests.AuditHistory) bool {
+	if request.Outcome != "" && event.Outcome != request.Outcome {
+		return false
+	}
+	if !request.From.IsZero() && event.Time.Before(request.From) {
+		return false
+	}
+	if !request.To.IsZero() && event.Time.After(request.To) {
+		return false
+	}
+	if len(request.Types) == 0 {
+		return true
+	}
+	for _, t := range request.Types {
+		if event.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// auditCursor is the ID events of the next page are below, if request has a cursor.
+func auditCursor(request requests.AuditHistory) (auditID, bool, error) {
+	if request.Cursor == "" {
+		return auditID{}, false, nil
+	}
+	id, ok := parseAuditID(request.Cursor)
+	if !ok {
+		return auditID{}, false, apperrors.ErrInvalidCursor
+	}
+	return id, true, nil
+}
+
+// auditHistory pages through events, which are in the order they were written.
+func auditHistory(events []audit.Event, phoneHash string, request requests.AuditHistory) (AuditPage, error) {
+	cursor, hasCursor, err := auditCursor(request)
+	if err != nil {
+		return AuditPage{}, err
+	}
+
+	page := AuditPage{Events: []audit.Event{}}
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if event.PhoneHash != phoneHash || !auditMatches(event, request) {
+			continue
+		}
+		if id, _ := parseAuditID(event.ID); hasCursor && !id.before(cursor) {
+			continue
+		}
+		if int64(len(page.Events)) == request.Limit() {
+			page.NextCursor = page.Events[len(page.Events)-1].ID
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+	return page, nil
+}
+
+const (
+	// auditEventsKey is the stream of every event.
+	auditEventsKey = "audit:events"
+	// auditPhoneEvents is how many events are kept per phone.
+	auditPhoneEvents = 1000
+	// auditBatch is how many entries History reads from a stream at a time.
+	auditBatch = 100
+)
+
+// auditRepository writes events to Redis streams: every event to audit:events, capped at
+// maxEvents, and the events of a phone to its own stream as well, under the same ID.
+type auditRepository struct {
+	redisConnection redis.UniversalClient
+	maxEvents       int64
+}
+
+func NewAuditRepository(redisConnection redis.UniversalClient, maxEvents int64) AuditRepository {
+	return &auditRepository{redisConnection: redisConnection, maxEvents: maxEvents}
+}
+
+func (r *auditRepository) Append(ctx context.Context, event audit.Event) error {
+	event.ID = ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	id, err := r.redisConnection.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditEventsKey,
+		MaxLen: r.maxEvents,
+		Approx: true,
+		Values: []interface{}{"event", data},
+	}).Result()
+	if err != nil || event.PhoneHash == "" {
+		return err
+	}
+
+	// A separate command: the two streams hash to different slots in a cluster.
+	return r.redisConnection.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditPhoneKey(event.PhoneHash),
+		ID:     id,
+		MaxLen: auditPhoneEvents,
+		Approx: true,
+		Values: []interface{}{"event", data},
+	}).Err()
+}
+
+func (r *auditRepository) History(ctx context.Context, phoneHash string, request requests.AuditHistory) (AuditPage, error) {
+	end, start := "+", "-"
+	if !request.To.IsZero() {
+		end = strconv.FormatInt(request.To.UnixMilli(), 10)
+	}
+	if !request.From.IsZero() {
+		start = strconv.FormatInt(request.From.UnixMilli(), 10)
+	}
+	cursor, hasCursor, err := auditCursor(request)
+	if err != nil {
+		return AuditPage{}, err
+	}
+	if hasCursor {
+		end = cursor.previous().String()
+	}
+
+	page := AuditPage{Events: []audit.Event{}}
+	for {
+		messages, err := r.redisConnection.XRevRangeN(ctx, auditPhoneKey(phoneHash), end, start, auditBatch).Result()
+		if err != nil {
+			return AuditPage{}, err
+		}
+		for _, message := range messages {
+			var event audit.Event
+			data, _ := message.Values["event"].(string)
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return AuditPage{}, err
+			}
+			event.ID = message.ID
+			if !auditMatches(event, request) {
+				continue
+			}
+			if int64(len(page.Events)) == request.Limit() {
+				page.NextCursor = page.Events[len(page.Events)-1].ID
+				return page, nil
+			}
+			page.Events = append(page.Events, event)
+		}
+		if len(messages) < auditBatch {
+			return page, nil
+		}
+		last, _ := parseAuditID(messages[len(messages)-1].ID)
+		if last == (auditID{}) {
+			return page, nil
+		}
+		end = last.previous().String()
+	}
+}
@@ -0,0 +1,274 @@
+package repositories
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/requests"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// memoryAuthRepository keeps everything in process memory. It follows the same
+// error and TTL semantics as authRepository so it can stand in for Redis in tests and local runs.
+type memoryAuthRepository struct {
+	mu      sync.Mutex
+	otps    map[string]memoryEntry
+	refresh map[string]memoryEntry
+	users   map[string]map[string]string
+	// index mirrors the Redis creation index, kept sorted by score then phone.
+	index []redis.Z
+}
+
+func NewMemoryAuthRepository() AuthRepository {
+	return &memoryAuthRepository{
+		otps:    make(map[string]memoryEntry),
+		refresh: make(map[string]memoryEntry),
+		users:   make(map[string]map[string]string),
+	}
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func copyUser(user map[string]string) map[string]string {
+	clone := make(map[string]string, len(user))
+	for k, v := range user {
+		clone[k] = v
+	}
+	return clone
+}
+
+func (r *memoryAuthRepository) SetOTP(ctx context.Context, phone string, code int, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := r.otps[phone]; ok && !entry.expired(now) {
+		return apperrors.ErrOTPAlreadySent.WithRetryAfter(entry.expiresAt.Sub(now))
+	}
+	r.otps[phone] = memoryEntry{value: strconv.Itoa(code), expiresAt: expiry(ttl)}
+	return nil
+}
+
+func (r *memoryAuthRepository) GetOTP(ctx context.Context, phone string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.otps[phone]
+	if !ok || entry.expired(time.Now()) {
+		delete(r.otps, phone)
+		return "", apperrors.ErrOTPInvalid
+	}
+	return entry.value, nil
+}
+
+func (r *memoryAuthRepository) DeleteOTP(ctx context.Context, phone string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.otps, phone)
+	return nil
+}
+
+func (r *memoryAuthRepository) DeleteAllOTPs(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	deleted := 0
+	for phone, entry := range r.otps {
+		if !entry.expired(now) {
+			deleted++
+		}
+		delete(r.otps, phone)
+	}
+	return deleted, nil
+}
+
+func (r *memoryAuthRepository) UserExists(ctx context.Context, phone string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.users[phone]
+	return ok, nil
+}
+
+func (r *memoryAuthRepository) CreateUser(ctx context.Context, phone string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	user := map[string]string{
+		"id":         fmt.Sprintf("user-%d", now.UnixNano()),
+		"phone":      phone,
+		"created_at": now.UTC().Format(time.RFC3339),
+		"status":     DefaultUserStatus,
+		"role":       DefaultUserRole,
+	}
+	r.users[phone] = copyUser(user)
+
+	entry := redis.Z{Score: createdScore(now), Member: phone}
+	i := sort.Search(len(r.index), func(i int) bool {
+		return indexLess(entry, r.index[i])
+	})
+	r.index = append(r.index, redis.Z{})
+	copy(r.index[i+1:], r.index[i:])
+	r.index[i] = entry
+
+	return user, nil
+}
+
+func (r *memoryAuthRepository) GetUser(ctx context.Context, phone string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[phone]
+	if !ok {
+		return nil, apperrors.ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
+
+func (r *memoryAuthRepository) SetRefreshToken(ctx context.Context, phone, refreshToken string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refresh[phone] = memoryEntry{value: refreshToken, expiresAt: expiry(ttl)}
+	return nil
+}
+
+func (r *memoryAuthRepository) GetRefreshToken(ctx context.Context, phone string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.refresh[phone]
+	if !ok || entry.expired(time.Now()) {
+		delete(r.refresh, phone)
+		return "", apperrors.ErrInvalidRefreshToken
+	}
+	return entry.value, nil
+}
+
+func (r *memoryAuthRepository) ListUsers(ctx context.Context, request requests.UsersList) (UsersPage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	desc := request.Descending()
+	filter := newUserFilter(request)
+	walker := &indexWalker{
+		skip:  request.Offset(),
+		limit: request.Limit(),
+	}
+
+	if request.Cursor != "" {
+		cursor, ok := decodeCursor(request.Cursor)
+		if !ok || cursor.Desc != desc {
+			return UsersPage{}, apperrors.ErrInvalidCursor
+		}
+		walker.after = cursor
+	}
+
+	// There are no secondary indexes in memory: every record is checked against the filter.
+	entries := make([]redis.Z, 0, len(r.index))
+	for _, entry := range r.index {
+		phone := entry.Member.(string)
+		if entry.Score < filter.createdFrom || entry.Score > filter.createdTo || !filter.matches(phone, r.users[phone]) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	walkSorted(entries, walker, desc)
+
+	users := make([]map[string]string, 0, len(walker.entries))
+	for _, entry := range walker.entries {
+		if user, ok := r.users[entry.Member.(string)]; ok {
+			users = append(users, copyUser(user))
+		}
+	}
+
+	return UsersPage{
+		Users:      users,
+		Total:      int64(len(entries)),
+		NextCursor: walker.nextCursor(desc),
+	}, nil
+}
+
+func (r *memoryAuthRepository) UpdateUser(ctx context.Context, phone string, changes map[string]string) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[phone]
+	if !ok {
+		return nil, apperrors.ErrUserNotFound
+	}
+	user = applyChanges(user, changes)
+	r.users[phone] = user
+
+	return copyUser(user), nil
+}
+
+func (r *memoryAuthRepository) DeleteUser(ctx context.Context, phone string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[phone]; !ok {
+		return apperrors.ErrUserNotFound
+	}
+	delete(r.users, phone)
+	delete(r.otps, phone)
+	delete(r.refresh, phone)
+
+	for i, entry := range r.index {
+		if entry.Member.(string) == phone {
+			r.index = append(r.index[:i], r.index[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *memoryAuthRepository) DeletedBefore(ctx context.Context, before time.Time) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	phones := make([]string, 0)
+	for phone, user := range r.users {
+		if deletedAt := indexOf(phone, user).deletedAt; deletedAt != 0 && deletedAt <= createdScore(before) {
+			phones = append(phones, phone)
+		}
+	}
+	return phones, nil
+}
+
+func (r *memoryAuthRepository) DeleteRefreshToken(ctx context.Context, phone string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.refresh, phone)
+	return nil
+}
+
+func indexLess(a, b redis.Z) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.Member.(string) < b.Member.(string)
+}
@@ -1,166 +1,493 @@
 package repositories
 
 import (
+	"authentication/pkg/apperrors"
 	"authentication/requests"
-	"authentication/utils"
+	"authentication/utils/logger"
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type AuthRepository interface {
-	SetOTP(ctx context.Context, phone string, code int, ttl time.Duration)
-	GetOTP(ctx context.Context, phone string) string
-	UserExists(ctx context.Context, phone string) bool
-	CreateUser(ctx context.Context, phone string) map[string]string
-	GetUser(ctx context.Context, phone string) map[string]string
+	// SetOTP refuses with ErrOTPAlreadySent, carrying the pending code's remaining
+	// lifetime, while an earlier code is still valid.
+	SetOTP(ctx context.Context, phone string, code int, ttl time.Duration) error
+	GetOTP(ctx context.Context, phone string) (string, error)
+	DeleteOTP(ctx context.Context, phone string) error
+	// DeleteAllOTPs deletes every pending code and returns how many there were.
+	DeleteAllOTPs(ctx context.Context) (int, error)
+	UserExists(ctx context.Context, phone string) (bool, error)
+	CreateUser(ctx context.Context, phone string) (map[string]string, error)
+	GetUser(ctx context.Context, phone string) (map[string]string, error)
 	SetRefreshToken(ctx context.Context, phone, refreshToken string, ttl time.Duration) error
 	GetRefreshToken(ctx context.Context, phone string) (string, error)
-	ListUsers(ctx context.Context, request requests.UsersList) []map[string]string
+	ListUsers(ctx context.Context, request requests.UsersList) (UsersPage, error)
+	// UpdateUser merges changes into the stored user; an empty value removes the field.
+	UpdateUser(ctx context.Context, phone string, changes map[string]string) (map[string]string, error)
+	// DeleteUser removes the user, its indexes, OTP and refresh token for good.
+	DeleteUser(ctx context.Context, phone string) error
+	// DeletedBefore lists soft-deleted users whose deleted_at is not after before.
+	DeletedBefore(ctx context.Context, before time.Time) ([]string, error)
+	DeleteRefreshToken(ctx context.Context, phone string) error
 }
 
 type authRepository struct {
-	redisConnection *redis.Client
+	redisConnection redis.UniversalClient
 }
 
-func NewAuthRepository(redisConnection *redis.Client) AuthRepository {
+func NewAuthRepository(redisConnection redis.UniversalClient) AuthRepository {
 	return &authRepository{
 		redisConnection: redisConnection,
 	}
 }
 
-func (r *authRepository) SetOTP(ctx context.Context, phone string, code int, ttl time.Duration) {
-	key := "otp:" + phone
+func (r *authRepository) SetOTP(ctx context.Context, phone string, code int, ttl time.Duration) error {
+	key := otpKey(phone)
 	set, err := r.redisConnection.SetNX(ctx, key, code, ttl).Result()
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if !set {
-		panic(utils.PanicMessage{MessageKey: 5})
+		// A new code can be sent once the pending one expires.
+		ttl, err := r.redisConnection.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		return apperrors.ErrOTPAlreadySent.WithRetryAfter(ttl)
 	}
+	return nil
 }
 
-func (r *authRepository) GetOTP(ctx context.Context, phone string) string {
-	key := "otp:" + phone
+func (r *authRepository) GetOTP(ctx context.Context, phone string) (string, error) {
+	key := otpKey(phone)
 	res, err := r.redisConnection.Get(ctx, key).Result()
 	if err == redis.Nil {
-		panic(utils.PanicMessage{MessageKey: 3})
-	} else if err != nil {
-		panic(err)
+		return "", apperrors.ErrOTPInvalid
+	}
+	return res, err
+}
+
+func (r *authRepository) DeleteOTP(ctx context.Context, phone string) error {
+	return r.redisConnection.Del(ctx, otpKey(phone)).Err()
+}
+
+func (r *authRepository) DeleteAllOTPs(ctx context.Context) (int, error) {
+	var deleted atomic.Int64
+	scan := func(ctx context.Context, client redis.UniversalClient) error {
+		iter := client.Scan(ctx, 0, otpPattern, listScanBatch).Iterator()
+		for iter.Next(ctx) {
+			// One DEL per key: the codes of different phones hash to different slots.
+			n, err := client.Del(ctx, iter.Val()).Result()
+			if err != nil {
+				return err
+			}
+			deleted.Add(n)
+		}
+		return iter.Err()
 	}
-	return res
+
+	// SCAN only walks the keys of the node it is sent to.
+	var err error
+	if cluster, ok := r.redisConnection.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, r.redisConnection)
+	}
+	return int(deleted.Load()), err
 }
 
-func (r *authRepository) UserExists(ctx context.Context, phone string) bool {
-	key := "user:" + phone
+func (r *authRepository) UserExists(ctx context.Context, phone string) (bool, error) {
+	key := userKey(phone)
 	exists, err := r.redisConnection.Exists(ctx, key).Result()
 	if err != nil {
-		panic(err)
+		return false, err
 	}
-	return exists > 0
+	return exists > 0, nil
 }
 
-func (r *authRepository) CreateUser(ctx context.Context, phone string) map[string]string {
+func (r *authRepository) CreateUser(ctx context.Context, phone string) (map[string]string, error) {
+	now := time.Now()
 	user := map[string]string{
-		"id":    fmt.Sprintf("user-%d", time.Now().UnixNano()),
-		"phone": phone,
+		"id":         fmt.Sprintf("user-%d", now.UnixNano()),
+		"phone":      phone,
+		"created_at": now.UTC().Format(time.RFC3339),
+		"status":     DefaultUserStatus,
+		"role":       DefaultUserRole,
 	}
 
 	data, err := json.Marshal(user)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	key := "user:" + phone
+	key := userKey(phone)
 	if err := r.redisConnection.Set(ctx, key, data, 0).Err(); err != nil {
-		panic(err)
+		return nil, err
 	}
-	fmt.Println("Saved user:", key)
 
-	if err := r.redisConnection.LPush(ctx, "users", phone).Err(); err != nil {
-		panic(err)
+	_, err = r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, usersByCreatedKey, redis.Z{Score: createdScore(now), Member: phone})
+		pipe.ZAdd(ctx, usersByPhoneKey, redis.Z{Score: 0, Member: phone})
+		applyIndex(ctx, pipe, phone, userIndex{}, indexOf(phone, user))
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("Pushed phone into users list:", phone)
 
-	return user
+	return user, nil
 }
 
-func (r *authRepository) GetUser(ctx context.Context, phone string) map[string]string {
-	key := "user:" + phone
+func (r *authRepository) GetUser(ctx context.Context, phone string) (map[string]string, error) {
+	key := userKey(phone)
 	data, err := r.redisConnection.Get(ctx, key).Result()
 	if err == redis.Nil {
-		panic(utils.PanicMessage{MessageKey: 4})
+		return nil, apperrors.ErrUserNotFound
 	} else if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	var user map[string]string
-	if err := json.Unmarshal([]byte(data), &user); err != nil {
-		panic(err)
+	return unmarshalUser(data)
+}
+
+// updateAttempts bounds the retries of UpdateUser while other writers change the user.
+const updateAttempts = 10
+
+// UpdateUser reads and writes the user in a WATCH transaction, so concurrent updates
+// never drop each other's changes. The indexes live in other slots, so they are updated
+// once the transaction has committed.
+func (r *authRepository) UpdateUser(ctx context.Context, phone string, changes map[string]string) (map[string]string, error) {
+	key := userKey(phone)
+	var old, user map[string]string
+	update := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return apperrors.ErrUserNotFound
+		} else if err != nil {
+			return err
+		}
+		if old, err = unmarshalUser(data); err != nil {
+			return err
+		}
+		user = applyChanges(old, changes)
+
+		encoded, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, 0)
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := r.redisConnection.Watch(ctx, update, key)
+		if err == redis.TxFailedErr && attempt < updateAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	_, err := r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		applyIndex(ctx, pipe, phone, indexOf(phone, old), indexOf(phone, user))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (r *authRepository) DeleteUser(ctx context.Context, phone string) error {
+	user, err := r.GetUser(ctx, phone)
+	if err != nil {
+		return err
 	}
 
-	return user
+	// The per-user keys share a hash tag, so a single DEL is cluster-safe.
+	if err := r.redisConnection.Del(ctx, userKey(phone), otpKey(phone), refreshKey(phone)).Err(); err != nil {
+		return err
+	}
+
+	_, err = r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, usersByCreatedKey, phone)
+		pipe.ZRem(ctx, usersByPhoneKey, phone)
+		applyIndex(ctx, pipe, phone, indexOf(phone, user), userIndex{})
+		return nil
+	})
+	return err
+}
+
+func (r *authRepository) DeletedBefore(ctx context.Context, before time.Time) ([]string, error) {
+	return r.redisConnection.ZRangeByScore(ctx, usersByDeletedKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: formatScore(createdScore(before)),
+	}).Result()
 }
 
 func (r *authRepository) SetRefreshToken(ctx context.Context, phone, refreshToken string, ttl time.Duration) error {
-	key := "refresh:" + phone
+	key := refreshKey(phone)
 	return r.redisConnection.Set(ctx, key, refreshToken, ttl).Err()
 }
 
 func (r *authRepository) GetRefreshToken(ctx context.Context, phone string) (string, error) {
-	key := "refresh:" + phone
+	key := refreshKey(phone)
 	token, err := r.redisConnection.Get(ctx, key).Result()
 	if err == redis.Nil {
-		return "", fmt.Errorf("refresh token not found")
+		return "", apperrors.ErrInvalidRefreshToken
 	}
 	return token, err
 }
 
-func (r *authRepository) ListUsers(ctx context.Context, request requests.UsersList) []map[string]string {
-	phones, err := r.redisConnection.LRange(ctx, "users", 0, -1).Result()
+func (r *authRepository) DeleteRefreshToken(ctx context.Context, phone string) error {
+	return r.redisConnection.Del(ctx, refreshKey(phone)).Err()
+}
+
+func (r *authRepository) ListUsers(ctx context.Context, request requests.UsersList) (UsersPage, error) {
+	desc := request.Descending()
+	filter := newUserFilter(request)
+	walker := &indexWalker{
+		skip:  request.Offset(),
+		limit: request.Limit(),
+	}
+
+	if request.Cursor != "" {
+		cursor, ok := decodeCursor(request.Cursor)
+		if !ok || cursor.Desc != desc {
+			return UsersPage{}, apperrors.ErrInvalidCursor
+		}
+		walker.after = cursor
+	}
+
+	var total int64
+	if filter.indexed() {
+		candidates, err := r.searchCandidates(ctx, filter)
+		if err != nil {
+			return UsersPage{}, err
+		}
+		entries, err := r.scoreCandidates(ctx, candidates, filter)
+		if err != nil {
+			return UsersPage{}, err
+		}
+		walkSorted(entries, walker, desc)
+		total = int64(len(entries))
+	} else {
+		walker.match = phoneMatcher(filter.phoneLike)
+		if err := r.walkIndex(ctx, walker, desc, filter.createdFrom, filter.createdTo); err != nil {
+			return UsersPage{}, err
+		}
+		var err error
+		if total, err = r.countUsers(ctx, filter); err != nil {
+			return UsersPage{}, err
+		}
+	}
+
+	users, err := r.fetchUsers(ctx, walker.entries)
 	if err != nil {
-		panic(err)
+		return UsersPage{}, err
+	}
+
+	return UsersPage{
+		Users:      users,
+		Total:      total,
+		NextCursor: walker.nextCursor(desc),
+	}, nil
+}
+
+// walkIndex reads the creation index in batches between min and max, starting at the
+// cursor score, until the walker is satisfied.
+func (r *authRepository) walkIndex(ctx context.Context, walker *indexWalker, desc bool, min, max float64) error {
+	if walker.after != nil {
+		if desc {
+			max = math.Min(max, walker.after.Score)
+		} else {
+			min = math.Max(min, walker.after.Score)
+		}
+	}
+
+	var offset int64
+	// Without a filter or cursor, page mode can jump straight to its offset.
+	if walker.match == nil && walker.after == nil {
+		offset, walker.skip = walker.skip, 0
+	}
+
+	batch := walker.limit + 1
+	if walker.match != nil && batch < listScanBatch {
+		batch = listScanBatch
 	}
 
-	filteredPhones := make([]string, 0)
-	if request.PhoneLike != "" {
-		for _, phone := range phones {
-			if strings.Contains(phone, request.PhoneLike) || phone == request.PhoneLike {
-				filteredPhones = append(filteredPhones, phone)
+	for {
+		entries, err := r.redisConnection.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+			Key:     usersByCreatedKey,
+			Start:   formatScore(min),
+			Stop:    formatScore(max),
+			ByScore: true,
+			Rev:     desc,
+			Offset:  offset,
+			Count:   batch,
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if !walker.offer(entry) {
+				return nil
 			}
 		}
-	} else {
-		filteredPhones = phones
+		if int64(len(entries)) < batch {
+			return nil
+		}
+		offset += batch
 	}
+}
 
-	start := (request.Page - 1) * request.PageSize
-	end := start + request.PageSize
-	if start >= int64(len(filteredPhones)) {
-		return []map[string]string{}
+// fetchUsers loads the records of one page in a single pipeline round trip. Plain GETs are used
+// instead of MGET because the records hash to different cluster slots.
+func (r *authRepository) fetchUsers(ctx context.Context, entries []redis.Z) ([]map[string]string, error) {
+	users := make([]map[string]string, 0, len(entries))
+	if len(entries) == 0 {
+		return users, nil
 	}
-	if end > int64(len(filteredPhones)) {
-		end = int64(len(filteredPhones))
+
+	cmds := make([]*redis.StringCmd, len(entries))
+	_, err := r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, entry := range entries {
+			cmds[i] = pipe.Get(ctx, userKey(entry.Member.(string)))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
 	}
 
-	users := make([]map[string]string, 0, end-start)
-	for _, phone := range filteredPhones[start:end] {
-		data, err := r.redisConnection.Get(ctx, "user:"+phone).Result()
+	for _, cmd := range cmds {
+		data, err := cmd.Result()
 		if err == redis.Nil {
 			continue
 		} else if err != nil {
-			panic(err)
+			return nil, err
+		}
+
+		user, err := unmarshalUser(data)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func (r *authRepository) countUsers(ctx context.Context, filter userFilter) (int64, error) {
+	min, max := formatScore(filter.createdFrom), formatScore(filter.createdTo)
+	if filter.phoneLike == "" {
+		return r.redisConnection.ZCount(ctx, usersByCreatedKey, min, max).Result()
+	}
+
+	// Substring search has no index; ZSCAN at least keeps the filtering inside Redis.
+	var total int64
+	iter := r.redisConnection.ZScan(ctx, usersByCreatedKey, 0, "*"+escapeGlob(filter.phoneLike)+"*", listScanBatch).Iterator()
+	for iter.Next(ctx) {
+		// ZSCAN yields member and score as consecutive elements.
+		if !iter.Next(ctx) {
+			break
 		}
+		score, err := strconv.ParseFloat(iter.Val(), 64)
+		if err == nil && score >= filter.createdFrom && score <= filter.createdTo {
+			total++
+		}
+	}
+	return total, iter.Err()
+}
+
+func unmarshalUser(data string) (map[string]string, error) {
+	var user map[string]string
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func escapeGlob(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(value)
+}
 
+// MigrateUsersIndex moves users recorded in the legacy "users" list into the creation index.
+// Their data is read from the legacy user key, or the tagged one when MigrateUserKeys got
+// there first. Once every entry is indexed the list is renamed to usersListBackupKey;
+// while one cannot be read the list is kept, and the migration tried again on next start.
+// It is idempotent and a no-op once the list is gone.
+func MigrateUsersIndex(ctx context.Context, redisConnection redis.UniversalClient) error {
+	phones, err := redisConnection.LRange(ctx, usersListKey, 0, -1).Result()
+	if err != nil || len(phones) == 0 {
+		return err
+	}
+
+	legacy := make([]*redis.StringCmd, len(phones))
+	tagged := make([]*redis.StringCmd, len(phones))
+	_, err = redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, phone := range phones {
+			legacy[i] = pipe.Get(ctx, legacyUserKey(phone))
+			tagged[i] = pipe.Get(ctx, userKey(phone))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	members := make([]redis.Z, 0, len(phones))
+	failed := 0
+	for i, phone := range phones {
+		data, err := legacy[i].Result()
+		if err == redis.Nil {
+			data, err = tagged[i].Result()
+		}
+		if err == redis.Nil {
+			// The list is all that is left of the user: nothing to index.
+			continue
+		} else if err != nil {
+			return err
+		}
 		var user map[string]string
 		if err := json.Unmarshal([]byte(data), &user); err != nil {
-			panic(err)
+			logger.LogInfo("MIGRATION", fmt.Sprintf("user %s: cannot be indexed: %v", phone, err))
+			failed++
+			continue
 		}
-		users = append(users, user)
+		score, ok := scoreFromUserID(user["id"])
+		if !ok {
+			score = createdScore(time.Now())
+		}
+		members = append(members, redis.Z{Score: score, Member: phone})
 	}
 
-	return users
+	if len(members) > 0 {
+		if err := redisConnection.ZAddNX(ctx, usersByCreatedKey, members...).Err(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		logger.LogInfo("MIGRATION", fmt.Sprintf("%d users could not be indexed, the %q list is kept", failed, usersListKey))
+		return nil
+	}
+	return redisConnection.Rename(ctx, usersListKey, usersListBackupKey).Err()
 }
@@ -0,0 +1,62 @@
+package repositories
+
+import (
+	"authentication/pkg/apperrors"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestUpdateUserConcurrently(t *testing.T) {
+	_, client := newRedis(t)
+	tests := []struct {
+		name       string
+		repository AuthRepository
+	}{
+		{name: "redis", repository: NewAuthRepository(client)},
+		{name: "memory", repository: NewMemoryAuthRepository()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			const phone, writers = "+989121234567", 8
+			if _, err := tt.repository.CreateUser(ctx, phone); err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, writers)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					_, err := tt.repository.UpdateUser(ctx, phone, map[string]string{fmt.Sprintf("meta.k%d", i): "v"})
+					errs <- err
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("UpdateUser: %v", err)
+				}
+			}
+
+			user, err := tt.repository.GetUser(ctx, phone)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < writers; i++ {
+				if user[fmt.Sprintf("meta.k%d", i)] != "v" {
+					t.Errorf("the change of writer %d was lost: %v", i, user)
+				}
+			}
+		})
+	}
+
+	if _, err := tests[0].repository.UpdateUser(context.Background(), "+989120000000", map[string]string{"name": "x"}); !errors.Is(err, apperrors.ErrUserNotFound) {
+		t.Errorf("unknown user: %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,76 @@
+package repositories
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryChallengeRepository is the in-process ChallengeRepository.
+type memoryChallengeRepository struct {
+	mu    sync.Mutex
+	risk  map[string]memoryEntry
+	spent map[string]memoryEntry
+}
+
+func NewMemoryChallengeRepository() ChallengeRepository {
+	return &memoryChallengeRepository{
+		risk:  make(map[string]memoryEntry),
+		spent: make(map[string]memoryEntry),
+	}
+}
+
+func (r *memoryChallengeRepository) AddRisk(ctx context.Context, subject string, window time.Duration) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.risk[subject]
+	if !ok || entry.expired(time.Now()) {
+		entry = memoryEntry{value: "0", expiresAt: expiry(window)}
+	}
+	risk, _ := strconv.ParseInt(entry.value, 10, 64)
+	risk++
+	entry.value = strconv.FormatInt(risk, 10)
+	r.risk[subject] = entry
+	return risk, nil
+}
+
+func (r *memoryChallengeRepository) Risk(ctx context.Context, subject string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.risk[subject]
+	if !ok || entry.expired(time.Now()) {
+		delete(r.risk, subject)
+		return 0, nil
+	}
+	return strconv.ParseInt(entry.value, 10, 64)
+}
+
+func (r *memoryChallengeRepository) ClearRisk(ctx context.Context, subjects ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, subject := range subjects {
+		delete(r.risk, subject)
+	}
+	return nil
+}
+
+func (r *memoryChallengeRepository) Spend(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key, entry := range r.spent {
+		if entry.expired(now) {
+			delete(r.spent, key)
+		}
+	}
+	if _, ok := r.spent[id]; ok {
+		return false, nil
+	}
+	r.spent[id] = memoryEntry{expiresAt: expiry(ttl)}
+	return true, nil
+}
@@ -0,0 +1,64 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ChallengeRepository keeps the risk counters that decide when a client is challenged,
+// and the challenge solutions already used.
+type ChallengeRepository interface {
+	// AddRisk adds one to the counter of subject, which expires window after its first
+	// increment, and returns the new value.
+	AddRisk(ctx context.Context, subject string, window time.Duration) (int64, error)
+	Risk(ctx context.Context, subject string) (int64, error)
+	ClearRisk(ctx context.Context, subjects ...string) error
+	// Spend records a used solution; see challenge.Store.
+	Spend(ctx context.Context, id string, ttl time.Duration) (bool, error)
+}
+
+type challengeRepository struct {
+	redisConnection redis.UniversalClient
+}
+
+func NewChallengeRepository(redisConnection redis.UniversalClient) ChallengeRepository {
+	return &challengeRepository{redisConnection: redisConnection}
+}
+
+func (r *challengeRepository) AddRisk(ctx context.Context, subject string, window time.Duration) (int64, error) {
+	risk, err := r.redisConnection.Incr(ctx, riskKey(subject)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if risk == 1 {
+		if err := r.redisConnection.Expire(ctx, riskKey(subject), window).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return risk, nil
+}
+
+func (r *challengeRepository) Risk(ctx context.Context, subject string) (int64, error) {
+	risk, err := r.redisConnection.Get(ctx, riskKey(subject)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return risk, err
+}
+
+func (r *challengeRepository) ClearRisk(ctx context.Context, subjects ...string) error {
+	// One DEL per key: the subjects hash to different slots in a cluster.
+	_, err := r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, subject := range subjects {
+			pipe.Del(ctx, riskKey(subject))
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *challengeRepository) Spend(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	return r.redisConnection.SetNX(ctx, spentChallengeKey(id), 1, ttl).Result()
+}
@@ -0,0 +1,124 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryFraudRepository is the in-process FraudRepository. Counters of past days are
+// dropped as new days are counted.
+type memoryFraudRepository struct {
+	mu        sync.Mutex
+	countries map[string]map[string]int64
+	prefixes  map[string]map[string]*PrefixStats
+	blocks    map[string]memoryEntry
+}
+
+func NewMemoryFraudRepository() FraudRepository {
+	return &memoryFraudRepository{
+		countries: make(map[string]map[string]int64),
+		prefixes:  make(map[string]map[string]*PrefixStats),
+		blocks:    make(map[string]memoryEntry),
+	}
+}
+
+// prefix returns the counters of prefix on day, creating them, and forgets days older
+// than the counters are kept in Redis.
+func (r *memoryFraudRepository) prefix(day, prefix string) *PrefixStats {
+	if _, ok := r.prefixes[day]; !ok {
+		oldest := time.Now().UTC().Add(-fraudCountersTTL).Format(time.DateOnly)
+		for d := range r.prefixes {
+			if d < oldest {
+				delete(r.prefixes, d)
+				delete(r.countries, d)
+			}
+		}
+		r.prefixes[day] = make(map[string]*PrefixStats)
+		r.countries[day] = make(map[string]int64)
+	}
+	stats, ok := r.prefixes[day][prefix]
+	if !ok {
+		stats = &PrefixStats{Prefix: prefix}
+		r.prefixes[day][prefix] = stats
+	}
+	return stats
+}
+
+func (r *memoryFraudRepository) CountSend(ctx context.Context, day, country, prefix string) (int64, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := r.prefix(day, prefix)
+	stats.Sent++
+	r.countries[day][country]++
+	return r.countries[day][country], stats.Sent, nil
+}
+
+func (r *memoryFraudRepository) CountLogin(ctx context.Context, day, prefix string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prefix(day, prefix).Logins++
+	return nil
+}
+
+func (r *memoryFraudRepository) PrefixStats(ctx context.Context, day, prefix string) (PrefixStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if stats, ok := r.prefixes[day][prefix]; ok {
+		return *stats, nil
+	}
+	return PrefixStats{Prefix: prefix}, nil
+}
+
+func (r *memoryFraudRepository) DayStats(ctx context.Context, day string) (map[string]int64, []PrefixStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sent := make(map[string]int64, len(r.countries[day]))
+	for country, count := range r.countries[day] {
+		sent[country] = count
+	}
+	stats := make([]PrefixStats, 0, len(r.prefixes[day]))
+	for _, s := range r.prefixes[day] {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Prefix < stats[j].Prefix })
+	return sent, stats, nil
+}
+
+func (r *memoryFraudRepository) Block(ctx context.Context, prefix, reason string, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.blocks[prefix] = memoryEntry{value: reason, expiresAt: expiry(ttl)}
+	return nil
+}
+
+func (r *memoryFraudRepository) Blocked(ctx context.Context, prefix string) (string, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	entry, ok := r.blocks[prefix]
+	if !ok || entry.expired(now) {
+		delete(r.blocks, prefix)
+		return "", 0, nil
+	}
+	if entry.expiresAt.IsZero() {
+		return entry.value, -1, nil
+	}
+	return entry.value, entry.expiresAt.Sub(now), nil
+}
+
+func (r *memoryFraudRepository) ResetPrefix(ctx context.Context, day, prefix string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.blocks, prefix)
+	delete(r.prefixes[day], prefix)
+	return nil
+}
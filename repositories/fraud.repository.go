@@ -0,0 +1,153 @@
+package repositories
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FraudRepository keeps the daily SMS counters and prefix blocks of the fraud guard.
+// Days are UTC dates such as 2006-01-02; counters are kept for two days.
+type FraudRepository interface {
+	// CountSend adds one code sent to a phone of country and prefix on day, and returns the
+	// day's totals for the country and the prefix.
+	CountSend(ctx context.Context, day, country, prefix string) (countrySent int64, prefixSent int64, err error)
+	// CountLogin adds one successful login of a phone of prefix on day.
+	CountLogin(ctx context.Context, day, prefix string) error
+	PrefixStats(ctx context.Context, day, prefix string) (PrefixStats, error)
+	// DayStats returns the codes sent per country and the counters of every prefix on day.
+	DayStats(ctx context.Context, day string) (map[string]int64, []PrefixStats, error)
+	// Block stops sending to prefix for ttl.
+	Block(ctx context.Context, prefix, reason string, ttl time.Duration) error
+	// Blocked returns the reason and remaining time of the block of prefix; reason is empty
+	// when the prefix is not blocked.
+	Blocked(ctx context.Context, prefix string) (reason string, ttl time.Duration, err error)
+	// ResetPrefix lifts the block of prefix and clears its counters of day.
+	ResetPrefix(ctx context.Context, day, prefix string) error
+}
+
+// PrefixStats counts, for one day, the codes sent to a prefix and the logins they led to.
+type PrefixStats struct {
+	Prefix string
+	Sent   int64
+	Logins int64
+}
+
+// fraudCountersTTL keeps yesterday's counters around for admins to look at.
+const fraudCountersTTL = 48 * time.Hour
+
+type fraudRepository struct {
+	redisConnection redis.UniversalClient
+}
+
+func NewFraudRepository(redisConnection redis.UniversalClient) FraudRepository {
+	return &fraudRepository{redisConnection: redisConnection}
+}
+
+func (r *fraudRepository) CountSend(ctx context.Context, day, country, prefix string) (int64, int64, error) {
+	var countrySent, prefixSent *redis.IntCmd
+	_, err := r.redisConnection.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		countrySent = pipe.HIncrBy(ctx, fraudCountriesKey(day), country, 1)
+		prefixSent = pipe.HIncrBy(ctx, fraudPrefixKey(day, prefix), "sent", 1)
+		pipe.SAdd(ctx, fraudPrefixesKey(day), prefix)
+		for _, key := range []string{fraudCountriesKey(day), fraudPrefixKey(day, prefix), fraudPrefixesKey(day)} {
+			pipe.Expire(ctx, key, fraudCountersTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return countrySent.Val(), prefixSent.Val(), nil
+}
+
+func (r *fraudRepository) CountLogin(ctx context.Context, day, prefix string) error {
+	_, err := r.redisConnection.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, fraudPrefixKey(day, prefix), "logins", 1)
+		pipe.SAdd(ctx, fraudPrefixesKey(day), prefix)
+		pipe.Expire(ctx, fraudPrefixKey(day, prefix), fraudCountersTTL)
+		pipe.Expire(ctx, fraudPrefixesKey(day), fraudCountersTTL)
+		return nil
+	})
+	return err
+}
+
+func (r *fraudRepository) PrefixStats(ctx context.Context, day, prefix string) (PrefixStats, error) {
+	counters, err := r.redisConnection.HGetAll(ctx, fraudPrefixKey(day, prefix)).Result()
+	if err != nil {
+		return PrefixStats{}, err
+	}
+	return prefixStats(prefix, counters), nil
+}
+
+func (r *fraudRepository) DayStats(ctx context.Context, day string) (map[string]int64, []PrefixStats, error) {
+	countries, err := r.redisConnection.HGetAll(ctx, fraudCountriesKey(day)).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	sent := make(map[string]int64, len(countries))
+	for country, value := range countries {
+		sent[country], _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	prefixes, err := r.redisConnection.SMembers(ctx, fraudPrefixesKey(day)).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(prefixes)
+	cmds := make([]*redis.MapStringStringCmd, len(prefixes))
+	_, err = r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, prefix := range prefixes {
+			cmds[i] = pipe.HGetAll(ctx, fraudPrefixKey(day, prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats := make([]PrefixStats, len(prefixes))
+	for i, prefix := range prefixes {
+		stats[i] = prefixStats(prefix, cmds[i].Val())
+	}
+	return sent, stats, nil
+}
+
+func (r *fraudRepository) Block(ctx context.Context, prefix, reason string, ttl time.Duration) error {
+	return r.redisConnection.Set(ctx, fraudBlockKey(prefix), reason, ttl).Err()
+}
+
+func (r *fraudRepository) Blocked(ctx context.Context, prefix string) (string, time.Duration, error) {
+	var reason *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		reason = pipe.Get(ctx, fraudBlockKey(prefix))
+		ttl = pipe.PTTL(ctx, fraudBlockKey(prefix))
+		return nil
+	})
+	if err == redis.Nil {
+		return "", 0, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	return reason.Val(), ttl.Val(), nil
+}
+
+func (r *fraudRepository) ResetPrefix(ctx context.Context, day, prefix string) error {
+	_, err := r.redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, fraudBlockKey(prefix))
+		pipe.Del(ctx, fraudPrefixKey(day, prefix))
+		return nil
+	})
+	return err
+}
+
+func prefixStats(prefix string, counters map[string]string) PrefixStats {
+	stats := PrefixStats{Prefix: prefix}
+	stats.Sent, _ = strconv.ParseInt(counters["sent"], 10, 64)
+	stats.Logins, _ = strconv.ParseInt(counters["logins"], 10, 64)
+	return stats
+}
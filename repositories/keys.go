@@ -0,0 +1,145 @@
+package repositories
+
+// Every per-user key carries the phone number as a Redis Cluster hash tag ({...}),
+// so all keys of one user hash to the same slot and can be used together in
+// MULTI/EXEC, Lua scripts and multi-key commands. Global keys (indexes) live in
+// their own slot and are never combined with per-user keys in a single command.
+
+func userTag(phone string) string {
+	return "{" + phone + "}"
+}
+
+func otpKey(phone string) string {
+	return "otp:" + userTag(phone)
+}
+
+func userKey(phone string) string {
+	return "user:" + userTag(phone)
+}
+
+func refreshKey(phone string) string {
+	return "refresh:" + userTag(phone)
+}
+
+// legacyUserKey is the key of a user before per-user keys carried the hash tag.
+func legacyUserKey(phone string) string {
+	return "user:" + phone
+}
+
+// legacyUserKeyPrefixes are the per-user keys written before they carried the hash tag,
+// as "<prefix><phone>". Only MigrateUserKeys reads them.
+var legacyUserKeyPrefixes = []string{"user:", "otp:", "refresh:"}
+
+const (
+	// usersByCreatedKey is a sorted set of phones scored by creation time in milliseconds.
+	usersByCreatedKey = "users:by_created"
+	// usersByLastLoginKey is a sorted set of phones scored by last login time in milliseconds.
+	usersByLastLoginKey = "users:by_last_login"
+	// usersByDeletedKey is a sorted set of soft-deleted phones scored by deletion time in milliseconds.
+	usersByDeletedKey = "users:by_deleted"
+	// usersByPhoneKey holds every phone with score 0, so ZRANGEBYLEX answers prefix searches.
+	usersByPhoneKey = "users:idx:phone"
+	// usersByEmailKey holds "<lowercased email>\x00<phone>" with score 0 for email prefix searches.
+	usersByEmailKey = "users:idx:email"
+	// usersListKey is the pre-index list of phones, only read by MigrateUsersIndex.
+	usersListKey = "users"
+	// usersListBackupKey is where MigrateUsersIndex keeps the list once it is indexed. Its
+	// hash tag puts it in the slot of usersListKey, so RENAME works in a cluster.
+	usersListBackupKey = "{users}:migrated"
+
+	// usersKeysVersionKey records that MigrateUserKeys has moved per-user keys under their hash tag.
+	usersKeysVersionKey = "users:keys:version"
+	usersKeysVersion    = "hashtag"
+
+	usersIndexVersionKey = "users:idx:version"
+	usersIndexVersion    = "1"
+
+	// usersPhonesVersionKey records that MigratePhoneNumbers has moved users to E.164 keys.
+	usersPhonesVersionKey = "users:phones:version"
+	usersPhonesVersion    = "e164"
+)
+
+// signingKeysKey is a hash of the JWT signing keys by id.
+const signingKeysKey = "jwt:keys"
+
+// otpPattern matches the keys of every pending OTP code.
+const otpPattern = "otp:*"
+
+func statusIndexKey(status string) string {
+	return "users:idx:status:" + status
+}
+
+func roleIndexKey(role string) string {
+	return "users:idx:role:" + role
+}
+
+func nameIndexKey(token string) string {
+	return "users:idx:name:" + token
+}
+
+func metadataIndexKey(key, value string) string {
+	return "users:idx:meta:" + key + ":" + value
+}
+
+const listScanBatch = 500
+
+// The fraud guard's counters of one day share the {<day>} hash tag.
+
+// fraudCountriesKey is a hash of country to codes sent on day.
+func fraudCountriesKey(day string) string {
+	return "fraud:{" + day + "}:countries"
+}
+
+// fraudPrefixesKey is the set of prefixes with counters on day.
+func fraudPrefixesKey(day string) string {
+	return "fraud:{" + day + "}:prefixes"
+}
+
+// fraudPrefixKey is a hash of the sent and logins counters of prefix on day.
+func fraudPrefixKey(day, prefix string) string {
+	return "fraud:{" + day + "}:prefix:" + prefix
+}
+
+// fraudBlockKey holds the reason prefix is blocked, and expires with the block.
+func fraudBlockKey(prefix string) string {
+	return "fraud:block:" + prefix
+}
+
+// riskKey counts the suspicious requests of a subject such as "phone:+989121234567".
+func riskKey(subject string) string {
+	return "challenge:risk:" + subject
+}
+
+// spentChallengeKey marks a challenge solution as used until the challenge expires.
+func spentChallengeKey(id string) string {
+	return "challenge:spent:" + id
+}
+
+// auditPhoneKey is the stream of the audit events of one phone, by its hash.
+func auditPhoneKey(phoneHash string) string {
+	return "audit:phone:" + phoneHash
+}
+
+// webhookSubscriptionsKey is a hash of the webhook subscriptions by id.
+const webhookSubscriptionsKey = "webhooks:subscriptions"
+
+// webhookQueueKey is a sorted set of the pending webhook deliveries, scored by the time of
+// their next attempt in milliseconds.
+const webhookQueueKey = "webhooks:queue"
+
+// The keys of one webhook delivery share the {<delivery id>} hash tag.
+
+// webhookDeliveryKey holds a webhook delivery as JSON.
+func webhookDeliveryKey(id string) string {
+	return "webhook:{" + id + "}:delivery"
+}
+
+// webhookLockKey is held by the instance attempting a delivery.
+func webhookLockKey(id string) string {
+	return "webhook:{" + id + "}:lock"
+}
+
+// webhookLogKey is the stream of the delivery ids of a subscription.
+func webhookLogKey(subscriptionID string) string {
+	return "webhooks:log:" + subscriptionID
+}
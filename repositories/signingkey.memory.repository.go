@@ -0,0 +1,44 @@
+package repositories
+
+import (
+	"authentication/utils"
+	"context"
+	"sync"
+)
+
+// memorySigningKeyRepository is the in-process SigningKeyRepository.
+type memorySigningKeyRepository struct {
+	mu   sync.Mutex
+	keys map[string]utils.SigningKey
+}
+
+func NewMemorySigningKeyRepository() SigningKeyRepository {
+	return &memorySigningKeyRepository{keys: make(map[string]utils.SigningKey)}
+}
+
+func (r *memorySigningKeyRepository) ListKeys(ctx context.Context) ([]utils.SigningKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]utils.SigningKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (r *memorySigningKeyRepository) AddKey(ctx context.Context, key utils.SigningKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys[key.ID] = key
+	return nil
+}
+
+func (r *memorySigningKeyRepository) DeleteKey(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.keys, id)
+	return nil
+}
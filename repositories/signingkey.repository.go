@@ -0,0 +1,53 @@
+package repositories
+
+import (
+	"authentication/utils"
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SigningKeyRepository stores the keys access tokens are signed with, shared by every
+// instance of the service.
+type SigningKeyRepository interface {
+	ListKeys(ctx context.Context) ([]utils.SigningKey, error)
+	AddKey(ctx context.Context, key utils.SigningKey) error
+	DeleteKey(ctx context.Context, id string) error
+}
+
+type signingKeyRepository struct {
+	redisConnection redis.UniversalClient
+}
+
+func NewSigningKeyRepository(redisConnection redis.UniversalClient) SigningKeyRepository {
+	return &signingKeyRepository{redisConnection: redisConnection}
+}
+
+func (r *signingKeyRepository) ListKeys(ctx context.Context) ([]utils.SigningKey, error) {
+	stored, err := r.redisConnection.HGetAll(ctx, signingKeysKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]utils.SigningKey, 0, len(stored))
+	for _, data := range stored {
+		var key utils.SigningKey
+		if err := json.Unmarshal([]byte(data), &key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (r *signingKeyRepository) AddKey(ctx context.Context, key utils.SigningKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return r.redisConnection.HSet(ctx, signingKeysKey, key.ID, data).Err()
+}
+
+func (r *signingKeyRepository) DeleteKey(ctx context.Context, id string) error {
+	return r.redisConnection.HDel(ctx, signingKeysKey, id).Err()
+}
@@ -0,0 +1,96 @@
+package repositories
+
+import (
+	"authentication/utils"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSigningKeysRotation(t *testing.T) {
+	_, client := newRedis(t)
+	tests := []struct {
+		name string
+		// writer and reader stand for two instances of the service.
+		writer, reader SigningKeyRepository
+	}{
+		{name: "redis", writer: NewSigningKeyRepository(client), reader: NewSigningKeyRepository(client)},
+		{name: "memory", writer: NewMemorySigningKeyRepository()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.reader == nil {
+				tt.reader = tt.writer
+			}
+			ctx := context.Background()
+			now := time.Now().Truncate(time.Second)
+			ids := func() []string {
+				t.Helper()
+				keys, err := tt.reader.ListKeys(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				utils.SortSigningKeys(keys)
+				var ids []string
+				for _, key := range keys {
+					ids = append(ids, key.ID)
+				}
+				return ids
+			}
+
+			if got := ids(); len(got) != 0 {
+				t.Fatalf("ListKeys() = %v, want no key", got)
+			}
+			old := utils.NewSigningKey(now.Add(-48 * time.Hour))
+			current := utils.NewSigningKey(now.Add(-24 * time.Hour))
+			for _, key := range []utils.SigningKey{current, old} {
+				if err := tt.writer.AddKey(ctx, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// A rotation adds a pending key, then retires those the next key replaced.
+			pending := utils.NewSigningKey(now.Add(time.Minute))
+			if err := tt.writer.AddKey(ctx, pending); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.writer.DeleteKey(ctx, old.ID); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{current.ID, pending.ID}
+			if got := ids(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+				t.Fatalf("ListKeys() = %v, want %v", got, want)
+			}
+
+			// Keys read back whole: a secret or an activation time that changed would break tokens.
+			keys, err := tt.reader.ListKeys(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range keys {
+				if key.ID != pending.ID {
+					continue
+				}
+				if !bytes.Equal(key.Secret, pending.Secret) || !key.ActiveAt.Equal(pending.ActiveAt) || !key.CreatedAt.Equal(pending.CreatedAt) {
+					t.Errorf("ListKeys() = %+v, want %+v", key, pending)
+				}
+			}
+
+			// Retiring a key twice, as two instances rotating at once would, is no error.
+			if err := tt.writer.DeleteKey(ctx, old.ID); err != nil {
+				t.Errorf("DeleteKey() of a retired key = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestSigningKeysCorrupted(t *testing.T) {
+	_, client := newRedis(t)
+	if err := client.HSet(context.Background(), signingKeysKey, "broken", "{").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSigningKeyRepository(client).ListKeys(context.Background()); err == nil {
+		t.Error("ListKeys() of a corrupted key succeeded")
+	}
+}
@@ -0,0 +1,130 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// UsersPage is one page of a user listing. NextCursor is empty on the last page.
+type UsersPage struct {
+	Users      []map[string]string
+	Total      int64
+	NextCursor string
+}
+
+// userCursor points at the last entry of a page in the creation index. It is handed
+// to clients base64-encoded so they treat it as opaque.
+type userCursor struct {
+	Score float64 `json:"s"`
+	Phone string  `json:"p"`
+	Desc  bool    `json:"d"`
+}
+
+func encodeCursor(cursor userCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*userCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, false
+	}
+	var cursor userCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Phone == "" {
+		return nil, false
+	}
+	return &cursor, true
+}
+
+// createdScore is the creation index score: milliseconds keep well inside float64 precision.
+func createdScore(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+// scoreFromUserID recovers the creation time of users created before the index existed;
+// their ids are "user-<unix nanos>".
+func scoreFromUserID(id string) (float64, bool) {
+	nanos, err := strconv.ParseInt(strings.TrimPrefix(id, "user-"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return createdScore(time.Unix(0, nanos)), true
+}
+
+// indexWalker consumes creation index entries in listing order and keeps the ones
+// belonging to the requested page. Both repositories feed it, so cursor and tie
+// handling is identical whether the index lives in Redis or in memory.
+type indexWalker struct {
+	after *userCursor
+	skip  int64
+	limit int64
+	match func(phone string) bool
+
+	entries []redis.Z
+	more    bool
+}
+
+// offer returns false once the page is full and the walk can stop.
+func (w *indexWalker) offer(entry redis.Z) bool {
+	phone := entry.Member.(string)
+
+	// Entries sharing the cursor score are ordered by phone, so skip the ones up to the cursor.
+	if w.after != nil && entry.Score == w.after.Score {
+		if w.after.Desc && phone >= w.after.Phone || !w.after.Desc && phone <= w.after.Phone {
+			return true
+		}
+	}
+	if w.match != nil && !w.match(phone) {
+		return true
+	}
+	if w.skip > 0 {
+		w.skip--
+		return true
+	}
+	if int64(len(w.entries)) == w.limit {
+		w.more = true
+		return false
+	}
+
+	w.entries = append(w.entries, entry)
+	return true
+}
+
+func (w *indexWalker) nextCursor(desc bool) string {
+	if !w.more || len(w.entries) == 0 {
+		return ""
+	}
+	last := w.entries[len(w.entries)-1]
+	return encodeCursor(userCursor{Score: last.Score, Phone: last.Member.(string), Desc: desc})
+}
+
+// walkSorted feeds entries, given in ascending index order, to the walker in listing order.
+func walkSorted(entries []redis.Z, walker *indexWalker, desc bool) {
+	for i := range entries {
+		entry := entries[i]
+		if desc {
+			entry = entries[len(entries)-1-i]
+		}
+		if walker.after != nil && (desc && entry.Score > walker.after.Score || !desc && entry.Score < walker.after.Score) {
+			continue
+		}
+		if !walker.offer(entry) {
+			return
+		}
+	}
+}
+
+func phoneMatcher(phoneLike string) func(string) bool {
+	if phoneLike == "" {
+		return nil
+	}
+	return func(phone string) bool {
+		return strings.Contains(phone, phoneLike)
+	}
+}
@@ -0,0 +1,169 @@
+package repositories
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/requests"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateUsersIndex(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	user := `{"id":"user-1709294400000000000"}`
+
+	tests := []struct {
+		name string
+		// users are the stored users by key.
+		users map[string]string
+		list  []string
+		// indexed are the phones expected in the creation index.
+		indexed []string
+		// kept tells whether the list is expected to stay in place.
+		kept bool
+	}{
+		{
+			name: "legacy keys",
+			users: map[string]string{
+				"user:09121234567": user,
+				"user:09127654321": user,
+			},
+			list:    []string{"09121234567", "09127654321"},
+			indexed: []string{"09121234567", "09127654321"},
+		},
+		{
+			name:    "tagged keys",
+			users:   map[string]string{"user:{09121234567}": user},
+			list:    []string{"09121234567"},
+			indexed: []string{"09121234567"},
+		},
+		{
+			name:    "user gone",
+			users:   map[string]string{"user:09121234567": user},
+			list:    []string{"09121234567", "09120000000"},
+			indexed: []string{"09121234567"},
+		},
+		{
+			name: "unreadable user",
+			users: map[string]string{
+				"user:09121234567": user,
+				"user:09127654321": "{",
+			},
+			list:    []string{"09121234567", "09127654321"},
+			indexed: []string{"09121234567"},
+			kept:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server, client := newRedis(t)
+			for key, value := range tt.users {
+				server.Set(key, value)
+			}
+			for _, phone := range tt.list {
+				server.Lpush(usersListKey, phone)
+			}
+
+			if err := MigrateUsersIndex(ctx, client); err != nil {
+				t.Fatalf("MigrateUsersIndex: %v", err)
+			}
+
+			members, err := server.ZMembers(usersByCreatedKey)
+			if err != nil && len(tt.indexed) > 0 {
+				t.Fatalf("ZMEMBERS: %v", err)
+			}
+			if len(members) != len(tt.indexed) {
+				t.Fatalf("indexed %v, want %v", members, tt.indexed)
+			}
+			for _, phone := range tt.indexed {
+				score, err := server.ZScore(usersByCreatedKey, phone)
+				if err != nil {
+					t.Fatalf("%s not indexed: %v", phone, err)
+				}
+				if score != createdScore(created) {
+					t.Errorf("%s scored %v, want its creation time %v", phone, score, createdScore(created))
+				}
+			}
+
+			if server.Exists(usersListKey) != tt.kept {
+				t.Errorf("list kept = %v, want %v", server.Exists(usersListKey), tt.kept)
+			}
+			if server.Exists(usersListBackupKey) == tt.kept {
+				t.Errorf("list backed up = %v, want %v", server.Exists(usersListBackupKey), !tt.kept)
+			}
+		})
+	}
+}
+
+func TestListUsersPages(t *testing.T) {
+	ctx := context.Background()
+	server, client := newRedis(t)
+	repository := NewAuthRepository(client)
+
+	// Users created three at a time share a score, so pages split ties.
+	var phones []string
+	for i := 0; i < 10; i++ {
+		phone := fmt.Sprintf("+98912000000%d", i)
+		phones = append(phones, phone)
+		server.Set(userKey(phone), fmt.Sprintf(`{"id":"user-%d","phone":%q}`, i, phone))
+		if _, err := server.ZAdd(usersByCreatedKey, float64(1000*(i/3)), phone); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reversed := make([]string, len(phones))
+	for i, phone := range phones {
+		reversed[len(phones)-1-i] = phone
+	}
+
+	tests := []struct {
+		name    string
+		request requests.UsersList
+		want    []string
+	}{
+		{name: "oldest first", request: requests.UsersList{Order: "asc", PageSize: 2}, want: phones},
+		{name: "newest first", request: requests.UsersList{PageSize: 2}, want: reversed},
+		{name: "single page", request: requests.UsersList{Order: "asc", PageSize: 100}, want: phones},
+		{name: "page size of a tie", request: requests.UsersList{PageSize: 3}, want: reversed},
+		{name: "phone filter", request: requests.UsersList{Order: "asc", PageSize: 1, PhoneLike: "0007"}, want: phones[7:8]},
+		{name: "phone filter across ties", request: requests.UsersList{PageSize: 2, PhoneLike: "+989"}, want: reversed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			request := tt.request
+			for pages := 0; ; pages++ {
+				if pages > len(phones) {
+					t.Fatal("cursor does not advance")
+				}
+				page, err := repository.ListUsers(ctx, request)
+				if err != nil {
+					t.Fatalf("ListUsers: %v", err)
+				}
+				for _, user := range page.Users {
+					got = append(got, user["phone"])
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				request.Cursor = page.NextCursor
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("listed %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A cursor only goes with the order it was issued for.
+	page, err := repository.ListUsers(ctx, requests.UsersList{PageSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repository.ListUsers(ctx, requests.UsersList{PageSize: 1, Order: "asc", Cursor: page.NextCursor})
+	if !errors.Is(err, apperrors.ErrInvalidCursor) {
+		t.Errorf("cursor of the other order: %v, want ErrInvalidCursor", err)
+	}
+}
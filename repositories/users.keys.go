@@ -0,0 +1,89 @@
+package repositories
+
+import (
+	"authentication/utils/logger"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MigrateUserKeys moves the keys of users written before per-user keys carried the phone
+// as a hash tag (user:<phone>, otp:<phone>, refresh:<phone>) to their tagged name, with
+// their remaining lifetime. A legacy key whose tagged name is already taken was superseded
+// since the upgrade; it is left in place and logged. It runs once.
+func MigrateUserKeys(ctx context.Context, redisConnection redis.UniversalClient) error {
+	version, err := redisConnection.Get(ctx, usersKeysVersionKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if version == usersKeysVersion {
+		return nil
+	}
+
+	scan := func(ctx context.Context, client redis.UniversalClient) error {
+		for _, prefix := range legacyUserKeyPrefixes {
+			iter := client.Scan(ctx, 0, prefix+"*", listScanBatch).Iterator()
+			for iter.Next(ctx) {
+				phone := strings.TrimPrefix(iter.Val(), prefix)
+				if strings.HasPrefix(phone, "{") {
+					continue
+				}
+				if err := moveKey(ctx, redisConnection, iter.Val(), prefix+userTag(phone)); err != nil {
+					return err
+				}
+			}
+			if err := iter.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// SCAN only walks the keys of the node it is sent to.
+	if cluster, ok := redisConnection.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, redisConnection)
+	}
+	if err != nil {
+		return err
+	}
+
+	return redisConnection.Set(ctx, usersKeysVersionKey, usersKeysVersion, 0).Err()
+}
+
+// moveKey copies the string at from to to and deletes from. RENAME would do in a single
+// node, but from and to hash to different slots in a cluster.
+func moveKey(ctx context.Context, redisConnection redis.UniversalClient, from, to string) error {
+	value, err := redisConnection.Get(ctx, from).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	ttl, err := redisConnection.PTTL(ctx, from).Result()
+	if err != nil {
+		return err
+	}
+	switch {
+	case ttl == -2:
+		// Expired since it was read.
+		return nil
+	case ttl < 0:
+		ttl = 0
+	}
+
+	set, err := redisConnection.SetNX(ctx, to, value, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !set {
+		logger.LogInfo("MIGRATION", fmt.Sprintf("%s: %s already exists, left as is", from, to))
+		return nil
+	}
+	return redisConnection.Del(ctx, from).Err()
+}
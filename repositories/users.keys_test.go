@@ -0,0 +1,68 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMigrateUserKeys(t *testing.T) {
+	ctx := context.Background()
+	server, client := newRedis(t)
+
+	server.Set("user:+989121234567", `{"phone":"+989121234567"}`)
+	server.Set("otp:+989121234567", "123456")
+	server.SetTTL("otp:+989121234567", 2*time.Minute)
+	server.Set("refresh:+989121234567", "token")
+	server.SetTTL("refresh:+989121234567", time.Hour)
+	// Written since the upgrade: the tagged key wins.
+	server.Set("user:+989127654321", `{"phone":"stale"}`)
+	server.Set("user:{+989127654321}", `{"phone":"+989127654321"}`)
+	// Not per-user keys.
+	server.Set("users:idx:version", "1")
+
+	if err := MigrateUserKeys(ctx, client); err != nil {
+		t.Fatalf("MigrateUserKeys: %v", err)
+	}
+
+	tests := []struct {
+		key   string
+		value string
+		ttl   time.Duration
+	}{
+		{key: "user:{+989121234567}", value: `{"phone":"+989121234567"}`},
+		{key: "otp:{+989121234567}", value: "123456", ttl: 2 * time.Minute},
+		{key: "refresh:{+989121234567}", value: "token", ttl: time.Hour},
+		{key: "user:{+989127654321}", value: `{"phone":"+989127654321"}`},
+		{key: "user:+989127654321", value: `{"phone":"stale"}`},
+		{key: "users:idx:version", value: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			value, err := server.Get(tt.key)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			if value != tt.value {
+				t.Errorf("value = %q, want %q", value, tt.value)
+			}
+			if ttl := server.TTL(tt.key); ttl != tt.ttl {
+				t.Errorf("TTL = %s, want %s", ttl, tt.ttl)
+			}
+		})
+	}
+	for _, key := range []string{"user:+989121234567", "otp:+989121234567", "refresh:+989121234567"} {
+		if server.Exists(key) {
+			t.Errorf("%s was not moved", key)
+		}
+	}
+
+	// It runs once.
+	server.Set("user:+989120000000", `{}`)
+	if err := MigrateUserKeys(ctx, client); err != nil {
+		t.Fatalf("MigrateUserKeys again: %v", err)
+	}
+	if !server.Exists("user:+989120000000") {
+		t.Error("second run moved keys")
+	}
+}
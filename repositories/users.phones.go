@@ -0,0 +1,143 @@
+package repositories
+
+import (
+	"authentication/pkg/phone"
+	"authentication/utils/logger"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MigratePhoneNumbers moves users stored under the phone exactly as a client typed it
+// (09121234567, 989121234567, ...) to their E.164 key, with their indexes and refresh
+// token, so that every spelling of a number is the same user. A user whose E.164 key is
+// already taken is left in place and logged for an operator to merge. It runs once.
+func MigratePhoneNumbers(ctx context.Context, redisConnection redis.UniversalClient) error {
+	version, err := redisConnection.Get(ctx, usersPhonesVersionKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if version == usersPhonesVersion {
+		return nil
+	}
+
+	// Collect first: moving users while scanning would reorder the set under the scan.
+	legacy := make(map[string]string)
+	iter := redisConnection.ZScan(ctx, usersByCreatedKey, 0, "", listScanBatch).Iterator()
+	for i := 0; iter.Next(ctx); i++ {
+		// ZSCAN yields members and scores alternately.
+		if i%2 == 1 {
+			continue
+		}
+		stored := iter.Val()
+		canonical, err := phone.Normalize(stored)
+		if err != nil {
+			logger.LogInfo("MIGRATION", fmt.Sprintf("user %s: phone is not a valid mobile number, left as is", stored))
+			continue
+		}
+		if canonical != stored {
+			legacy[stored] = canonical
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for stored, canonical := range legacy {
+		if err := movePhone(ctx, redisConnection, stored, canonical); err != nil {
+			return err
+		}
+	}
+
+	return redisConnection.Set(ctx, usersPhonesVersionKey, usersPhonesVersion, 0).Err()
+}
+
+// movePhone reads the keys of from under their tagged name or, not moved by MigrateUserKeys
+// yet, their legacy one. A user that is indexed but not stored is left alone.
+func movePhone(ctx context.Context, redisConnection redis.UniversalClient, from, to string) error {
+	data, _, err := getPerUserKey(ctx, redisConnection, "user:", from)
+	if err == redis.Nil {
+		logger.LogInfo("MIGRATION", fmt.Sprintf("user %s: indexed but not stored, left as is", from))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	user, err := unmarshalUser(data)
+	if err != nil {
+		return err
+	}
+
+	moved := applyChanges(user, map[string]string{"phone": to})
+	encoded, err := json.Marshal(moved)
+	if err != nil {
+		return err
+	}
+	set, err := redisConnection.SetNX(ctx, userKey(to), encoded, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !set {
+		logger.LogInfo("MIGRATION", fmt.Sprintf("user %s: %s already exists, merge them by hand", from, to))
+		return nil
+	}
+
+	// Keep sessions alive: the refresh token follows the user with its remaining lifetime.
+	token, key, err := getPerUserKey(ctx, redisConnection, "refresh:", from)
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if token != "" {
+		ttl, err := redisConnection.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			if err := redisConnection.Set(ctx, refreshKey(to), token, ttl).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	created, err := redisConnection.ZScore(ctx, usersByCreatedKey, from).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	_, err = redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, usersByCreatedKey, redis.Z{Score: created, Member: to})
+		pipe.ZAdd(ctx, usersByPhoneKey, redis.Z{Score: 0, Member: to})
+		applyIndex(ctx, pipe, to, userIndex{}, indexOf(to, moved))
+
+		pipe.ZRem(ctx, usersByCreatedKey, from)
+		pipe.ZRem(ctx, usersByPhoneKey, from)
+		applyIndex(ctx, pipe, from, indexOf(from, user), userIndex{})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The tagged keys share a slot, so a single DEL is cluster-safe; the legacy ones do not.
+	_, err = redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, userKey(from), otpKey(from), refreshKey(from))
+		for _, prefix := range legacyUserKeyPrefixes {
+			pipe.Del(ctx, prefix+from)
+		}
+		return nil
+	})
+	return err
+}
+
+// getPerUserKey reads the per-user key prefix of phone under its tagged name, then its
+// legacy one, and returns the name it was found under. It returns redis.Nil for neither.
+func getPerUserKey(ctx context.Context, redisConnection redis.UniversalClient, prefix, phone string) (string, string, error) {
+	for _, key := range []string{prefix + userTag(phone), prefix + phone} {
+		value, err := redisConnection.Get(ctx, key).Result()
+		if err != redis.Nil {
+			return value, key, err
+		}
+	}
+	return "", "", redis.Nil
+}
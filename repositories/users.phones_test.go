@@ -0,0 +1,87 @@
+package repositories
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMigratePhoneNumbers(t *testing.T) {
+	ctx := context.Background()
+	server, client := newRedis(t)
+
+	stored := map[string]string{
+		// Tagged keys, written since per-user keys carry the hash tag.
+		"user:{09121234567}":    `{"id":"user-1","phone":"09121234567"}`,
+		"refresh:{09121234567}": "token",
+		// Legacy keys, not moved by MigrateUserKeys.
+		"user:989351234567": `{"id":"user-2","phone":"989351234567"}`,
+		// Both spellings of one number: the second one is left for an operator.
+		"user:{+989127654321}": `{"id":"user-3","phone":"+989127654321"}`,
+		"user:{09127654321}":   `{"id":"user-4","phone":"09127654321"}`,
+		"user:{12345}":         `{"id":"user-5","phone":"12345"}`,
+	}
+	for key, value := range stored {
+		server.Set(key, value)
+	}
+	server.SetTTL("refresh:{09121234567}", time.Hour)
+	// 09350000000 is indexed but its user is gone.
+	for i, phone := range []string{"09121234567", "989351234567", "+989127654321", "09127654321", "12345", "09350000000"} {
+		if _, err := server.ZAdd(usersByCreatedKey, float64(i), phone); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := MigratePhoneNumbers(ctx, client); err != nil {
+		t.Fatalf("MigratePhoneNumbers: %v", err)
+	}
+
+	tests := []struct {
+		phone   string
+		indexed bool
+		// stored is the key the user is expected under, if any.
+		stored string
+	}{
+		{phone: "+989121234567", indexed: true, stored: "user:{+989121234567}"},
+		{phone: "09121234567"},
+		{phone: "+989351234567", indexed: true, stored: "user:{+989351234567}"},
+		{phone: "989351234567"},
+		{phone: "+989127654321", indexed: true, stored: "user:{+989127654321}"},
+		{phone: "09127654321", indexed: true, stored: "user:{09127654321}"},
+		{phone: "12345", indexed: true, stored: "user:{12345}"},
+		{phone: "09350000000", indexed: true},
+	}
+	members, err := server.ZMembers(usersByCreatedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := make(map[string]bool)
+	for _, member := range members {
+		index[member] = true
+	}
+	for _, tt := range tests {
+		t.Run(tt.phone, func(t *testing.T) {
+			if indexed := index[tt.phone]; indexed != tt.indexed {
+				t.Errorf("indexed = %v, want %v", indexed, tt.indexed)
+			}
+			if tt.stored != "" && !server.Exists(tt.stored) {
+				t.Errorf("%s is missing", tt.stored)
+			}
+		})
+	}
+
+	for _, key := range []string{"user:{09121234567}", "refresh:{09121234567}", "user:989351234567"} {
+		if server.Exists(key) {
+			t.Errorf("%s was not moved", key)
+		}
+	}
+	if user, _ := server.Get("user:{+989351234567}"); user != `{"id":"user-2","phone":"+989351234567"}` {
+		t.Errorf("moved user = %s", user)
+	}
+	if token, _ := server.Get("refresh:{+989121234567}"); token != "token" || server.TTL("refresh:{+989121234567}") != time.Hour {
+		t.Errorf("refresh token = %q with TTL %s, want it moved with its lifetime", token, server.TTL("refresh:{+989121234567}"))
+	}
+	if version, _ := server.Get(usersPhonesVersionKey); version != usersPhonesVersion {
+		t.Errorf("version = %q", version)
+	}
+}
@@ -0,0 +1,407 @@
+package repositories
+
+import (
+	"authentication/requests"
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	DefaultUserStatus = "active"
+	DefaultUserRole   = "user"
+
+	// MetadataPrefix marks user fields that hold free-form metadata ("meta.plan" => "pro").
+	MetadataPrefix = "meta."
+)
+
+// userIndex lists the secondary index entries of one user. Comparing the entries
+// before and after an update tells which index keys have to change.
+type userIndex struct {
+	sets      []string
+	email     string
+	lastLogin float64
+	deletedAt float64
+}
+
+func indexOf(phone string, user map[string]string) userIndex {
+	index := userIndex{
+		sets: []string{
+			statusIndexKey(fieldOr(user, "status", DefaultUserStatus)),
+			roleIndexKey(fieldOr(user, "role", DefaultUserRole)),
+		},
+	}
+
+	for _, token := range nameTokens(user["name"]) {
+		index.sets = append(index.sets, nameIndexKey(token))
+	}
+	for field, value := range user {
+		if strings.HasPrefix(field, MetadataPrefix) {
+			index.sets = append(index.sets, metadataIndexKey(strings.TrimPrefix(field, MetadataPrefix), value))
+		}
+	}
+	if email := strings.ToLower(user["email"]); email != "" {
+		index.email = email + "\x00" + phone
+	}
+	if lastLogin, err := time.Parse(time.RFC3339, user["last_login_at"]); err == nil {
+		index.lastLogin = createdScore(lastLogin)
+	}
+	if deletedAt, err := time.Parse(time.RFC3339, user["deleted_at"]); err == nil {
+		index.deletedAt = createdScore(deletedAt)
+	}
+
+	return index
+}
+
+// applyChanges returns a copy of user with changes merged in; empty values delete fields.
+func applyChanges(user map[string]string, changes map[string]string) map[string]string {
+	updated := make(map[string]string, len(user)+len(changes))
+	for field, value := range user {
+		updated[field] = value
+	}
+	for field, value := range changes {
+		if value == "" {
+			delete(updated, field)
+		} else {
+			updated[field] = value
+		}
+	}
+	return updated
+}
+
+func fieldOr(user map[string]string, field, fallback string) string {
+	if value := user[field]; value != "" {
+		return value
+	}
+	return fallback
+}
+
+func nameTokens(name string) []string {
+	return strings.Fields(strings.ToLower(name))
+}
+
+// userFilter is a UsersList search normalized once per request.
+type userFilter struct {
+	phoneLike   string
+	phonePrefix string
+	email       string
+	nameTokens  []string
+	status      string
+	role        string
+	metadata    map[string]string
+
+	createdFrom, createdTo     float64
+	lastLoginFrom, lastLoginTo float64
+}
+
+func newUserFilter(request requests.UsersList) userFilter {
+	filter := userFilter{
+		phoneLike:     request.PhoneLike,
+		phonePrefix:   request.PhonePrefix,
+		email:         strings.ToLower(request.Email),
+		nameTokens:    nameTokens(request.Name),
+		status:        request.Status,
+		role:          request.Role,
+		metadata:      request.Metadata,
+		createdFrom:   math.Inf(-1),
+		createdTo:     math.Inf(1),
+		lastLoginFrom: math.Inf(-1),
+		lastLoginTo:   math.Inf(1),
+	}
+	if !request.CreatedFrom.IsZero() {
+		filter.createdFrom = createdScore(request.CreatedFrom)
+	}
+	if !request.CreatedTo.IsZero() {
+		filter.createdTo = createdScore(request.CreatedTo)
+	}
+	if !request.LastLoginFrom.IsZero() {
+		filter.lastLoginFrom = createdScore(request.LastLoginFrom)
+	}
+	if !request.LastLoginTo.IsZero() {
+		filter.lastLoginTo = createdScore(request.LastLoginTo)
+	}
+	return filter
+}
+
+func (f userFilter) filtersLastLogin() bool {
+	return !math.IsInf(f.lastLoginFrom, -1) || !math.IsInf(f.lastLoginTo, 1)
+}
+
+// indexed reports whether a secondary index can narrow the search down before
+// walking the creation index.
+func (f userFilter) indexed() bool {
+	return f.phonePrefix != "" || f.email != "" || len(f.nameTokens) > 0 || f.status != "" ||
+		f.role != "" || len(f.metadata) > 0 || f.filtersLastLogin()
+}
+
+// matches evaluates the whole filter against a stored record. The in-memory repository
+// uses it directly; Redis answers the same questions from its secondary indexes.
+func (f userFilter) matches(phone string, user map[string]string) bool {
+	if f.phoneLike != "" && !strings.Contains(phone, f.phoneLike) {
+		return false
+	}
+	if f.phonePrefix != "" && !strings.HasPrefix(phone, f.phonePrefix) {
+		return false
+	}
+	if f.email != "" && !strings.HasPrefix(strings.ToLower(user["email"]), f.email) {
+		return false
+	}
+	if f.status != "" && fieldOr(user, "status", DefaultUserStatus) != f.status {
+		return false
+	}
+	if f.role != "" && fieldOr(user, "role", DefaultUserRole) != f.role {
+		return false
+	}
+	if len(f.nameTokens) > 0 {
+		tokens := make(map[string]bool)
+		for _, token := range nameTokens(user["name"]) {
+			tokens[token] = true
+		}
+		for _, token := range f.nameTokens {
+			if !tokens[token] {
+				return false
+			}
+		}
+	}
+	for key, value := range f.metadata {
+		if user[MetadataPrefix+key] != value {
+			return false
+		}
+	}
+	if f.filtersLastLogin() {
+		lastLogin := indexOf(phone, user).lastLogin
+		if lastLogin == 0 || lastLogin < f.lastLoginFrom || lastLogin > f.lastLoginTo {
+			return false
+		}
+	}
+	return true
+}
+
+// searchCandidates intersects the secondary indexes touched by the filter and returns the
+// matching phones. The intersection happens here rather than with SINTER because it mixes
+// sets, lex ranges and score ranges, and because index keys may sit in different cluster slots.
+func (r *authRepository) searchCandidates(ctx context.Context, filter userFilter) ([]string, error) {
+	var candidates map[string]bool
+	narrow := func(phones []string) {
+		next := make(map[string]bool, len(phones))
+		for _, phone := range phones {
+			if candidates == nil || candidates[phone] {
+				next[phone] = true
+			}
+		}
+		candidates = next
+	}
+	exhausted := func() bool {
+		return candidates != nil && len(candidates) == 0
+	}
+
+	var sets []string
+	if filter.status != "" {
+		sets = append(sets, statusIndexKey(filter.status))
+	}
+	if filter.role != "" {
+		sets = append(sets, roleIndexKey(filter.role))
+	}
+	for _, token := range filter.nameTokens {
+		sets = append(sets, nameIndexKey(token))
+	}
+	for key, value := range filter.metadata {
+		sets = append(sets, metadataIndexKey(key, value))
+	}
+
+	for _, key := range sets {
+		if exhausted() {
+			return nil, nil
+		}
+		phones, err := r.redisConnection.SMembers(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		narrow(phones)
+	}
+
+	if filter.phonePrefix != "" && !exhausted() {
+		phones, err := r.redisConnection.ZRangeByLex(ctx, usersByPhoneKey, &redis.ZRangeBy{
+			Min: "[" + filter.phonePrefix,
+			Max: "[" + filter.phonePrefix + "\xff",
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		narrow(phones)
+	}
+
+	if filter.email != "" && !exhausted() {
+		members, err := r.redisConnection.ZRangeByLex(ctx, usersByEmailKey, &redis.ZRangeBy{
+			Min: "[" + filter.email,
+			Max: "[" + filter.email + "\xff",
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		phones := make([]string, 0, len(members))
+		for _, member := range members {
+			phones = append(phones, member[strings.LastIndexByte(member, 0)+1:])
+		}
+		narrow(phones)
+	}
+
+	if filter.filtersLastLogin() && !exhausted() {
+		phones, err := r.redisConnection.ZRangeByScore(ctx, usersByLastLoginKey, &redis.ZRangeBy{
+			Min: formatScore(filter.lastLoginFrom),
+			Max: formatScore(filter.lastLoginTo),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		narrow(phones)
+	}
+
+	phones := make([]string, 0, len(candidates))
+	for phone := range candidates {
+		if filter.phoneLike == "" || strings.Contains(phone, filter.phoneLike) {
+			phones = append(phones, phone)
+		}
+	}
+	return phones, nil
+}
+
+// scoreCandidates attaches creation scores to the candidates, drops the ones outside the
+// created range and returns them in ascending index order.
+func (r *authRepository) scoreCandidates(ctx context.Context, phones []string, filter userFilter) ([]redis.Z, error) {
+	if len(phones) == 0 {
+		return nil, nil
+	}
+
+	scores, err := r.redisConnection.ZMScore(ctx, usersByCreatedKey, phones...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]redis.Z, 0, len(phones))
+	for i, phone := range phones {
+		if scores[i] < filter.createdFrom || scores[i] > filter.createdTo {
+			continue
+		}
+		entries = append(entries, redis.Z{Score: scores[i], Member: phone})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return indexLess(entries[i], entries[j])
+	})
+	return entries, nil
+}
+
+// applyIndex moves a user's secondary index entries from old to new inside pipe.
+func applyIndex(ctx context.Context, pipe redis.Pipeliner, phone string, old, new userIndex) {
+	keep := make(map[string]bool, len(new.sets))
+	for _, key := range new.sets {
+		keep[key] = true
+		pipe.SAdd(ctx, key, phone)
+	}
+	for _, key := range old.sets {
+		if !keep[key] {
+			pipe.SRem(ctx, key, phone)
+		}
+	}
+
+	if old.email != "" && old.email != new.email {
+		pipe.ZRem(ctx, usersByEmailKey, old.email)
+	}
+	if new.email != "" {
+		pipe.ZAdd(ctx, usersByEmailKey, redis.Z{Score: 0, Member: new.email})
+	}
+
+	if new.lastLogin != 0 {
+		pipe.ZAdd(ctx, usersByLastLoginKey, redis.Z{Score: new.lastLogin, Member: phone})
+	} else if old.lastLogin != 0 {
+		pipe.ZRem(ctx, usersByLastLoginKey, phone)
+	}
+
+	if new.deletedAt != 0 {
+		pipe.ZAdd(ctx, usersByDeletedKey, redis.Z{Score: new.deletedAt, Member: phone})
+	} else if old.deletedAt != 0 {
+		pipe.ZRem(ctx, usersByDeletedKey, phone)
+	}
+}
+
+// ReindexUsers rebuilds the search indexes from the stored user records. It runs once
+// per index version, so upgrading deployments get their existing users indexed.
+func ReindexUsers(ctx context.Context, redisConnection redis.UniversalClient) error {
+	version, err := redisConnection.Get(ctx, usersIndexVersionKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if version == usersIndexVersion {
+		return nil
+	}
+
+	var offset int64
+	for {
+		phones, err := redisConnection.ZRange(ctx, usersByCreatedKey, offset, offset+listScanBatch-1).Result()
+		if err != nil {
+			return err
+		}
+		if len(phones) == 0 {
+			break
+		}
+
+		cmds := make([]*redis.StringCmd, len(phones))
+		_, err = redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, phone := range phones {
+				cmds[i] = pipe.Get(ctx, userKey(phone))
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		_, err = redisConnection.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, phone := range phones {
+				user, ok := decodeUser(cmds[i])
+				if !ok {
+					continue
+				}
+				pipe.ZAdd(ctx, usersByPhoneKey, redis.Z{Score: 0, Member: phone})
+				applyIndex(ctx, pipe, phone, userIndex{}, indexOf(phone, user))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		offset += listScanBatch
+	}
+
+	return redisConnection.Set(ctx, usersIndexVersionKey, usersIndexVersion, 0).Err()
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, -1):
+		return "-inf"
+	case math.IsInf(score, 1):
+		return "+inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+// decodeUser reads a pipelined GET of a user record; missing or corrupt records are skipped.
+func decodeUser(cmd *redis.StringCmd) (map[string]string, bool) {
+	data, err := cmd.Result()
+	if err != nil {
+		return nil, false
+	}
+	var user map[string]string
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, false
+	}
+	return user, true
+}
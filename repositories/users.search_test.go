@@ -0,0 +1,92 @@
+package repositories
+
+import (
+	"authentication/requests"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedSearch stores the same users in repository: the Redis one answers searches from its
+// indexes, the memory one by matching every user, and both must agree.
+func seedSearch(t *testing.T, repository AuthRepository) {
+	t.Helper()
+	ctx := context.Background()
+	users := map[string]map[string]string{
+		"+989120000001": {"email": "Ali@Example.com", "name": "Ali Rezaei", "meta.plan": "pro", "last_login_at": "2024-03-01T10:00:00Z"},
+		"+989120000002": {"email": "alice@example.org", "name": "Alice Rezaei", "role": "admin", "last_login_at": "2024-03-05T10:00:00Z"},
+		"+989350000003": {"email": "old@example.com", "name": "Sara", "meta.plan": "free", "status": "banned"},
+		"+989350000004": {"name": "ali"},
+	}
+	for phone, changes := range users {
+		if _, err := repository.CreateUser(ctx, phone); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repository.UpdateUser(ctx, phone, changes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Index entries follow updates.
+	if _, err := repository.UpdateUser(ctx, "+989350000003", map[string]string{"email": "sara@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	_, client := newRedis(t)
+	repositories := map[string]AuthRepository{
+		"redis":  NewAuthRepository(client),
+		"memory": NewMemoryAuthRepository(),
+	}
+	for _, repository := range repositories {
+		seedSearch(t, repository)
+	}
+
+	tests := []struct {
+		name    string
+		request requests.UsersList
+		want    []string
+	}{
+		{name: "email prefix", request: requests.UsersList{Email: "ALI"}, want: []string{"+989120000001", "+989120000002"}},
+		{name: "replaced email", request: requests.UsersList{Email: "old@"}},
+		{name: "new email", request: requests.UsersList{Email: "sara@"}, want: []string{"+989350000003"}},
+		{name: "name words", request: requests.UsersList{Name: "rezaei ali"}, want: []string{"+989120000001"}},
+		{name: "name word", request: requests.UsersList{Name: "Ali"}, want: []string{"+989120000001", "+989350000004"}},
+		{name: "status", request: requests.UsersList{Status: "banned"}, want: []string{"+989350000003"}},
+		{name: "default status", request: requests.UsersList{Status: "active"}, want: []string{"+989120000001", "+989120000002", "+989350000004"}},
+		{name: "role", request: requests.UsersList{Role: "admin"}, want: []string{"+989120000002"}},
+		{name: "metadata", request: requests.UsersList{Metadata: map[string]string{"plan": "pro"}}, want: []string{"+989120000001"}},
+		{name: "phone prefix", request: requests.UsersList{PhonePrefix: "+98935"}, want: []string{"+989350000003", "+989350000004"}},
+		{name: "phone prefix and contains", request: requests.UsersList{PhonePrefix: "+98935", PhoneLike: "04"}, want: []string{"+989350000004"}},
+		{
+			name:    "last login",
+			request: requests.UsersList{LastLoginFrom: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+			want:    []string{"+989120000002"},
+		},
+		{name: "every filter", request: requests.UsersList{Email: "a", Name: "rezaei", Role: "user", Status: "active"}, want: []string{"+989120000001"}},
+		{name: "no match", request: requests.UsersList{Role: "admin", Status: "banned"}},
+	}
+	for _, tt := range tests {
+		for name, repository := range repositories {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				page, err := repository.ListUsers(context.Background(), tt.request)
+				if err != nil {
+					t.Fatalf("ListUsers: %v", err)
+				}
+				var got []string
+				for _, user := range page.Users {
+					got = append(got, user["phone"])
+				}
+				sort.Strings(got)
+				if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+					t.Errorf("found %v, want %v", got, tt.want)
+				}
+				if page.Total != int64(len(tt.want)) {
+					t.Errorf("total %d, want %d", page.Total, len(tt.want))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package repositories
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/webhook"
+	"authentication/requests"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// webhookLogEntry is a delivery in the log of its subscription.
+type webhookLogEntry struct {
+	id       auditID
+	delivery string
+}
+
+// memoryWebhookRepository keeps subscriptions and deliveries in process memory. Only the
+// deliveries still in a log are kept.
+type memoryWebhookRepository struct {
+	mu            sync.Mutex
+	ids           auditIDs
+	subscriptions map[string]webhook.Subscription
+	deliveries    map[string]webhook.Delivery
+	logs          map[string][]webhookLogEntry
+	// leases are when the claims of deliveries end.
+	leases map[string]time.Time
+}
+
+func NewMemoryWebhookRepository() WebhookRepository {
+	return &memoryWebhookRepository{
+		subscriptions: make(map[string]webhook.Subscription),
+		deliveries:    make(map[string]webhook.Delivery),
+		logs:          make(map[string][]webhookLogEntry),
+		leases:        make(map[string]time.Time),
+	}
+}
+
+func (r *memoryWebhookRepository) AddSubscription(ctx context.Context, subscription webhook.Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subscriptions[subscription.ID] = subscription
+	return nil
+}
+
+func (r *memoryWebhookRepository) ListSubscriptions(ctx context.Context) ([]webhook.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subscriptions := make([]webhook.Subscription, 0, len(r.subscriptions))
+	for _, subscription := range r.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func (r *memoryWebhookRepository) GetSubscription(ctx context.Context, id string) (webhook.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subscription, ok := r.subscriptions[id]
+	if !ok {
+		return webhook.Subscription{}, apperrors.ErrWebhookNotFound
+	}
+	return subscription, nil
+}
+
+func (r *memoryWebhookRepository) DeleteSubscription(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.subscriptions[id]; !ok {
+		return apperrors.ErrWebhookNotFound
+	}
+	delete(r.subscriptions, id)
+	for _, entry := range r.logs[id] {
+		if r.deliveries[entry.delivery].Status != webhook.Pending {
+			delete(r.deliveries, entry.delivery)
+		}
+	}
+	delete(r.logs, id)
+	return nil
+}
+
+func (r *memoryWebhookRepository) AddDelivery(ctx context.Context, delivery webhook.Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deliveries[delivery.ID] = delivery
+	log := append(r.logs[delivery.SubscriptionID], webhookLogEntry{id: r.ids.next(time.Now()), delivery: delivery.ID})
+	if len(log) > webhookLogEntries {
+		for _, entry := range log[:len(log)-webhookLogEntries] {
+			if r.deliveries[entry.delivery].Status != webhook.Pending {
+				delete(r.deliveries, entry.delivery)
+			}
+		}
+		log = append([]webhookLogEntry(nil), log[len(log)-webhookLogEntries:]...)
+	}
+	r.logs[delivery.SubscriptionID] = log
+	return nil
+}
+
+func (r *memoryWebhookRepository) SaveDelivery(ctx context.Context, delivery webhook.Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deliveries[delivery.ID] = delivery
+	delete(r.leases, delivery.ID)
+	return nil
+}
+
+func (r *memoryWebhookRepository) GetDelivery(ctx context.Context, subscriptionID, id string) (webhook.Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delivery, ok := r.deliveries[id]
+	if !ok || delivery.SubscriptionID != subscriptionID {
+		return webhook.Delivery{}, apperrors.ErrDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+func (r *memoryWebhookRepository) ClaimDue(ctx context.Context, now time.Time, limit int64, lease time.Duration) ([]webhook.Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []webhook.Delivery
+	for id, delivery := range r.deliveries {
+		if delivery.Status != webhook.Pending || delivery.NextAttemptAt == nil || delivery.NextAttemptAt.After(now) {
+			continue
+		}
+		if until, ok := r.leases[id]; ok && until.After(now) {
+			continue
+		}
+		due = append(due, delivery)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt) })
+	if int64(len(due)) > limit {
+		due = due[:limit]
+	}
+	for _, delivery := range due {
+		r.leases[delivery.ID] = now.Add(lease)
+	}
+	return due, nil
+}
+
+func (r *memoryWebhookRepository) Deliveries(ctx context.Context, subscriptionID string, request requests.WebhookDeliveries) (DeliveriesPage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cursor, hasCursor, err := deliveriesCursor(request)
+	if err != nil {
+		return DeliveriesPage{}, err
+	}
+
+	page := DeliveriesPage{Deliveries: []webhook.Delivery{}}
+	log := r.logs[subscriptionID]
+	var last auditID
+	for i := len(log) - 1; i >= 0; i-- {
+		entry := log[i]
+		if hasCursor && !entry.id.before(cursor) {
+			continue
+		}
+		delivery, ok := r.deliveries[entry.delivery]
+		if !ok || request.Status != "" && delivery.Status != request.Status {
+			continue
+		}
+		if int64(len(page.Deliveries)) == request.Limit() {
+			page.NextCursor = last.String()
+			break
+		}
+		page.Deliveries = append(page.Deliveries, delivery)
+		last = entry.id
+	}
+	return page, nil
+}
@@ -0,0 +1,269 @@
+package repositories
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/webhook"
+	"authentication/requests"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WebhookRepository stores the webhook subscriptions and the deliveries of their events:
+// the queue of those waiting for an attempt, and the log of every one of a subscription.
+type WebhookRepository interface {
+	AddSubscription(ctx context.Context, subscription webhook.Subscription) error
+	ListSubscriptions(ctx context.Context) ([]webhook.Subscription, error)
+	GetSubscription(ctx context.Context, id string) (webhook.Subscription, error)
+	// DeleteSubscription also deletes its delivery log.
+	DeleteSubscription(ctx context.Context, id string) error
+	// AddDelivery saves a new delivery and adds it to the log of its subscription.
+	AddDelivery(ctx context.Context, delivery webhook.Delivery) error
+	// SaveDelivery writes delivery back. Pending deliveries are queued for their next
+	// attempt; the others leave the queue and are kept for webhookDeliveryTTL.
+	SaveDelivery(ctx context.Context, delivery webhook.Delivery) error
+	GetDelivery(ctx context.Context, subscriptionID, id string) (webhook.Delivery, error)
+	// ClaimDue returns up to limit pending deliveries due at now, and holds them for lease:
+	// no other caller gets them back before lease has passed or they are saved.
+	ClaimDue(ctx context.Context, now time.Time, limit int64, lease time.Duration) ([]webhook.Delivery, error)
+	// Deliveries pages through the log of a subscription, newest first.
+	Deliveries(ctx context.Context, subscriptionID string, request requests.WebhookDeliveries) (DeliveriesPage, error)
+}
+
+type DeliveriesPage struct {
+	Deliveries []webhook.Delivery
+	NextCursor string
+}
+
+const (
+	// webhookLogEntries is how many deliveries are kept in the log of a subscription.
+	webhookLogEntries = 1000
+	// webhookDeliveryTTL is how long finished deliveries are kept.
+	webhookDeliveryTTL = 30 * 24 * time.Hour
+)
+
+// webhookRepository keeps every delivery under its own key, pending ones in a sorted set
+// by due time, and the log of a subscription in a stream whose IDs are the page cursors.
+type webhookRepository struct {
+	redisConnection redis.UniversalClient
+}
+
+func NewWebhookRepository(redisConnection redis.UniversalClient) WebhookRepository {
+	return &webhookRepository{redisConnection: redisConnection}
+}
+
+func (r *webhookRepository) AddSubscription(ctx context.Context, subscription webhook.Subscription) error {
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+	return r.redisConnection.HSet(ctx, webhookSubscriptionsKey, subscription.ID, data).Err()
+}
+
+func (r *webhookRepository) ListSubscriptions(ctx context.Context) ([]webhook.Subscription, error) {
+	stored, err := r.redisConnection.HGetAll(ctx, webhookSubscriptionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := make([]webhook.Subscription, 0, len(stored))
+	for _, data := range stored {
+		var subscription webhook.Subscription
+		if err := json.Unmarshal([]byte(data), &subscription); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func (r *webhookRepository) GetSubscription(ctx context.Context, id string) (webhook.Subscription, error) {
+	data, err := r.redisConnection.HGet(ctx, webhookSubscriptionsKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return webhook.Subscription{}, apperrors.ErrWebhookNotFound
+	} else if err != nil {
+		return webhook.Subscription{}, err
+	}
+	var subscription webhook.Subscription
+	err = json.Unmarshal([]byte(data), &subscription)
+	return subscription, err
+}
+
+func (r *webhookRepository) DeleteSubscription(ctx context.Context, id string) error {
+	deleted, err := r.redisConnection.HDel(ctx, webhookSubscriptionsKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return apperrors.ErrWebhookNotFound
+	}
+	return r.redisConnection.Del(ctx, webhookLogKey(id)).Err()
+}
+
+func (r *webhookRepository) AddDelivery(ctx context.Context, delivery webhook.Delivery) error {
+	if err := r.SaveDelivery(ctx, delivery); err != nil {
+		return err
+	}
+	return r.redisConnection.XAdd(ctx, &redis.XAddArgs{
+		Stream: webhookLogKey(delivery.SubscriptionID),
+		MaxLen: webhookLogEntries,
+		Approx: true,
+		Values: []interface{}{"delivery", delivery.ID},
+	}).Err()
+}
+
+func (r *webhookRepository) SaveDelivery(ctx context.Context, delivery webhook.Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Duration(0)
+	if delivery.Status != webhook.Pending {
+		ttl = webhookDeliveryTTL
+	}
+	// The delivery is written before it is queued, so the queue never holds an ID whose
+	// delivery cannot be read.
+	_, err = r.redisConnection.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, webhookDeliveryKey(delivery.ID), data, ttl)
+		pipe.Del(ctx, webhookLockKey(delivery.ID))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if delivery.Status == webhook.Pending && delivery.NextAttemptAt != nil {
+		return r.redisConnection.ZAdd(ctx, webhookQueueKey, redis.Z{
+			Score:  float64(delivery.NextAttemptAt.UnixMilli()),
+			Member: delivery.ID,
+		}).Err()
+	}
+	return r.redisConnection.ZRem(ctx, webhookQueueKey, delivery.ID).Err()
+}
+
+func (r *webhookRepository) GetDelivery(ctx context.Context, subscriptionID, id string) (webhook.Delivery, error) {
+	data, err := r.redisConnection.Get(ctx, webhookDeliveryKey(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return webhook.Delivery{}, apperrors.ErrDeliveryNotFound
+	} else if err != nil {
+		return webhook.Delivery{}, err
+	}
+	var delivery webhook.Delivery
+	if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+		return webhook.Delivery{}, err
+	}
+	if delivery.SubscriptionID != subscriptionID {
+		return webhook.Delivery{}, apperrors.ErrDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+// ClaimDue takes the lock of each due delivery, then pushes it back in the queue by lease
+// so the next callers look past it. A caller that dies holding deliveries leaves them
+// queued: they are due again once the lease is over.
+func (r *webhookRepository) ClaimDue(ctx context.Context, now time.Time, limit int64, lease time.Duration) ([]webhook.Delivery, error) {
+	ids, err := r.redisConnection.ZRangeByScore(ctx, webhookQueueKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.UnixMilli(), 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]webhook.Delivery, 0, len(ids))
+	for _, id := range ids {
+		claimed, err := r.redisConnection.SetNX(ctx, webhookLockKey(id), now.UnixMilli(), lease).Result()
+		if err != nil {
+			return deliveries, err
+		}
+		if !claimed {
+			continue
+		}
+		err = r.redisConnection.ZAddXX(ctx, webhookQueueKey, redis.Z{
+			Score:  float64(now.Add(lease).UnixMilli()),
+			Member: id,
+		}).Err()
+		if err != nil {
+			return deliveries, err
+		}
+
+		data, err := r.redisConnection.Get(ctx, webhookDeliveryKey(id)).Result()
+		if errors.Is(err, redis.Nil) {
+			// Nothing left to send.
+			r.redisConnection.ZRem(ctx, webhookQueueKey, id)
+			continue
+		} else if err != nil {
+			return deliveries, err
+		}
+		var delivery webhook.Delivery
+		if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+func (r *webhookRepository) Deliveries(ctx context.Context, subscriptionID string, request requests.WebhookDeliveries) (DeliveriesPage, error) {
+	end := "+"
+	cursor, hasCursor, err := deliveriesCursor(request)
+	if err != nil {
+		return DeliveriesPage{}, err
+	}
+	if hasCursor {
+		end = cursor.previous().String()
+	}
+
+	page := DeliveriesPage{Deliveries: []webhook.Delivery{}}
+	// last is the log ID of the last delivery on the page, the cursor of the next one.
+	var last string
+	for {
+		messages, err := r.redisConnection.XRevRangeN(ctx, webhookLogKey(subscriptionID), end, "-", auditBatch).Result()
+		if err != nil {
+			return DeliveriesPage{}, err
+		}
+		for _, message := range messages {
+			id, _ := message.Values["delivery"].(string)
+			delivery, err := r.GetDelivery(ctx, subscriptionID, id)
+			if errors.Is(err, apperrors.ErrDeliveryNotFound) {
+				continue
+			} else if err != nil {
+				return DeliveriesPage{}, err
+			}
+			if request.Status != "" && delivery.Status != request.Status {
+				continue
+			}
+			if int64(len(page.Deliveries)) == request.Limit() {
+				page.NextCursor = last
+				return page, nil
+			}
+			page.Deliveries = append(page.Deliveries, delivery)
+			last = message.ID
+		}
+		if len(messages) < auditBatch {
+			return page, nil
+		}
+		oldest, _ := parseAuditID(messages[len(messages)-1].ID)
+		if oldest == (auditID{}) {
+			return page, nil
+		}
+		end = oldest.previous().String()
+	}
+}
+
+// deliveriesCursor is the log ID deliveries of the next page are below, if request has a
+// cursor. Log IDs are shaped like audit event IDs.
+func deliveriesCursor(request requests.WebhookDeliveries) (auditID, bool, error) {
+	if request.Cursor == "" {
+		return auditID{}, false, nil
+	}
+	id, ok := parseAuditID(request.Cursor)
+	if !ok {
+		return auditID{}, false, apperrors.ErrInvalidCursor
+	}
+	return id, true, nil
+}
@@ -0,0 +1,198 @@
+package repositories
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/webhook"
+	"authentication/requests"
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newDelivery(id string, due time.Time) webhook.Delivery {
+	return webhook.Delivery{
+		ID:             id,
+		SubscriptionID: "wh_1",
+		EventType:      webhook.UserCreated,
+		Status:         webhook.Pending,
+		NextAttemptAt:  &due,
+		CreatedAt:      due,
+	}
+}
+
+func deliveryIDs(deliveries []webhook.Delivery) []string {
+	ids := []string{}
+	for _, delivery := range deliveries {
+		ids = append(ids, delivery.ID)
+	}
+	return ids
+}
+
+func TestWebhookClaimDue(t *testing.T) {
+	server, client := newRedis(t)
+	tests := []struct {
+		name       string
+		repository WebhookRepository
+		// expire lets the locks of the claims run out, where they have a TTL.
+		expire func(time.Duration)
+	}{
+		{name: "redis", repository: NewWebhookRepository(client), expire: server.FastForward},
+		{name: "memory", repository: NewMemoryWebhookRepository(), expire: func(time.Duration) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now().Truncate(time.Millisecond)
+			lease := time.Minute
+			claim := func(at time.Time, limit int64) []string {
+				t.Helper()
+				due, err := tt.repository.ClaimDue(ctx, at, limit, lease)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return deliveryIDs(due)
+			}
+
+			for _, delivery := range []webhook.Delivery{
+				newDelivery("whd_late", now.Add(-time.Second)),
+				newDelivery("whd_early", now.Add(-time.Minute)),
+				newDelivery("whd_next", now.Add(-30*time.Second)),
+				newDelivery("whd_future", now.Add(time.Hour)),
+			} {
+				if err := tt.repository.AddDelivery(ctx, delivery); err != nil {
+					t.Fatal(err)
+				}
+			}
+			delivered := newDelivery("whd_delivered", now.Add(-time.Hour))
+			delivered.Status, delivered.NextAttemptAt = webhook.Delivered, nil
+			if err := tt.repository.AddDelivery(ctx, delivered); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := claim(now, 2), []string{"whd_early", "whd_next"}; !slices.Equal(got, want) {
+				t.Fatalf("ClaimDue(limit 2) = %v, want the most overdue first %v", got, want)
+			}
+			// Another instance looks past the claimed deliveries.
+			if got, want := claim(now, 10), []string{"whd_late"}; !slices.Equal(got, want) {
+				t.Fatalf("ClaimDue() = %v, want the unclaimed %v", got, want)
+			}
+			if got := claim(now.Add(lease/2), 10); len(got) != 0 {
+				t.Fatalf("ClaimDue() during the lease = %v, want none", got)
+			}
+
+			// Saving a delivery ends its claim.
+			saved := newDelivery("whd_early", now.Add(-time.Minute))
+			saved.Attempts = 1
+			if err := tt.repository.SaveDelivery(ctx, saved); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := claim(now, 10), []string{"whd_early"}; !slices.Equal(got, want) {
+				t.Fatalf("ClaimDue() after SaveDelivery = %v, want %v", got, want)
+			}
+
+			// Once the lease has passed, deliveries whose caller died are due again.
+			tt.expire(lease)
+			got := claim(now.Add(lease+time.Second), 10)
+			slices.Sort(got)
+			if want := []string{"whd_early", "whd_late", "whd_next"}; !slices.Equal(got, want) {
+				t.Fatalf("ClaimDue() after the lease = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestWebhookClaimDueLock(t *testing.T) {
+	server, client := newRedis(t)
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Millisecond)
+	lease := time.Minute
+	first, second := NewWebhookRepository(client), NewWebhookRepository(client)
+
+	if err := first.AddDelivery(ctx, newDelivery("whd_1", now)); err != nil {
+		t.Fatal(err)
+	}
+	if due, err := first.ClaimDue(ctx, now, 10, lease); err != nil || len(due) != 1 {
+		t.Fatalf("ClaimDue() = %v, %v, want the delivery", deliveryIDs(due), err)
+	}
+	// The queue says the delivery is due again, but the lock of the first claim holds.
+	if due, err := second.ClaimDue(ctx, now.Add(lease), 10, lease); err != nil || len(due) != 0 {
+		t.Fatalf("ClaimDue() while locked = %v, %v, want none", deliveryIDs(due), err)
+	}
+	server.FastForward(lease)
+	if due, err := second.ClaimDue(ctx, now.Add(lease), 10, lease); err != nil || len(due) != 1 {
+		t.Fatalf("ClaimDue() once unlocked = %v, %v, want the delivery", deliveryIDs(due), err)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	_, client := newRedis(t)
+	tests := []struct {
+		name       string
+		repository WebhookRepository
+	}{
+		{name: "redis", repository: NewWebhookRepository(client)},
+		{name: "memory", repository: NewMemoryWebhookRepository()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now()
+			for i, id := range []string{"whd_1", "whd_2", "whd_3", "whd_4", "whd_5"} {
+				delivery := newDelivery(id, now)
+				if i%2 == 1 {
+					delivery.Status, delivery.NextAttemptAt = webhook.Dead, nil
+				}
+				if err := tt.repository.AddDelivery(ctx, delivery); err != nil {
+					t.Fatal(err)
+				}
+			}
+			other := newDelivery("whd_other", now)
+			other.SubscriptionID = "wh_2"
+			if err := tt.repository.AddDelivery(ctx, other); err != nil {
+				t.Fatal(err)
+			}
+
+			pages := func(request requests.WebhookDeliveries) [][]string {
+				t.Helper()
+				var pages [][]string
+				for {
+					page, err := tt.repository.Deliveries(ctx, "wh_1", request)
+					if err != nil {
+						t.Fatal(err)
+					}
+					pages = append(pages, deliveryIDs(page.Deliveries))
+					if page.NextCursor == "" {
+						return pages
+					}
+					request.Cursor = page.NextCursor
+				}
+			}
+
+			tests := []struct {
+				name    string
+				request requests.WebhookDeliveries
+				want    [][]string
+			}{
+				{"one page", requests.WebhookDeliveries{}, [][]string{{"whd_5", "whd_4", "whd_3", "whd_2", "whd_1"}}},
+				{"pages of two", requests.WebhookDeliveries{PageSize: 2}, [][]string{{"whd_5", "whd_4"}, {"whd_3", "whd_2"}, {"whd_1"}}},
+				{"exact pages", requests.WebhookDeliveries{PageSize: 5}, [][]string{{"whd_5", "whd_4", "whd_3", "whd_2", "whd_1"}}},
+				{"dead", requests.WebhookDeliveries{PageSize: 1, Status: webhook.Dead}, [][]string{{"whd_4"}, {"whd_2"}}},
+				{"delivered", requests.WebhookDeliveries{Status: webhook.Delivered}, [][]string{{}}},
+			}
+			for _, tc := range tests {
+				t.Run(tc.name, func(t *testing.T) {
+					if got := pages(tc.request); !slices.EqualFunc(got, tc.want, slices.Equal) {
+						t.Errorf("Deliveries() = %v, want %v", got, tc.want)
+					}
+				})
+			}
+
+			_, err := tt.repository.Deliveries(ctx, "wh_1", requests.WebhookDeliveries{Cursor: "not-a-cursor"})
+			if !errors.Is(err, apperrors.ErrInvalidCursor) {
+				t.Errorf("Deliveries(bad cursor) = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
@@ -1,20 +1,143 @@
 package requests
 
+import "time"
+
 type LoginRequest struct {
-	PhoneNumber string `json:"phoneNumber" binding:"required"`
-	OTPCode     string `json:"OTPCode" binding:"required,min=6"`
+	PhoneNumber string `json:"phoneNumber" binding:"required,phone"`
+	OTPCode     string `json:"OTPCode" binding:"required,otp"`
 }
 
 type OTPRequest struct {
-	PhoneNumber string `json:"phoneNumber" binding:"required"`
+	PhoneNumber string `json:"phoneNumber" binding:"required,phone"`
+}
+
+type RefreshRequest struct {
+	PhoneNumber  string `json:"phoneNumber" binding:"required,phone"`
+	RefreshToken string `json:"refreshToken" binding:"required"`
 }
 
+// Profile asks for the profile of PhoneNumber, by default the caller's own.
 type Profile struct {
-	PhoneNumber string `json:"phone" form:"phone"`
+	PhoneNumber string `json:"phone" form:"phone" binding:"omitempty,phone"`
+	// Caller and CallerRole come from the access token and are filled in by the controller.
+	Caller     string `form:"-"`
+	CallerRole string `form:"-"`
 }
 
+// UsersList pages through users by creation time. Clients either follow Cursor
+// (the next_cursor of the previous response) or, for compatibility, ask for a Page.
+// All search fields are optional and combined with AND.
 type UsersList struct {
-	Page      int64  `form:"page" binding:"required,min=1"`
-	PageSize  int64  `form:"page_size" binding:"required,min=1,max=100"`
+	Page      int64  `form:"page" binding:"omitempty,min=1"`
+	PageSize  int64  `form:"page_size" binding:"omitempty,min=1,max=100"`
+	Cursor    string `form:"cursor"`
+	Order     string `form:"order" binding:"omitempty,oneof=asc desc"`
 	PhoneLike string `form:"phone"`
+
+	PhonePrefix   string    `form:"phone_prefix"`
+	Email         string    `form:"email"`
+	Name          string    `form:"name"`
+	Status        string    `form:"status"`
+	Role          string    `form:"role" binding:"omitempty,oneof=user admin"`
+	CreatedFrom   time.Time `form:"created_from" time_format:"2006-01-02T15:04:05Z07:00"`
+	CreatedTo     time.Time `form:"created_to" time_format:"2006-01-02T15:04:05Z07:00"`
+	LastLoginFrom time.Time `form:"last_login_from" time_format:"2006-01-02T15:04:05Z07:00"`
+	LastLoginTo   time.Time `form:"last_login_to" time_format:"2006-01-02T15:04:05Z07:00"`
+	// Metadata comes from meta[key]=value query parameters and is filled in by the controller.
+	Metadata map[string]string `form:"-"`
+}
+
+// UpdateUser changes profile fields of a user. Nil fields are left untouched and
+// metadata entries with an empty value are removed.
+type UpdateUser struct {
+	Email *string `json:"email" binding:"omitempty,email"`
+	Name  *string `json:"name" binding:"omitempty,max=100"`
+	Role  *string `json:"role" binding:"omitempty,oneof=user admin"`
+	// Locale is the language of the user's SMS and error messages; empty clears it.
+	Locale   *string           `json:"locale" binding:"omitempty,max=16"`
+	Metadata map[string]string `json:"metadata" binding:"omitempty,max=20,dive,keys,min=1,max=64,printascii,excludesall=:,endkeys,max=256"`
+}
+
+const DefaultUsersPageSize = 20
+
+func (r UsersList) Limit() int64 {
+	if r.PageSize == 0 {
+		return DefaultUsersPageSize
+	}
+	return r.PageSize
+}
+
+// Descending is the default order: newest users first.
+func (r UsersList) Descending() bool {
+	return r.Order != "asc"
+}
+
+// Offset is only used in page mode; a cursor always takes precedence.
+func (r UsersList) Offset() int64 {
+	if r.Cursor != "" || r.Page == 0 {
+		return 0
+	}
+	return (r.Page - 1) * r.Limit()
+}
+
+// UserStatus moves an account between states. Until only applies to suspensions;
+// without it the suspension lasts until an admin lifts it.
+type UserStatus struct {
+	Status string     `json:"status" binding:"required,oneof=active suspended banned deleted"`
+	Reason string     `json:"reason" binding:"required,max=500"`
+	Until  *time.Time `json:"until"`
+}
+
+type DeleteUser struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// AuditHistory pages through the security events of a user, newest first. Types and
+// Outcome narrow the events; From and To bound their time.
+type AuditHistory struct {
+	PageSize int64     `form:"page_size" binding:"omitempty,min=1,max=100"`
+	Cursor   string    `form:"cursor"`
+	Types    []string  `form:"type" binding:"omitempty,dive,oneof=otp_sent login user_created token_refreshed user_updated status_changed sessions_revoked"`
+	Outcome  string    `form:"outcome" binding:"omitempty,oneof=success failure"`
+	From     time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To       time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+const DefaultAuditPageSize = 50
+
+func (r AuditHistory) Limit() int64 {
+	if r.PageSize == 0 {
+		return DefaultAuditPageSize
+	}
+	return r.PageSize
+}
+
+// WebhookSubscription registers an endpoint for events of the types in Events. Without a
+// Secret, one is generated.
+type WebhookSubscription struct {
+	URL    string   `json:"url" binding:"required,http_url,max=2048"`
+	Events []string `json:"events" binding:"required,min=1,dive,oneof=user.created user.logged_in user.updated user.status_changed user.sessions_revoked"`
+	Secret string   `json:"secret" binding:"omitempty,min=16,max=256,printascii"`
+}
+
+// WebhookDeliveries pages through the deliveries of a subscription, newest first. Status
+// narrows them, to the dead letters for instance.
+type WebhookDeliveries struct {
+	PageSize int64  `form:"page_size" binding:"omitempty,min=1,max=100"`
+	Cursor   string `form:"cursor"`
+	Status   string `form:"status" binding:"omitempty,oneof=pending delivered dead"`
+}
+
+const DefaultWebhookDeliveriesPageSize = 20
+
+func (r WebhookDeliveries) Limit() int64 {
+	if r.PageSize == 0 {
+		return DefaultWebhookDeliveriesPageSize
+	}
+	return r.PageSize
+}
+
+// LogLevel changes the level of the service's logs at runtime.
+type LogLevel struct {
+	Level string `json:"level" binding:"required,oneof=trace debug info warn error"`
 }
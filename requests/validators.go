@@ -0,0 +1,68 @@
+package requests
+
+import (
+	"authentication/pkg/phone"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+var registerOnce sync.Once
+
+// RegisterValidators adds the custom rules below to gin's validator and makes it report
+// fields by their JSON or query names. It is safe to call more than once.
+func RegisterValidators() {
+	registerOnce.Do(func() {
+		validate, ok := binding.Validator.Engine().(*validator.Validate)
+		if !ok {
+			return
+		}
+
+		validate.RegisterTagNameFunc(fieldName)
+		for tag, fn := range map[string]validator.Func{
+			"phone": validPhone,
+			"otp":   validOTP,
+		} {
+			if err := validate.RegisterValidation(tag, fn); err != nil {
+				panic(err)
+			}
+		}
+	})
+}
+
+// fieldName is the name clients know a field by: its json tag, else its form tag.
+func fieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "form"} {
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == "-" {
+			continue
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// validPhone accepts mobile numbers of supported countries in any format pkg/phone reads.
+func validPhone(fl validator.FieldLevel) bool {
+	return phone.Valid(fl.Field().String())
+}
+
+// validOTP accepts the six-digit codes the service sends.
+func validOTP(fl validator.FieldLevel) bool {
+	code := fl.Field().String()
+	return len(code) == 6 && digitsOnly(code)
+}
+
+func digitsOnly(value string) bool {
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -2,28 +2,107 @@ package routes
 
 import (
 	"authentication/bootstrap"
+	"authentication/middleware"
+	"authentication/pkg/metrics"
 	"github.com/gin-gonic/gin"
+	"net/http/pprof"
+	"strings"
 )
 
+// Urls serves every route but metrics and the profiler on r, for a service with a single
+// listener: that one is public, and they need no token.
 func Urls(r *gin.Engine, app *bootstrap.AppContainer) *gin.Engine {
-	apiV1 := r.Group("api/v1/auth/")
+	healthUrls(r, app)
+	publicUrls(r, app)
+	adminUrls(r, app)
+	return r
+}
+
+// PublicUrls serves the routes of end users on r, the public listener of a service whose
+// admin routes have a listener of their own.
+func PublicUrls(r *gin.Engine, app *bootstrap.AppContainer) *gin.Engine {
+	healthUrls(r, app)
+	publicUrls(r, app)
+	return r
+}
+
+// AdminUrls serves user management, metrics and the profiler on r, the admin listener.
+func AdminUrls(r *gin.Engine, app *bootstrap.AppContainer) *gin.Engine {
+	healthUrls(r, app)
+	adminUrls(r, app)
+	// Scraped by Prometheus; the admin listener keeps it off the public internet.
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	r.GET("/debug/pprof/*profile", profile)
+	r.POST("/debug/pprof/*profile", profile)
+	return r
+}
+
+func healthUrls(r *gin.Engine, app *bootstrap.AppContainer) {
+	r.GET("/healthz", app.HealthAPI.Live)
+	r.GET("/readyz", app.HealthAPI.Ready)
+}
+
+func publicUrls(r *gin.Engine, app *bootstrap.AppContainer) {
+	apiV1 := r.Group("api/v1/auth/", middleware.Ready(app.Health))
 	{
 		auth := apiV1.Group("")
 		{
-			auth.POST("/login/", app.AuthAPI.Login)
-			auth.POST("/send/otp/", app.AuthAPI.SendOTP)
-			auth.GET("/profile/", app.AuthAPI.Profile)
-			auth.GET("/users", app.AuthAPI.ListUsers)
+			auth.POST("/login/",
+				middleware.RateLimit(app.Limiter, app.RateLimits, "login"),
+				middleware.Challenge(app.Challenges, middleware.CountFailures),
+				app.AuthAPI.Login)
+			auth.POST("/send/otp/",
+				middleware.RateLimit(app.Limiter, app.RateLimits, "send_otp"),
+				middleware.Challenge(app.Challenges, middleware.CountAttempts),
+				app.AuthAPI.SendOTP)
+			auth.POST("/refresh/",
+				middleware.RateLimit(app.Limiter, app.RateLimits, "refresh"),
+				app.AuthAPI.Refresh)
+			auth.GET("/profile/", middleware.JWTAuthMiddleware(app.AuthService), app.AuthAPI.Profile)
 		}
 	}
+}
 
-	// example of protected routes with jwt token
+func adminUrls(r *gin.Engine, app *bootstrap.AppContainer) {
+	adminOnly := []gin.HandlerFunc{middleware.Ready(app.Health), middleware.MachineAuth(app.Machines), middleware.JWTAuthMiddleware(app.AuthService), middleware.RequireRole("admin")}
 
-	//protected := r.Group("api/v1/user/")
-	//protected.Use(middleware.JWTAuthMiddleware())
-	//{
-	//	protected.GET("/profile/", app.AuthAPI.Profile)
-	//}
+	// Kept for existing clients; same handler and protection as the admin route.
+	r.GET("api/v1/auth/users", append(adminOnly, app.AuthAPI.ListUsers)...)
 
-	return r
+	admin := r.Group("api/v1/admin/")
+	admin.Use(adminOnly...)
+	{
+		admin.GET("/users", app.AuthAPI.ListUsers)
+		admin.PATCH("/users/:phone", app.AuthAPI.UpdateUser)
+		admin.POST("/users/:phone/status", app.AuthAPI.SetUserStatus)
+		admin.DELETE("/users/:phone", app.AuthAPI.DeleteUser)
+		admin.GET("/users/:phone/audit", app.AuditAPI.History)
+		admin.GET("/fraud/prefixes", app.FraudAPI.Prefixes)
+		admin.GET("/fraud/prefixes/:prefix", app.FraudAPI.Prefix)
+		admin.DELETE("/fraud/prefixes/:prefix", app.FraudAPI.ResetPrefix)
+		admin.GET("/logging/level", app.LoggingAPI.Level)
+		admin.PUT("/logging/level", app.LoggingAPI.SetLevel)
+		admin.POST("/webhooks", app.WebhookAPI.Subscribe)
+		admin.GET("/webhooks", app.WebhookAPI.Subscriptions)
+		admin.DELETE("/webhooks/:id", app.WebhookAPI.Unsubscribe)
+		admin.GET("/webhooks/:id/deliveries", app.WebhookAPI.Deliveries)
+		admin.POST("/webhooks/:id/deliveries/:delivery/redeliver", app.WebhookAPI.Redeliver)
+	}
+}
+
+// profile serves net/http/pprof: the index and named profiles, and the handlers that are
+// not profiles.
+func profile(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
 }
@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"authentication/bootstrap"
+	"authentication/middleware"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newApp(t *testing.T) *bootstrap.AppContainer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	return bootstrap.InitMemoryAppContainer()
+}
+
+func status(router *gin.Engine, path, remoteAddr string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestListenerRoutes(t *testing.T) {
+	app := newApp(t)
+	single, public, admin := Urls(gin.New(), app), PublicUrls(gin.New(), app), AdminUrls(gin.New(), app)
+
+	// 404 is a route the listener does not serve; the others ask for a token.
+	tests := []struct {
+		path                  string
+		single, public, admin int
+	}{
+		{"/healthz", http.StatusOK, http.StatusOK, http.StatusOK},
+		{"/api/v1/auth/profile/", http.StatusUnauthorized, http.StatusUnauthorized, http.StatusNotFound},
+		{"/api/v1/auth/users", http.StatusUnauthorized, http.StatusNotFound, http.StatusUnauthorized},
+		{"/api/v1/admin/users", http.StatusUnauthorized, http.StatusNotFound, http.StatusUnauthorized},
+		// Metrics and the profiler need no token: never on a public listener.
+		{"/metrics", http.StatusNotFound, http.StatusNotFound, http.StatusOK},
+		{"/debug/pprof/", http.StatusNotFound, http.StatusNotFound, http.StatusOK},
+		{"/debug/pprof/cmdline", http.StatusNotFound, http.StatusNotFound, http.StatusOK},
+		{"/debug/pprof/goroutine", http.StatusNotFound, http.StatusNotFound, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := status(single, tt.path, ""); got != tt.single {
+				t.Errorf("Urls %s = %d, want %d", tt.path, got, tt.single)
+			}
+			if got := status(public, tt.path, ""); got != tt.public {
+				t.Errorf("PublicUrls %s = %d, want %d", tt.path, got, tt.public)
+			}
+			if got := status(admin, tt.path, ""); got != tt.admin {
+				t.Errorf("AdminUrls %s = %d, want %d", tt.path, got, tt.admin)
+			}
+		})
+	}
+}
+
+func TestAdminAllowedIPs(t *testing.T) {
+	app := newApp(t)
+	networks := []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32"), netip.MustParsePrefix("10.0.0.0/8")}
+	router := gin.New()
+	router.Use(middleware.AllowIPs(networks))
+	AdminUrls(router, app)
+
+	tests := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"127.0.0.1:40000", http.StatusOK},
+		{"10.1.2.3:40000", http.StatusOK},
+		// Admins from other networks are refused, token or not.
+		{"192.168.1.7:40000", http.StatusForbidden},
+		{"[2001:db8::1]:40000", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if got := status(router, "/metrics", tt.remoteAddr); got != tt.want {
+			t.Errorf("/metrics from %s = %d, want %d", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package services
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/audit"
+	"authentication/pkg/metrics"
+	"authentication/pkg/tracing"
+	"authentication/pkg/webhook"
+	"authentication/repositories"
+	"authentication/requests"
+	"authentication/utils"
+	"authentication/utils/logger"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	UserStatusActive    = repositories.DefaultUserStatus
+	UserStatusSuspended = "suspended"
+	UserStatusBanned    = "banned"
+	UserStatusDeleted   = "deleted"
+)
+
+const (
+	defaultPurgeAfter    = 30 * 24 * time.Hour
+	defaultPurgeInterval = time.Hour
+)
+
+// accessTokenTTL is how long an access token is accepted.
+const accessTokenTTL = 15 * time.Minute
+
+// ensureActive refuses accounts that may not log in. A suspension whose end has passed
+// is lifted on the spot, so the returned user may differ from the given one.
+func (s *authService) ensureActive(ctx context.Context, phone string, user map[string]string) (map[string]string, error) {
+	switch user["status"] {
+	case UserStatusSuspended:
+		until, err := time.Parse(time.RFC3339, user["suspended_until"])
+		if err != nil || time.Now().Before(until) {
+			return nil, apperrors.ErrAccountSuspended
+		}
+		user, err := s.authRepository.UpdateUser(ctx, phone, map[string]string{
+			"status":            UserStatusActive,
+			"status_reason":     "suspension expired",
+			"status_changed_at": time.Now().UTC().Format(time.RFC3339),
+			"suspended_until":   "",
+		})
+		if err == nil {
+			s.webhooks.Publish(ctx, webhook.UserStatusChanged, user)
+		}
+		return user, err
+	case UserStatusBanned:
+		return nil, apperrors.ErrAccountBanned
+	case UserStatusDeleted:
+		return nil, apperrors.ErrAccountDeleted
+	}
+	return user, nil
+}
+
+// issueTokens starts a new session: a short-lived access token and a rotated refresh token.
+func (s *authService) issueTokens(ctx context.Context, phone string, user map[string]string) (map[string]string, error) {
+	_, span := tracer.Start(ctx, "jwt.Sign")
+	accessToken, err := utils.GenerateAccessToken(phone, user["role"], user["session_version"], accessTokenTTL)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken := utils.GenerateRefreshToken()
+	err = s.authRepository.SetRefreshToken(ctx, phone, refreshToken, time.Hour*24*7)
+	if err != nil {
+		return nil, err
+	}
+
+	user["access_token"] = accessToken
+	user["refresh_token"] = refreshToken
+
+	return user, nil
+}
+
+func (s *authService) RefreshToken(request requests.RefreshRequest, ctx context.Context) (map[string]string, error) {
+	user, err := s.refreshToken(request, ctx)
+	s.audit.Record(ctx, audit.Event{Type: audit.TokenRefreshed, UserID: user["id"], SessionID: sessionID(user)}, request.PhoneNumber, err)
+	if err == nil {
+		metrics.TokenRefreshed.Inc()
+	}
+	return user, err
+}
+
+func (s *authService) refreshToken(request requests.RefreshRequest, ctx context.Context) (map[string]string, error) {
+	number, err := canonicalPhone(request.PhoneNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := s.authRepository.GetRefreshToken(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(request.RefreshToken)) != 1 {
+		return nil, apperrors.ErrInvalidRefreshToken
+	}
+
+	user, err := s.authRepository.GetUser(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if user, err = s.ensureActive(ctx, number, user); err != nil {
+		return nil, err
+	}
+
+	return s.issueTokens(ctx, number, user)
+}
+
+// CheckAccount is consulted by JWTAuthMiddleware on every authenticated request. Tokens of
+// accounts that are gone or not active, or that predate a session revocation, are refused.
+func (s *authService) CheckAccount(ctx context.Context, claims *utils.JWTClaims) (map[string]string, error) {
+	user, err := s.authRepository.GetUser(ctx, claims.Phone)
+	if errors.Is(err, apperrors.ErrUserNotFound) {
+		return nil, apperrors.ErrUnauthenticated
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user, err = s.ensureActive(ctx, claims.Phone, user); err != nil {
+		return nil, err
+	}
+
+	if claims.SessionVersion != user["session_version"] {
+		return nil, apperrors.ErrSessionRevoked
+	}
+	return user, nil
+}
+
+// revokeSessions invalidates every access token by bumping the session version, and
+// the refresh token by deleting it.
+func (s *authService) revokeSessions(ctx context.Context, phone string, user map[string]string) (map[string]string, error) {
+	version, _ := strconv.Atoi(user["session_version"])
+	user, err := s.authRepository.UpdateUser(ctx, phone, map[string]string{
+		"session_version": strconv.Itoa(version + 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.authRepository.DeleteRefreshToken(ctx, phone); err != nil {
+		return nil, err
+	}
+	s.audit.Record(ctx, audit.Event{Type: audit.SessionsRevoked, UserID: user["id"]}, phone, nil)
+	s.webhooks.Publish(ctx, webhook.SessionsRevoked, user)
+	return user, nil
+}
+
+// RevokeSessions logs the user out everywhere; see revokeSessions.
+func (s *authService) RevokeSessions(ctx context.Context, raw string) (map[string]string, error) {
+	phone, err := canonicalPhone(raw)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.authRepository.GetUser(ctx, phone)
+	if err != nil {
+		return nil, err
+	}
+	return s.revokeSessions(ctx, phone, user)
+}
+
+// CreateAdmin gives the user the admin role, signing them up first when they have no
+// account yet. It is how the first administrator of a new deployment is made.
+func (s *authService) CreateAdmin(ctx context.Context, raw string) (map[string]string, error) {
+	user, err := s.createAdmin(ctx, raw)
+	s.audit.Record(ctx, audit.Event{Type: audit.UserUpdated, UserID: user["id"], Reason: "role: admin"}, raw, err)
+	if err == nil {
+		s.webhooks.Publish(ctx, webhook.UserUpdated, user)
+	}
+	return user, err
+}
+
+func (s *authService) createAdmin(ctx context.Context, raw string) (map[string]string, error) {
+	phone, err := canonicalPhone(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.authRepository.GetUser(ctx, phone)
+	if errors.Is(err, apperrors.ErrUserNotFound) {
+		created, err := s.authRepository.CreateUser(ctx, phone)
+		if err != nil {
+			return nil, err
+		}
+		s.audit.Record(ctx, audit.Event{Type: audit.UserCreated, UserID: created["id"]}, phone, nil)
+		s.webhooks.Publish(ctx, webhook.UserCreated, created)
+		metrics.UserCreated.Inc()
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.authRepository.UpdateUser(ctx, phone, map[string]string{"role": "admin"})
+}
+
+// PurgeOTPs deletes the pending code of a phone, or every pending code when raw is empty,
+// and returns how many were deleted. Users whose code is purged have to ask for a new one.
+func (s *authService) PurgeOTPs(ctx context.Context, raw string) (int, error) {
+	if raw == "" {
+		return s.authRepository.DeleteAllOTPs(ctx)
+	}
+
+	phone, err := canonicalPhone(raw)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.authRepository.GetOTP(ctx, phone); errors.Is(err, apperrors.ErrOTPInvalid) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return 1, s.authRepository.DeleteOTP(ctx, phone)
+}
+
+func (s *authService) SetUserStatus(ctx context.Context, raw string, request requests.UserStatus) (map[string]string, error) {
+	user, err := s.setUserStatus(ctx, raw, request)
+	event := audit.Event{Type: audit.StatusChanged, UserID: user["id"], Reason: request.Status + ": " + request.Reason}
+	s.audit.Record(ctx, event, raw, err)
+	if err == nil {
+		s.webhooks.Publish(ctx, webhook.UserStatusChanged, user)
+	}
+	return user, err
+}
+
+func (s *authService) setUserStatus(ctx context.Context, raw string, request requests.UserStatus) (map[string]string, error) {
+	phone, err := canonicalPhone(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	changes := map[string]string{
+		"status":            request.Status,
+		"status_reason":     request.Reason,
+		"status_changed_at": now.Format(time.RFC3339),
+		"suspended_until":   "",
+		"deleted_at":        "",
+	}
+
+	switch request.Status {
+	case UserStatusSuspended:
+		if request.Until != nil {
+			if !request.Until.After(now) {
+				return nil, apperrors.ErrSuspensionInPast
+			}
+			changes["suspended_until"] = request.Until.UTC().Format(time.RFC3339)
+		}
+	case UserStatusDeleted:
+		changes["deleted_at"] = now.Format(time.RFC3339)
+	}
+
+	user, err := s.authRepository.UpdateUser(ctx, phone, changes)
+	if err != nil || request.Status == UserStatusActive {
+		return user, err
+	}
+
+	return s.revokeSessions(ctx, phone, user)
+}
+
+// DeleteUser soft-deletes the account. The record is kept, and can be restored by
+// setting the status back to active, until PurgeDeletedUsers removes it.
+func (s *authService) DeleteUser(ctx context.Context, phone string, request requests.DeleteUser) (map[string]string, error) {
+	return s.SetUserStatus(ctx, phone, requests.UserStatus{Status: UserStatusDeleted, Reason: request.Reason})
+}
+
+// PurgeDeletedUsers permanently removes users soft-deleted longer than USER_PURGE_AFTER ago.
+func (s *authService) PurgeDeletedUsers(ctx context.Context) (int, error) {
+	phones, err := s.authRepository.DeletedBefore(ctx, time.Now().Add(-s.purgeAfter))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, phone := range phones {
+		err := s.authRepository.DeleteUser(ctx, phone)
+		if errors.Is(err, apperrors.ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartDeletedUsersPurger runs PurgeDeletedUsers every USER_PURGE_INTERVAL (default 1h)
+// in the background for the lifetime of the process.
+func StartDeletedUsersPurger(service AuthService) {
+	interval := durationFromEnv("USER_PURGE_INTERVAL", defaultPurgeInterval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			purgeDeletedUsers(service)
+		}
+	}()
+}
+
+func purgeDeletedUsers(service AuthService) {
+	purged, err := service.PurgeDeletedUsers(context.Background())
+	if err != nil {
+		logger.LogErrorWithDepth(map[string]interface{}{
+			"error":   fmt.Errorf("purge deleted users: %w", err),
+			"depth":   2,
+			"message": "Purging deleted users failed",
+		})
+	}
+	if purged > 0 {
+		logger.LogInfo("PurgeDeletedUsers", fmt.Sprintf("purged %d users", purged))
+	}
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/audit"
+	"authentication/pkg/phone"
+	"authentication/pkg/tlsconfig"
+	"authentication/repositories"
+	"authentication/requests"
+	"authentication/utils/logger"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// AuditLog records security events and answers for a user's history.
+type AuditLog interface {
+	// Record completes event with the time, the client and the outcome err stands for, and
+	// writes it for the phone it is about. It never fails the request: an event that cannot
+	// be written is logged instead.
+	Record(ctx context.Context, event audit.Event, phone string, err error)
+	History(ctx context.Context, phone string, request requests.AuditHistory) (repositories.AuditPage, error)
+}
+
+type auditLog struct {
+	repository repositories.AuditRepository
+	hasher     audit.Hasher
+}
+
+func NewAuditLog(repository repositories.AuditRepository, hasher audit.Hasher) AuditLog {
+	return &auditLog{repository: repository, hasher: hasher}
+}
+
+func (l *auditLog) Record(ctx context.Context, event audit.Event, raw string, err error) {
+	number, parseErr := phone.Normalize(raw)
+	if parseErr != nil {
+		number = raw
+	}
+
+	client := audit.ClientFrom(ctx)
+	event.Time = time.Now().UTC()
+	event.PhoneHash = l.hasher.Hash(number)
+	event.IP = client.IP
+	event.UserAgent = client.UserAgent
+	event.RequestID = client.RequestID
+	event.Outcome = audit.Success
+	if err != nil {
+		event.Outcome = audit.Failure
+		event.Reason = apperrors.As(err).Code
+	}
+	// JWTAuthMiddleware stores the phone of the token; it is an admin acting on someone else.
+	if actor, _ := ctx.Value("phone").(string); actor != "" && actor != number {
+		event.Actor = l.hasher.Hash(actor)
+	}
+	if machine, _ := ctx.Value(tlsconfig.MachineKey).(string); machine != "" {
+		event.Actor = "machine:" + machine
+	}
+
+	if err := l.repository.Append(ctx, event); err != nil {
+		logger.LogErrorWithDepth(map[string]interface{}{
+			"error":   fmt.Errorf("audit %s: %w", event.Type, err),
+			"depth":   2,
+			"message": "Audit event not written",
+			"context": ctx,
+		})
+	}
+}
+
+func (l *auditLog) History(ctx context.Context, raw string, request requests.AuditHistory) (repositories.AuditPage, error) {
+	number, err := canonicalPhone(raw)
+	if err != nil {
+		return repositories.AuditPage{}, err
+	}
+	return l.repository.History(ctx, l.hasher.Hash(number), request)
+}
+
+// sessionID names the session of a refresh token in the audit log without revealing the
+// token. Refreshing starts a new one.
+func sessionID(user map[string]string) string {
+	token := user["refresh_token"]
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
@@ -1,105 +1,284 @@
 package services
 
 import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/audit"
+	"authentication/pkg/i18n"
+	"authentication/pkg/metrics"
+	"authentication/pkg/phone"
+	"authentication/pkg/sms"
+	"authentication/pkg/tracing"
+	"authentication/pkg/webhook"
 	"authentication/repositories"
 	"authentication/requests"
 	"authentication/utils"
 	"context"
-	"github.com/go-redis/redis_rate/v10"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 )
 
+// otpTTL is how long a sent OTP code stays valid.
+const otpTTL = 2 * time.Minute
+
 type AuthService interface {
-	Login(loginRequest requests.LoginRequest, ctx context.Context) map[string]string
-	SendOTPCode(otpRequest requests.OTPRequest, ctx context.Context)
-	GetUserProfile(request requests.Profile, ctx context.Context) map[string]string
-	ListUsers(ctx context.Context, request requests.UsersList) []map[string]string
+	Login(loginRequest requests.LoginRequest, ctx context.Context) (map[string]string, error)
+	// SendOTPCode returns how long the code is valid; no new code is sent before then.
+	SendOTPCode(otpRequest requests.OTPRequest, ctx context.Context) (time.Duration, error)
+	GetUserProfile(request requests.Profile, ctx context.Context) (map[string]string, error)
+	ListUsers(ctx context.Context, request requests.UsersList) (repositories.UsersPage, error)
+	UpdateUser(ctx context.Context, phone string, request requests.UpdateUser) (map[string]string, error)
+	RefreshToken(request requests.RefreshRequest, ctx context.Context) (map[string]string, error)
+	CheckAccount(ctx context.Context, claims *utils.JWTClaims) (map[string]string, error)
+	SetUserStatus(ctx context.Context, phone string, request requests.UserStatus) (map[string]string, error)
+	DeleteUser(ctx context.Context, phone string, request requests.DeleteUser) (map[string]string, error)
+	PurgeDeletedUsers(ctx context.Context) (int, error)
+	RevokeSessions(ctx context.Context, phone string) (map[string]string, error)
+	CreateAdmin(ctx context.Context, phone string) (map[string]string, error)
+	PurgeOTPs(ctx context.Context, phone string) (int, error)
 }
 
 type authService struct {
 	authRepository repositories.AuthRepository
-	limiter        *redis_rate.Limiter
+	sms            sms.Sender
+	fraudGuard     FraudGuard
+	audit          AuditLog
+	webhooks       WebhookPublisher
+	adminPhones    map[string]bool
+	purgeAfter     time.Duration
 }
 
-func NewAuthService(authRepository repositories.AuthRepository, limiter *redis_rate.Limiter) AuthService {
-	return &authService{
-		authRepository: authRepository,
-		limiter:        limiter,
+// NewAuthService reads ADMIN_PHONES, a comma-separated list of phones that are given the
+// admin role when they log in. It is deprecated and only kept for existing deployments:
+// the CLI's "admin create" is how administrators are made. Entries that are not valid
+// mobile numbers are ignored.
+// USER_PURGE_AFTER (default 720h) is how long soft-deleted users are kept.
+// Every method runs in a tracing span, and changes to users are published to webhooks.
+func NewAuthService(authRepository repositories.AuthRepository, sender sms.Sender, fraudGuard FraudGuard, auditLog AuditLog, webhooks WebhookPublisher) AuthService {
+	adminPhones := make(map[string]bool)
+	for _, raw := range strings.Split(os.Getenv("ADMIN_PHONES"), ",") {
+		if number, err := phone.Normalize(raw); err == nil {
+			adminPhones[number] = true
+		}
 	}
+
+	return tracedAuthService{next: &authService{
+		authRepository: authRepository,
+		sms:            sender,
+		fraudGuard:     fraudGuard,
+		audit:          auditLog,
+		webhooks:       webhooks,
+		adminPhones:    adminPhones,
+		purgeAfter:     durationFromEnv("USER_PURGE_AFTER", defaultPurgeAfter),
+	}}
 }
 
-func (s *authService) SendOTPCode(otpRequest requests.OTPRequest, ctx context.Context) {
-	key := "otp_request:" + otpRequest.PhoneNumber
-	res, err := s.limiter.Allow(ctx, key, redis_rate.Limit{
-		Rate:   3,
-		Period: 10 * time.Minute,
-		Burst:  3,
-	})
-	if err != nil {
-		panic(err)
+func (s *authService) SendOTPCode(otpRequest requests.OTPRequest, ctx context.Context) (time.Duration, error) {
+	validFor, err := s.sendOTPCode(otpRequest, ctx)
+	s.audit.Record(ctx, audit.Event{Type: audit.OTPSent}, otpRequest.PhoneNumber, err)
+	if err == nil {
+		metrics.OTPSent.Inc()
 	}
+	return validFor, err
+}
 
-	if res.Remaining == 0 {
-		panic(utils.PanicMessage{MessageKey: 6})
+func (s *authService) sendOTPCode(otpRequest requests.OTPRequest, ctx context.Context) (time.Duration, error) {
+	parsed, err := parsePhone(otpRequest.PhoneNumber)
+	if err != nil {
+		return 0, err
 	}
+	number := parsed.E164()
 
 	// Generate OTP
 	code := utils.Generate6DigitCode()
-	s.authRepository.SetOTP(ctx, otpRequest.PhoneNumber, code, 2*time.Minute)
+	if err := s.authRepository.SetOTP(ctx, number, code, otpTTL); err != nil {
+		return 0, err
+	}
+	// Only codes that are actually sent count against the fraud budgets, not requests
+	// refused because one is pending.
+	if err := s.fraudGuard.CheckSend(ctx, parsed); err != nil {
+		_ = s.authRepository.DeleteOTP(ctx, number)
+		return 0, err
+	}
+
+	locale, err := s.userLocale(ctx, number)
+	if err != nil {
+		return 0, err
+	}
+	text := i18n.T(locale, "sms.otp", i18n.Args{"code": code, "count": int(otpTTL / time.Minute)})
+	if err := s.sendSMS(ctx, number, text); err != nil {
+		// Let the user ask again right away instead of waiting for a code that never came.
+		_ = s.authRepository.DeleteOTP(ctx, number)
+		return 0, err
+	}
+	return otpTTL, nil
 }
 
-func (s *authService) Login(loginRequest requests.LoginRequest, ctx context.Context) map[string]string {
-	key := "login:" + loginRequest.PhoneNumber
+// sendSMS traces the gateway, the slowest part of sending a code.
+func (s *authService) sendSMS(ctx context.Context, number, text string) (err error) {
+	ctx, span := tracer.Start(ctx, "sms.Send")
+	defer func() { tracing.End(span, err) }()
+	return s.sms.Send(ctx, number, text)
+}
 
-	res, err := s.limiter.Allow(ctx, key, redis_rate.Limit{
-		Rate:   3,
-		Period: 10 * time.Minute,
-		Burst:  3,
-	})
-	if err != nil {
-		panic(utils.PanicMessage{0, &err})
+// userLocale is the locale a user saved, or the one negotiated for this request when the
+// user has none or does not exist yet.
+func (s *authService) userLocale(ctx context.Context, phone string) (string, error) {
+	user, err := s.authRepository.GetUser(ctx, phone)
+	if err != nil && !errors.Is(err, apperrors.ErrUserNotFound) {
+		return "", err
+	}
+	if locale := user["locale"]; locale != "" && i18n.Supported(locale) {
+		return locale, nil
+	}
+	return i18n.FromContext(ctx), nil
+}
+
+func (s *authService) Login(loginRequest requests.LoginRequest, ctx context.Context) (map[string]string, error) {
+	user, err := s.login(loginRequest, ctx)
+	s.audit.Record(ctx, audit.Event{Type: audit.Login, UserID: user["id"], SessionID: sessionID(user)}, loginRequest.PhoneNumber, err)
+	switch {
+	case err == nil:
+		metrics.LoginSuccess.Inc()
+		s.webhooks.Publish(ctx, webhook.UserLoggedIn, user)
+	case errors.Is(err, apperrors.ErrOTPInvalid):
+		metrics.OTPVerifyFailed.Inc()
 	}
-	if res.Remaining == 0 {
-		panic(utils.PanicMessage{MessageKey: 6})
+	return user, err
+}
+
+func (s *authService) login(loginRequest requests.LoginRequest, ctx context.Context) (map[string]string, error) {
+	parsed, err := parsePhone(loginRequest.PhoneNumber)
+	if err != nil {
+		return nil, err
 	}
+	number := parsed.E164()
 
-	otp := s.authRepository.GetOTP(ctx, loginRequest.PhoneNumber)
+	otp, err := s.authRepository.GetOTP(ctx, number)
+	if err != nil {
+		return nil, err
+	}
 	if otp != loginRequest.OTPCode {
-		panic(utils.PanicMessage{MessageKey: 3}) // "Invalid OTP"
+		return nil, apperrors.ErrOTPInvalid
+	}
+	// The code reached its owner: this is what the fraud guard's conversion rate measures.
+	if err := s.fraudGuard.RecordLogin(ctx, parsed); err != nil {
+		return nil, err
 	}
 
-	var user map[string]string
-	exists := s.authRepository.UserExists(ctx, loginRequest.PhoneNumber)
-	if exists {
-		user = s.authRepository.GetUser(ctx, loginRequest.PhoneNumber)
-	} else {
-		user = s.authRepository.CreateUser(ctx, loginRequest.PhoneNumber)
+	user, err := s.authRepository.GetUser(ctx, number)
+	switch {
+	case err == nil:
+		if _, err := s.ensureActive(ctx, number, user); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, apperrors.ErrUserNotFound):
+		created, err := s.authRepository.CreateUser(ctx, number)
+		if err != nil {
+			return nil, err
+		}
+		s.audit.Record(ctx, audit.Event{Type: audit.UserCreated, UserID: created["id"]}, number, nil)
+		s.webhooks.Publish(ctx, webhook.UserCreated, created)
+		metrics.UserCreated.Inc()
+	default:
+		return nil, err
 	}
 
-	accessToken, err := utils.GenerateAccessToken(loginRequest.PhoneNumber, time.Minute*15)
+	changes := map[string]string{"last_login_at": time.Now().UTC().Format(time.RFC3339)}
+	if s.adminPhones[number] {
+		changes["role"] = "admin"
+	}
+	user, err = s.authRepository.UpdateUser(ctx, number, changes)
 	if err != nil {
-		panic(utils.PanicMessage{0, &err})
+		return nil, err
 	}
 
-	refreshToken := utils.GenerateRefreshToken()
-	err = s.authRepository.SetRefreshToken(ctx, loginRequest.PhoneNumber, refreshToken, time.Hour*24*7)
+	return s.issueTokens(ctx, number, user)
+}
+
+// GetUserProfile only lets admins see the profile of another user than the caller.
+func (s *authService) GetUserProfile(request requests.Profile, ctx context.Context) (map[string]string, error) {
+	if request.PhoneNumber == "" {
+		request.PhoneNumber = request.Caller
+	}
+	number, err := canonicalPhone(request.PhoneNumber)
 	if err != nil {
-		panic(utils.PanicMessage{0, &err})
+		return nil, err
 	}
+	if number != request.Caller && request.CallerRole != "admin" {
+		return nil, apperrors.ErrForbidden
+	}
+	return s.authRepository.GetUser(ctx, number)
+}
 
-	user["access_token"] = accessToken
-	user["refresh_token"] = refreshToken
+// ListUsers matches the phone filters against stored E.164 numbers, so 0912 finds the
+// same users as +98912.
+func (s *authService) ListUsers(ctx context.Context, request requests.UsersList) (repositories.UsersPage, error) {
+	if digits := phone.Digits(request.PhoneLike); digits != "" {
+		request.PhoneLike = digits
+	}
+	if prefix := phone.NormalizePrefix(request.PhonePrefix); prefix != "" {
+		request.PhonePrefix = prefix
+	}
+	return s.authRepository.ListUsers(ctx, request)
+}
 
-	return user
+func (s *authService) UpdateUser(ctx context.Context, raw string, request requests.UpdateUser) (map[string]string, error) {
+	user, err := s.updateUser(ctx, raw, request)
+	s.audit.Record(ctx, audit.Event{Type: audit.UserUpdated, UserID: user["id"]}, raw, err)
+	if err == nil {
+		s.webhooks.Publish(ctx, webhook.UserUpdated, user)
+	}
+	return user, err
 }
 
-func (s *authService) GetUserProfile(request requests.Profile, ctx context.Context) map[string]string {
-	return s.authRepository.GetUser(ctx, request.PhoneNumber)
+func (s *authService) updateUser(ctx context.Context, raw string, request requests.UpdateUser) (map[string]string, error) {
+	number, err := canonicalPhone(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]string)
+	if request.Email != nil {
+		changes["email"] = *request.Email
+	}
+	if request.Name != nil {
+		changes["name"] = *request.Name
+	}
+	if request.Role != nil {
+		changes["role"] = *request.Role
+	}
+	if request.Locale != nil {
+		if *request.Locale != "" && !i18n.Supported(*request.Locale) {
+			return nil, apperrors.ErrInvalidRequest.Wrap(fmt.Errorf("no messages for locale %q", *request.Locale))
+		}
+		changes["locale"] = *request.Locale
+	}
+	for key, value := range request.Metadata {
+		changes[repositories.MetadataPrefix+key] = value
+	}
+
+	return s.authRepository.UpdateUser(ctx, number, changes)
 }
 
-func (s *authService) ListUsers(ctx context.Context, request requests.UsersList) []map[string]string {
-	users := s.authRepository.ListUsers(ctx, request)
-	return users
+// canonicalPhone is the E.164 form of a phone number from a request. Repositories build
+// their keys from it, whatever way the client wrote the number.
+func canonicalPhone(raw string) (string, error) {
+	number, err := parsePhone(raw)
+	if err != nil {
+		return "", err
+	}
+	return number.E164(), nil
+}
+
+func parsePhone(raw string) (phone.Number, error) {
+	number, err := phone.Parse(raw)
+	if err != nil {
+		return phone.Number{}, apperrors.ErrInvalidRequest.Wrap(err)
+	}
+	return number, nil
 }
 
 //func (s *authService) SearchUsers(ctx context.Context, query string) []map[string]string {
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/challenge"
+	"authentication/repositories"
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	defaultChallengePhoneThreshold = 3
+	defaultChallengeIPThreshold    = 10
+	defaultChallengeWindow         = time.Hour
+)
+
+// ChallengeConfig sets when clients are challenged: once a phone number or an address
+// made Threshold suspicious requests within Window.
+type ChallengeConfig struct {
+	PhoneThreshold int64
+	IPThreshold    int64
+	Window         time.Duration
+}
+
+// ChallengeConfigFromEnv reads CHALLENGE_PHONE_THRESHOLD, CHALLENGE_IP_THRESHOLD and
+// CHALLENGE_WINDOW.
+func ChallengeConfigFromEnv() (ChallengeConfig, error) {
+	config := ChallengeConfig{Window: durationFromEnv("CHALLENGE_WINDOW", defaultChallengeWindow)}
+
+	var err error
+	if config.PhoneThreshold, err = intFromEnv("CHALLENGE_PHONE_THRESHOLD", defaultChallengePhoneThreshold); err != nil {
+		return config, err
+	}
+	if config.IPThreshold, err = intFromEnv("CHALLENGE_IP_THRESHOLD", defaultChallengeIPThreshold); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// ChallengeGuard asks clients that look like bots to solve a challenge before their
+// requests go through. Unlike a rate limit it does not stop a person, who solves it.
+type ChallengeGuard interface {
+	// Check lets the request of phone from ip through, or returns ErrChallengeRequired or
+	// ErrChallengeFailed wrapping a *challenge.Required. token is the client's solution, if
+	// any. Either subject may be empty when the request does not have it.
+	Check(ctx context.Context, phone, ip, token string) error
+	// AddRisk counts a suspicious request of phone from ip.
+	AddRisk(ctx context.Context, phone, ip string) error
+}
+
+type challengeGuard struct {
+	repository repositories.ChallengeRepository
+	verifier   challenge.Verifier
+	config     ChallengeConfig
+}
+
+// NewChallengeGuard uses verifier to challenge clients; without one, nobody is.
+func NewChallengeGuard(repository repositories.ChallengeRepository, verifier challenge.Verifier, config ChallengeConfig) ChallengeGuard {
+	return &challengeGuard{repository: repository, verifier: verifier, config: config}
+}
+
+// riskSubjects pairs the subjects of a request with their thresholds.
+func (g *challengeGuard) riskSubjects(phone, ip string) map[string]int64 {
+	subjects := make(map[string]int64, 2)
+	if phone != "" {
+		subjects["phone:"+phone] = g.config.PhoneThreshold
+	}
+	if ip != "" {
+		subjects["ip:"+ip] = g.config.IPThreshold
+	}
+	return subjects
+}
+
+func (g *challengeGuard) Check(ctx context.Context, phone, ip, token string) error {
+	if g.verifier == nil {
+		return nil
+	}
+
+	subjects := g.riskSubjects(phone, ip)
+	required := false
+	for subject, threshold := range subjects {
+		risk, err := g.repository.Risk(ctx, subject)
+		if err != nil {
+			return err
+		}
+		if risk >= threshold {
+			required = true
+			break
+		}
+	}
+	if !required {
+		return nil
+	}
+
+	if token == "" {
+		return g.challenge(ctx, apperrors.ErrChallengeRequired)
+	}
+	if err := g.verifier.Verify(ctx, token, ip); errors.Is(err, challenge.ErrFailed) {
+		return g.challenge(ctx, apperrors.ErrChallengeFailed)
+	} else if err != nil {
+		return err
+	}
+
+	// A solved challenge buys as many requests as a fresh client gets.
+	cleared := make([]string, 0, len(subjects))
+	for subject := range subjects {
+		cleared = append(cleared, subject)
+	}
+	return g.repository.ClearRisk(ctx, cleared...)
+}
+
+// challenge is base carrying a new challenge for the client.
+func (g *challengeGuard) challenge(ctx context.Context, base *apperrors.Error) error {
+	issued, err := g.verifier.Issue(ctx)
+	if err != nil {
+		return err
+	}
+	return base.Wrap(&challenge.Required{Challenge: issued})
+}
+
+func (g *challengeGuard) AddRisk(ctx context.Context, phone, ip string) error {
+	if g.verifier == nil {
+		return nil
+	}
+	for subject := range g.riskSubjects(phone, ip) {
+		if _, err := g.repository.AddRisk(ctx, subject, g.config.Window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package services
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/phone"
+	"authentication/repositories"
+	"authentication/utils/logger"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reasons a prefix is blocked for.
+const (
+	BlockReasonBudget        = "prefix_budget"
+	BlockReasonLowConversion = "low_conversion"
+)
+
+const (
+	defaultCountryDailyBudget = 10000
+	defaultPrefixDailyBudget  = 500
+	defaultFraudPrefixDigits  = 3
+	defaultFraudMinSample     = 50
+	defaultFraudMinConversion = 0.2
+	defaultFraudBreakerFor    = time.Hour
+)
+
+// FraudConfig is the policy of the fraud guard. Prefixes are the country code and the first
+// PrefixDigits digits of the national number, the blocks operators allocate numbers in.
+type FraudConfig struct {
+	// AllowedCountries, when not empty, are the only regions codes are sent to.
+	AllowedCountries map[string]bool
+	DeniedCountries  map[string]bool
+	// CountryBudget codes a day are sent to each country, unless CountryBudgets has its own.
+	CountryBudget  int64
+	CountryBudgets map[string]int64
+	// PrefixBudget codes a day are sent to each prefix; the prefix is blocked past it.
+	PrefixBudget int64
+	PrefixDigits int
+	// A prefix with MinSample codes sent today whose logins per code sent fall below
+	// MinConversion is blocked for BreakerDuration: the codes are not reaching people.
+	MinSample       int64
+	MinConversion   float64
+	BreakerDuration time.Duration
+}
+
+// FraudConfigFromEnv reads the FRAUD_* variables. Country lists are comma-separated ISO
+// 3166 regions and FRAUD_COUNTRY_BUDGETS reads like "IR=100000,GB=100".
+func FraudConfigFromEnv() (FraudConfig, error) {
+	config := FraudConfig{
+		CountryBudgets:  make(map[string]int64),
+		BreakerDuration: durationFromEnv("FRAUD_BREAKER_DURATION", defaultFraudBreakerFor),
+	}
+
+	var err error
+	if config.AllowedCountries, err = regionsFromEnv("FRAUD_ALLOWED_COUNTRIES"); err != nil {
+		return config, err
+	}
+	if config.DeniedCountries, err = regionsFromEnv("FRAUD_DENIED_COUNTRIES"); err != nil {
+		return config, err
+	}
+	if config.CountryBudget, err = intFromEnv("FRAUD_COUNTRY_DAILY_BUDGET", defaultCountryDailyBudget); err != nil {
+		return config, err
+	}
+	if config.PrefixBudget, err = intFromEnv("FRAUD_PREFIX_DAILY_BUDGET", defaultPrefixDailyBudget); err != nil {
+		return config, err
+	}
+	if config.MinSample, err = intFromEnv("FRAUD_MIN_SAMPLE", defaultFraudMinSample); err != nil {
+		return config, err
+	}
+	digits, err := intFromEnv("FRAUD_PREFIX_DIGITS", defaultFraudPrefixDigits)
+	if err != nil {
+		return config, err
+	}
+	config.PrefixDigits = int(digits)
+
+	config.MinConversion = defaultFraudMinConversion
+	if value := os.Getenv("FRAUD_MIN_CONVERSION"); value != "" {
+		config.MinConversion, err = strconv.ParseFloat(value, 64)
+		if err != nil || config.MinConversion < 0 || config.MinConversion > 1 {
+			return config, fmt.Errorf("FRAUD_MIN_CONVERSION: %q is not a ratio between 0 and 1", value)
+		}
+	}
+
+	for _, entry := range strings.Split(os.Getenv("FRAUD_COUNTRY_BUDGETS"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		region, value, _ := strings.Cut(entry, "=")
+		region = strings.ToUpper(strings.TrimSpace(region))
+		budget, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if !phone.SupportedRegion(region) || err != nil || budget < 0 {
+			return config, fmt.Errorf("FRAUD_COUNTRY_BUDGETS: invalid entry %q", entry)
+		}
+		config.CountryBudgets[region] = budget
+	}
+	return config, nil
+}
+
+func regionsFromEnv(name string) (map[string]bool, error) {
+	regions := make(map[string]bool)
+	for _, region := range strings.Split(os.Getenv(name), ",") {
+		region = strings.ToUpper(strings.TrimSpace(region))
+		if region == "" {
+			continue
+		}
+		if !phone.SupportedRegion(region) {
+			return nil, fmt.Errorf("%s: unsupported region %q", name, region)
+		}
+		regions[region] = true
+	}
+	return regions, nil
+}
+
+func intFromEnv(name string, fallback int64) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("%s: %q is not a positive number", name, value)
+	}
+	return parsed, nil
+}
+
+// FraudGuard protects the SMS budget against SMS pumping, where bots request codes for
+// premium-rate numbers the attacker is paid for. Such traffic shows up as sends to a few
+// prefixes that never turn into logins.
+type FraudGuard interface {
+	// CheckSend counts a code about to be sent to number, or refuses it with
+	// ErrCountryNotAllowed or ErrDestinationBlocked.
+	CheckSend(ctx context.Context, number phone.Number) error
+	// RecordLogin counts a login with a code sent to number.
+	RecordLogin(ctx context.Context, number phone.Number) error
+	// Stats returns today's counters.
+	Stats(ctx context.Context) (FraudStats, error)
+	PrefixStatus(ctx context.Context, prefix string) (PrefixStatus, error)
+	// ResetPrefix lifts the block of prefix and starts its counters of today from zero.
+	ResetPrefix(ctx context.Context, prefix string) error
+}
+
+// FraudStats are the counters of one UTC day.
+type FraudStats struct {
+	Day       string
+	Countries map[string]int64
+	Prefixes  []PrefixStatus
+}
+
+type PrefixStatus struct {
+	repositories.PrefixStats
+	// BlockReason is empty when codes are sent to the prefix.
+	BlockReason string
+	// BlockedFor is how long the block lasts.
+	BlockedFor time.Duration
+}
+
+// Conversion is the share of codes sent today that were used to log in.
+func (s PrefixStatus) Conversion() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Logins) / float64(s.Sent)
+}
+
+type fraudGuard struct {
+	repository repositories.FraudRepository
+	config     FraudConfig
+}
+
+func NewFraudGuard(repository repositories.FraudRepository, config FraudConfig) FraudGuard {
+	return &fraudGuard{repository: repository, config: config}
+}
+
+// today is the UTC day the counters are kept for, and how long it lasts.
+func today() (string, time.Duration) {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return now.Format(time.DateOnly), midnight.Sub(now)
+}
+
+func (g *fraudGuard) prefix(number phone.Number) string {
+	return number.Prefix(g.config.PrefixDigits)
+}
+
+func (g *fraudGuard) CheckSend(ctx context.Context, number phone.Number) error {
+	if g.config.DeniedCountries[number.Region] ||
+		len(g.config.AllowedCountries) > 0 && !g.config.AllowedCountries[number.Region] {
+		return apperrors.ErrCountryNotAllowed
+	}
+
+	prefix := g.prefix(number)
+	reason, ttl, err := g.repository.Blocked(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return blocked(ttl)
+	}
+
+	day, untilMidnight := today()
+	countrySent, prefixSent, err := g.repository.CountSend(ctx, day, number.Region, prefix)
+	if err != nil {
+		return err
+	}
+
+	budget, ok := g.config.CountryBudgets[number.Region]
+	if !ok {
+		budget = g.config.CountryBudget
+	}
+	if countrySent > budget {
+		return blocked(untilMidnight)
+	}
+
+	if prefixSent > g.config.PrefixBudget {
+		return g.trip(ctx, prefix, BlockReasonBudget, untilMidnight)
+	}
+	if prefixSent >= g.config.MinSample {
+		stats, err := g.repository.PrefixStats(ctx, day, prefix)
+		if err != nil {
+			return err
+		}
+		if (PrefixStatus{PrefixStats: stats}).Conversion() < g.config.MinConversion {
+			return g.trip(ctx, prefix, BlockReasonLowConversion, g.config.BreakerDuration)
+		}
+	}
+	return nil
+}
+
+// trip blocks prefix for ttl and refuses the send that tripped the breaker.
+func (g *fraudGuard) trip(ctx context.Context, prefix, reason string, ttl time.Duration) error {
+	if err := g.repository.Block(ctx, prefix, reason, ttl); err != nil {
+		return err
+	}
+	logger.FromContext(ctx).Warn().Str("handle", "FRAUD").Str("prefix", prefix).Str("reason", reason).
+		Dur("blocked_for", ttl.Round(time.Second)).Msg("prefix blocked")
+	return blocked(ttl)
+}
+
+func blocked(ttl time.Duration) error {
+	if ttl <= 0 {
+		return apperrors.ErrDestinationBlocked
+	}
+	return apperrors.ErrDestinationBlocked.WithRetryAfter(ttl)
+}
+
+func (g *fraudGuard) RecordLogin(ctx context.Context, number phone.Number) error {
+	day, _ := today()
+	return g.repository.CountLogin(ctx, day, g.prefix(number))
+}
+
+func (g *fraudGuard) Stats(ctx context.Context) (FraudStats, error) {
+	day, _ := today()
+	countries, prefixes, err := g.repository.DayStats(ctx, day)
+	if err != nil {
+		return FraudStats{}, err
+	}
+
+	stats := FraudStats{Day: day, Countries: countries, Prefixes: make([]PrefixStatus, len(prefixes))}
+	for i, counters := range prefixes {
+		if stats.Prefixes[i], err = g.status(ctx, counters); err != nil {
+			return FraudStats{}, err
+		}
+	}
+	return stats, nil
+}
+
+func (g *fraudGuard) PrefixStatus(ctx context.Context, raw string) (PrefixStatus, error) {
+	prefix, err := canonicalPrefix(raw)
+	if err != nil {
+		return PrefixStatus{}, err
+	}
+	day, _ := today()
+	stats, err := g.repository.PrefixStats(ctx, day, prefix)
+	if err != nil {
+		return PrefixStatus{}, err
+	}
+	return g.status(ctx, stats)
+}
+
+func (g *fraudGuard) status(ctx context.Context, stats repositories.PrefixStats) (PrefixStatus, error) {
+	reason, ttl, err := g.repository.Blocked(ctx, stats.Prefix)
+	if err != nil {
+		return PrefixStatus{}, err
+	}
+	return PrefixStatus{PrefixStats: stats, BlockReason: reason, BlockedFor: ttl}, nil
+}
+
+func (g *fraudGuard) ResetPrefix(ctx context.Context, raw string) error {
+	prefix, err := canonicalPrefix(raw)
+	if err != nil {
+		return err
+	}
+	day, _ := today()
+	if err := g.repository.ResetPrefix(ctx, day, prefix); err != nil {
+		return err
+	}
+	logger.FromContext(ctx).Info().Str("handle", "FRAUD").Str("prefix", prefix).Msg("prefix reset")
+	return nil
+}
+
+// canonicalPrefix is the stored form of a prefix from a request: +98912, 98912 and 0912
+// are the same prefix.
+func canonicalPrefix(raw string) (string, error) {
+	prefix := phone.NormalizePrefix(raw)
+	if prefix == "" || prefix == "+" {
+		return "", apperrors.ErrInvalidRequest.Wrap(fmt.Errorf("%q is not a phone number prefix", raw))
+	}
+	return prefix, nil
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"authentication/repositories"
+	"authentication/utils"
+	"authentication/utils/logger"
+	"context"
+	"fmt"
+	"time"
+)
+
+const defaultKeysRefresh = time.Minute
+
+// KeyService manages the keys access tokens are signed with. They are stored in the
+// repository, shared by every instance, and each instance loads them every
+// JWT_KEYS_REFRESH (default 1m).
+type KeyService interface {
+	// Keys lists the stored keys, oldest active first.
+	Keys(ctx context.Context) ([]utils.SigningKey, error)
+	// Generate stores a new key. It starts signing two refresh intervals later, once every
+	// instance has loaded it.
+	Generate(ctx context.Context) (utils.SigningKey, error)
+	// Rotate generates a key and retires the keys that no valid token can be signed with
+	// anymore: those that stopped signing more than an access token's lifetime ago.
+	Rotate(ctx context.Context) (key utils.SigningKey, retired []string, err error)
+	// Load makes the stored keys the ones this instance signs and verifies tokens with.
+	Load(ctx context.Context) error
+}
+
+type keyService struct {
+	repository repositories.SigningKeyRepository
+	refresh    time.Duration
+}
+
+func NewKeyService(repository repositories.SigningKeyRepository) KeyService {
+	return &keyService{repository: repository, refresh: durationFromEnv("JWT_KEYS_REFRESH", defaultKeysRefresh)}
+}
+
+func (s *keyService) Keys(ctx context.Context) ([]utils.SigningKey, error) {
+	keys, err := s.repository.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	utils.SortSigningKeys(keys)
+	return keys, nil
+}
+
+func (s *keyService) Generate(ctx context.Context) (utils.SigningKey, error) {
+	key := utils.NewSigningKey(time.Now().Add(2 * s.refresh))
+	if err := s.repository.AddKey(ctx, key); err != nil {
+		return utils.SigningKey{}, err
+	}
+	logger.Logger().Info().Str("kid", key.ID).Time("active_at", key.ActiveAt).Msg("Signing key generated")
+	return key, nil
+}
+
+func (s *keyService) Rotate(ctx context.Context) (utils.SigningKey, []string, error) {
+	keys, err := s.Keys(ctx)
+	if err != nil {
+		return utils.SigningKey{}, nil, err
+	}
+	key, err := s.Generate(ctx)
+	if err != nil {
+		return utils.SigningKey{}, nil, err
+	}
+
+	// A key stops signing when the next one activates.
+	var retired []string
+	now := time.Now()
+	for i := 0; i+1 < len(keys); i++ {
+		if keys[i+1].ActiveAt.Add(accessTokenTTL).After(now) {
+			break
+		}
+		if err := s.repository.DeleteKey(ctx, keys[i].ID); err != nil {
+			return key, retired, fmt.Errorf("retire key %s: %w", keys[i].ID, err)
+		}
+		retired = append(retired, keys[i].ID)
+	}
+	return key, retired, nil
+}
+
+func (s *keyService) Load(ctx context.Context) error {
+	keys, err := s.repository.ListKeys(ctx)
+	if err != nil {
+		return err
+	}
+	utils.SetSigningKeys(keys)
+	return nil
+}
+
+// StartSigningKeysRefresher loads the stored keys every JWT_KEYS_REFRESH in the
+// background, for the lifetime of the process, to pick up the keys other instances or
+// the CLI generate.
+func StartSigningKeysRefresher(keys KeyService) {
+	interval := durationFromEnv("JWT_KEYS_REFRESH", defaultKeysRefresh)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := keys.Load(context.Background()); err != nil {
+				logger.LogErrorWithDepth(map[string]interface{}{
+					"error":   fmt.Errorf("load signing keys: %w", err),
+					"depth":   2,
+					"message": "Loading signing keys failed",
+				})
+			}
+		}
+	}()
+}
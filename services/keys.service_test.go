@@ -0,0 +1,90 @@
+package services
+
+import (
+	"authentication/repositories"
+	"authentication/utils"
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestKeyServiceGenerate(t *testing.T) {
+	t.Setenv("JWT_KEYS_REFRESH", "30s")
+	keys := NewKeyService(repositories.NewMemorySigningKeyRepository())
+
+	// Instances only sign with a key once they all had the time to load it.
+	before := time.Now()
+	key, err := keys.Generate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ActiveAt.Before(before.Add(time.Minute)) || key.ActiveAt.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Generate() activates at %v, want two refresh intervals from now", key.ActiveAt)
+	}
+	if stored, err := keys.Keys(context.Background()); err != nil || len(stored) != 1 || stored[0].ID != key.ID {
+		t.Errorf("Keys() = %v, %v, want the generated key", stored, err)
+	}
+}
+
+func TestKeyServiceRotate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		// activeAt are when the stored keys activated, by ID.
+		activeAt    map[string]time.Time
+		wantRetired []string
+	}{
+		{"no key", nil, nil},
+		{"current key kept", map[string]time.Time{"current": now.Add(-time.Hour)}, nil},
+		{
+			"tokens of the previous key may still be valid",
+			map[string]time.Time{"previous": now.Add(-time.Hour), "current": now.Add(-accessTokenTTL / 2)},
+			nil,
+		},
+		{
+			"keys retired once their tokens expired",
+			map[string]time.Time{"old": now.Add(-3 * time.Hour), "previous": now.Add(-2 * time.Hour), "current": now.Add(-time.Hour)},
+			[]string{"old", "previous"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := repositories.NewMemorySigningKeyRepository()
+			for id, activeAt := range tt.activeAt {
+				if err := repository.AddKey(context.Background(), utils.SigningKey{ID: id, Secret: []byte(id), ActiveAt: activeAt}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			key, retired, err := NewKeyService(repository).Rotate(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(retired, tt.wantRetired) {
+				t.Errorf("Rotate() retired %v, want %v", retired, tt.wantRetired)
+			}
+			stored, _ := repository.ListKeys(context.Background())
+			if want := len(tt.activeAt) - len(tt.wantRetired) + 1; len(stored) != want || !key.ActiveAt.After(now) {
+				t.Errorf("Rotate() left %d keys, the new one activating at %v, want %d and a pending key", len(stored), key.ActiveAt, want)
+			}
+		})
+	}
+}
+
+func TestKeyServiceLoad(t *testing.T) {
+	t.Cleanup(func() { utils.SetSigningKeys(nil) })
+	repository := repositories.NewMemorySigningKeyRepository()
+	keys := NewKeyService(repository)
+	key := utils.NewSigningKey(time.Now().Add(-time.Minute))
+	if err := repository.AddKey(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if current := utils.CurrentSigningKey(); current.ID != key.ID {
+		t.Errorf("CurrentSigningKey() = %q after Load(), want %q", current.ID, key.ID)
+	}
+}
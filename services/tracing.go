@@ -0,0 +1,96 @@
+package services
+
+import (
+	"authentication/pkg/tracing"
+	"authentication/repositories"
+	"authentication/requests"
+	"authentication/utils"
+	"context"
+	"time"
+)
+
+var tracer = tracing.Tracer("authentication/services")
+
+// tracedAuthService runs every method of an AuthService in a span named after it, such as
+// "AuthService.Login". The repository's Redis commands are spans of their own under it.
+type tracedAuthService struct {
+	next AuthService
+}
+
+func (s tracedAuthService) Login(request requests.LoginRequest, ctx context.Context) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.Login")
+	defer func() { tracing.End(span, err) }()
+	return s.next.Login(request, ctx)
+}
+
+func (s tracedAuthService) SendOTPCode(request requests.OTPRequest, ctx context.Context) (validFor time.Duration, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.SendOTPCode")
+	defer func() { tracing.End(span, err) }()
+	return s.next.SendOTPCode(request, ctx)
+}
+
+func (s tracedAuthService) GetUserProfile(request requests.Profile, ctx context.Context) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.GetUserProfile")
+	defer func() { tracing.End(span, err) }()
+	return s.next.GetUserProfile(request, ctx)
+}
+
+func (s tracedAuthService) ListUsers(ctx context.Context, request requests.UsersList) (page repositories.UsersPage, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.ListUsers")
+	defer func() { tracing.End(span, err) }()
+	return s.next.ListUsers(ctx, request)
+}
+
+func (s tracedAuthService) UpdateUser(ctx context.Context, phone string, request requests.UpdateUser) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.UpdateUser")
+	defer func() { tracing.End(span, err) }()
+	return s.next.UpdateUser(ctx, phone, request)
+}
+
+func (s tracedAuthService) RefreshToken(request requests.RefreshRequest, ctx context.Context) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.RefreshToken")
+	defer func() { tracing.End(span, err) }()
+	return s.next.RefreshToken(request, ctx)
+}
+
+func (s tracedAuthService) CheckAccount(ctx context.Context, claims *utils.JWTClaims) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.CheckAccount")
+	defer func() { tracing.End(span, err) }()
+	return s.next.CheckAccount(ctx, claims)
+}
+
+func (s tracedAuthService) SetUserStatus(ctx context.Context, phone string, request requests.UserStatus) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.SetUserStatus")
+	defer func() { tracing.End(span, err) }()
+	return s.next.SetUserStatus(ctx, phone, request)
+}
+
+func (s tracedAuthService) DeleteUser(ctx context.Context, phone string, request requests.DeleteUser) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.DeleteUser")
+	defer func() { tracing.End(span, err) }()
+	return s.next.DeleteUser(ctx, phone, request)
+}
+
+func (s tracedAuthService) PurgeDeletedUsers(ctx context.Context) (purged int, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.PurgeDeletedUsers")
+	defer func() { tracing.End(span, err) }()
+	return s.next.PurgeDeletedUsers(ctx)
+}
+
+func (s tracedAuthService) RevokeSessions(ctx context.Context, phone string) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.RevokeSessions")
+	defer func() { tracing.End(span, err) }()
+	return s.next.RevokeSessions(ctx, phone)
+}
+
+func (s tracedAuthService) CreateAdmin(ctx context.Context, phone string) (user map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.CreateAdmin")
+	defer func() { tracing.End(span, err) }()
+	return s.next.CreateAdmin(ctx, phone)
+}
+
+func (s tracedAuthService) PurgeOTPs(ctx context.Context, phone string) (purged int, err error) {
+	ctx, span := tracer.Start(ctx, "AuthService.PurgeOTPs")
+	defer func() { tracing.End(span, err) }()
+	return s.next.PurgeOTPs(ctx, phone)
+}
@@ -0,0 +1,381 @@
+package services
+
+import (
+	"authentication/pkg/apperrors"
+	"authentication/pkg/metrics"
+	"authentication/pkg/tracing"
+	"authentication/pkg/webhook"
+	"authentication/repositories"
+	"authentication/requests"
+	"authentication/utils/logger"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebhookMaxAttempts  = 8
+	defaultWebhookRetryBase    = 30 * time.Second
+	defaultWebhookRetryMax     = 6 * time.Hour
+	defaultWebhookTimeout      = 10 * time.Second
+	defaultWebhookPollInterval = time.Second
+)
+
+// webhookBatch is how many deliveries one Dispatch attempts at most, all at once.
+const webhookBatch = 50
+
+// WebhookConfig are the settings of webhook deliveries. A delivery is attempted up to
+// MaxAttempts times, RetryBase after the first failure and twice as long after each
+// further one, up to RetryMax; then it is dead.
+type WebhookConfig struct {
+	MaxAttempts int
+	RetryBase   time.Duration
+	RetryMax    time.Duration
+	// Timeout bounds each attempt.
+	Timeout time.Duration
+	// AllowedNetworks are the internal networks endpoints may be on; see webhook.Guard.
+	AllowedNetworks []netip.Prefix
+}
+
+// WebhookConfigFromEnv reads WEBHOOK_MAX_ATTEMPTS (default 8), WEBHOOK_RETRY_BASE (30s),
+// WEBHOOK_RETRY_MAX (6h), WEBHOOK_TIMEOUT (10s) and WEBHOOK_ALLOWED_NETWORKS (none), a
+// comma-separated list of CIDR ranges.
+func WebhookConfigFromEnv() (WebhookConfig, error) {
+	config := WebhookConfig{
+		RetryBase: durationFromEnv("WEBHOOK_RETRY_BASE", defaultWebhookRetryBase),
+		RetryMax:  durationFromEnv("WEBHOOK_RETRY_MAX", defaultWebhookRetryMax),
+		Timeout:   durationFromEnv("WEBHOOK_TIMEOUT", defaultWebhookTimeout),
+	}
+	attempts, err := intFromEnv("WEBHOOK_MAX_ATTEMPTS", defaultWebhookMaxAttempts)
+	if err != nil {
+		return config, err
+	}
+	config.MaxAttempts = int(attempts)
+	if config.AllowedNetworks, err = webhook.ParseNetworks(os.Getenv("WEBHOOK_ALLOWED_NETWORKS")); err != nil {
+		return config, fmt.Errorf("WEBHOOK_ALLOWED_NETWORKS: %w", err)
+	}
+	return config, nil
+}
+
+// WebhookPublisher tells subscribers what happened to users.
+type WebhookPublisher interface {
+	// Publish queues an event of eventType about user for every subscription to the type.
+	// It never fails the caller: an event that cannot be queued is logged instead.
+	Publish(ctx context.Context, eventType string, user map[string]string)
+}
+
+// WebhookService manages the webhook subscriptions, and delivers their events at least
+// once: a delivery is only done when the endpoint answers 2xx, and may be retried after an
+// attempt the endpoint did receive.
+type WebhookService interface {
+	WebhookPublisher
+	// Subscribe registers an endpoint and returns it with its secret, which is not shown
+	// again.
+	Subscribe(ctx context.Context, request requests.WebhookSubscription) (webhook.Subscription, error)
+	// Subscriptions lists the endpoints, oldest first, without their secrets.
+	Subscriptions(ctx context.Context) ([]webhook.Subscription, error)
+	// Unsubscribe deletes an endpoint and its delivery log; its pending deliveries are
+	// dropped.
+	Unsubscribe(ctx context.Context, id string) error
+	Deliveries(ctx context.Context, id string, request requests.WebhookDeliveries) (repositories.DeliveriesPage, error)
+	// Redeliver queues a delivery again with a fresh set of attempts, to replay a dead one.
+	Redeliver(ctx context.Context, id, deliveryID string) (webhook.Delivery, error)
+	// Dispatch attempts the deliveries that are due, and returns how many it attempted.
+	Dispatch(ctx context.Context) (int, error)
+}
+
+type webhookService struct {
+	repository repositories.WebhookRepository
+	config     WebhookConfig
+	guard      webhook.Guard
+	client     *http.Client
+}
+
+// NewWebhookService delivers to the endpoints webhook.Guard allows, checked on every
+// connection. Deliveries do not go through HTTP proxies, which would connect for them.
+func NewWebhookService(repository repositories.WebhookRepository, config WebhookConfig) WebhookService {
+	guard := webhook.Guard{Allowed: config.AllowedNetworks}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: guard.Control}).DialContext
+	return &webhookService{
+		repository: repository,
+		config:     config,
+		guard:      guard,
+		client: &http.Client{
+			Transport: transport,
+			// A redirect is an answer like any other: it does not deliver the event.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (s *webhookService) Subscribe(ctx context.Context, request requests.WebhookSubscription) (webhook.Subscription, error) {
+	if err := s.guard.CheckURL(request.URL); err != nil {
+		return webhook.Subscription{}, apperrors.ErrInvalidRequest.Wrap(err)
+	}
+	subscription := webhook.Subscription{
+		ID:        webhook.NewID("wh_"),
+		URL:       request.URL,
+		Events:    request.Events,
+		Secret:    request.Secret,
+		CreatedAt: time.Now().UTC(),
+	}
+	if subscription.Secret == "" {
+		subscription.Secret = webhook.NewSecret()
+	}
+	if err := s.repository.AddSubscription(ctx, subscription); err != nil {
+		return webhook.Subscription{}, err
+	}
+	return subscription, nil
+}
+
+func (s *webhookService) Subscriptions(ctx context.Context) ([]webhook.Subscription, error) {
+	subscriptions, err := s.repository.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	return subscriptions, nil
+}
+
+func (s *webhookService) Unsubscribe(ctx context.Context, id string) error {
+	return s.repository.DeleteSubscription(ctx, id)
+}
+
+func (s *webhookService) Deliveries(ctx context.Context, id string, request requests.WebhookDeliveries) (repositories.DeliveriesPage, error) {
+	if _, err := s.repository.GetSubscription(ctx, id); err != nil {
+		return repositories.DeliveriesPage{}, err
+	}
+	return s.repository.Deliveries(ctx, id, request)
+}
+
+func (s *webhookService) Redeliver(ctx context.Context, id, deliveryID string) (webhook.Delivery, error) {
+	if _, err := s.repository.GetSubscription(ctx, id); err != nil {
+		return webhook.Delivery{}, err
+	}
+	delivery, err := s.repository.GetDelivery(ctx, id, deliveryID)
+	if err != nil {
+		return webhook.Delivery{}, err
+	}
+
+	now := time.Now().UTC()
+	delivery.Status = webhook.Pending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = &now
+	if err := s.repository.SaveDelivery(ctx, delivery); err != nil {
+		return webhook.Delivery{}, err
+	}
+	return delivery, nil
+}
+
+func (s *webhookService) Publish(ctx context.Context, eventType string, user map[string]string) {
+	// The event outlives the request that caused it.
+	ctx = context.WithoutCancel(ctx)
+	if err := s.publish(ctx, eventType, user); err != nil {
+		logger.LogErrorWithDepth(map[string]interface{}{
+			"error":   fmt.Errorf("publish %s: %w", eventType, err),
+			"depth":   2,
+			"message": "Webhook event not queued",
+			"context": ctx,
+		})
+	}
+}
+
+func (s *webhookService) publish(ctx context.Context, eventType string, user map[string]string) error {
+	subscriptions, err := s.repository.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	event := webhook.Event{ID: webhook.NewID("evt_"), Type: eventType, CreatedAt: now, Data: webhookUser(user)}
+	var payload []byte
+	for _, subscription := range subscriptions {
+		if !subscription.Wants(eventType) {
+			continue
+		}
+		if payload == nil {
+			if payload, err = json.Marshal(event); err != nil {
+				return err
+			}
+		}
+		err := s.repository.AddDelivery(ctx, webhook.Delivery{
+			ID:             webhook.NewID("dlv_"),
+			SubscriptionID: subscription.ID,
+			EventID:        event.ID,
+			EventType:      eventType,
+			Payload:        payload,
+			Status:         webhook.Pending,
+			NextAttemptAt:  &now,
+			CreatedAt:      now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookUser is what subscribers learn of a user: the profile, without tokens.
+func webhookUser(user map[string]string) map[string]string {
+	data := make(map[string]string, len(user))
+	for key, value := range user {
+		switch key {
+		case "access_token", "refresh_token", "session_version":
+			continue
+		}
+		data[key] = value
+	}
+	return data
+}
+
+// Dispatch claims the due deliveries for twice the attempt timeout, which covers the
+// attempts it makes of them concurrently.
+func (s *webhookService) Dispatch(ctx context.Context) (int, error) {
+	deliveries, err := s.repository.ClaimDue(ctx, time.Now(), webhookBatch, 2*s.config.Timeout)
+	if len(deliveries) == 0 {
+		return 0, err
+	}
+	subscriptions, listErr := s.repository.ListSubscriptions(ctx)
+	if listErr != nil {
+		return 0, listErr
+	}
+	byID := make(map[string]webhook.Subscription, len(subscriptions))
+	for _, subscription := range subscriptions {
+		byID[subscription.ID] = subscription
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(deliveries))
+	for i, delivery := range deliveries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.attempt(ctx, byID, delivery)
+		}()
+	}
+	wg.Wait()
+
+	for _, attemptErr := range errs {
+		if attemptErr != nil && err == nil {
+			err = attemptErr
+		}
+	}
+	return len(deliveries), err
+}
+
+// attempt sends delivery once, and saves what came of it.
+func (s *webhookService) attempt(ctx context.Context, subscriptions map[string]webhook.Subscription, delivery webhook.Delivery) error {
+	subscription, ok := subscriptions[delivery.SubscriptionID]
+	if !ok {
+		delivery.Status = webhook.Dead
+		delivery.NextAttemptAt = nil
+		delivery.LastError = "subscription deleted"
+		return s.repository.SaveDelivery(ctx, delivery)
+	}
+
+	code, err := s.send(ctx, subscription, delivery)
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.LastStatusCode = code
+	delivery.LastError = ""
+	delivery.NextAttemptAt = nil
+
+	outcome := "delivered"
+	switch {
+	case err == nil:
+		delivery.Status = webhook.Delivered
+	case delivery.Attempts >= s.config.MaxAttempts:
+		outcome = "dead"
+		delivery.Status = webhook.Dead
+		delivery.LastError = err.Error()
+		logger.Logger().Warn().Err(err).Str("webhook", subscription.ID).Str("delivery", delivery.ID).
+			Int("attempts", delivery.Attempts).Msg("Webhook delivery dead")
+	default:
+		outcome = "failed"
+		next := now.Add(webhook.Backoff(delivery.Attempts, s.config.RetryBase, s.config.RetryMax))
+		delivery.Status = webhook.Pending
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = &next
+	}
+	metrics.WebhookDeliveries.WithLabelValues(outcome).Inc()
+	return s.repository.SaveDelivery(ctx, delivery)
+}
+
+// send posts the payload of delivery, signed with the subscription's secret, and returns
+// the status code of the answer.
+func (s *webhookService) send(ctx context.Context, subscription webhook.Subscription, delivery webhook.Delivery) (code int, err error) {
+	ctx, span := tracer.Start(ctx, "webhook.Deliver")
+	defer func() { tracing.End(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "authentication-webhooks")
+	request.Header.Set(webhook.EventHeader, delivery.EventType)
+	request.Header.Set(webhook.DeliveryHeader, delivery.ID)
+	request.Header.Set(webhook.SignatureHeader, webhook.Sign(subscription.Secret, time.Now(), delivery.Payload))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint answered %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// StartWebhookDispatcher attempts the due webhook deliveries every WEBHOOK_POLL_INTERVAL
+// (default 1s) in the background, for the lifetime of the process. Every instance runs
+// one; a delivery is only attempted by the instance that claimed it.
+func StartWebhookDispatcher(webhooks WebhookService) {
+	interval := durationFromEnv("WEBHOOK_POLL_INTERVAL", defaultWebhookPollInterval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		failing := false
+		for range ticker.C {
+			// A full batch means more may be due already.
+			attempted, err := webhooks.Dispatch(context.Background())
+			for err == nil && attempted == webhookBatch {
+				attempted, err = webhooks.Dispatch(context.Background())
+			}
+			// Log once while Redis is unreachable, not every interval.
+			if err != nil && !failing {
+				logger.LogErrorWithDepth(map[string]interface{}{
+					"error":   fmt.Errorf("dispatch webhooks: %w", err),
+					"depth":   2,
+					"message": "Dispatching webhooks failed",
+				})
+			}
+			failing = err != nil
+		}
+	}()
+}
@@ -1,39 +1,159 @@
 package utils
 
 import (
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
-var jwtSecret = []byte("fsfdsfewerwtet57497yr")
+// SigningKey is a secret access tokens are signed with. Tokens name it by ID in their kid
+// header.
+type SigningKey struct {
+	ID        string    `json:"id"`
+	Secret    []byte    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+	// ActiveAt is when the key starts signing. Until then it only verifies, which gives
+	// every instance the time to learn it before the first token signed with it shows up.
+	ActiveAt time.Time `json:"active_at"`
+}
+
+// builtinKey signs tokens as long as no stored key is active. Its secret is public, so it
+// is only fit for development.
+var builtinKey = SigningKey{ID: "builtin", Secret: []byte("fsfdsfewerwtet57497yr")}
+
+// signingKeys are the stored keys, oldest active first.
+var signingKeys atomic.Pointer[[]SigningKey]
+
+// NewSigningKey is a random key that starts signing at activeAt.
+func NewSigningKey(activeAt time.Time) SigningKey {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	_, _ = rand.Read(id)
+	_, _ = rand.Read(secret)
+	return SigningKey{
+		ID:        fmt.Sprintf("%x", id),
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+		ActiveAt:  activeAt.UTC(),
+	}
+}
+
+// SortSigningKeys puts keys in the order they activate.
+func SortSigningKeys(keys []SigningKey) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ActiveAt.Before(keys[j].ActiveAt) })
+}
+
+// SetSigningKeys replaces the stored keys tokens are signed and verified with.
+func SetSigningKeys(keys []SigningKey) {
+	keys = append([]SigningKey(nil), keys...)
+	SortSigningKeys(keys)
+	signingKeys.Store(&keys)
+}
+
+// SigningKeys are the stored keys, oldest active first.
+func SigningKeys() []SigningKey {
+	if keys := signingKeys.Load(); keys != nil {
+		return *keys
+	}
+	return nil
+}
+
+// CurrentSigningKey is the key tokens are signed with now: the stored key activated last,
+// or the built-in key when none is active yet.
+func CurrentSigningKey() SigningKey {
+	return currentKey(SigningKeys(), time.Now())
+}
+
+func currentKey(keys []SigningKey, now time.Time) SigningKey {
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !keys[i].ActiveAt.After(now) {
+			return keys[i]
+		}
+	}
+	return builtinKey
+}
+
+// verifyingKey is the key of id that verifies tokens: any stored key, and the built-in
+// key while it is the one signing.
+func verifyingKey(id string) (SigningKey, bool) {
+	keys := SigningKeys()
+	for _, key := range keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	if current := currentKey(keys, time.Now()); current.ID == builtinKey.ID && (id == "" || id == builtinKey.ID) {
+		return builtinKey, true
+	}
+	return SigningKey{}, false
+}
 
 type JWTClaims struct {
 	Phone string `json:"phone"`
+	Role  string `json:"role,omitempty"`
+	// SessionVersion must match the user's current session version; bumping it revokes every token.
+	SessionVersion string `json:"sv,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func GenerateAccessToken(phone string, duration time.Duration) (string, error) {
+func GenerateAccessToken(phone, role, sessionVersion string, duration time.Duration) (string, error) {
 	claims := JWTClaims{
-		Phone: phone,
+		Phone:          phone,
+		Role:           role,
+		SessionVersion: sessionVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
+	key := CurrentSigningKey()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
+}
+
+// CheckSigningKey signs and verifies a token the way access tokens are, to tell whether
+// tokens can be issued. Unless allowBuiltin, the built-in key does not count: its secret
+// is public, so anyone could forge tokens it signs.
+func CheckSigningKey(allowBuiltin bool) error {
+	key := CurrentSigningKey()
+	if key.ID == builtinKey.ID && !allowBuiltin {
+		return errors.New("no JWT signing key generated: tokens are signed with the built-in key")
+	}
+	if len(key.Secret) == 0 {
+		return errors.New("no JWT signing key")
+	}
+	token, err := GenerateAccessToken("health", "", "", time.Minute)
+	if err != nil {
+		return err
+	}
+	_, err = ParseAccessToken(token)
+	return err
 }
 
+// GenerateRefreshToken is 32 random bytes in hex. Refresh tokens are bearer credentials
+// that live for a week, so they must not be guessable from when they were issued.
 func GenerateRefreshToken() string {
-	return fmt.Sprintf("%x", time.Now().UnixNano())
+	token := make([]byte, 32)
+	_, _ = rand.Read(token)
+	return fmt.Sprintf("%x", token)
 }
 
 func ParseAccessToken(tokenStr string) (*JWTClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+		// Tokens issued before keys were rotated carry no kid: the built-in key signed them.
+		id, _ := token.Header["kid"].(string)
+		key, ok := verifyingKey(id)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", id)
+		}
+		return key.Secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCurrentKey(t *testing.T) {
+	now := time.Now()
+	old := SigningKey{ID: "old", Secret: []byte("old"), ActiveAt: now.Add(-2 * time.Hour)}
+	current := SigningKey{ID: "current", Secret: []byte("current"), ActiveAt: now.Add(-time.Hour)}
+	pending := SigningKey{ID: "pending", Secret: []byte("pending"), ActiveAt: now.Add(time.Minute)}
+
+	tests := []struct {
+		name string
+		keys []SigningKey
+		want string
+	}{
+		{"no key", nil, builtinKey.ID},
+		{"only pending", []SigningKey{pending}, builtinKey.ID},
+		{"activated last", []SigningKey{old, current}, "current"},
+		{"pending is not yet current", []SigningKey{old, current, pending}, "current"},
+		{"activating now", []SigningKey{old, {ID: "now", ActiveAt: now}}, "now"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := currentKey(tt.keys, now); got.ID != tt.want {
+				t.Errorf("currentKey() = %q, want %q", got.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigningKeysRotation(t *testing.T) {
+	t.Cleanup(func() { SetSigningKeys(nil) })
+	now := time.Now()
+
+	SetSigningKeys(nil)
+	builtin, err := GenerateAccessToken("+989120000000", "admin", "1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := ParseAccessToken(builtin); err != nil || claims.Role != "admin" {
+		t.Fatalf("ParseAccessToken(built-in) = %v, %v, want the claims while the built-in key signs", claims, err)
+	}
+
+	// A pending key verifies nothing yet, and the built-in key still signs.
+	first := NewSigningKey(now.Add(time.Hour))
+	SetSigningKeys([]SigningKey{first})
+	if _, err := ParseAccessToken(builtin); err != nil {
+		t.Fatalf("ParseAccessToken(built-in) = %v, want it accepted until a stored key signs", err)
+	}
+
+	// Once a stored key signs, tokens of the public built-in key are refused.
+	first.ActiveAt = now.Add(-time.Hour)
+	second := NewSigningKey(now.Add(time.Hour))
+	SetSigningKeys([]SigningKey{second, first})
+	if _, err := ParseAccessToken(builtin); err == nil {
+		t.Fatal("ParseAccessToken(built-in) = nil, want the built-in key refused")
+	}
+	token, err := GenerateAccessToken("+989120000000", "user", "1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &JWTClaims{})
+	if err != nil || parsed.Header["kid"] != first.ID {
+		t.Fatalf("token kid = %v, want %q", parsed.Header["kid"], first.ID)
+	}
+
+	// After a rotation, tokens of the previous key verify as long as it is stored.
+	second.ActiveAt = now.Add(-time.Minute)
+	SetSigningKeys([]SigningKey{first, second})
+	if CurrentSigningKey().ID != second.ID {
+		t.Fatalf("CurrentSigningKey() = %q, want %q", CurrentSigningKey().ID, second.ID)
+	}
+	if _, err := ParseAccessToken(token); err != nil {
+		t.Fatalf("ParseAccessToken(previous key) = %v, want it accepted", err)
+	}
+	SetSigningKeys([]SigningKey{second})
+	if _, err := ParseAccessToken(token); err == nil || !strings.Contains(err.Error(), first.ID) {
+		t.Fatalf("ParseAccessToken(retired key) = %v, want an unknown key", err)
+	}
+}
+
+func TestCheckSigningKey(t *testing.T) {
+	t.Cleanup(func() { SetSigningKeys(nil) })
+
+	SetSigningKeys(nil)
+	if err := CheckSigningKey(false); err == nil {
+		t.Error("CheckSigningKey(false) = nil with the built-in key, want an error")
+	}
+	if err := CheckSigningKey(true); err != nil {
+		t.Errorf("CheckSigningKey(true) = %v with the built-in key, want nil", err)
+	}
+	SetSigningKeys([]SigningKey{NewSigningKey(time.Now().Add(-time.Minute))})
+	if err := CheckSigningKey(false); err != nil {
+		t.Errorf("CheckSigningKey(false) = %v with a generated key, want nil", err)
+	}
+}
+
+func TestGenerateRefreshToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token := GenerateRefreshToken()
+		if len(token) != 64 || strings.Trim(token, "0123456789abcdef") != "" {
+			t.Fatalf("GenerateRefreshToken() = %q, want 32 bytes in hex", token)
+		}
+		if seen[token] {
+			t.Fatalf("GenerateRefreshToken() = %q twice", token)
+		}
+		seen[token] = true
+	}
+}
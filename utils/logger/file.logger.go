@@ -1,59 +1,136 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"github.com/natefinch/lumberjack"
-	"github.com/rs/zerolog"
+	"io"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+
+	"github.com/natefinch/lumberjack"
+	"github.com/rs/zerolog"
 )
 
+// ContextKey is the gin context key holding the logger of a request, see FromContext.
+const ContextKey = "logger"
+
+// DefaultFile is where logs go unless LOG_OUTPUT says otherwise.
+const DefaultFile = "logs/auth.log"
+
 var (
-	logger zerolog.Logger
-	mu     sync.Mutex
+	current atomic.Pointer[zerolog.Logger]
+	mu      sync.Mutex
+	// file is the log file of the current logger, closed when SetupLogger replaces it.
+	file io.Closer
 )
 
 func init() {
 	SetupLogger()
 }
 
+// timeFormat is the format of timestamps: RFC 3339 with milliseconds.
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// SetupLogger configures the logger from the environment:
+//   - LOG_OUTPUT: "stdout", "stderr" or a file path (default logs/auth.log, rotated at 200 MB).
+//   - LOG_LEVEL: debug, info (default), warn or error; SetLevel changes it at runtime.
+//   - LOG_REDACT: "false" keeps phone numbers, codes and tokens in the logs, for development.
+//
+// Every line is a JSON object.
 func SetupLogger() {
 	mu.Lock()
 	defer mu.Unlock()
 
-	filename := fmt.Sprintf("logs/%v.log", "auth")
+	var out io.Writer
+	var closer io.Closer
+	switch output := os.Getenv("LOG_OUTPUT"); output {
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		if output == "" {
+			output = DefaultFile
+		}
+		rotated := &lumberjack.Logger{
+			Filename:  output,
+			MaxSize:   200, // Maximum size in megabytes before rotation
+			Compress:  true,
+			LocalTime: true,
+		}
+		out, closer = rotated, rotated
+	}
+	if os.Getenv("LOG_REDACT") != "false" {
+		out = redactingWriter{out}
+	}
+
+	// The format is global to zerolog, and read by loggers in use: only set it once.
+	if zerolog.TimeFieldFormat != timeFormat {
+		zerolog.TimeFieldFormat = timeFormat
+	}
+	logger := zerolog.New(out).With().Timestamp().Str("service", "authentication").Logger()
+	current.Store(&logger)
+	if file != nil {
+		_ = file.Close()
+	}
+	file = closer
 
-	// Set up lumberjack logger for log rotation with compression
-	logFile := &lumberjack.Logger{
-		Filename: filename, // Use filename with date
-		MaxSize:  200,      // Maximum size in megabytes before rotation
-		//MaxBackups: 10,     // Maximum number of old log files to retain, use this to omit old log files
-		Compress:  true, // Compress rotated log files
-		LocalTime: true, // Use local time for file timestamps
+	level := os.Getenv("LOG_LEVEL")
+	if level == "" {
+		level = zerolog.InfoLevel.String()
+	}
+	if err := SetLevel(level); err != nil {
+		_ = SetLevel(zerolog.InfoLevel.String())
+		logger.Warn().Err(err).Msg("LOG_LEVEL ignored")
 	}
+}
 
-	logger = zerolog.New(logFile).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
-		Out:        logFile,
-		NoColor:    true,
-		TimeFormat: "2006-01-02 15:04:05",
-		FormatLevel: func(i interface{}) string {
-			if ll, ok := i.(string); ok {
-				return strings.ToUpper(ll)
-			}
-			return ""
-		},
-	})
-	fmt.Println("Logger reinitialized with filename:", logFile.Filename)
+// SetLevel changes the level of every logger, including the ones of requests in flight.
+func SetLevel(level string) error {
+	parsed, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil || parsed == zerolog.NoLevel {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	zerolog.SetGlobalLevel(parsed)
+	return nil
 }
 
+// Level is the current level, such as "info".
+func Level() string {
+	return zerolog.GlobalLevel().String()
+}
+
+// Logger is the process-wide logger, for code that runs outside of a request.
+func Logger() *zerolog.Logger {
+	return current.Load()
+}
+
+// WithFields returns a child of the process-wide logger, such as the logger of a request.
+func WithFields(fields map[string]interface{}) zerolog.Logger {
+	return Logger().With().Fields(fields).Logger()
+}
+
+// FromContext returns the logger of the request ctx belongs to, which tags every line with
+// the request ID, or the process-wide logger outside of requests.
+func FromContext(ctx context.Context) *zerolog.Logger {
+	if ctx != nil {
+		if requestLogger, ok := ctx.Value(ContextKey).(*zerolog.Logger); ok {
+			return requestLogger
+		}
+	}
+	return Logger()
+}
+
+// LogErrorWithDepth logs data["error"] with data["message"] and the file and line of the
+// caller data["depth"] frames up. With data["context"], it goes to the request's logger.
 func LogErrorWithDepth(data interface{}) {
 	defer func() {
 		if r := recover(); r != nil {
 			// Silent recovery - doesn't affect the main request
-			logger.Error().Msg("There was an error happened in logger.")
-			fmt.Printf("Recovered in logger: %v\n", r)
+			Logger().Error().Interface("panic", r).Msg("There was an error happened in logger.")
 		}
 	}()
 	errorData := data.(map[string]interface{})
@@ -67,19 +144,14 @@ func LogErrorWithDepth(data interface{}) {
 		line = 0
 	}
 
-	customMsg := fmt.Sprintf("File: %s, Line: %d, ErrorMessage: \"%s\", ErrorDetails: \"%v\"", file, line, message, err)
-	logger.Error().Msg(customMsg)
+	l := Logger()
+	if ctx, ok := errorData["context"].(context.Context); ok {
+		l = FromContext(ctx)
+	}
+	l.Error().Str("file", file).Int("line", line).Err(err).Msg(message)
 }
 
+// LogInfo logs msg about handle, the part of the service it comes from.
 func LogInfo(handle string, msg string) {
-	defer func() {
-		if r := recover(); r != nil {
-			// Silent recovery - doesn't affect the main request
-			logger.Error().Msg("There was an error happened in logger.")
-			fmt.Printf("Recovered in logger: %v\n", r)
-		}
-	}()
-
-	customMsg := fmt.Sprintf("Service: %s, Handle: \"%s\", InfoDetail: \"%v\"", os.Getenv("LOG_FILE"), handle, msg)
-	logger.Info().Msg(customMsg)
+	Logger().Info().Str("handle", handle).Msg(msg)
 }
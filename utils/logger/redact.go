@@ -0,0 +1,41 @@
+package logger
+
+import (
+	"io"
+	"regexp"
+)
+
+// Redacted stands in for secrets removed from the logs.
+const Redacted = "[REDACTED]"
+
+var (
+	// sensitiveField matches the value of a JSON field that holds a secret, also inside a
+	// message that quotes JSON (\"OTPCode\":\"123456\").
+	sensitiveField = regexp.MustCompile(`(?i)(\\?"(?:otp|otpcode|otp_code|code|password|secret|token|access_token|refresh_token|refreshtoken|authorization|sms_text)\\?"\s*:\s*\\?")(?:[^"\\]|\\[^"])*`)
+	// bearerToken and jwt catch tokens wherever they appear.
+	bearerToken = regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/=-]+`)
+	jwt         = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	// phoneNumber is an E.164 number, or an Iranian mobile number in national or
+	// international format. The last four digits are kept to tell numbers apart.
+	phoneNumber = regexp.MustCompile(`(?:\+\d{4,11}|\b(?:00|0)?(?:98)?9\d{5})(\d{4})\b`)
+)
+
+// redact removes phone numbers, one-time codes and tokens from a log line.
+func redact(line []byte) []byte {
+	line = sensitiveField.ReplaceAll(line, []byte("${1}"+Redacted))
+	line = bearerToken.ReplaceAll(line, []byte("Bearer "+Redacted))
+	line = jwt.ReplaceAll(line, []byte(Redacted))
+	return phoneNumber.ReplaceAll(line, []byte("***${1}"))
+}
+
+// redactingWriter redacts every line zerolog writes; zerolog writes one line per call.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -1,6 +0,0 @@
-package utils
-
-type PanicMessage struct {
-	MessageKey int
-	Error      *error
-}